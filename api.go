@@ -0,0 +1,605 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/openapi"
+)
+
+// The JSON API for stories, info, covers and portfolios. Requests and
+// responses are typed; every error is an RFC 9457 problem details object.
+
+// apiMaxBodyBytes caps a JSON request body.
+const apiMaxBodyBytes = 1 << 20
+
+// problem is an RFC 9457 problem details object. Type is always
+// "about:blank", so Title is the status text; Detail says what went wrong
+// with this request and Errors which fields, if any, failed validation.
+type problem struct {
+	Type     string         `json:"type"`
+	Title    string         `json:"title"`
+	Status   int            `json:"status"`
+	Detail   string         `json:"detail,omitempty"`
+	Instance string         `json:"instance,omitempty"`
+	Errors   []fieldProblem `json:"errors,omitempty"`
+}
+
+// fieldProblem is one invalid field of a request body, located by JSON
+// pointer (RFC 6901).
+type fieldProblem struct {
+	Pointer string `json:"pointer"`
+	Detail  string `json:"detail"`
+}
+
+func respondWithProblem(w http.ResponseWriter, r *http.Request, status int, detail string, errs ...fieldProblem) {
+	p := problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+		Errors:   errs,
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Printf("Error encoding problem response: %v", err)
+	}
+}
+
+func respondMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	respondWithProblem(w, r, http.StatusMethodNotAllowed, fmt.Sprintf("%s is not supported here", r.Method))
+}
+
+// decodeJSON reads the request body into dst. Unknown fields and trailing
+// data are refused. On failure it has already responded and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		respondWithProblem(w, r, http.StatusUnsupportedMediaType, "The request body must be application/json")
+		return false
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBodyBytes))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(dst)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("the body must hold a single JSON object")
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &tooLarge):
+		respondWithProblem(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("The request body is larger than %d bytes", tooLarge.Limit))
+	case errors.As(err, &syntaxErr):
+		respondWithProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Malformed JSON at byte %d", syntaxErr.Offset))
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		respondWithProblem(w, r, http.StatusBadRequest, "The request body is empty or cut short")
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		respondWithProblem(w, r, http.StatusUnprocessableEntity, "The request body is invalid", fieldProblem{
+			Pointer: "/" + strings.ReplaceAll(typeErr.Field, ".", "/"),
+			Detail:  fmt.Sprintf("must be a %s", typeErr.Type),
+		})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		respondWithProblem(w, r, http.StatusUnprocessableEntity, "The request body is invalid", fieldProblem{
+			Pointer: "/" + field,
+			Detail:  "is not a known field",
+		})
+	default:
+		respondWithProblem(w, r, http.StatusBadRequest, err.Error())
+	}
+	return false
+}
+
+// requireText checks a string field of a request: it must be present,
+// unless partial, and not blank.
+func requireText(errs []fieldProblem, pointer string, value *string, partial bool) []fieldProblem {
+	switch {
+	case value == nil && !partial:
+		return append(errs, fieldProblem{Pointer: pointer, Detail: "is required"})
+	case value != nil && strings.TrimSpace(*value) == "":
+		return append(errs, fieldProblem{Pointer: pointer, Detail: "must not be blank"})
+	}
+	return errs
+}
+
+// apiID parses the {id} of the request path. There is nothing under a
+// non-numeric id, so it reports 404 for those.
+func apiID(w http.ResponseWriter, r *http.Request, resource string) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		respondWithProblem(w, r, http.StatusNotFound, fmt.Sprintf("No %s with id %q", resource, r.PathValue("id")))
+		return 0, false
+	}
+	return id, true
+}
+
+// storyRequest is the body of POST, PUT and PATCH on stories. PATCH may
+// leave fields out; the others need all of them.
+type storyRequest struct {
+	Title   *string `json:"title"`
+	Content *string `json:"content"`
+}
+
+func (req storyRequest) validate(partial bool) []fieldProblem {
+	var errs []fieldProblem
+	errs = requireText(errs, "/title", req.Title, partial)
+	errs = requireText(errs, "/content", req.Content, partial)
+	return errs
+}
+
+type storyResponse struct {
+	ID        int       `json:"id"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type storyListResponse struct {
+	Stories []storyResponse `json:"stories"`
+}
+
+func newStoryResponse(s Story) storyResponse {
+	return storyResponse{ID: s.ID, Title: s.Title, Content: s.Content, CreatedAt: s.CreatedAt}
+}
+
+func storyLocation(id int) string {
+	return fmt.Sprintf("/api/v1/stories/%d", id)
+}
+
+// storiesApiHandler serves /api/v1/stories.
+func (app *App) storiesApiHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		stories, err := app.getStories()
+		if err != nil {
+			log.Printf("Error retrieving stories: %v", err)
+			respondWithProblem(w, r, http.StatusInternalServerError, "Failed to retrieve stories")
+			return
+		}
+		resp := storyListResponse{Stories: make([]storyResponse, len(stories))}
+		for i, s := range stories {
+			resp.Stories[i] = newStoryResponse(s)
+		}
+		respondWithJSON(w, http.StatusOK, resp)
+	case http.MethodPost:
+		app.handleApiPostStory(w, r)
+	default:
+		respondMethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (app *App) handleApiPostStory(w http.ResponseWriter, r *http.Request) {
+	var req storyRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if errs := req.validate(false); len(errs) > 0 {
+		respondWithProblem(w, r, http.StatusUnprocessableEntity, "The story is invalid", errs...)
+		return
+	}
+
+	story := Story{Title: *req.Title, Content: *req.Content}
+	id, err := app.insertStory(story)
+	if errors.Is(err, errStoryTitleTaken) {
+		respondWithProblem(w, r, http.StatusConflict, fmt.Sprintf("A story titled %q already exists", story.Title))
+		return
+	}
+	if err != nil {
+		log.Printf("Error inserting story: %v", err)
+		respondWithProblem(w, r, http.StatusInternalServerError, "Failed to save story")
+		return
+	}
+	story.ID = id
+	app.recordAuditEvent(r, "story.create", "story", id, nil, story)
+
+	stories, err := app.getStories(id)
+	if err != nil || len(stories) == 0 {
+		log.Printf("Error retrieving story %d: %v", id, err)
+		respondWithProblem(w, r, http.StatusInternalServerError, "Failed to retrieve the saved story")
+		return
+	}
+	w.Header().Set("Location", storyLocation(id))
+	respondWithJSON(w, http.StatusCreated, newStoryResponse(stories[0]))
+}
+
+// storyApiHandler serves /api/v1/stories/{id}.
+func (app *App) storyApiHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r, "story")
+	if !ok {
+		return
+	}
+	stories, err := app.getStories(id)
+	if err != nil {
+		log.Printf("Error retrieving story %d: %v", id, err)
+		respondWithProblem(w, r, http.StatusInternalServerError, "Failed to retrieve story")
+		return
+	}
+	if len(stories) == 0 {
+		respondWithProblem(w, r, http.StatusNotFound, fmt.Sprintf("No story with id %d", id))
+		return
+	}
+	story := stories[0]
+
+	switch r.Method {
+	case http.MethodGet:
+		respondWithJSON(w, http.StatusOK, newStoryResponse(story))
+	case http.MethodPut, http.MethodPatch:
+		app.handleApiUpdateStory(w, r, story)
+	case http.MethodDelete:
+		if err := app.deleteStory(id); err != nil {
+			log.Printf("Error deleting story %d: %v", id, err)
+			respondWithProblem(w, r, http.StatusInternalServerError, "Failed to delete story")
+			return
+		}
+		app.recordAuditEvent(r, "story.delete", "story", id, story, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w, r, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+func (app *App) handleApiUpdateStory(w http.ResponseWriter, r *http.Request, before Story) {
+	var req storyRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if errs := req.validate(r.Method == http.MethodPatch); len(errs) > 0 {
+		respondWithProblem(w, r, http.StatusUnprocessableEntity, "The story is invalid", errs...)
+		return
+	}
+
+	story := before
+	if req.Title != nil {
+		story.Title = *req.Title
+	}
+	if req.Content != nil {
+		story.Content = *req.Content
+	}
+	err := app.updateStory(story)
+	if errors.Is(err, errStoryTitleTaken) {
+		respondWithProblem(w, r, http.StatusConflict, fmt.Sprintf("Another story is already titled %q", story.Title))
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating story %d: %v", story.ID, err)
+		respondWithProblem(w, r, http.StatusInternalServerError, "Failed to update story")
+		return
+	}
+	app.recordAuditEvent(r, "story.update", "story", story.ID, before, story)
+	respondWithJSON(w, http.StatusOK, newStoryResponse(story))
+}
+
+// infoRequest is the body of PUT and PATCH on info. There is only the one
+// field, so both need it.
+type infoRequest struct {
+	Content *string `json:"content"`
+}
+
+type infoResponse struct {
+	Content string `json:"content"`
+}
+
+// infoApiHandler serves /api/v1/info, the text of the info page.
+func (app *App) infoApiHandler(w http.ResponseWriter, r *http.Request) {
+	before, err := app.getInfo()
+	if err != nil {
+		log.Printf("Error retrieving info: %v", err)
+		respondWithProblem(w, r, http.StatusInternalServerError, "Failed to retrieve info")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		respondWithJSON(w, http.StatusOK, infoResponse{Content: before.Content})
+	case http.MethodPut, http.MethodPatch:
+		var req infoRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if errs := requireText(nil, "/content", req.Content, false); len(errs) > 0 {
+			respondWithProblem(w, r, http.StatusUnprocessableEntity, "The info is invalid", errs...)
+			return
+		}
+		after := Info{Content: *req.Content}
+		if err := app.updateInfo(after); err != nil {
+			log.Printf("Error updating info: %v", err)
+			respondWithProblem(w, r, http.StatusInternalServerError, "Failed to update info")
+			return
+		}
+		app.recordAuditEvent(r, "info.update", "info", nil, before, after)
+		respondWithJSON(w, http.StatusOK, infoResponse{Content: after.Content})
+	default:
+		respondMethodNotAllowed(w, r, http.MethodGet, http.MethodPut, http.MethodPatch)
+	}
+}
+
+// coverResponse describes an uploaded cover. Current is set on the one the
+// home page shows, which is the newest.
+type coverResponse struct {
+	ID        int             `json:"id"`
+	FilePath  string          `json:"file_path"`
+	URL       string          `json:"url"`
+	Current   bool            `json:"current"`
+	Image     responsiveImage `json:"image"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type coverListResponse struct {
+	Covers []coverResponse `json:"covers"`
+}
+
+func (app *App) newCoverResponse(c Cover, current bool) coverResponse {
+	key := path.Join("covers", c.FilePath)
+	return coverResponse{
+		ID:        c.ID,
+		FilePath:  c.FilePath,
+		URL:       "/fs/" + key,
+		Current:   current,
+		Image:     app.responsiveImage(key, c.Width, c.Height, coverSizes),
+		CreatedAt: c.CreatedAt,
+	}
+}
+
+// coversApiHandler serves /api/v1/covers. Uploading a cover, as multipart
+// form field "cover", makes it the current one.
+func (app *App) coversApiHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		covers, err := app.getCovers()
+		if err != nil {
+			log.Printf("Error retrieving covers: %v", err)
+			respondWithProblem(w, r, http.StatusInternalServerError, "Failed to retrieve covers")
+			return
+		}
+		resp := coverListResponse{Covers: make([]coverResponse, len(covers))}
+		for i, c := range covers {
+			resp.Covers[i] = app.newCoverResponse(c, i == 0)
+		}
+		respondWithJSON(w, http.StatusOK, resp)
+	case http.MethodPost:
+		fileHeader, ok := apiUpload(w, r, "cover", app.cfg.Uploads.CoverMaxBytes)
+		if !ok {
+			return
+		}
+		id, err := app.replaceCover(r, fileHeader)
+		if errors.Is(err, errUploadRejected) {
+			respondWithProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Error replacing cover: %v", err)
+			respondWithProblem(w, r, http.StatusInternalServerError, "Failed to save cover")
+			return
+		}
+		covers, err := app.getCovers(id)
+		if err != nil || len(covers) == 0 {
+			log.Printf("Error retrieving cover %d: %v", id, err)
+			respondWithProblem(w, r, http.StatusInternalServerError, "Failed to retrieve the saved cover")
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("/api/v1/covers/%d", id))
+		respondWithJSON(w, http.StatusCreated, app.newCoverResponse(covers[0], true))
+	default:
+		respondMethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// coverApiHandler serves /api/v1/covers/{id}. Deleting the current cover
+// brings back the one before it; the last one cannot be deleted.
+func (app *App) coverApiHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r, "cover")
+	if !ok {
+		return
+	}
+	covers, err := app.getCovers()
+	if err != nil {
+		log.Printf("Error retrieving covers: %v", err)
+		respondWithProblem(w, r, http.StatusInternalServerError, "Failed to retrieve cover")
+		return
+	}
+	i := slices.IndexFunc(covers, func(c Cover) bool { return c.ID == id })
+	if i < 0 {
+		respondWithProblem(w, r, http.StatusNotFound, fmt.Sprintf("No cover with id %d", id))
+		return
+	}
+	cover := covers[i]
+
+	switch r.Method {
+	case http.MethodGet:
+		respondWithJSON(w, http.StatusOK, app.newCoverResponse(cover, i == 0))
+	case http.MethodDelete:
+		err := app.deleteCover(id)
+		if errors.Is(err, errLastCover) {
+			respondWithProblem(w, r, http.StatusConflict, "This is the only cover; upload another before deleting it")
+			return
+		}
+		if err != nil {
+			log.Printf("Error deleting cover %d: %v", id, err)
+			respondWithProblem(w, r, http.StatusInternalServerError, "Failed to delete cover")
+			return
+		}
+		app.deleteImageFiles(r.Context(), path.Join("covers", cover.FilePath))
+		app.recordAuditEvent(r, "cover.delete", "cover", id, Cover{FilePath: cover.FilePath}, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w, r, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// portfolioResponse describes an uploaded portfolio. Current is set on the
+// one /portfolio serves, which is the newest.
+type portfolioResponse struct {
+	ID        int       `json:"id"`
+	FilePath  string    `json:"file_path"`
+	URL       string    `json:"url"`
+	Current   bool      `json:"current"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type portfolioListResponse struct {
+	Portfolios []portfolioResponse `json:"portfolios"`
+}
+
+func newPortfolioResponse(p Portfolio, current bool) portfolioResponse {
+	return portfolioResponse{
+		ID:        p.ID,
+		FilePath:  p.FilePath,
+		URL:       "/fs/" + path.Join("portfolios", p.FilePath),
+		Current:   current,
+		CreatedAt: p.CreatedAt,
+	}
+}
+
+// portfoliosApiHandler serves /api/v1/portfolios. Uploading a PDF, as
+// multipart form field "portfolio", makes it the current one.
+func (app *App) portfoliosApiHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		portfolios, err := app.getPortfolios()
+		if err != nil {
+			log.Printf("Error retrieving portfolios: %v", err)
+			respondWithProblem(w, r, http.StatusInternalServerError, "Failed to retrieve portfolios")
+			return
+		}
+		resp := portfolioListResponse{Portfolios: make([]portfolioResponse, len(portfolios))}
+		for i, p := range portfolios {
+			resp.Portfolios[i] = newPortfolioResponse(p, i == 0)
+		}
+		respondWithJSON(w, http.StatusOK, resp)
+	case http.MethodPost:
+		fileHeader, ok := apiUpload(w, r, "portfolio", app.cfg.Uploads.PortfolioMaxBytes)
+		if !ok {
+			return
+		}
+		id, err := app.replacePortfolio(r, fileHeader)
+		if errors.Is(err, errUploadRejected) {
+			respondWithProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Error replacing portfolio: %v", err)
+			respondWithProblem(w, r, http.StatusInternalServerError, "Failed to save portfolio")
+			return
+		}
+		portfolios, err := app.getPortfolios(id)
+		if err != nil || len(portfolios) == 0 {
+			log.Printf("Error retrieving portfolio %d: %v", id, err)
+			respondWithProblem(w, r, http.StatusInternalServerError, "Failed to retrieve the saved portfolio")
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("/api/v1/portfolios/%d", id))
+		respondWithJSON(w, http.StatusCreated, newPortfolioResponse(portfolios[0], true))
+	default:
+		respondMethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// portfolioApiHandler serves /api/v1/portfolios/{id}. As with covers, the
+// last one cannot be deleted.
+func (app *App) portfolioApiHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiID(w, r, "portfolio")
+	if !ok {
+		return
+	}
+	portfolios, err := app.getPortfolios()
+	if err != nil {
+		log.Printf("Error retrieving portfolios: %v", err)
+		respondWithProblem(w, r, http.StatusInternalServerError, "Failed to retrieve portfolio")
+		return
+	}
+	i := slices.IndexFunc(portfolios, func(p Portfolio) bool { return p.ID == id })
+	if i < 0 {
+		respondWithProblem(w, r, http.StatusNotFound, fmt.Sprintf("No portfolio with id %d", id))
+		return
+	}
+	portfolio := portfolios[i]
+
+	switch r.Method {
+	case http.MethodGet:
+		respondWithJSON(w, http.StatusOK, newPortfolioResponse(portfolio, i == 0))
+	case http.MethodDelete:
+		err := app.deletePortfolio(id)
+		if errors.Is(err, errLastPortfolio) {
+			respondWithProblem(w, r, http.StatusConflict, "This is the only portfolio; upload another before deleting it")
+			return
+		}
+		if err != nil {
+			log.Printf("Error deleting portfolio %d: %v", id, err)
+			respondWithProblem(w, r, http.StatusInternalServerError, "Failed to delete portfolio")
+			return
+		}
+		key := path.Join("portfolios", portfolio.FilePath)
+		if err := app.storage.Delete(r.Context(), key); err != nil {
+			log.Printf("Warning: Failed to delete file at '%s': %v", key, err)
+		}
+		app.recordAuditEvent(r, "portfolio.delete", "portfolio", id, Portfolio{FilePath: portfolio.FilePath}, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondMethodNotAllowed(w, r, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// apiUpload reads the file in field of a multipart upload of at most
+// maxBytes. On failure it has already responded and returns false.
+func apiUpload(w http.ResponseWriter, r *http.Request, field string, maxBytes int64) (*multipart.FileHeader, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	if err := r.ParseMultipartForm(maxBytes); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondWithProblem(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("The upload is larger than %d bytes", maxBytes))
+			return nil, false
+		}
+		respondWithProblem(w, r, http.StatusBadRequest, "The request body must be multipart/form-data")
+		return nil, false
+	}
+	file, fileHeader, err := r.FormFile(field)
+	if err != nil {
+		respondWithProblem(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("No file uploaded in form field %q", field))
+		return nil, false
+	}
+	file.Close()
+	return fileHeader, true
+}
+
+// openAPIHandler serves the OpenAPI document describing /api/v1.
+func (app *App) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondMethodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openapi.Document())
+}
+
+// apiExplorerHandler serves a page that lists the operations of the
+// OpenAPI document and sends requests to them with the visitor's session.
+func (app *App) apiExplorerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, loggedIn := app.getLoginStatus(r)
+	data := apiExplorerData{Login: loggedIn, CSRFToken: app.csrfToken(r)}
+	if err := app.tpl.ExecuteTemplate(w, "api-explorer.gohtml", data); err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+	}
+}
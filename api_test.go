@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/openapi"
+)
+
+// TestAPIMatchesOpenAPI sends requests to every operation of the OpenAPI
+// document, through the same middleware --validate-api uses, and fails on
+// any request or response that the document does not describe.
+func TestAPIMatchesOpenAPI(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.Duplicates.Action = "reject"
+	owner := createTestUser(t, app, "owner@example.com", "password1", RoleOwner)
+	editor := createTestUser(t, app, "editor@example.com", "password1", RoleEditor)
+	ownerToken, _, err := app.createAPIToken(owner, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editorToken, _, err := app.createAPIToken(editor, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Responses must always match the document. Requests are allowed not
+	// to, as some here are malformed on purpose, but then the API must
+	// refuse them: it may be stricter than the document, never laxer.
+	var requestErr error
+	handler := app.api.Middleware(app.routes(), func(r *http.Request, err error) {
+		var verr *openapi.ValidationError
+		if errors.As(err, &verr) && !strings.HasPrefix(verr.Subject, "response ") {
+			requestErr = err
+			return
+		}
+		t.Error(err)
+	})
+	done := map[string]bool{}
+
+	// call sends a request to the documented operation op, e.g.
+	// "GET /stories/{id}", and checks the status it gets back.
+	call := func(op, token, method, target, contentType string, body []byte, want int) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, "/api/v1"+target, bytes.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		requestErr = nil
+		handler.ServeHTTP(w, r)
+		if requestErr != nil && w.Code < 400 {
+			t.Errorf("%s %s: accepted with %d: %v", method, target, w.Code, requestErr)
+		}
+		if w.Code != want {
+			t.Errorf("%s %s: status %d, want %d: %s", method, target, w.Code, want, w.Body)
+		}
+		done[op] = true
+		return w
+	}
+	jsonCall := func(op, token, method, target, body string, want int) *httptest.ResponseRecorder {
+		t.Helper()
+		return call(op, token, method, target, "application/json", []byte(body), want)
+	}
+	formCall := func(op, token, method, target string, form multipartForm, want int) *httptest.ResponseRecorder {
+		t.Helper()
+		contentType, body := form.encode(t)
+		return call(op, token, method, target, contentType, body, want)
+	}
+	// created checks the Location of a 201 and returns the id at its end.
+	created := func(w *httptest.ResponseRecorder, prefix string) int {
+		t.Helper()
+		var id int
+		location := w.Header().Get("Location")
+		if _, err := fmt.Sscanf(location, prefix+"%d", &id); err != nil {
+			t.Fatalf("Location %q, want %s<id>", location, prefix)
+		}
+		return id
+	}
+
+	call("GET /openapi.json", "", "GET", "/openapi.json", "", nil, http.StatusOK)
+
+	t.Run("stories", func(t *testing.T) {
+		call("GET /stories", "", "GET", "/stories", "", nil, http.StatusOK)
+		jsonCall("POST /stories", "", "POST", "/stories", `{"title":"A","content":"a"}`, http.StatusUnauthorized)
+		jsonCall("POST /stories", ownerToken, "POST", "/stories", `{"title":"A"`, http.StatusBadRequest)
+		call("POST /stories", ownerToken, "POST", "/stories", "text/plain", []byte("A"), http.StatusUnsupportedMediaType)
+		jsonCall("POST /stories", ownerToken, "POST", "/stories", `{"title":" "}`, http.StatusUnprocessableEntity)
+		w := jsonCall("POST /stories", ownerToken, "POST", "/stories", `{"title":"A","content":"a"}`, http.StatusCreated)
+		a := created(w, "/api/v1/stories/")
+		jsonCall("POST /stories", ownerToken, "POST", "/stories", `{"title":"A","content":"again"}`, http.StatusConflict)
+		w = jsonCall("POST /stories", editorToken, "POST", "/stories", `{"title":"B","content":"b"}`, http.StatusCreated)
+		b := created(w, "/api/v1/stories/")
+
+		call("GET /stories/{id}", "", "GET", fmt.Sprintf("/stories/%d", a), "", nil, http.StatusOK)
+		call("GET /stories/{id}", "", "GET", "/stories/999", "", nil, http.StatusNotFound)
+		call("GET /stories/{id}", "", "GET", "/stories/x", "", nil, http.StatusNotFound)
+		jsonCall("PUT /stories/{id}", ownerToken, "PUT", fmt.Sprintf("/stories/%d", a), `{"title":"A2","content":"a2"}`, http.StatusOK)
+		jsonCall("PUT /stories/{id}", ownerToken, "PUT", fmt.Sprintf("/stories/%d", a), `{"title":"A3"}`, http.StatusUnprocessableEntity)
+		jsonCall("PUT /stories/{id}", ownerToken, "PUT", "/stories/999", `{"title":"C","content":"c"}`, http.StatusNotFound)
+		jsonCall("PATCH /stories/{id}", editorToken, "PATCH", fmt.Sprintf("/stories/%d", b), `{"content":"b2"}`, http.StatusOK)
+		jsonCall("PATCH /stories/{id}", editorToken, "PATCH", fmt.Sprintf("/stories/%d", b), `{"title":"A2"}`, http.StatusConflict)
+		jsonCall("PATCH /stories/{id}", editorToken, "PATCH", fmt.Sprintf("/stories/%d", b), `{"subtitle":"b"}`, http.StatusUnprocessableEntity)
+		call("DELETE /stories/{id}", editorToken, "DELETE", fmt.Sprintf("/stories/%d", b), "", nil, http.StatusForbidden)
+		call("DELETE /stories/{id}", ownerToken, "DELETE", fmt.Sprintf("/stories/%d", b), "", nil, http.StatusNoContent)
+		call("DELETE /stories/{id}", ownerToken, "DELETE", fmt.Sprintf("/stories/%d", b), "", nil, http.StatusNotFound)
+	})
+
+	t.Run("info", func(t *testing.T) {
+		call("GET /info", "", "GET", "/info", "", nil, http.StatusOK)
+		jsonCall("PUT /info", "", "PUT", "/info", `{"content":"x"}`, http.StatusUnauthorized)
+		jsonCall("PUT /info", editorToken, "PUT", "/info", `{"content":"About"}`, http.StatusOK)
+		jsonCall("PATCH /info", editorToken, "PATCH", "/info", `{}`, http.StatusUnprocessableEntity)
+		jsonCall("PATCH /info", editorToken, "PATCH", "/info", `{"content":"About me"}`, http.StatusOK)
+	})
+
+	t.Run("covers", func(t *testing.T) {
+		upload := func(token string, file []byte, want int) *httptest.ResponseRecorder {
+			t.Helper()
+			return formCall("POST /covers", token, "POST", "/covers", multipartForm{
+				files: []formFile{{"cover", "cover.jpg", "image/jpeg", file}},
+			}, want)
+		}
+		upload(editorToken, testJPEG(t, 1), http.StatusForbidden)
+		formCall("POST /covers", ownerToken, "POST", "/covers", multipartForm{}, http.StatusUnprocessableEntity)
+		formCall("POST /covers", ownerToken, "POST", "/covers", multipartForm{
+			files: []formFile{{"cover", "cover.txt", "text/plain", []byte("not an image")}},
+		}, http.StatusUnprocessableEntity)
+		first := created(upload(ownerToken, testJPEG(t, 1), http.StatusCreated), "/api/v1/covers/")
+		// Delete the cover the first migration put in, so that first is the
+		// last one left.
+		var covers coverListResponse
+		w := call("GET /covers", "", "GET", "/covers", "", nil, http.StatusOK)
+		if err := json.Unmarshal(w.Body.Bytes(), &covers); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range covers.Covers {
+			if c.ID != first {
+				call("DELETE /covers/{id}", ownerToken, "DELETE", fmt.Sprintf("/covers/%d", c.ID), "", nil, http.StatusNoContent)
+			}
+		}
+		call("DELETE /covers/{id}", ownerToken, "DELETE", fmt.Sprintf("/covers/%d", first), "", nil, http.StatusConflict)
+		second := created(upload(ownerToken, testJPEG(t, 2), http.StatusCreated), "/api/v1/covers/")
+
+		call("GET /covers/{id}", "", "GET", fmt.Sprintf("/covers/%d", second), "", nil, http.StatusOK)
+		call("GET /covers/{id}", "", "GET", "/covers/999", "", nil, http.StatusNotFound)
+		call("DELETE /covers/{id}", "", "DELETE", fmt.Sprintf("/covers/%d", second), "", nil, http.StatusUnauthorized)
+		call("DELETE /covers/{id}", ownerToken, "DELETE", fmt.Sprintf("/covers/%d", second), "", nil, http.StatusNoContent)
+		call("DELETE /covers/{id}", ownerToken, "DELETE", fmt.Sprintf("/covers/%d", second), "", nil, http.StatusNotFound)
+	})
+
+	t.Run("portfolios", func(t *testing.T) {
+		pdf := []byte("%PDF-1.4\n%%EOF\n")
+		upload := func(token string, want int) *httptest.ResponseRecorder {
+			t.Helper()
+			return formCall("POST /portfolios", token, "POST", "/portfolios", multipartForm{
+				files: []formFile{{"portfolio", "portfolio.pdf", "application/pdf", pdf}},
+			}, want)
+		}
+		upload("", http.StatusUnauthorized)
+		formCall("POST /portfolios", ownerToken, "POST", "/portfolios", multipartForm{
+			files: []formFile{{"portfolio", "portfolio.jpg", "image/jpeg", testJPEG(t, 1)}},
+		}, http.StatusUnprocessableEntity)
+		call("POST /portfolios", ownerToken, "POST", "/portfolios", "multipart/form-data", []byte("x"), http.StatusBadRequest)
+		first := created(upload(ownerToken, http.StatusCreated), "/api/v1/portfolios/")
+		var portfolios portfolioListResponse
+		w := call("GET /portfolios", "", "GET", "/portfolios", "", nil, http.StatusOK)
+		if err := json.Unmarshal(w.Body.Bytes(), &portfolios); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range portfolios.Portfolios {
+			if p.ID != first {
+				call("DELETE /portfolios/{id}", ownerToken, "DELETE", fmt.Sprintf("/portfolios/%d", p.ID), "", nil, http.StatusNoContent)
+			}
+		}
+		call("DELETE /portfolios/{id}", ownerToken, "DELETE", fmt.Sprintf("/portfolios/%d", first), "", nil, http.StatusConflict)
+		second := created(upload(ownerToken, http.StatusCreated), "/api/v1/portfolios/")
+
+		call("GET /portfolios/{id}", "", "GET", fmt.Sprintf("/portfolios/%d", first), "", nil, http.StatusOK)
+		call("GET /portfolios/{id}", "", "GET", "/portfolios/999", "", nil, http.StatusNotFound)
+		call("DELETE /portfolios/{id}", editorToken, "DELETE", fmt.Sprintf("/portfolios/%d", second), "", nil, http.StatusForbidden)
+		call("DELETE /portfolios/{id}", ownerToken, "DELETE", fmt.Sprintf("/portfolios/%d", second), "", nil, http.StatusNoContent)
+	})
+
+	t.Run("visuals", func(t *testing.T) {
+		photo := func(name string, seed int) formFile {
+			return formFile{"photos", name, "image/jpeg", testJPEG(t, seed)}
+		}
+		newVisual := multipartForm{
+			fields: [][2]string{{"title", "Visual"}, {"description", "Photos"}},
+			files:  []formFile{photo("one.jpg", 1), photo("two.jpg", 2)},
+		}
+		formCall("POST /visuals", "", "POST", "/visuals", newVisual, http.StatusUnauthorized)
+		formCall("POST /visuals", editorToken, "POST", "/visuals", multipartForm{files: newVisual.files}, http.StatusBadRequest)
+		w := formCall("POST /visuals", editorToken, "POST", "/visuals", newVisual, http.StatusSeeOther)
+		var id int
+		if _, err := fmt.Sscanf(w.Header().Get("Location"), "/visuals/%d", &id); err != nil {
+			t.Fatalf("Location %q, want /visuals/<id>", w.Header().Get("Location"))
+		}
+		formCall("POST /visuals/", editorToken, "POST", "/visuals/", multipartForm{
+			fields: [][2]string{{"title", "Copies"}},
+			files:  []formFile{photo("one.jpg", 1), photo("again.jpg", 1)},
+		}, http.StatusConflict)
+		visual := fmt.Sprintf("/visuals/%d", id)
+
+		call("GET /visuals/{id}", "", "GET", visual, "", nil, http.StatusOK)
+		call("GET /visuals/{id}", "", "GET", "/visuals/x", "", nil, http.StatusBadRequest)
+		w = call("GET /visuals/{id}/photos", "", "GET", visual+"/photos?page=1&per_page=1", "", nil, http.StatusOK)
+		var photos photoListResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &photos); err != nil || len(photos.Photos) != 1 {
+			t.Fatalf("photos = %s (%v), want one", w.Body, err)
+		}
+		call("GET /visuals/{id}/photos", "", "GET", "/visuals/x/photos", "", nil, http.StatusBadRequest)
+
+		key := visualPrefix(id) + "/" + photos.Photos[0].Filename
+		call("GET /thumbnails/", "", "GET", "/thumbnails/?path="+key, "", nil, http.StatusOK)
+		call("GET /thumbnails/", "", "GET", "/thumbnails/?path="+visualPrefix(id)+"/missing.jpg", "", nil, http.StatusNotFound)
+		call("GET /thumbnails/", "", "GET", "/thumbnails/?path=../config.yaml", "", nil, http.StatusBadRequest)
+
+		edit := multipartForm{
+			fields: [][2]string{{"title", "Visual 2"}, {"description", "More photos"}},
+			files:  []formFile{photo("three.jpg", 3)},
+		}
+		formCall("PATCH /visuals/{id}", editorToken, "PATCH", visual, edit, http.StatusSeeOther)
+		formCall("PATCH /visuals/{id}", editorToken, "PATCH", "/visuals/999", edit, http.StatusNotFound)
+		formCall("PATCH /visuals/{id}", editorToken, "PATCH", visual, multipartForm{
+			fields: [][2]string{{"title", "Visual 2"}},
+			files:  []formFile{photo("three-again.jpg", 3)},
+		}, http.StatusConflict)
+		formCall("POST /visuals/{id}", editorToken, "POST", visual, multipartForm{}, http.StatusMethodNotAllowed)
+		formCall("POST /visuals/{id}", editorToken, "POST", visual, multipartForm{
+			fields: [][2]string{{"_method", "PATCH"}, {"title", "Visual 3"}},
+		}, http.StatusSeeOther)
+
+		photoURL := fmt.Sprintf("%s/photos/%d", visual, photos.Photos[0].ID)
+		call("DELETE /visuals/{id}/photos/{photoID}", editorToken, "DELETE", photoURL, "", nil, http.StatusForbidden)
+		call("DELETE /visuals/{id}/photos/{photoID}", ownerToken, "DELETE", photoURL, "", nil, http.StatusNoContent)
+		call("DELETE /visuals/{id}/photos/{photoID}", ownerToken, "DELETE", photoURL, "", nil, http.StatusNotFound)
+		call("DELETE /visuals/{id}/photos/{photoID}", ownerToken, "DELETE", visual+"/photos/x", "", nil, http.StatusBadRequest)
+
+		call("DELETE /visuals/{id}", editorToken, "DELETE", visual, "", nil, http.StatusForbidden)
+		call("DELETE /visuals/{id}", ownerToken, "DELETE", visual, "", nil, http.StatusSeeOther)
+		call("DELETE /visuals/{id}", ownerToken, "DELETE", visual, "", nil, http.StatusNotFound)
+	})
+
+	t.Run("audit events", func(t *testing.T) {
+		call("GET /audit-events", "", "GET", "/audit-events", "", nil, http.StatusUnauthorized)
+		call("GET /audit-events", editorToken, "GET", "/audit-events", "", nil, http.StatusForbidden)
+		call("GET /audit-events", ownerToken, "GET", "/audit-events?since=yesterday", "", nil, http.StatusBadRequest)
+		w := call("GET /audit-events", ownerToken, "GET", "/audit-events?action=story.create", "", nil, http.StatusOK)
+		var events auditEventListResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+			t.Fatal(err)
+		}
+		if len(events.Events) != 2 {
+			t.Errorf("got %d story.create events, want 2: %s", len(events.Events), w.Body)
+		}
+	})
+
+	for _, op := range documentedOperations(t) {
+		if !done[op] {
+			t.Errorf("%s is documented but not tested", op)
+		}
+	}
+}
+
+// documentedOperations lists the operations of the OpenAPI document as
+// "METHOD /path".
+func documentedOperations(t *testing.T) []string {
+	t.Helper()
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openapi.Document(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	for path, item := range doc.Paths {
+		for method := range item {
+			if method := strings.ToUpper(method); slices.Contains([]string{"GET", "POST", "PUT", "PATCH", "DELETE"}, method) {
+				ops = append(ops, method+" "+path)
+			}
+		}
+	}
+	slices.Sort(ops)
+	return ops
+}
+
+type formFile struct {
+	field, name, contentType string
+	data                     []byte
+}
+
+type multipartForm struct {
+	fields [][2]string
+	files  []formFile
+}
+
+func (f multipartForm) encode(t *testing.T) (string, []byte) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, field := range f.fields {
+		mw.WriteField(field[0], field[1])
+	}
+	for _, file := range f.files {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, file.field, file.name))
+		h.Set("Content-Type", file.contentType)
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(part, bytes.NewReader(file.data))
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return mw.FormDataContentType(), body.Bytes()
+}
+
+// testJPEG draws a JPEG whose pixels depend on seed, so that different
+// seeds do not look like duplicates of each other.
+func testJPEG(t *testing.T, seed int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := range 48 {
+		for x := range 64 {
+			v := uint8((x*seed*7 + y*seed*13 + (x/(seed+3))*(y/(seed+2))*97) % 256)
+			img.Set(x, y, color.RGBA{v, 255 - v, uint8(seed * 40), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/apitoken"
+)
+
+var errAPITokenNotFound = errors.New("api token not found")
+
+type APIToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+	RevokedAt  sql.NullTime
+}
+
+// HasScope reports whether the token may be used for an action. Tokens
+// created without scopes carry their owner's full rights.
+func (t *APIToken) HasScope(scope string) bool {
+	return len(t.Scopes) == 0 || slices.Contains(t.Scopes, scope)
+}
+
+func (t *APIToken) Revoked() bool {
+	return t.RevokedAt.Valid
+}
+
+// bearerToken extracts the credential from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// getAPIToken authenticates the bearer token on a request, if any.
+func (app *App) getAPIToken(r *http.Request) (*APIToken, bool) {
+	raw, ok := bearerToken(r)
+	if !ok {
+		return nil, false
+	}
+	token, err := app.authenticateAPIToken(raw, time.Now().UTC())
+	if err != nil {
+		if !errors.Is(err, errAPITokenNotFound) {
+			log.Printf("Failed to authenticate API token: %v", err)
+		}
+		return nil, false
+	}
+	return token, true
+}
+
+// authenticateAPIToken resolves a raw token to a live, unrevoked token whose
+// owner is still enabled, and records when it was last used.
+func (app *App) authenticateAPIToken(raw string, now time.Time) (*APIToken, error) {
+	var token APIToken
+	var scopes string
+	var disabled bool
+	err := app.db.QueryRow(`
+		SELECT t.id, t.user_id, t.name, t.scopes, t.created_at, t.last_used_at, t.revoked_at, u.disabled
+		FROM api_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = ?`, apitoken.Hash(raw)).
+		Scan(&token.ID, &token.UserID, &token.Name, &scopes, &token.CreatedAt, &token.LastUsedAt, &token.RevokedAt, &disabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errAPITokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("authenticateAPIToken: %w", err)
+	}
+	if token.Revoked() || disabled {
+		return nil, errAPITokenNotFound
+	}
+	token.Scopes = strings.Fields(scopes)
+
+	if !token.LastUsedAt.Valid || now.Sub(token.LastUsedAt.Time) >= sessionTouchInterval {
+		token.LastUsedAt = sql.NullTime{Time: now, Valid: true}
+		if _, err := app.db.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, now, token.ID); err != nil {
+			log.Printf("authenticateAPIToken: failed to record last use: %v", err)
+		}
+	}
+	return &token, nil
+}
+
+// createAPIToken stores a new token and returns its raw value, which is the
+// only time it is ever available, along with its ID.
+func (app *App) createAPIToken(userID int, name string, scopes []string) (string, int64, error) {
+	raw, hash, err := apitoken.New()
+	if err != nil {
+		return "", 0, err
+	}
+	result, err := app.db.Exec(`
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		userID, name, hash, apitoken.FormatScopes(scopes), time.Now().UTC())
+	if err != nil {
+		return "", 0, fmt.Errorf("createAPIToken: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", 0, fmt.Errorf("createAPIToken (get ID): %w", err)
+	}
+	return raw, id, nil
+}
+
+func (app *App) listAPITokens(userID int) ([]APIToken, error) {
+	rows, err := app.db.Query(`
+		SELECT id, user_id, name, scopes, created_at, last_used_at, revoked_at
+		FROM api_tokens
+		WHERE user_id = ?
+		ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("listAPITokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		var t APIToken
+		var scopes string
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &scopes, &t.CreatedAt, &t.LastUsedAt, &t.RevokedAt); err != nil {
+			return nil, fmt.Errorf("listAPITokens: %w", err)
+		}
+		t.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (app *App) revokeAPIToken(userID, tokenID int) error {
+	result, err := app.db.Exec(`
+		UPDATE api_tokens
+		SET revoked_at = ?
+		WHERE id = ? AND user_id = ? AND revoked_at IS NULL`,
+		time.Now().UTC(), tokenID, userID)
+	if err != nil {
+		return fmt.Errorf("revokeAPIToken: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("revokeAPIToken (rows affected): %w", err)
+	}
+	if n == 0 {
+		return errAPITokenNotFound
+	}
+	return nil
+}
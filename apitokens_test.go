@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticateAPIToken(t *testing.T) {
+	app := newTestApp(t)
+	userID := createTestUser(t, app, "a@example.com", "password1", RoleOwner)
+	raw, id, err := app.createAPIToken(userID, "laptop", []string{"visuals:write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+
+	token, err := app.authenticateAPIToken(raw, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.UserID != userID || !token.HasScope("visuals:write") || token.HasScope("stories:write") {
+		t.Errorf("token = %+v", token)
+	}
+	if !token.LastUsedAt.Valid {
+		t.Error("last use was not recorded")
+	}
+	if _, err := app.authenticateAPIToken(raw+"x", now); !errors.Is(err, errAPITokenNotFound) {
+		t.Errorf("altered token: %v, want errAPITokenNotFound", err)
+	}
+
+	// Disabling the owner suspends the token; enabling them brings it back.
+	if _, err := app.db.Exec("UPDATE users SET disabled = 1 WHERE id = ?", userID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.authenticateAPIToken(raw, now); !errors.Is(err, errAPITokenNotFound) {
+		t.Errorf("token of a disabled user: %v, want errAPITokenNotFound", err)
+	}
+	if _, err := app.db.Exec("UPDATE users SET disabled = 0 WHERE id = ?", userID); err != nil {
+		t.Fatal(err)
+	}
+
+	other := createTestUser(t, app, "b@example.com", "password1", RoleOwner)
+	if err := app.revokeAPIToken(other, int(id)); !errors.Is(err, errAPITokenNotFound) {
+		t.Errorf("revoking someone else's token: %v, want errAPITokenNotFound", err)
+	}
+	if err := app.revokeAPIToken(userID, int(id)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.authenticateAPIToken(raw, now); !errors.Is(err, errAPITokenNotFound) {
+		t.Errorf("revoked token: %v, want errAPITokenNotFound", err)
+	}
+}
+
+func TestAPITokenScopes(t *testing.T) {
+	app := newTestApp(t)
+	owner := createTestUser(t, app, "owner@example.com", "password1", RoleOwner)
+	viewer := createTestUser(t, app, "viewer@example.com", "password1", RoleViewer)
+	token := func(userID int, scopes ...string) string {
+		raw, _, err := app.createAPIToken(userID, "test", scopes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	full := token(owner)
+	storiesOnly := token(owner, "stories:write")
+	auditOnly := token(owner, "audit:read")
+	viewerFull := token(viewer)
+	handler := app.routes()
+
+	tests := []struct {
+		name, token, method, path string
+		want                      int
+	}{
+		{"unscoped token", full, http.MethodGet, "/api/v1/audit-events", http.StatusOK},
+		{"read scope", auditOnly, http.MethodGet, "/api/v1/audit-events", http.StatusOK},
+		{"missing read scope", storiesOnly, http.MethodGet, "/api/v1/audit-events", http.StatusForbidden},
+		{"write scope", storiesOnly, http.MethodPost, "/api/v1/stories", http.StatusCreated},
+		{"missing write scope", auditOnly, http.MethodPost, "/api/v1/stories", http.StatusForbidden},
+		// Scopes narrow the owner's rights, they never add to them.
+		{"scope beyond the role", viewerFull, http.MethodPost, "/api/v1/stories", http.StatusForbidden},
+		{"unknown token", "pyz_nope", http.MethodGet, "/api/v1/audit-events", http.StatusUnauthorized},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"title":"Story ` + string(rune('A'+i)) + `","content":"x"}`
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
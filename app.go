@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/config"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/openapi"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/storage"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/thumbnail"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// App carries everything the handlers share: the configuration, the open
+// database, the parsed templates, the stores built on top of the database
+// and the storage uploads are kept in.
+type App struct {
+	cfg        *config.Config
+	db         *sql.DB
+	tpl        *template.Template
+	sessions   SessionStore
+	throttle   *LoginThrottle
+	storage    storage.Storage
+	jobs       *JobQueue
+	images     *ImageCache
+	imageKey   []byte
+	thumbnails *thumbnail.Renderer
+	api        *openapi.Spec
+}
+
+// newApp opens the database, brings its schema up to date and parses the
+// templates. The caller owns the returned App and must Close it. The job
+// queue is set up but not started.
+func newApp(cfg *config.Config) (*App, error) {
+	store, err := cfg.Storage.NewStorage(context.Background(), cfg.ServeDir)
+	if err != nil {
+		return nil, fmt.Errorf("newApp: %w", err)
+	}
+
+	thumbnails, err := thumbnail.NewRenderer(cfg.Thumbnails)
+	if err != nil {
+		return nil, fmt.Errorf("newApp: %w", err)
+	}
+
+	api, err := openapi.Load()
+	if err != nil {
+		return nil, fmt.Errorf("newApp: %w", err)
+	}
+
+	db, err := sql.Open("sqlite3", cfg.DatabasePath)
+	if err != nil {
+		return nil, fmt.Errorf("newApp: %w", err)
+	}
+	if err := configDatabase(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("newApp: %w", err)
+	}
+
+	imageKey := []byte(cfg.Images.SigningKey)
+	if len(imageKey) == 0 {
+		imageKey, err = loadOrCreateSecret(db, imageSigningKeyName, 32)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("newApp: %w", err)
+		}
+	}
+
+	app := &App{
+		cfg:        cfg,
+		db:         db,
+		sessions:   newSQLiteSessionStore(db, sessionIdleTimeout, sessionAbsoluteTimeout),
+		throttle:   newLoginThrottle(db),
+		storage:    store,
+		jobs:       newJobQueue(db, cfg.Jobs),
+		images:     newImageCache(cfg.Images.CacheDir, cfg.Images.CacheMaxAge),
+		imageKey:   imageKey,
+		thumbnails: thumbnails,
+		api:        api,
+	}
+	app.jobs.Register(jobThumbnails, app.runThumbnailJob, app.thumbnailJobFailed)
+	app.jobs.Register(jobMetadata, app.runMetadataJob, nil)
+	app.jobs.Register(jobPhotoHashes, app.runPhotoHashesJob, nil)
+
+	app.tpl, err = template.New("").Funcs(template.FuncMap{
+		"imageURL":    app.imageURL,
+		"formatBytes": formatBytes,
+	}).ParseGlob(filepath.Join(cfg.StaticDir, "html", "*.gohtml"))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("newApp: parsing templates: %w", err)
+	}
+	return app, nil
+}
+
+func (app *App) Close() error {
+	return app.db.Close()
+}
+
+func (app *App) routes() http.Handler {
+	fileHandler := http.HandlerFunc(app.fsHandler)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", app.requireCSRF(app.requirePermissions(methodPermissions{http.MethodPost: "covers:replace"}, app.indexHandler)))
+	mux.HandleFunc("/stories/", methodOverride(app.requireCSRF(app.requirePermissions(methodPermissions{
+		http.MethodPatch:  "stories:edit",
+		http.MethodDelete: "stories:delete",
+	}, app.storiesHandler))))
+	mux.HandleFunc("/stories", app.requireCSRF(app.requirePermissions(methodPermissions{http.MethodPost: "stories:create"}, app.listStoriesHandler)))
+	mux.HandleFunc("/api/v1/thumbnails/", app.requirePermissions(methodPermissions{}, app.thumbnailsHandler))
+	mux.HandleFunc("/api/v1/visuals", app.requireCSRF(app.requirePermission("visuals:create", app.createVisualHandler)))
+	// The trailing slash is how visuals were first created; kept for scripts.
+	mux.HandleFunc("/api/v1/visuals/{$}", app.requireCSRF(app.requirePermission("visuals:create", app.createVisualHandler)))
+	mux.HandleFunc("/api/v1/visuals/{id}", methodOverride(app.requireCSRF(app.requirePermissions(methodPermissions{
+		http.MethodPatch:  "visuals:edit",
+		http.MethodDelete: "visuals:delete",
+	}, app.visualApiHandler))))
+	mux.HandleFunc("/api/v1/visuals/{id}/photos", app.requirePermissions(methodPermissions{}, app.visualPhotosApiHandler))
+	mux.HandleFunc("/api/v1/visuals/{id}/photos/{photoID}", app.requireCSRF(app.requirePermissions(methodPermissions{
+		http.MethodDelete: "visuals:delete",
+	}, app.visualPhotoApiHandler)))
+	mux.HandleFunc("/visuals/", methodOverride(app.requireCSRF(app.requirePermissions(methodPermissions{
+		http.MethodPatch:  "visuals:edit",
+		http.MethodDelete: "visuals:delete",
+	}, app.visualsHandler))))
+	mux.HandleFunc("/visuals", app.requirePermissions(methodPermissions{}, app.listVisualsHandler))
+	mux.HandleFunc("/info", methodOverride(app.requireCSRF(app.requirePermissions(methodPermissions{http.MethodPost: "info:edit"}, app.infoHandler))))
+	mux.HandleFunc("/upload/", app.requireAuth(app.uploadFormHandler))
+	mux.HandleFunc("/upload", app.requireAuth(app.uploadHandler))
+	mux.HandleFunc("/login", app.loginHandler)
+	mux.HandleFunc("/login/2fa", app.loginTwoFactorHandler)
+	mux.HandleFunc("/account/2fa", app.requireCSRF(app.requireSession(app.accountTwoFactorHandler)))
+	mux.HandleFunc("/account/tokens", app.requireCSRF(app.requireSession(app.accountTokensHandler)))
+	mux.HandleFunc("/admin/audit", app.requirePermission("audit:view", app.auditPageHandler))
+	mux.HandleFunc("/api/v1/audit-events", app.requirePermission("audit:view", app.auditEventsApiHandler))
+	mux.HandleFunc("/admin/duplicates", app.requirePermission("visuals:delete", app.duplicatesPageHandler))
+	mux.HandleFunc("/admin/storage", app.requireCSRF(app.requirePermission("storage:check", app.storagePageHandler)))
+	mux.HandleFunc("/logout", app.requireCSRF(app.logoutHandler))
+	mux.HandleFunc("/portfolio", app.requireCSRF(app.requirePermissions(methodPermissions{http.MethodPost: "portfolios:replace"}, app.portfolioHandler)))
+	mux.HandleFunc("/api/v1/stories", app.requireCSRF(app.requirePermissions(methodPermissions{http.MethodPost: "stories:create"}, app.storiesApiHandler)))
+	mux.HandleFunc("/api/v1/stories/{id}", app.requireCSRF(app.requirePermissions(methodPermissions{
+		http.MethodPut:    "stories:edit",
+		http.MethodPatch:  "stories:edit",
+		http.MethodDelete: "stories:delete",
+	}, app.storyApiHandler)))
+	mux.HandleFunc("/api/v1/info", app.requireCSRF(app.requirePermissions(methodPermissions{
+		http.MethodPut:   "info:edit",
+		http.MethodPatch: "info:edit",
+	}, app.infoApiHandler)))
+	mux.HandleFunc("/api/v1/covers", app.requireCSRF(app.requirePermissions(methodPermissions{http.MethodPost: "covers:replace"}, app.coversApiHandler)))
+	mux.HandleFunc("/api/v1/covers/{id}", app.requireCSRF(app.requirePermissions(methodPermissions{http.MethodDelete: "covers:replace"}, app.coverApiHandler)))
+	mux.HandleFunc("/api/v1/portfolios", app.requireCSRF(app.requirePermissions(methodPermissions{http.MethodPost: "portfolios:replace"}, app.portfoliosApiHandler)))
+	mux.HandleFunc("/api/v1/portfolios/{id}", app.requireCSRF(app.requirePermissions(methodPermissions{http.MethodDelete: "portfolios:replace"}, app.portfolioApiHandler)))
+	mux.Handle("/fs/", fileHandler)
+	mux.HandleFunc("/thumbnails/", app.thumbnailHandler)
+	mux.HandleFunc("/img/", app.imageHandler)
+	mux.Handle("/favicon.ico", http.NotFoundHandler())
+	mux.Handle("/robots.txt", AddPrefixHandler("/fs", fileHandler))
+	mux.HandleFunc("/style.css", app.styleSheetHandler)
+	mux.HandleFunc("/api/v1/openapi.json", app.requirePermissions(methodPermissions{}, app.openAPIHandler))
+	mux.HandleFunc("/api/docs", app.requirePermissions(methodPermissions{}, app.apiExplorerHandler))
+
+	if !app.cfg.ValidateAPI {
+		return mux
+	}
+	return app.api.Middleware(mux, func(r *http.Request, err error) {
+		log.Printf("API validation: %v", err)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestApp returns an App on a fresh database and storage directory
+// under t.TempDir, with the real templates. Its job queue is not started.
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.DatabasePath = filepath.Join(dir, "sqlite.DB")
+	cfg.ServeDir = filepath.Join(dir, "serve")
+	cfg.Images.CacheDir = filepath.Join(dir, "cache")
+	app, err := newApp(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.Close() })
+	return app
+}
+
+// createTestUser adds a user with the given role and returns their id.
+func createTestUser(t *testing.T, app *App, email, password string, role Role) int {
+	t.Helper()
+	digest, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := app.db.Exec("INSERT INTO users (email, password_digest, role) VALUES (?, ?, ?)", email, digest, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
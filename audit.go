@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	auditDefaultPerPage = 50
+	auditMaxPerPage     = 500
+)
+
+// AuditEvent records one change made through the admin interface or API.
+// Before and After hold JSON snapshots of the entity and are empty for
+// creations and deletions respectively.
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	ActorID    *int            `json:"actor_id"`
+	ActorEmail string          `json:"actor_email"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   string          `json:"entity_id"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	IP         string          `json:"ip"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+type auditFilter struct {
+	Actor      string
+	Action     string
+	EntityType string
+	EntityID   string
+	Since      time.Time
+	Until      time.Time
+	Page       int
+	PerPage    int
+}
+
+// recordAuditEvent stores who made a change, and what it looked like before
+// and after. It is called once the change has succeeded; a failure to write
+// the event is logged rather than undoing the change.
+func (app *App) recordAuditEvent(r *http.Request, action, entityType string, entityID any, before, after any) {
+	event := AuditEvent{
+		Action:     action,
+		EntityType: entityType,
+		IP:         clientIP(r),
+		CreatedAt:  time.Now().UTC(),
+	}
+	if entityID != nil {
+		event.EntityID = fmt.Sprint(entityID)
+	}
+	if userId, ok := app.getLoginStatus(r); ok {
+		event.ActorID = userId
+		email, err := app.getUserEmail(*userId)
+		if err != nil {
+			log.Printf("recordAuditEvent: %v", err)
+		}
+		event.ActorEmail = email
+	}
+
+	var err error
+	if event.Before, err = auditSnapshot(before); err != nil {
+		log.Printf("recordAuditEvent: %s %s/%s: %v", action, entityType, event.EntityID, err)
+	}
+	if event.After, err = auditSnapshot(after); err != nil {
+		log.Printf("recordAuditEvent: %s %s/%s: %v", action, entityType, event.EntityID, err)
+	}
+
+	if err := app.insertAuditEvent(event); err != nil {
+		log.Printf("Failed to record audit event %s %s/%s: %v", action, entityType, event.EntityID, err)
+	}
+}
+
+func auditSnapshot(v any) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("auditSnapshot: %w", err)
+	}
+	return b, nil
+}
+
+func nullableJSON(raw json.RawMessage) sql.NullString {
+	return sql.NullString{String: string(raw), Valid: raw != nil}
+}
+
+func (app *App) insertAuditEvent(event AuditEvent) error {
+	_, err := app.db.Exec(`
+		INSERT INTO audit_events (actor_id, actor_email, action, entity_type, entity_id, before_json, after_json, ip, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.ActorID, event.ActorEmail, event.Action, event.EntityType, event.EntityID,
+		nullableJSON(event.Before), nullableJSON(event.After), event.IP, event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("insertAuditEvent: %w", err)
+	}
+	return nil
+}
+
+// listAuditEvents returns one page of events matching the filter, newest
+// first, together with the total number of matches.
+func (app *App) listAuditEvents(filter auditFilter) ([]AuditEvent, int, error) {
+	var conditions []string
+	var args []any
+	if filter.Actor != "" {
+		conditions = append(conditions, "actor_email = ? COLLATE NOCASE")
+		args = append(args, normalizeEmail(filter.Actor))
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.EntityType != "" {
+		conditions = append(conditions, "entity_type = ?")
+		args = append(args, filter.EntityType)
+	}
+	if filter.EntityID != "" {
+		conditions = append(conditions, "entity_id = ?")
+		args = append(args, filter.EntityID)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.Until.UTC())
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM audit_events"+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("listAuditEvents (count): %w", err)
+	}
+
+	query := `
+		SELECT id, actor_id, actor_email, action, entity_type, entity_id, before_json, after_json, ip, created_at
+		FROM audit_events` + where + `
+		ORDER BY created_at DESC, id DESC
+		LIMIT ? OFFSET ?`
+	args = append(args, filter.PerPage, (filter.Page-1)*filter.PerPage)
+	rows, err := app.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("listAuditEvents: %w", err)
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		var actorID sql.NullInt64
+		var before, after sql.NullString
+		if err := rows.Scan(&e.ID, &actorID, &e.ActorEmail, &e.Action, &e.EntityType, &e.EntityID, &before, &after, &e.IP, &e.CreatedAt); err != nil {
+			return nil, 0, fmt.Errorf("listAuditEvents: %w", err)
+		}
+		if actorID.Valid {
+			id := int(actorID.Int64)
+			e.ActorID = &id
+		}
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		events = append(events, e)
+	}
+	return events, total, rows.Err()
+}
+
+// parseAuditFilter reads the filter shared by the audit page and the JSON
+// endpoint from the query string. Dates are either YYYY-MM-DD, in which case
+// "until" includes the whole day, or RFC 3339 timestamps.
+func parseAuditFilter(r *http.Request) (auditFilter, error) {
+	q := r.URL.Query()
+	filter := auditFilter{
+		Actor:      strings.TrimSpace(q.Get("actor")),
+		Action:     strings.TrimSpace(q.Get("action")),
+		EntityType: strings.TrimSpace(q.Get("entity_type")),
+		EntityID:   strings.TrimSpace(q.Get("entity_id")),
+	}
+
+	var err error
+	if filter.Since, err = parseAuditTime(q.Get("since"), false); err != nil {
+		return auditFilter{}, fmt.Errorf("invalid since: %w", err)
+	}
+	if filter.Until, err = parseAuditTime(q.Get("until"), true); err != nil {
+		return auditFilter{}, fmt.Errorf("invalid until: %w", err)
+	}
+
+	// per_page is read here rather than by getPaginationParams, which caps
+	// it at 100 and has no default.
+	filter.Page, _ = getPaginationParams(r)
+	filter.PerPage = auditDefaultPerPage
+	if val, err := strconv.Atoi(q.Get("per_page")); err == nil && val > 0 {
+		filter.PerPage = min(val, auditMaxPerPage)
+	}
+	return filter, nil
+}
+
+func parseAuditTime(value string, endOfDay bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseAuditFilterPerPage(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", auditDefaultPerPage},
+		{"?per_page=300", 300},
+		{"?per_page=1000", auditMaxPerPage},
+		{"?per_page=0", auditDefaultPerPage},
+		{"?per_page=x", auditDefaultPerPage},
+	}
+	for _, tt := range tests {
+		filter, err := parseAuditFilter(httptest.NewRequest("GET", "/api/v1/audit-events"+tt.query, nil))
+		if err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+		if filter.PerPage != tt.want {
+			t.Errorf("%q: PerPage = %d, want %d", tt.query, filter.PerPage, tt.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/config"
+)
+
+// loadConfig builds the configuration from args (without the program name)
+// and the environment. printOnly is set when --print-config was given.
+func loadConfig(args []string, getenv func(string) string) (cfg *config.Config, printOnly bool, err error) {
+	fs := flag.NewFlagSet("web-app", flag.ContinueOnError)
+	configPath := fs.String("config", getenv("PORTFOLIO_CONFIG"), "Path to a YAML or TOML config file (env PORTFOLIO_CONFIG).")
+	port := fs.Int("port", 0, "Port to listen on (env PORTFOLIO_PORT or SERVER_PORT).")
+	dbPath := fs.String("db", "", "Path to the SQLite database (env PORTFOLIO_DATABASE_PATH).")
+	serveDir := fs.String("serve-dir", "", "Directory uploads are stored in and served from under /fs/ (env PORTFOLIO_SERVE_DIR).")
+	staticDir := fs.String("static-dir", "", "Directory holding the html templates and styles (env PORTFOLIO_STATIC_DIR).")
+	readTimeout := fs.Duration("read-timeout", 0, "HTTP read timeout (env PORTFOLIO_READ_TIMEOUT).")
+	writeTimeout := fs.Duration("write-timeout", 0, "HTTP write timeout (env PORTFOLIO_WRITE_TIMEOUT).")
+	idleTimeout := fs.Duration("idle-timeout", 0, "HTTP keep-alive idle timeout (env PORTFOLIO_IDLE_TIMEOUT).")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 0, "How long to drain in-flight requests on shutdown (env PORTFOLIO_SHUTDOWN_TIMEOUT).")
+	validateAPI := fs.Bool("validate-api", false, "Log /api/v1 requests and responses that do not match the OpenAPI document (env PORTFOLIO_VALIDATE_API).")
+	reapplyWatermarks := fs.Bool("reapply-watermarks", false, "Make the watermarked thumbnails of every photo again, in the background.")
+	fsck := fs.Bool("fsck", false, "Check storage against the database, print the report and exit.")
+	fsckRepair := fs.Bool("fsck-repair", false, "Like --fsck, and also queue missing thumbnails, delete orphan rows and quarantine orphan files.")
+	printConfig := fs.Bool("print-config", false, "Print the resolved configuration and exit.")
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if fs.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	cfg, err = config.Load(*configPath, getenv)
+	if err != nil {
+		return nil, false, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "db":
+			cfg.DatabasePath = *dbPath
+		case "serve-dir":
+			cfg.ServeDir = *serveDir
+		case "static-dir":
+			cfg.StaticDir = *staticDir
+		case "read-timeout":
+			cfg.ReadTimeout = *readTimeout
+		case "write-timeout":
+			cfg.WriteTimeout = *writeTimeout
+		case "idle-timeout":
+			cfg.IdleTimeout = *idleTimeout
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = *shutdownTimeout
+		case "validate-api":
+			cfg.ValidateAPI = *validateAPI
+		case "reapply-watermarks":
+			cfg.ReapplyWatermarks = *reapplyWatermarks
+		case "fsck":
+			cfg.Fsck = *fsck
+		case "fsck-repair":
+			cfg.FsckRepair = *fsckRepair
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, false, err
+	}
+	// Only the server needs the templates, so this is checked here rather
+	// than by Validate.
+	if info, err := os.Stat(filepath.Join(cfg.StaticDir, "html")); err != nil || !info.IsDir() {
+		return nil, false, fmt.Errorf("invalid configuration:\n  static_dir %q has no html directory", cfg.StaticDir)
+	}
+	return cfg, *printConfig, nil
+}
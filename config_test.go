@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFlagsOverrideEnv(t *testing.T) {
+	getenv := func(name string) string {
+		return map[string]string{
+			"PORTFOLIO_PORT":          "9100",
+			"PORTFOLIO_DATABASE_PATH": "env.db",
+		}[name]
+	}
+	cfg, printOnly, err := loadConfig([]string{"--port", "9200", "--print-config"}, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 9200 || cfg.DatabasePath != "env.db" || !printOnly {
+		t.Errorf("port %d, database %q, printOnly %v; want 9200, env.db, true", cfg.Port, cfg.DatabasePath, printOnly)
+	}
+
+	// A flag set to the zero value still counts.
+	cfg, _, err = loadConfig([]string{"--validate-api=false"}, func(name string) string {
+		if name == "PORTFOLIO_VALIDATE_API" {
+			return "true"
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ValidateAPI {
+		t.Error("validate_api is the environment's true, want the flag's false")
+	}
+
+	tests := map[string][]string{
+		"invalid value":       {"--port", "70000"},
+		"no templates":        {"--static-dir", t.TempDir()},
+		"unexpected argument": {"serve"},
+	}
+	for name, args := range tests {
+		if _, _, err := loadConfig(args, func(string) string { return "" }); err == nil {
+			t.Errorf("%s: loadConfig(%s) succeeded", name, strings.Join(args, " "))
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequireCSRF(t *testing.T) {
+	app := newTestApp(t)
+	userID := createTestUser(t, app, "a@example.com", "password1", RoleOwner)
+	session, err := app.sessions.Create(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := app.sessions.Create(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := app.requireCSRF(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name    string
+		method  string
+		session bool
+		form    string
+		header  string
+		bearer  bool
+		want    int
+	}{
+		{name: "safe method", method: http.MethodGet, session: true, want: http.StatusNoContent},
+		{name: "no session", method: http.MethodPost, want: http.StatusNoContent},
+		{name: "missing token", method: http.MethodPost, session: true, want: http.StatusForbidden},
+		{name: "form token", method: http.MethodPost, session: true, form: session.CSRFToken, want: http.StatusNoContent},
+		{name: "header token", method: http.MethodDelete, session: true, header: session.CSRFToken, want: http.StatusNoContent},
+		{name: "wrong token", method: http.MethodPost, session: true, form: "not-the-token", want: http.StatusForbidden},
+		{name: "token of another session", method: http.MethodPatch, session: true, header: other.CSRFToken, want: http.StatusForbidden},
+		// Left to the auth middleware, which ignores the cookie.
+		{name: "api token", method: http.MethodPost, session: true, bearer: true, want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			if tt.form != "" {
+				form.Set(csrfFormField, tt.form)
+			}
+			req := httptest.NewRequest(tt.method, "/", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.session {
+				req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: session.ID})
+			}
+			if tt.header != "" {
+				req.Header.Set(csrfHeader, tt.header)
+			}
+			if tt.bearer {
+				req.Header.Set("Authorization", "Bearer something")
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSRFTokenIsTheSessions(t *testing.T) {
+	app := newTestApp(t)
+	userID := createTestUser(t, app, "a@example.com", "password1", RoleOwner)
+	session, err := app.sessions.Create(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/upload", nil)
+	if got := app.csrfToken(req); got != "" {
+		t.Errorf("anonymous visitor got token %q", got)
+	}
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: session.ID})
+	if got := app.csrfToken(req); got != session.CSRFToken {
+		t.Errorf("csrfToken = %q, want the session's", got)
+	}
+	if len(session.CSRFToken) < 40 {
+		t.Errorf("token %q is shorter than 32 random bytes", session.CSRFToken)
+	}
+}
@@ -1,109 +1,146 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log"
+	"path"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/migrate"
+	"github.com/mattn/go-sqlite3"
 )
 
-var DB *sql.DB
-
-func configDatabase() error {
-	createStatements := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			email TEXT NOT NULL UNIQUE,
-			password_digest BLOB NOT NULL
-		);`,
-		`CREATE TABLE IF NOT EXISTS stories (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			title TEXT NOT NULL,
-			content TEXT NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE(title)
-		);
-		CREATE INDEX IF NOT EXISTS idx_stories_created_at ON stories(created_at);`,
-		`CREATE TABLE IF NOT EXISTS visuals (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			title TEXT NOT NULL,
-			description TEXT NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		);
-		CREATE INDEX IF NOT EXISTS idx_visuals_created_at ON visuals(created_at);`,
-		`CREATE TABLE IF NOT EXISTS visual_photos (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			visual_id INTEGER NOT NULL,
-			file_path TEXT NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (visual_id) REFERENCES visuals(id) ON DELETE CASCADE
-		);
-		CREATE INDEX IF NOT EXISTS idx_visual_photos_visual_id ON visual_photos(visual_id);`,
-		`CREATE TABLE IF NOT EXISTS info (
-			singleton INTEGER PRIMARY KEY CHECK (singleton = 1),
-			content TEXT NOT NULL,
-			last_updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		);
-		INSERT OR IGNORE INTO info (singleton, content) VALUES (1, 'Welcome to my Website');`,
-		`CREATE TABLE IF NOT EXISTS covers (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			file_path TEXT NOT NULL UNIQUE,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		);`,
-		`CREATE TABLE IF NOT EXISTS portfolios (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			file_path TEXT NOT NULL UNIQUE,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		);`,
-	}
-
-	for _, stmt := range createStatements {
-		if _, err := DB.Exec(stmt); err != nil {
-			log.Printf("configDatabase: %q: %v\n", stmt, err)
-			return err
-		}
-	}
+// errStoryTitleTaken is returned when a story would get the title of
+// another; titles are UNIQUE.
+var errStoryTitleTaken = errors.New("a story with this title already exists")
 
-	if err := ensureDefaultExists("covers", "file_path", "cover.png"); err != nil {
+// errLastCover and errLastPortfolio are returned instead of deleting the
+// only cover or portfolio there is.
+var (
+	errLastCover     = errors.New("the last cover cannot be deleted")
+	errLastPortfolio = errors.New("the last portfolio cannot be deleted")
+)
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// configDatabase brings the schema up to date by applying any pending
+// migrations from internal/migrate.
+func configDatabase(db *sql.DB) error {
+	migrator, err := migrate.New(db)
+	if err != nil {
 		return err
 	}
-	if err := ensureDefaultExists("portfolios", "file_path", "portfolios/portfolio.pdf"); err != nil {
-		return err
+	applied, err := migrator.Up(0)
+	for _, m := range applied {
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("configDatabase: %w", err)
 	}
-
 	return nil
 }
 
-func ensureDefaultExists(table, column, value string) error {
-	var count int
-	err := DB.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %s`, table)).Scan(&count)
+func (app *App) getLatestCover() (Cover, error) {
+	var cover Cover
+	err := app.db.QueryRow("SELECT id, file_path, width, height FROM covers ORDER BY created_at DESC, id DESC LIMIT 1").
+		Scan(&cover.ID, &cover.FilePath, &cover.Width, &cover.Height)
 	if err != nil {
-		return fmt.Errorf("failed to check %s count: %w", table, err)
+		return Cover{}, fmt.Errorf("failed to get latest cover: %w", err)
 	}
-	if count == 0 {
-		_, err = DB.Exec(fmt.Sprintf(`INSERT INTO %s (%s) VALUES (?)`, table, column), value)
-		if err != nil {
-			return fmt.Errorf("failed to insert into %s: %w", table, err)
+	return cover, nil
+}
+
+// getCovers returns every cover ever uploaded, or only the one with the
+// given id, newest first. The first is the one on the home page.
+func (app *App) getCovers(id ...int) ([]Cover, error) {
+	query := "SELECT id, file_path, width, height, created_at FROM covers"
+	var args []any
+	if len(id) > 0 {
+		query += " WHERE id = ?"
+		args = append(args, id[0])
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+
+	rows, err := app.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("getCovers: %w", err)
+	}
+	defer rows.Close()
+
+	var covers []Cover
+	for rows.Next() {
+		var c Cover
+		if err := rows.Scan(&c.ID, &c.FilePath, &c.Width, &c.Height, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("getCovers: %w", err)
 		}
+		covers = append(covers, c)
 	}
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getCovers: %w", err)
+	}
+	return covers, nil
 }
 
-func getLatestCoverFilename() (string, error) {
-	var filePath string
-	err := DB.QueryRow("SELECT file_path FROM covers ORDER BY created_at DESC LIMIT 1").Scan(&filePath)
+func (app *App) insertCover(filePath string) (int, error) {
+	result, err := app.db.Exec("INSERT INTO covers (file_path) VALUES (?)", filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to get latest cover: %w", err)
+		return 0, fmt.Errorf("insertCover: %w", err)
 	}
-	return filePath, nil
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("insertCover: %w", err)
+	}
+	return int(id), nil
 }
 
-func getInfo() (Info, error) {
+// deleteCover deletes a cover unless it is the last one, checking the count in
+// the same statement so that two deletes cannot both pass.
+func (app *App) deleteCover(id int) error {
+	result, err := app.db.Exec("DELETE FROM covers WHERE id = ? AND (SELECT COUNT(*) FROM covers) > 1", id)
+	if err != nil {
+		return fmt.Errorf("deleteCover: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("deleteCover: %w", err)
+	}
+	if n == 0 {
+		return errLastCover
+	}
+	return nil
+}
+
+// loadOrCreateSecret returns the secret stored under name, generating and
+// storing size random bytes the first time.
+func loadOrCreateSecret(db *sql.DB, name string, size int) ([]byte, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("loadOrCreateSecret: %w", err)
+	}
+	if _, err := db.Exec("INSERT INTO secrets (name, value) VALUES (?, ?) ON CONFLICT(name) DO NOTHING", name, b); err != nil {
+		return nil, fmt.Errorf("loadOrCreateSecret: %w", err)
+	}
+	var secret []byte
+	if err := db.QueryRow("SELECT value FROM secrets WHERE name = ?", name).Scan(&secret); err != nil {
+		return nil, fmt.Errorf("loadOrCreateSecret: %w", err)
+	}
+	return secret, nil
+}
+
+func (app *App) setCoverDimensions(id, width, height int) error {
+	if _, err := app.db.Exec("UPDATE covers SET width = ?, height = ? WHERE id = ?", width, height, id); err != nil {
+		return fmt.Errorf("setCoverDimensions: %w", err)
+	}
+	return nil
+}
+
+func (app *App) getInfo() (Info, error) {
 	const query = `
     SELECT content 
     FROM info 
@@ -112,7 +149,7 @@ func getInfo() (Info, error) {
 
 	var info Info
 
-	err := DB.QueryRow(query).Scan(&info.Content)
+	err := app.db.QueryRow(query).Scan(&info.Content)
 	if err != nil {
 		return Info{}, fmt.Errorf("failed to get info: %w", err)
 	}
@@ -120,13 +157,13 @@ func getInfo() (Info, error) {
 	return info, nil
 }
 
-func updateInfo(info Info) error {
+func (app *App) updateInfo(info Info) error {
 	sqlStmt := `
       UPDATE info 
       SET content = ?, last_updated = CURRENT_TIMESTAMP
       WHERE singleton = 1;
     `
-	result, err := DB.Exec(sqlStmt, info.Content)
+	result, err := app.db.Exec(sqlStmt, info.Content)
 	if err != nil {
 		return fmt.Errorf("updateInfo: %v", err)
 	}
@@ -142,7 +179,7 @@ func updateInfo(info Info) error {
 	return nil
 }
 
-func getStories(id ...int) ([]Story, error) {
+func (app *App) getStories(id ...int) ([]Story, error) {
 	var query string
 	var args []any
 
@@ -155,7 +192,7 @@ func getStories(id ...int) ([]Story, error) {
 
 	query += " ORDER BY created_at DESC;"
 
-	rows, err := DB.Query(query, args...)
+	rows, err := app.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -180,25 +217,31 @@ func getStories(id ...int) ([]Story, error) {
 	return stories, nil
 }
 
-func insertStory(story Story) (int, error) {
+func (app *App) insertStory(story Story) (int, error) {
 	sqlStmt := `
 		INSERT INTO stories (title, content) VALUES (?, ?) RETURNING id;
 	`
 	var id int
-	err := DB.QueryRow(sqlStmt, story.Title, story.Content).Scan(&id)
+	err := app.db.QueryRow(sqlStmt, story.Title, story.Content).Scan(&id)
+	if isUniqueViolation(err) {
+		return 0, errStoryTitleTaken
+	}
 	if err != nil {
 		return 0, fmt.Errorf("insertStory: %v", err)
 	}
 	return id, nil
 }
 
-func updateStory(story Story) error {
+func (app *App) updateStory(story Story) error {
 	sqlStmt := `
        UPDATE stories
        SET title = ?, content = ?
        WHERE id = ?;
     `
-	result, err := DB.Exec(sqlStmt, story.Title, story.Content, story.ID)
+	result, err := app.db.Exec(sqlStmt, story.Title, story.Content, story.ID)
+	if isUniqueViolation(err) {
+		return errStoryTitleTaken
+	}
 	if err != nil {
 		return fmt.Errorf("updateStory: %v", err)
 	}
@@ -214,16 +257,83 @@ func updateStory(story Story) error {
 	return nil
 }
 
-func getLatestPortfolioPath() (string, error) {
+func (app *App) deleteStory(id int) error {
+	if _, err := app.db.Exec("DELETE FROM stories WHERE id = ?", id); err != nil {
+		return fmt.Errorf("deleteStory: %w", err)
+	}
+	return nil
+}
+
+func (app *App) getLatestPortfolioPath() (string, error) {
 	var filePath string
-	err := DB.QueryRow("SELECT file_path FROM portfolios ORDER BY created_at DESC LIMIT 1").Scan(&filePath)
+	err := app.db.QueryRow("SELECT file_path FROM portfolios ORDER BY created_at DESC, id DESC LIMIT 1").Scan(&filePath)
 	if err != nil {
 		return "", fmt.Errorf("failed to get latest portfolio: %w", err)
 	}
 	return filePath, nil
 }
 
-func getVisuals(id ...int) ([]Visual, error) {
+// getPortfolios returns every portfolio ever uploaded, or only the one with
+// the given id, newest first. The first is the one /portfolio serves.
+func (app *App) getPortfolios(id ...int) ([]Portfolio, error) {
+	query := "SELECT id, file_path, created_at FROM portfolios"
+	var args []any
+	if len(id) > 0 {
+		query += " WHERE id = ?"
+		args = append(args, id[0])
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+
+	rows, err := app.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("getPortfolios: %w", err)
+	}
+	defer rows.Close()
+
+	var portfolios []Portfolio
+	for rows.Next() {
+		var p Portfolio
+		if err := rows.Scan(&p.ID, &p.FilePath, &p.CreatedAt); err != nil {
+			return nil, fmt.Errorf("getPortfolios: %w", err)
+		}
+		portfolios = append(portfolios, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getPortfolios: %w", err)
+	}
+	return portfolios, nil
+}
+
+func (app *App) insertPortfolio(filePath string) (int, error) {
+	result, err := app.db.Exec("INSERT INTO portfolios (file_path) VALUES (?)", filePath)
+	if err != nil {
+		return 0, fmt.Errorf("insertPortfolio: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("insertPortfolio: %w", err)
+	}
+	return int(id), nil
+}
+
+// deletePortfolio deletes a portfolio unless it is the last one, checking the count in
+// the same statement so that two deletes cannot both pass.
+func (app *App) deletePortfolio(id int) error {
+	result, err := app.db.Exec("DELETE FROM portfolios WHERE id = ? AND (SELECT COUNT(*) FROM portfolios) > 1", id)
+	if err != nil {
+		return fmt.Errorf("deletePortfolio: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("deletePortfolio: %w", err)
+	}
+	if n == 0 {
+		return errLastPortfolio
+	}
+	return nil
+}
+
+func (app *App) getVisuals(id ...int) ([]Visual, error) {
 	query := "SELECT id, title, description, created_at, updated_at FROM visuals"
 	var args []any
 
@@ -233,7 +343,7 @@ func getVisuals(id ...int) ([]Visual, error) {
 	}
 	query += " ORDER BY created_at DESC"
 
-	rows, err := DB.Query(query, args...)
+	rows, err := app.db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("getVisuals: %w", err)
 	}
@@ -252,8 +362,8 @@ func getVisuals(id ...int) ([]Visual, error) {
 	return visuals, nil
 }
 
-func getVisualByID(id int) (*Visual, error) {
-	visuals, err := getVisuals(id)
+func (app *App) getVisualByID(id int) (*Visual, error) {
+	visuals, err := app.getVisuals(id)
 	if err != nil {
 		return nil, fmt.Errorf("getVisualByID: %w", err)
 	}
@@ -263,8 +373,8 @@ func getVisualByID(id int) (*Visual, error) {
 	return &visuals[0], nil
 }
 
-func updateVisual(visual Visual) error {
-	_, err := DB.Exec(`
+func (app *App) updateVisual(visual Visual) error {
+	_, err := app.db.Exec(`
       UPDATE visuals
       SET title = ?, description = ?
       WHERE id = ?`,
@@ -275,8 +385,8 @@ func updateVisual(visual Visual) error {
 	return nil
 }
 
-func deleteVisual(id int) error {
-	tx, err := DB.Begin()
+func (app *App) deleteVisual(id int) error {
+	tx, err := app.db.Begin()
 	if err != nil {
 		return fmt.Errorf("deleteVisual (begin tx): %w", err)
 	}
@@ -305,8 +415,8 @@ func deleteVisual(id int) error {
 	return nil
 }
 
-func insertVisual(visual Visual) (int, error) {
-	result, err := DB.Exec(`INSERT INTO visuals (title, description) VALUES (?, ?)`, visual.Title, visual.Description)
+func (app *App) insertVisual(visual Visual) (int, error) {
+	result, err := app.db.Exec(`INSERT INTO visuals (title, description) VALUES (?, ?)`, visual.Title, visual.Description)
 	if err != nil {
 		return 0, fmt.Errorf("insertVisual (insert visual): %v", err)
 	}
@@ -318,16 +428,18 @@ func insertVisual(visual Visual) (int, error) {
 	return int(visualID), nil
 }
 
-func getPhotosByVisualID(visualID, offset, limit int) ([]Photo, int, error) {
+func (app *App) getPhotosByVisualID(visualID, offset, limit int) ([]Photo, int, error) {
 	// Get total count
 	var totalCount int
-	err := DB.QueryRow("SELECT COUNT(*) FROM visual_photos WHERE visual_id = ?", visualID).Scan(&totalCount)
+	err := app.db.QueryRow("SELECT COUNT(*) FROM visual_photos WHERE visual_id = ?", visualID).Scan(&totalCount)
 	if err != nil {
 		return nil, 0, fmt.Errorf("getPhotosByVisualID count: %w", err)
 	}
 
 	query := `
-        SELECT id, visual_id, file_path, created_at 
+        SELECT id, visual_id, file_path, status, width, height, created_at,
+               taken_at, camera_make, camera_model, lens, orientation, color, blurhash, lqip,
+               sha256, phash
         FROM visual_photos 
         WHERE visual_id = ? 
         ORDER BY created_at DESC, id DESC
@@ -339,7 +451,7 @@ func getPhotosByVisualID(visualID, offset, limit int) ([]Photo, int, error) {
 		args = append(args, limit, offset)
 	}
 
-	rows, err := DB.Query(query, args...)
+	rows, err := app.db.Query(query, args...)
 	if err != nil {
 		return nil, 0, fmt.Errorf("getPhotosByVisualID query: %w", err)
 	}
@@ -351,8 +463,8 @@ func getPhotosByVisualID(visualID, offset, limit int) ([]Photo, int, error) {
 	}
 
 	for rows.Next() {
-		var p Photo
-		if err := rows.Scan(&p.ID, &p.VisualID, &p.Filename, &p.CreatedAt); err != nil {
+		p, err := scanPhoto(rows)
+		if err != nil {
 			return nil, 0, fmt.Errorf("getPhotosByVisualID scan: %w", err)
 		}
 		photos = append(photos, p)
@@ -361,12 +473,12 @@ func getPhotosByVisualID(visualID, offset, limit int) ([]Photo, int, error) {
 	return photos, totalCount, nil
 }
 
-func getPhotoByID(id int) (*Photo, error) {
-	query := "SELECT id, visual_id, file_path, created_at FROM visual_photos WHERE id = ?"
-	row := DB.QueryRow(query, id)
-
-	var p Photo
-	err := row.Scan(&p.ID, &p.VisualID, &p.Filename, &p.CreatedAt)
+func (app *App) getPhotoByID(id int) (*Photo, error) {
+	query := `SELECT id, visual_id, file_path, status, width, height, created_at,
+		taken_at, camera_make, camera_model, lens, orientation, color, blurhash, lqip,
+		sha256, phash
+		FROM visual_photos WHERE id = ?`
+	p, err := scanPhoto(app.db.QueryRow(query, id))
 	if err != nil {
 		return nil, fmt.Errorf("getPhotoByID: %w", err)
 	}
@@ -374,45 +486,170 @@ func getPhotoByID(id int) (*Photo, error) {
 	return &p, nil
 }
 
-func deletePhoto(id int) error {
-	_, err := DB.Exec("DELETE FROM visual_photos WHERE id = ?", id)
+// scanPhoto scans a visual_photos row selected with the columns of
+// getPhotoByID.
+func scanPhoto(row interface{ Scan(...any) error }) (Photo, error) {
+	var p Photo
+	var takenAt sql.NullTime
+	err := row.Scan(&p.ID, &p.VisualID, &p.Filename, &p.Status, &p.Width, &p.Height, &p.CreatedAt,
+		&takenAt, &p.CameraMake, &p.CameraModel, &p.Lens, &p.Orientation,
+		&p.Placeholder.Color, &p.Placeholder.Blurhash, &p.Placeholder.LQIP,
+		&p.SHA256, &p.PHash)
+	if takenAt.Valid {
+		p.TakenAt = &takenAt.Time
+	}
+	return p, err
+}
+
+func (app *App) deletePhoto(id int) error {
+	_, err := app.db.Exec("DELETE FROM visual_photos WHERE id = ?", id)
 	return err
 }
 
-func insertPhotos(visualID int, filenames []string) error {
-	tx, err := DB.Begin()
+// insertPhotos records newly stored photos as processing, along with their
+// metadata, and queues their thumbnail jobs in the same transaction. It sets
+// the ID and VisualID of each.
+func (app *App) insertPhotos(visualID int, photos []Photo) error {
+	tx, err := app.db.Begin()
 	if err != nil {
 		return fmt.Errorf("insertPhotos begin tx: %w", err)
 	}
 
-	stmt, err := tx.Prepare("INSERT INTO visual_photos (visual_id, file_path) VALUES (?, ?)")
+	stmt, err := tx.Prepare(`
+		INSERT INTO visual_photos (visual_id, file_path, status, width, height, taken_at, camera_make, camera_model, lens, orientation, sha256, phash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("insertPhotos prepare: %w", err)
 	}
 	defer stmt.Close()
 
-	for _, filename := range filenames {
-		_, err = stmt.Exec(visualID, filename)
+	for i := range photos {
+		p := &photos[i]
+		result, err := stmt.Exec(visualID, p.Filename, photoProcessing, p.Width, p.Height,
+			p.TakenAt, p.CameraMake, p.CameraModel, p.Lens, p.Orientation, p.SHA256, p.PHash)
 		if err != nil {
 			tx.Rollback()
 			return fmt.Errorf("insertPhotos exec: %w", err)
 		}
+		photoID, _ := result.LastInsertId()
+		p.ID, p.VisualID = int(photoID), visualID
+		job := thumbnailJob{Key: path.Join(visualPrefix(visualID), p.Filename), PhotoID: p.ID}
+		if err := app.jobs.Enqueue(tx, jobThumbnails, job); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("insertPhotos: %w", err)
+		}
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("insertPhotos commit: %w", err)
+	}
+	app.jobs.Notify()
+	return nil
+}
+
+func (app *App) setPhotoStatus(id int, status string) error {
+	if _, err := app.db.Exec("UPDATE visual_photos SET status = ? WHERE id = ?", status, id); err != nil {
+		return fmt.Errorf("setPhotoStatus: %w", err)
+	}
+	return nil
+}
+
+// markPhotoReady records that the thumbnails of a photo are made, along with
+// its size and placeholder.
+func (app *App) markPhotoReady(id int, result thumbnailResult) error {
+	_, err := app.db.Exec(`
+		UPDATE visual_photos SET status = ?, width = ?, height = ?, color = ?, blurhash = ?, lqip = ?
+		WHERE id = ?`,
+		photoReady, result.Width, result.Height,
+		result.Placeholder.Color, result.Placeholder.Blurhash, result.Placeholder.LQIP, id)
+	if err != nil {
+		return fmt.Errorf("markPhotoReady: %w", err)
+	}
+	return nil
 }
 
-func getCredentials(email string) (*int, []byte, error) {
+// setPhotoMetadata records the EXIF/XMP fields of p for the photo with id.
+func (app *App) setPhotoMetadata(id int, p Photo) error {
+	_, err := app.db.Exec(`
+		UPDATE visual_photos SET taken_at = ?, camera_make = ?, camera_model = ?, lens = ?, orientation = ?
+		WHERE id = ?`,
+		p.TakenAt, p.CameraMake, p.CameraModel, p.Lens, p.Orientation, id)
+	if err != nil {
+		return fmt.Errorf("setPhotoMetadata: %w", err)
+	}
+	return nil
+}
+
+// getPhotoHashes returns the ID, visual, filename and hashes of the photos
+// of a visual, or of every photo for visualID 0, leaving out the ones not
+// hashed yet.
+func (app *App) getPhotoHashes(visualID int) ([]Photo, error) {
+	query := "SELECT id, visual_id, file_path, sha256, phash FROM visual_photos WHERE (sha256 != '' OR phash != '')"
+	var args []any
+	if visualID != 0 {
+		query += " AND visual_id = ?"
+		args = append(args, visualID)
+	}
+	rows, err := app.db.Query(query+" ORDER BY visual_id, id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("getPhotoHashes: %w", err)
+	}
+	defer rows.Close()
+
+	var photos []Photo
+	for rows.Next() {
+		var p Photo
+		if err := rows.Scan(&p.ID, &p.VisualID, &p.Filename, &p.SHA256, &p.PHash); err != nil {
+			return nil, fmt.Errorf("getPhotoHashes: %w", err)
+		}
+		photos = append(photos, p)
+	}
+	return photos, rows.Err()
+}
+
+func (app *App) setPhotoHashes(id int, sha256, phash string) error {
+	if _, err := app.db.Exec("UPDATE visual_photos SET sha256 = ?, phash = ? WHERE id = ?", sha256, phash, id); err != nil {
+		return fmt.Errorf("setPhotoHashes: %w", err)
+	}
+	return nil
+}
+
+func (app *App) getCredentials(email string) (*int, []byte, error) {
 	var userId int
 	var passwordDigest []byte
-	err := DB.QueryRow("SELECT id, password_digest FROM users WHERE email=?;", email).Scan(&userId, &passwordDigest)
+	var disabled bool
+	err := app.db.QueryRow("SELECT id, password_digest, disabled FROM users WHERE email = ? COLLATE NOCASE;", normalizeEmail(email)).Scan(&userId, &passwordDigest, &disabled)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil, fmt.Errorf("user not found")
 	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("getCredentials: %w", err)
+	}
+	if disabled {
+		return nil, nil, fmt.Errorf("user %d is disabled", userId)
+	}
 	if passwordDigest == nil {
 		log.Println("getCredentials: password digest not found")
 		return nil, nil, errors.New("password digest not found")
 	}
 	return &userId, passwordDigest, nil
 }
+
+func (app *App) getUserEmail(userId int) (string, error) {
+	var email string
+	err := app.db.QueryRow("SELECT email FROM users WHERE id = ?", userId).Scan(&email)
+	if err != nil {
+		return "", fmt.Errorf("getUserEmail: %w", err)
+	}
+	return email, nil
+}
+
+func (app *App) getUserRole(userId int) (Role, error) {
+	var role string
+	err := app.db.QueryRow("SELECT role FROM users WHERE id = ?", userId).Scan(&role)
+	if err != nil {
+		return "", fmt.Errorf("getUserRole: %w", err)
+	}
+	return Role(role), nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math/bits"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/config"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/storage"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/thumbnail"
+	"github.com/disintegration/imaging"
+)
+
+// Uploads are recognised as duplicates two ways: the SHA-256 of the stored
+// file catches exact copies, a perceptual hash the same photo exported
+// again, resized or recompressed.
+
+// imageHash returns the perceptual hash of the image in r as 16 hex digits,
+// or "" if it cannot be decoded.
+func imageHash(r io.Reader) string {
+	img, _, err := thumbnail.Decode(r)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%016x", dHash(img))
+}
+
+// dHash is the difference hash of img: shrunk to 9x8 grey pixels, one bit
+// per pair of horizontal neighbours, set where the left one is brighter. It
+// survives scaling and recompression but not cropping or rotation.
+func dHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+	var hash uint64
+	for y := range 8 {
+		row := small.Pix[y*small.Stride:]
+		for x := range 8 {
+			hash <<= 1
+			if row[x*4] > row[(x+1)*4] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// hashDistance is the number of bits two perceptual hashes differ in, or -1
+// if either is unknown.
+func hashDistance(a, b string) int {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return -1
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return -1
+	}
+	return bits.OnesCount64(x ^ y)
+}
+
+// isDuplicate reports whether a and b are the same photo, as far as c is
+// concerned.
+func isDuplicate(c config.DuplicatesConfig, a, b Photo) bool {
+	if c.Scope == "visual" && a.VisualID != b.VisualID {
+		return false
+	}
+	if a.SHA256 != "" && a.SHA256 == b.SHA256 {
+		return true
+	}
+	d := hashDistance(a.PHash, b.PHash)
+	return d >= 0 && d <= c.Threshold
+}
+
+// duplicateUpload is a photo in an upload that looks like another one.
+type duplicateUpload struct {
+	// Index is the photo's position in the upload.
+	Index int
+	// Of is the photo already on the site it looks like. When it is an
+	// earlier photo of the same upload instead, Of is zero and OfIndex is
+	// that photo's position.
+	Of      Photo
+	OfIndex int
+}
+
+// findDuplicates checks photos about to be added to a visual against the
+// photos already in scope and against each other.
+func (app *App) findDuplicates(visualID int, photos []Photo) ([]duplicateUpload, error) {
+	c := app.cfg.Duplicates
+	if c.Action == "off" {
+		return nil, nil
+	}
+	scope := 0
+	if c.Scope == "visual" {
+		scope = visualID
+	}
+	existing, err := app.getPhotoHashes(scope)
+	if err != nil {
+		return nil, fmt.Errorf("findDuplicates: %w", err)
+	}
+
+	var duplicates []duplicateUpload
+	for i, p := range photos {
+		p.VisualID = visualID
+		if j := slices.IndexFunc(existing, func(e Photo) bool { return isDuplicate(c, p, e) }); j >= 0 {
+			duplicates = append(duplicates, duplicateUpload{Index: i, Of: existing[j], OfIndex: -1})
+			continue
+		}
+		if j := slices.IndexFunc(photos[:i], func(e Photo) bool {
+			e.VisualID = visualID
+			return isDuplicate(c, p, e)
+		}); j >= 0 {
+			duplicates = append(duplicates, duplicateUpload{Index: i, OfIndex: j})
+		}
+	}
+	return duplicates, nil
+}
+
+// duplicatesMessage explains duplicates to the uploader, who knows the
+// photos by the names they were uploaded under.
+func duplicatesMessage(duplicates []duplicateUpload, names []string) string {
+	lines := make([]string, len(duplicates))
+	for i, d := range duplicates {
+		if d.OfIndex >= 0 {
+			lines[i] = fmt.Sprintf("%s looks like %s in the same upload", names[d.Index], names[d.OfIndex])
+		} else {
+			lines[i] = fmt.Sprintf("%s looks like photo %d of visual %d", names[d.Index], d.Of.ID, d.Of.VisualID)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// visualURL is where an upload to a visual redirects to. The visual page
+// warns about the number of duplicates it is given.
+func visualURL(visualID, duplicates int) string {
+	u := fmt.Sprintf("/visuals/%d", visualID)
+	if duplicates > 0 {
+		u += fmt.Sprintf("?duplicates=%d", duplicates)
+	}
+	return u
+}
+
+// deleteUploadedPhotos removes the originals of photos that were stored but
+// will not be inserted.
+func (app *App) deleteUploadedPhotos(ctx context.Context, visualID int, photos []Photo) {
+	for _, p := range photos {
+		key := path.Join(visualPrefix(visualID), p.Filename)
+		if err := app.storage.Delete(ctx, key); err != nil {
+			log.Printf("Warning: Failed to delete abandoned upload at '%s': %v", key, err)
+		}
+	}
+}
+
+// duplicateClusters groups the photos in scope that are duplicates of each
+// other, directly or through another photo. Photos without duplicates are
+// left out.
+func (app *App) duplicateClusters() ([][]Photo, error) {
+	photos, err := app.getPhotoHashes(0)
+	if err != nil {
+		return nil, fmt.Errorf("duplicateClusters: %w", err)
+	}
+
+	parent := make([]int, len(photos))
+	for i := range parent {
+		parent[i] = i
+	}
+	find := func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	for i := range photos {
+		for j := i + 1; j < len(photos); j++ {
+			if isDuplicate(app.cfg.Duplicates, photos[i], photos[j]) {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	members := map[int][]Photo{}
+	var roots []int
+	for i, p := range photos {
+		root := find(i)
+		if members[root] == nil {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], p)
+	}
+	var clusters [][]Photo
+	for _, root := range roots {
+		if len(members[root]) > 1 {
+			clusters = append(clusters, members[root])
+		}
+	}
+	return clusters, nil
+}
+
+type duplicatesData struct {
+	Login       bool
+	Permissions permissionSet
+	Clusters    [][]Photo
+	Config      config.DuplicatesConfig
+}
+
+// duplicatesPageHandler serves /admin/duplicates, the report of photos
+// that are on the site more than once.
+func (app *App) duplicatesPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	clusters, err := app.duplicateClusters()
+	if err != nil {
+		log.Printf("Error finding duplicate photos: %v", err)
+		http.Error(w, "Failed to find duplicate photos", http.StatusInternalServerError)
+		return
+	}
+	data := duplicatesData{
+		Login:       true,
+		Permissions: app.currentPermissions(r),
+		Clusters:    clusters,
+		Config:      app.cfg.Duplicates,
+	}
+	if err := app.tpl.ExecuteTemplate(w, "duplicates.gohtml", data); err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+	}
+}
+
+const jobPhotoHashes = "photo_hashes"
+
+// photoHashesJob hashes a photo stored before uploads were hashed.
+// Migration 0008 queues one for every photo.
+type photoHashesJob struct {
+	Key     string `json:"key"`
+	PhotoID int    `json:"photo_id"`
+}
+
+func (app *App) runPhotoHashesJob(ctx context.Context, payload json.RawMessage) error {
+	var job photoHashesJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return fmt.Errorf("%w: %v", errJobPermanent, err)
+	}
+	obj, _, err := app.storage.Get(ctx, job.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil // Deleted since.
+	}
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", job.Key, err)
+	}
+	sum := sha256.Sum256(data)
+	return app.setPhotoHashes(job.PhotoID, hex.EncodeToString(sum[:]), imageHash(bytes.NewReader(data)))
+}
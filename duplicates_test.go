@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/config"
+	"github.com/disintegration/imaging"
+)
+
+// scene is a smooth stand-in for a photo, with detail at several scales.
+func scene(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			u, v := float64(x)/float64(width), float64(y)/float64(height)
+			light := 0.5 + 0.25*math.Sin(7*u+3*v) + 0.2*math.Cos(11*v-5*u*u)
+			img.Set(x, y, color.RGBA{uint8(255 * light), uint8(200 * v), uint8(255 * (1 - u)), 255})
+		}
+	}
+	return img
+}
+
+func TestDHashSurvivesResizeAndRecompression(t *testing.T) {
+	original := scene(640, 480)
+	base := fmt.Sprintf("%016x", dHash(original))
+	recompress := func(img image.Image, quality int) image.Image {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			t.Fatal(err)
+		}
+		return decodeJPEG(t, buf.Bytes())
+	}
+	threshold := config.Default().Duplicates.Threshold
+
+	same := map[string]image.Image{
+		"half size":           imaging.Resize(original, 320, 240, imaging.Lanczos),
+		"double size":         imaging.Resize(original, 1280, 960, imaging.Linear),
+		"thumbnail":           imaging.Resize(original, 96, 72, imaging.Box),
+		"recompressed":        recompress(original, 40),
+		"resized and resaved": recompress(imaging.Resize(original, 400, 300, imaging.CatmullRom), 70),
+		"brightened":          imaging.AdjustBrightness(original, 10),
+	}
+	for name, img := range same {
+		if d := hashDistance(base, fmt.Sprintf("%016x", dHash(img))); d > threshold {
+			t.Errorf("%s: distance %d, want at most %d", name, d, threshold)
+		}
+	}
+
+	different := map[string]image.Image{
+		"mirrored":      imaging.FlipH(original),
+		"upside down":   imaging.Rotate180(original),
+		"another photo": decodeJPEG(t, testJPEG(t, 5)),
+	}
+	for name, img := range different {
+		if d := hashDistance(base, fmt.Sprintf("%016x", dHash(img))); d <= threshold {
+			t.Errorf("%s: distance %d, want more than %d", name, d, threshold)
+		}
+	}
+}
+
+func decodeJPEG(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestImageHash(t *testing.T) {
+	data := testJPEG(t, 3)
+	if got, want := imageHash(bytes.NewReader(data)), fmt.Sprintf("%016x", dHash(decodeJPEG(t, data))); got != want {
+		t.Errorf("imageHash = %q, want %q", got, want)
+	}
+	if got := imageHash(bytes.NewReader([]byte("not an image"))); got != "" {
+		t.Errorf("imageHash of garbage = %q, want empty", got)
+	}
+}
+
+func TestHashDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"0000000000000000", "0000000000000000", 0},
+		{"0000000000000000", "0000000000000001", 1},
+		{"00000000000000ff", "0000000000000000", 8},
+		{"ffffffffffffffff", "0000000000000000", 64},
+		{"f0f0f0f0f0f0f0f0", "0f0f0f0f0f0f0f0f", 64},
+		{"8000000000000001", "0000000000000000", 2},
+		{"", "0000000000000000", -1},
+		{"0000000000000000", "not a hash", -1},
+		{"1ffffffffffffffff", "0000000000000000", -1},
+	}
+	for _, tt := range tests {
+		if got := hashDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("hashDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestIsDuplicate(t *testing.T) {
+	visual := config.DuplicatesConfig{Scope: "visual", Threshold: 6}
+	site := config.DuplicatesConfig{Scope: "site", Threshold: 6}
+	tests := []struct {
+		name string
+		c    config.DuplicatesConfig
+		a, b Photo
+		want bool
+	}{
+		{"same file", visual, Photo{VisualID: 1, SHA256: "abc"}, Photo{VisualID: 1, SHA256: "abc"}, true},
+		{"close hashes", visual, Photo{VisualID: 1, PHash: "000000000000003f"}, Photo{VisualID: 1, PHash: "0000000000000000"}, true},
+		{"far hashes", visual, Photo{VisualID: 1, PHash: "000000000000007f"}, Photo{VisualID: 1, PHash: "0000000000000000"}, false},
+		{"other visual", visual, Photo{VisualID: 1, SHA256: "abc"}, Photo{VisualID: 2, SHA256: "abc"}, false},
+		{"other visual, site scope", site, Photo{VisualID: 1, SHA256: "abc"}, Photo{VisualID: 2, SHA256: "abc"}, true},
+		{"no hashes", visual, Photo{VisualID: 1}, Photo{VisualID: 1}, false},
+		{"one hash unknown", visual, Photo{VisualID: 1, PHash: "0000000000000000"}, Photo{VisualID: 1}, false},
+		{"threshold zero", config.DuplicatesConfig{Scope: "site"}, Photo{PHash: "0000000000000001"}, Photo{PHash: "0000000000000000"}, false},
+	}
+	for _, tt := range tests {
+		if got := isDuplicate(tt.c, tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: isDuplicate = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDuplicateClusters(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.Duplicates.Scope = "visual"
+	app.cfg.Duplicates.Threshold = 6
+	newVisual := func(title string, photos ...Photo) {
+		t.Helper()
+		id, err := app.insertVisual(Visual{Title: title, Description: "x"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := app.insertPhotos(id, photos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a and c are 8 bits apart, too far on their own, but each is within 4
+	// of b, so all three are one cluster.
+	newVisual("Chain",
+		Photo{Filename: "a.jpg", PHash: "000000000000000f"},
+		Photo{Filename: "b.jpg", PHash: "00000000000000ff"},
+		Photo{Filename: "c.jpg", PHash: "00000000000000f0"},
+		Photo{Filename: "alone.jpg", PHash: "ffffffff00000000"},
+		Photo{Filename: "copy1.jpg", SHA256: "abc"},
+		Photo{Filename: "copy2.jpg", SHA256: "abc"},
+	)
+	// In another visual, which the visual scope keeps apart.
+	newVisual("Elsewhere", Photo{Filename: "copy3.jpg", SHA256: "abc"})
+
+	filenames := func(clusters [][]Photo) [][]string {
+		var names [][]string
+		for _, c := range clusters {
+			var n []string
+			for _, p := range c {
+				n = append(n, p.Filename)
+			}
+			names = append(names, n)
+		}
+		return names
+	}
+	clusters, err := app.duplicateClusters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(filenames(clusters)), "[[a.jpg b.jpg c.jpg] [copy1.jpg copy2.jpg]]"; got != want {
+		t.Errorf("visual scope: clusters %s, want %s", got, want)
+	}
+
+	app.cfg.Duplicates.Scope = "site"
+	clusters, err = app.duplicateClusters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(filenames(clusters)), "[[a.jpg b.jpg c.jpg] [copy1.jpg copy2.jpg copy3.jpg]]"; got != want {
+		t.Errorf("site scope: clusters %s, want %s", got, want)
+	}
+}
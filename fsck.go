@@ -0,0 +1,553 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/config"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/storage"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/thumbnail"
+)
+
+// The storage check reconciles the database with the files in storage:
+// originals rows point at that are gone, thumbnails that were never made,
+// files no row accounts for and photo rows whose visual is gone. Repairing
+// queues thumbnail jobs for the missing thumbnails, deletes the orphan rows
+// and moves orphan files to quarantine/, from where they can be restored by
+// hand or deleted.
+
+// quarantinePrefix is where repairs move orphan files to, under a directory
+// per run. It is not served.
+const quarantinePrefix = "quarantine"
+
+// fsckGracePeriod keeps recent files from being taken for orphans: an
+// upload stores its files before inserting the rows that point at them.
+const fsckGracePeriod = time.Hour
+
+func isQuarantined(key string) bool {
+	return strings.HasPrefix(key, quarantinePrefix+"/")
+}
+
+// fsckPrefixes are the parts of storage the check covers.
+var fsckPrefixes = []string{"visuals/", "covers/", "portfolios/"}
+
+type fsckReport struct {
+	// MissingOriginals are files rows point at that are not in storage.
+	MissingOriginals []fsckEntry
+	// MissingVariants are the thumbnails and masters of existing originals
+	// that are not in storage. Photos still being processed are left out.
+	MissingVariants []fsckVariant
+	// OrphanFiles are files that no row accounts for.
+	OrphanFiles []storage.ObjectInfo
+	// OrphanRows are photos of visuals that no longer exist.
+	OrphanRows []fsckEntry
+	Usage      []storageUsage
+	CheckedAt  time.Time
+}
+
+// fsckEntry is a row, and the file it points at.
+type fsckEntry struct {
+	Key string
+	// What describes the row, e.g. "photo 12 of visual 3".
+	What string
+	// PhotoID is set for the rows of visual_photos.
+	PhotoID int
+}
+
+type fsckVariant struct {
+	Key      string
+	Original string
+	// Size is the thumbnail size, or "master".
+	Size    string
+	PhotoID int
+	CoverID int
+}
+
+// storageUsage is how much a visual, or another part of storage, takes up.
+type storageUsage struct {
+	Name string
+	// URL is the page of the visual, if it has one.
+	URL       string
+	Files     int
+	Originals int64
+	// Derived is thumbnails and masters.
+	Derived int64
+	// Cache is the resized copies in the image cache.
+	Cache int64
+}
+
+func (u storageUsage) Total() int64 {
+	return u.Originals + u.Derived + u.Cache
+}
+
+// Problems is the number of inconsistencies found.
+func (r *fsckReport) Problems() int {
+	return len(r.MissingOriginals) + len(r.MissingVariants) + len(r.OrphanFiles) + len(r.OrphanRows)
+}
+
+// checkStorage compares the rows that point at files with what is in
+// storage.
+func (app *App) checkStorage(ctx context.Context) (*fsckReport, error) {
+	report := &fsckReport{CheckedAt: time.Now().UTC()}
+
+	files := map[string]storage.ObjectInfo{}
+	var keys []string
+	for _, prefix := range append(fsckPrefixes, quarantinePrefix+"/") {
+		objects, err := app.storage.List(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("checkStorage: %w", err)
+		}
+		for _, o := range objects {
+			files[o.Key] = o
+			keys = append(keys, o.Key)
+		}
+	}
+
+	// known is every file a row accounts for, whether or not it exists.
+	known := map[string]bool{}
+	claim := func(original string) {
+		known[original] = true
+		known[thumbnail.MasterKey(original)] = true
+		for _, key := range thumbnail.Keys(original, app.cfg.Thumbnails) {
+			known[key] = true
+		}
+	}
+	checkVariants := func(original string, photoID, coverID int) {
+		if thumbnail.NeedsMaster(original) {
+			if key := thumbnail.MasterKey(original); !hasKey(files, key) {
+				report.MissingVariants = append(report.MissingVariants, fsckVariant{key, original, "master", photoID, coverID})
+			}
+		}
+		for _, t := range app.cfg.Thumbnails {
+			for _, f := range t.StoredFormats() {
+				if key := thumbnail.Key(original, t.Name, f); !hasKey(files, key) {
+					report.MissingVariants = append(report.MissingVariants, fsckVariant{key, original, t.Name, photoID, coverID})
+				}
+			}
+		}
+	}
+
+	rows, err := app.db.Query(`
+		SELECT p.id, p.visual_id, p.file_path, p.status, v.id IS NOT NULL
+		FROM visual_photos p LEFT JOIN visuals v ON v.id = p.visual_id
+		ORDER BY p.visual_id, p.id`)
+	if err != nil {
+		return nil, fmt.Errorf("checkStorage: %w", err)
+	}
+	for rows.Next() {
+		var p Photo
+		var visualExists bool
+		if err := rows.Scan(&p.ID, &p.VisualID, &p.Filename, &p.Status, &visualExists); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("checkStorage: %w", err)
+		}
+		key := path.Join(visualPrefix(p.VisualID), p.Filename)
+		what := fmt.Sprintf("photo %d of visual %d", p.ID, p.VisualID)
+		switch {
+		case !visualExists:
+			report.OrphanRows = append(report.OrphanRows, fsckEntry{key, what, p.ID})
+		case !hasKey(files, key):
+			report.MissingOriginals = append(report.MissingOriginals, fsckEntry{key, what, p.ID})
+			claim(key)
+		default:
+			claim(key)
+			if p.Status != photoProcessing {
+				checkVariants(key, p.ID, 0)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("checkStorage: %w", err)
+	}
+
+	// Earlier covers keep their files, but only the current one is shown.
+	rows, err = app.db.Query("SELECT id, file_path FROM covers ORDER BY created_at DESC, id DESC")
+	if err != nil {
+		return nil, fmt.Errorf("checkStorage: %w", err)
+	}
+	for first := true; rows.Next(); first = false {
+		var cover Cover
+		if err := rows.Scan(&cover.ID, &cover.FilePath); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("checkStorage: %w", err)
+		}
+		key := path.Join("covers", cover.FilePath)
+		claim(key)
+		if !hasKey(files, key) {
+			report.MissingOriginals = append(report.MissingOriginals, fsckEntry{Key: key, What: fmt.Sprintf("cover %d", cover.ID)})
+		} else if first {
+			checkVariants(key, 0, cover.ID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("checkStorage: %w", err)
+	}
+
+	rows, err = app.db.Query("SELECT id, file_path FROM portfolios ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("checkStorage: %w", err)
+	}
+	for rows.Next() {
+		var id int
+		var filePath string
+		if err := rows.Scan(&id, &filePath); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("checkStorage: %w", err)
+		}
+		key := path.Join("portfolios", filePath)
+		known[key] = true
+		if !hasKey(files, key) {
+			report.MissingOriginals = append(report.MissingOriginals, fsckEntry{Key: key, What: fmt.Sprintf("portfolio %d", id)})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("checkStorage: %w", err)
+	}
+
+	for _, key := range keys {
+		o := files[key]
+		if known[key] || isQuarantined(key) || report.CheckedAt.Sub(o.ModTime) < fsckGracePeriod {
+			continue
+		}
+		report.OrphanFiles = append(report.OrphanFiles, o)
+	}
+
+	report.Usage, err = app.storageUsage(keys, files)
+	if err != nil {
+		return nil, fmt.Errorf("checkStorage: %w", err)
+	}
+	return report, nil
+}
+
+func hasKey(files map[string]storage.ObjectInfo, key string) bool {
+	_, ok := files[key]
+	return ok
+}
+
+// storageUsage adds up the files by visual, followed by the other parts of
+// storage.
+func (app *App) storageUsage(keys []string, files map[string]storage.ObjectInfo) ([]storageUsage, error) {
+	titles := map[int]string{}
+	visuals, err := app.getVisuals()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range visuals {
+		titles[v.ID] = v.Title
+	}
+
+	byVisual := map[int]*storageUsage{}
+	visual := func(id int) *storageUsage {
+		if byVisual[id] == nil {
+			u := &storageUsage{Name: fmt.Sprintf("Visual %d (no longer exists)", id)}
+			if title, ok := titles[id]; ok {
+				u.Name = fmt.Sprintf("Visual %d: %s", id, title)
+				u.URL = visualURL(id, 0)
+			}
+			byVisual[id] = u
+		}
+		return byVisual[id]
+	}
+	others := map[string]*storageUsage{}
+	for _, prefix := range append(fsckPrefixes, quarantinePrefix+"/") {
+		others[prefix] = &storageUsage{Name: strings.TrimSuffix(prefix, "/")}
+	}
+
+	for _, key := range keys {
+		parts := strings.Split(key, "/")
+		var u *storageUsage
+		if id, err := strconv.Atoi(parts[1]); parts[0] == "visuals" && len(parts) > 2 && err == nil {
+			u = visual(id)
+			if len(parts) == 3 {
+				u.Originals += files[key].Size
+			} else {
+				u.Derived += files[key].Size
+			}
+		} else {
+			u = others[parts[0]+"/"]
+			if len(parts) == 2 || parts[0] == quarantinePrefix {
+				u.Originals += files[key].Size
+			} else {
+				u.Derived += files[key].Size
+			}
+		}
+		u.Files++
+	}
+
+	// The image cache mirrors storage keys: <cache dir>/visuals/<id>/...
+	cacheDir := filepath.Join(app.cfg.Images.CacheDir, "visuals")
+	err = filepath.WalkDir(cacheDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(cacheDir, p)
+		id, err := strconv.Atoi(strings.Split(filepath.ToSlash(rel), "/")[0])
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			visual(id).Cache += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var usage []storageUsage
+	for _, u := range byVisual {
+		usage = append(usage, *u)
+	}
+	slices.SortFunc(usage, func(a, b storageUsage) int {
+		return cmp.Or(cmp.Compare(b.Total(), a.Total()), strings.Compare(a.Name, b.Name))
+	})
+	// Files under visuals/ that belong to no visual are listed after the
+	// visuals, if there are any.
+	if stray := others["visuals/"]; stray.Files > 0 {
+		stray.Name = "visuals (not in a visual)"
+		usage = append(usage, *stray)
+	}
+	for _, prefix := range append(fsckPrefixes[1:], quarantinePrefix+"/") {
+		usage = append(usage, *others[prefix])
+	}
+	return usage, nil
+}
+
+// fsckRepair is what repairStorage did.
+type fsckRepair struct {
+	QueuedJobs  int
+	DeletedRows int
+	Quarantined int
+	// QuarantineDir is where this repair moved orphan files to.
+	QuarantineDir string
+	Errors        []string
+}
+
+// repairStorage fixes what report found, as far as it can be fixed:
+// missing originals are only reported.
+func (app *App) repairStorage(ctx context.Context, report *fsckReport) (fsckRepair, error) {
+	repair := fsckRepair{QuarantineDir: path.Join(quarantinePrefix, report.CheckedAt.Format("20060102-150405"))}
+
+	// One job per original, for the sizes it is missing. Masters come with
+	// any thumbnail job of a HEIC original, so one missing its master gets
+	// a job for all sizes.
+	var jobs []thumbnailJob
+	allSizes := map[string]bool{}
+	for _, v := range report.MissingVariants {
+		i := slices.IndexFunc(jobs, func(j thumbnailJob) bool { return j.Key == v.Original })
+		if i < 0 {
+			jobs = append(jobs, thumbnailJob{Key: v.Original, PhotoID: v.PhotoID, CoverID: v.CoverID})
+			i = len(jobs) - 1
+		}
+		if v.Size == "master" {
+			allSizes[v.Original] = true
+		} else if !slices.Contains(jobs[i].Sizes, v.Size) {
+			jobs[i].Sizes = append(jobs[i].Sizes, v.Size)
+		}
+	}
+	tx, err := app.db.Begin()
+	if err != nil {
+		return repair, fmt.Errorf("repairStorage: %w", err)
+	}
+	for _, job := range jobs {
+		if allSizes[job.Key] {
+			job.Sizes = nil
+		}
+		if err := app.jobs.Enqueue(tx, jobThumbnails, job); err != nil {
+			tx.Rollback()
+			return repair, fmt.Errorf("repairStorage: %w", err)
+		}
+	}
+	for _, row := range report.OrphanRows {
+		if _, err := tx.Exec("DELETE FROM visual_photos WHERE id = ?", row.PhotoID); err != nil {
+			tx.Rollback()
+			return repair, fmt.Errorf("repairStorage: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return repair, fmt.Errorf("repairStorage: %w", err)
+	}
+	repair.QueuedJobs = len(jobs)
+	repair.DeletedRows = len(report.OrphanRows)
+
+	for _, o := range report.OrphanFiles {
+		if err := app.quarantine(ctx, o, path.Join(repair.QuarantineDir, o.Key)); err != nil {
+			repair.Errors = append(repair.Errors, fmt.Sprintf("%s: %v", o.Key, err))
+			continue
+		}
+		repair.Quarantined++
+	}
+	return repair, nil
+}
+
+// quarantine moves the file o to key.
+func (app *App) quarantine(ctx context.Context, o storage.ObjectInfo, key string) error {
+	obj, _, err := app.storage.Get(ctx, o.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil // Gone since the check.
+	}
+	if err != nil {
+		return err
+	}
+	err = app.storage.Put(ctx, key, obj, o.Size, o.ContentType)
+	obj.Close()
+	if err != nil {
+		return err
+	}
+	if err := app.storage.Delete(ctx, o.Key); err != nil {
+		return err
+	}
+	return app.images.Purge(o.Key)
+}
+
+// formatBytes renders n bytes for people: 0 B, 812 KB, 1.4 GB.
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, exp := float64(n)/unit, 0
+	for value >= unit && exp < 3 {
+		value /= unit
+		exp++
+	}
+	if value < 10 {
+		return fmt.Sprintf("%.1f %cB", value, "KMGT"[exp])
+	}
+	return fmt.Sprintf("%.0f %cB", value, "KMGT"[exp])
+}
+
+// writeFsckReport prints report for the --fsck command line.
+func writeFsckReport(w io.Writer, report *fsckReport) {
+	section := func(title string, n int) bool {
+		if n == 0 {
+			return false
+		}
+		fmt.Fprintf(w, "%s (%d):\n", title, n)
+		return true
+	}
+	if section("Missing originals", len(report.MissingOriginals)) {
+		for _, e := range report.MissingOriginals {
+			fmt.Fprintf(w, "  %s  (%s)\n", e.Key, e.What)
+		}
+	}
+	if section("Missing thumbnails", len(report.MissingVariants)) {
+		for _, v := range report.MissingVariants {
+			fmt.Fprintf(w, "  %s\n", v.Key)
+		}
+	}
+	if section("Orphan files", len(report.OrphanFiles)) {
+		for _, o := range report.OrphanFiles {
+			fmt.Fprintf(w, "  %s  (%s)\n", o.Key, formatBytes(o.Size))
+		}
+	}
+	if section("Orphan rows", len(report.OrphanRows)) {
+		for _, e := range report.OrphanRows {
+			fmt.Fprintf(w, "  %s, of a visual that no longer exists  (%s)\n", e.What, e.Key)
+		}
+	}
+	if report.Problems() == 0 {
+		fmt.Fprintln(w, "Storage and database agree.")
+	}
+
+	fmt.Fprintln(w, "\nDisk usage:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "FILES\tORIGINALS\tTHUMBNAILS\tRESIZED\tTOTAL\t\t")
+	for _, u := range report.Usage {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t\t%s\n", u.Files, formatBytes(u.Originals), formatBytes(u.Derived), formatBytes(u.Cache), formatBytes(u.Total()), u.Name)
+	}
+	tw.Flush()
+}
+
+// runFsck checks storage for the --fsck and --fsck-repair command line
+// options. It reports whether storage was found consistent.
+func runFsck(cfg *config.Config, w io.Writer) (bool, error) {
+	app, err := newApp(cfg)
+	if err != nil {
+		return false, err
+	}
+	defer app.Close()
+
+	ctx := context.Background()
+	report, err := app.checkStorage(ctx)
+	if err != nil {
+		return false, err
+	}
+	writeFsckReport(w, report)
+	if !cfg.FsckRepair || report.Problems() == 0 {
+		return report.Problems() == 0, nil
+	}
+
+	repair, err := app.repairStorage(ctx, report)
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(w, "\nRepaired: %d thumbnail jobs queued, %d orphan rows deleted, %d orphan files moved to %s.\n",
+		repair.QueuedJobs, repair.DeletedRows, repair.Quarantined, repair.QuarantineDir)
+	if repair.QueuedJobs > 0 {
+		fmt.Fprintln(w, "The thumbnail jobs run in the web app.")
+	}
+	for _, e := range repair.Errors {
+		fmt.Fprintf(w, "Failed to quarantine %s\n", e)
+	}
+	return len(report.MissingOriginals) == 0 && len(repair.Errors) == 0, nil
+}
+
+type storageData struct {
+	Login       bool
+	CSRFToken   string
+	Permissions permissionSet
+	Report      *fsckReport
+	// Repair is set after a repair, Report then being what it found.
+	Repair *fsckRepair
+}
+
+// storagePageHandler serves /admin/storage: GET checks storage against the
+// database and shows the report, POST repairs what it finds.
+func (app *App) storagePageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := app.checkStorage(r.Context())
+	if err != nil {
+		log.Printf("Error checking storage: %v", err)
+		http.Error(w, "Failed to check storage", http.StatusInternalServerError)
+		return
+	}
+	data := storageData{
+		Login:       true,
+		CSRFToken:   app.csrfToken(r),
+		Permissions: app.currentPermissions(r),
+		Report:      report,
+	}
+	if r.Method == http.MethodPost {
+		repair, err := app.repairStorage(r.Context(), report)
+		if err != nil {
+			log.Printf("Error repairing storage: %v", err)
+			http.Error(w, "Failed to repair storage", http.StatusInternalServerError)
+			return
+		}
+		app.recordAuditEvent(r, "storage.repair", "storage", nil, nil, repair)
+		data.Repair = &repair
+	}
+	if err := app.tpl.ExecuteTemplate(w, "storage.gohtml", data); err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+	}
+}
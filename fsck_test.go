@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/storage"
+)
+
+func TestStorageUsageKeepsStrayVisualFiles(t *testing.T) {
+	app := newTestApp(t)
+	files := map[string]storage.ObjectInfo{
+		"visuals/tmp/upload.jpg": {Key: "visuals/tmp/upload.jpg", Size: 7},
+		"covers/cover.png":       {Key: "covers/cover.png", Size: 3},
+	}
+	keys := []string{"covers/cover.png", "visuals/tmp/upload.jpg"}
+
+	usage, err := app.storageUsage(keys, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, u := range usage {
+		total += u.Total()
+	}
+	if total != 10 {
+		t.Errorf("usage adds up to %d bytes, want 10: %+v", total, usage)
+	}
+	if usage[0].Name != "visuals (not in a visual)" || usage[0].Files != 1 {
+		t.Errorf("first entry is %+v, want the stray visual file", usage[0])
+	}
+}
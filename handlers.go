@@ -1,52 +1,58 @@
 package main
 
 import (
+	"cmp"
 	"database/sql"
+	"errors"
 	"fmt"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 	"log"
+	"mime/multipart"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/apitoken"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/storage"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func indexHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) indexHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
 		return
 	}
 	switch r.Method {
 	case http.MethodGet:
-		handleGetIndex(w, r)
+		app.handleGetIndex(w, r)
 	case http.MethodPost:
-		handlePostIndex(w, r)
+		app.handlePostIndex(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func handleGetIndex(w http.ResponseWriter, r *http.Request) {
-	filename, err := getLatestCoverFilename()
+func (app *App) handleGetIndex(w http.ResponseWriter, r *http.Request) {
+	cover, err := app.getLatestCover()
 	if err != nil {
-		if err != sql.ErrNoRows {
+		if !errors.Is(err, sql.ErrNoRows) {
 			http.Error(w, "Failed to fetch cover data", http.StatusInternalServerError)
 			return
 		}
 	}
 
-	visuals, err := getVisuals()
+	visuals, err := app.getVisuals()
 	if err != nil {
 		http.Error(w, "Failed to retrieve visuals", http.StatusInternalServerError)
 		log.Printf("Error retrieving visuals: %v", err)
 		return
 	}
 
-	stories, err := getStories()
+	stories, err := app.getStories()
 	if err != nil {
 		http.Error(w, "Failed to retrieve stories", http.StatusInternalServerError)
 		log.Printf("Error retrieving stories: %v", err)
@@ -54,26 +60,24 @@ func handleGetIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	const coversDir = "covers"
-	originalPath := filepath.Join(coversDir, filename)
-	largeThumbPath := thumbnailPath(originalPath, "large")
-	mediumThumbPath := thumbnailPath(originalPath, "medium")
-	_, loggedIn := getLoginStatus(r)
+	originalPath := path.Join(coversDir, cover.FilePath)
+	_, loggedIn := app.getLoginStatus(r)
 	data := coverData{
 		Login:             loggedIn,
 		OriginalCoverPath: originalPath,
-		LargeCoverPath:    largeThumbPath,
-		MediumCoverPath:   mediumThumbPath,
+		Cover:             app.responsiveImage(originalPath, cover.Width, cover.Height, coverSizes),
 		Visuals:           visuals,
 		Stories:           stories,
 	}
-	err = TPL.ExecuteTemplate(w, "index.gohtml", data)
+	err = app.tpl.ExecuteTemplate(w, "index.gohtml", data)
 	if err != nil {
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 	}
 }
 
-func handlePostIndex(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(2 << 20)
+func (app *App) handlePostIndex(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, app.cfg.Uploads.CoverMaxBytes)
+	err := r.ParseMultipartForm(app.cfg.Uploads.CoverMaxBytes)
 	if err != nil {
 		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
@@ -86,56 +90,81 @@ func handlePostIndex(w http.ResponseWriter, r *http.Request) {
 	}
 	file.Close()
 
+	if _, err := app.replaceCover(r, fileHeader); err != nil {
+		if errors.Is(err, errUploadRejected) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error replacing cover: %v", err)
+		http.Error(w, "Failed to save cover", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// replaceCover stores an uploaded image as the new cover, queues its
+// thumbnails and returns its id. Errors wrapping errUploadRejected are the
+// upload's fault.
+func (app *App) replaceCover(r *http.Request, fileHeader *multipart.FileHeader) (int, error) {
 	contentType := fileHeader.Header.Get("Content-Type")
 	if !strings.HasPrefix(contentType, "image/") {
-		http.Error(w, fmt.Sprintf("uploaded file type %s is not supported", contentType), http.StatusBadRequest)
-		return
+		return 0, fmt.Errorf("%w: file type %s is not supported", errUploadRejected, contentType)
 	}
 
-	filename, err := storeFile(fileHeader, FileUploadConfig{
-		AllowedTypes:   allowedImageMIMETypes,
-		DestinationDir: fmt.Sprintf("%s/covers", localFSDir),
-		Thumbnails:     thumbnailConfigs,
+	stored, err := app.storeFile(r.Context(), fileHeader, FileUploadConfig{
+		AllowedTypes: app.cfg.AllowedImageTypes(),
+		Prefix:       "covers",
+		MaxSize:      app.cfg.Uploads.CoverMaxBytes,
 	})
 	if err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
+		return 0, err
 	}
+	filename := stored.Filename
 
-	_, err = DB.Exec("INSERT INTO covers (file_path) VALUES (?)", filename) // Or `(filename)`
-	if err != nil {
-		http.Error(w, "Failed to update database", http.StatusInternalServerError)
-		return
+	var before any
+	if previous, err := app.getLatestCover(); err == nil {
+		before = Cover{FilePath: previous.FilePath}
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	coverID, err := app.insertCover(filename)
+	if err != nil {
+		return 0, fmt.Errorf("replaceCover: %w", err)
+	}
+	job := thumbnailJob{Key: path.Join("covers", filename), CoverID: coverID}
+	if err := app.jobs.Enqueue(app.db, jobThumbnails, job); err != nil {
+		log.Printf("Failed to queue thumbnails for cover %s: %v", filename, err)
+	}
+	app.jobs.Notify()
+	app.recordAuditEvent(r, "cover.replace", "cover", coverID, before, Cover{FilePath: filename})
+	return coverID, nil
 }
 
-func infoHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) infoHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		handleGetInfo(w, r)
+		app.handleGetInfo(w, r)
 	case http.MethodPost:
-		handlePatchInfo(w, r)
+		app.handlePatchInfo(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func handleGetInfo(w http.ResponseWriter, r *http.Request) {
-	info, err := getInfo()
+func (app *App) handleGetInfo(w http.ResponseWriter, r *http.Request) {
+	info, err := app.getInfo()
 	if err != nil {
 		http.Error(w, "Failed to fetch cover data", http.StatusInternalServerError)
 		return
 	}
-	_, loggedIn := getLoginStatus(r)
-	err = TPL.ExecuteTemplate(w, "info.gohtml", infoData{Login: loggedIn, Info: info})
+	_, loggedIn := app.getLoginStatus(r)
+	err = app.tpl.ExecuteTemplate(w, "info.gohtml", infoData{Login: loggedIn, Info: info, CSRFToken: app.csrfToken(r), Permissions: app.currentPermissions(r)})
 	if err != nil {
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 	}
 }
 
-func handlePatchInfo(w http.ResponseWriter, r *http.Request) {
+func (app *App) handlePatchInfo(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -147,42 +176,51 @@ func handlePatchInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := updateInfo(Info{Content: content})
+	before, err := app.getInfo()
 	if err != nil {
+		log.Printf("Error retrieving info: %v", err)
 		http.Error(w, "Failed to update info", http.StatusInternalServerError)
 		return
 	}
 
+	after := Info{Content: content}
+	err = app.updateInfo(after)
+	if err != nil {
+		http.Error(w, "Failed to update info", http.StatusInternalServerError)
+		return
+	}
+	app.recordAuditEvent(r, "info.update", "info", nil, before, after)
+
 	http.Redirect(w, r, "/info", http.StatusSeeOther)
 }
 
-func listStoriesHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) listStoriesHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		handleListStories(w, r)
+		app.handleListStories(w, r)
 	case http.MethodPost:
-		handlePostStories(w, r)
+		app.handlePostStories(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func handleListStories(w http.ResponseWriter, r *http.Request) {
-	stories, err := getStories()
+func (app *App) handleListStories(w http.ResponseWriter, r *http.Request) {
+	stories, err := app.getStories()
 	if err != nil {
 		http.Error(w, "Failed to retrieve stories", http.StatusInternalServerError)
 		log.Printf("Error retrieving stories: %v", err)
 		return
 	}
 
-	_, loggedIn := getLoginStatus(r)
-	err = TPL.ExecuteTemplate(w, "stories.gohtml", listStoryData{Login: loggedIn, Stories: stories})
+	_, loggedIn := app.getLoginStatus(r)
+	err = app.tpl.ExecuteTemplate(w, "stories.gohtml", listStoryData{Login: loggedIn, Stories: stories, CSRFToken: app.csrfToken(r), Permissions: app.currentPermissions(r)})
 	if err != nil {
 		http.Error(w, "Template error", http.StatusInternalServerError)
 	}
 }
 
-func handlePostStories(w http.ResponseWriter, r *http.Request) {
+func (app *App) handlePostStories(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -200,30 +238,36 @@ func handlePostStories(w http.ResponseWriter, r *http.Request) {
 		Content: content,
 	}
 
-	id, err := insertStory(story)
+	id, err := app.insertStory(story)
+	if errors.Is(err, errStoryTitleTaken) {
+		http.Error(w, "A story with this title already exists", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to save story", http.StatusInternalServerError)
 		log.Printf("Error inserting story: %v", err)
 		return
 	}
+	story.ID = id
+	app.recordAuditEvent(r, "story.create", "story", id, nil, story)
 
 	http.Redirect(w, r, fmt.Sprintf("/stories/%d", id), http.StatusSeeOther)
 }
 
-func storiesHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) storiesHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		handleGetStory(w, r)
+		app.handleGetStory(w, r)
 	case http.MethodPatch:
-		handlePatchStory(w, r)
+		app.handlePatchStory(w, r)
 	case http.MethodDelete:
-		handleDeleteStory(w, r)
+		app.handleDeleteStory(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func handleGetStory(w http.ResponseWriter, r *http.Request) {
+func (app *App) handleGetStory(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.TrimPrefix(r.URL.Path, "/stories/")
 
 	id, err := strconv.Atoi(idStr)
@@ -232,7 +276,7 @@ func handleGetStory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stories, err := getStories(id)
+	stories, err := app.getStories(id)
 	if err != nil {
 		log.Printf("Error retrieving stories: %v", err)
 		http.Error(w, "Failed to retrieve stories", http.StatusInternalServerError)
@@ -240,14 +284,14 @@ func handleGetStory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	story := stories[0]
-	_, loggedIn := getLoginStatus(r)
-	err = TPL.ExecuteTemplate(w, "story.gohtml", storyData{Login: loggedIn, Story: story})
+	_, loggedIn := app.getLoginStatus(r)
+	err = app.tpl.ExecuteTemplate(w, "story.gohtml", storyData{Login: loggedIn, Story: story, CSRFToken: app.csrfToken(r), Permissions: app.currentPermissions(r)})
 	if err != nil {
 		http.Error(w, "Template error", http.StatusInternalServerError)
 	}
 }
 
-func handlePatchStory(w http.ResponseWriter, r *http.Request) {
+func (app *App) handlePatchStory(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -258,56 +302,87 @@ func handlePatchStory(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid story ID", http.StatusBadRequest)
 		return
 	}
+	before, err := app.getStories(storyID)
+	if err != nil {
+		log.Printf("Error retrieving story: %v", err)
+		http.Error(w, "Failed to update story", http.StatusInternalServerError)
+		return
+	}
+	if len(before) == 0 {
+		http.Error(w, "Story not found", http.StatusNotFound)
+		return
+	}
 	story := Story{
-		ID:      storyID,
-		Title:   r.FormValue("title"),
-		Content: r.FormValue("content"),
+		ID:        storyID,
+		Title:     r.FormValue("title"),
+		Content:   r.FormValue("content"),
+		CreatedAt: before[0].CreatedAt,
+	}
+	err = app.updateStory(story)
+	if errors.Is(err, errStoryTitleTaken) {
+		http.Error(w, "A story with this title already exists", http.StatusConflict)
+		return
 	}
-	err = updateStory(story)
 	if err != nil {
 		http.Error(w, "Failed to update story", http.StatusInternalServerError)
 		return
 	}
+	app.recordAuditEvent(r, "story.update", "story", storyID, before[0], story)
 
 	http.Redirect(w, r, fmt.Sprintf("/stories/%d", storyID), http.StatusSeeOther)
 }
 
-func handleDeleteStory(w http.ResponseWriter, r *http.Request) {
+func (app *App) handleDeleteStory(w http.ResponseWriter, r *http.Request) {
 	storyID, err := strconv.Atoi(r.FormValue("id"))
 	if err != nil {
 		http.Error(w, "Invalid story ID", http.StatusBadRequest)
 		return
 	}
 
-	_, err = DB.Exec("DELETE FROM stories WHERE id = ?", storyID)
+	before, err := app.getStories(storyID)
+	if err != nil {
+		log.Printf("Error retrieving story: %v", err)
+		http.Error(w, "Failed to delete story", http.StatusInternalServerError)
+		return
+	}
+	if len(before) == 0 {
+		http.Error(w, "Story not found", http.StatusNotFound)
+		return
+	}
+
+	err = app.deleteStory(storyID)
 	if err != nil {
 		http.Error(w, "Failed to delete story", http.StatusInternalServerError)
 		return
 	}
+	app.recordAuditEvent(r, "story.delete", "story", storyID, before[0], nil)
 
 	http.Redirect(w, r, "/stories", http.StatusSeeOther)
 }
 
-func portfolioHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) portfolioHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		handleGetPortfolio(w, r)
+		app.handleGetPortfolio(w, r)
+	case http.MethodPost:
+		app.handlePostPortfolio(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func handleGetPortfolio(w http.ResponseWriter, r *http.Request) {
-	filePath, err := getLatestPortfolioPath()
+func (app *App) handleGetPortfolio(w http.ResponseWriter, r *http.Request) {
+	filePath, err := app.getLatestPortfolioPath()
 	if err != nil {
 		http.Error(w, "Failed to fetch portfolio data", http.StatusInternalServerError)
 		return
 	}
-	http.ServeFile(w, r, filepath.Join(localFSDir, "portfolios", filePath))
+	app.serveFile(w, r, path.Join("portfolios", filePath))
 }
 
-func portfolioUploadHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(10 << 20)
+func (app *App) handlePostPortfolio(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, app.cfg.Uploads.PortfolioMaxBytes)
+	err := r.ParseMultipartForm(app.cfg.Uploads.PortfolioMaxBytes)
 	if err != nil {
 		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
@@ -320,45 +395,64 @@ func portfolioUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	file.Close()
 
+	if _, err := app.replacePortfolio(r, fileHeader); err != nil {
+		if errors.Is(err, errUploadRejected) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error replacing portfolio: %v", err)
+		http.Error(w, "Failed to save portfolio", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// replacePortfolio stores an uploaded PDF as the new portfolio and returns
+// its id. Errors wrapping errUploadRejected are the upload's fault.
+func (app *App) replacePortfolio(r *http.Request, fileHeader *multipart.FileHeader) (int, error) {
 	contentType := fileHeader.Header.Get("Content-Type")
 	if !strings.HasPrefix(contentType, "application/pdf") {
-		http.Error(w, fmt.Sprintf("uploaded file type %s is not supported", contentType), http.StatusBadRequest)
-		return
+		return 0, fmt.Errorf("%w: file type %s is not supported", errUploadRejected, contentType)
 	}
 
-	filePath, err := storeFile(fileHeader, FileUploadConfig{
-		AllowedTypes:   map[string]bool{"application/pdf": true},
-		DestinationDir: fmt.Sprintf("./%s/portfolios", localFSDir),
-		MaxSize:        10_000_000,
+	stored, err := app.storeFile(r.Context(), fileHeader, FileUploadConfig{
+		AllowedTypes: map[string]bool{"application/pdf": true},
+		Prefix:       "portfolios",
+		MaxSize:      app.cfg.Uploads.PortfolioMaxBytes,
 	})
 	if err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
+		return 0, err
 	}
+	filePath := stored.Filename
 
-	_, err = DB.Exec("INSERT INTO portfolios (file_path) VALUES (?)", filePath)
-	if err != nil {
-		http.Error(w, "Failed to update database", http.StatusInternalServerError)
-		return
+	var before any
+	if previous, err := app.getLatestPortfolioPath(); err == nil {
+		before = Portfolio{FilePath: previous}
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	portfolioID, err := app.insertPortfolio(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("replacePortfolio: %w", err)
+	}
+	app.recordAuditEvent(r, "portfolio.replace", "portfolio", portfolioID, before, Portfolio{FilePath: filePath})
+	return portfolioID, nil
 }
 
-func visualsHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) visualsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		handleGetVisual(w, r)
+		app.handleGetVisual(w, r)
 	case http.MethodPatch:
-		handlePatchVisual(w, r)
+		app.handlePatchVisual(w, r)
 	case http.MethodDelete:
-		handleDeleteVisual(w, r)
+		app.handleDeleteVisual(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func handleGetVisual(w http.ResponseWriter, r *http.Request) {
+func (app *App) handleGetVisual(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.TrimPrefix(r.URL.Path, "/visuals/")
 
 	id, err := strconv.Atoi(idStr)
@@ -366,7 +460,7 @@ func handleGetVisual(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/visuals", http.StatusSeeOther)
 		return
 	}
-	visuals, err := getVisuals(id)
+	visuals, err := app.getVisuals(id)
 	if err != nil {
 		log.Printf("Error retrieving visual: %v", err)
 		http.Error(w, "Failed to retrieve visual work", http.StatusInternalServerError)
@@ -378,40 +472,49 @@ func handleGetVisual(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, loggedIn := getLoginStatus(r)
+	_, loggedIn := app.getLoginStatus(r)
 
-	err = TPL.ExecuteTemplate(w, "visual.gohtml", visualData{Login: loggedIn, Visual: visuals[0]})
+	duplicates, _ := strconv.Atoi(r.URL.Query().Get("duplicates"))
+	err = app.tpl.ExecuteTemplate(w, "visual.gohtml", visualData{
+		Login:       loggedIn,
+		Visual:      visuals[0],
+		CSRFToken:   app.csrfToken(r),
+		Permissions: app.currentPermissions(r),
+		Duplicates:  duplicates,
+	})
 	if err != nil {
 		http.Error(w, "Template error", http.StatusInternalServerError)
 	}
 }
 
-func getVisualUploadConfig(visualDir string) FileUploadConfig {
+func (app *App) getVisualUploadConfig(vid int) FileUploadConfig {
 	return FileUploadConfig{
-		AllowedTypes:   allowedImageMIMETypes,
-		DestinationDir: visualDir,
-		MaxSize:        2_000_000,
-		Thumbnails:     thumbnailConfigs,
+		AllowedTypes: app.cfg.AllowedImageTypes(),
+		Prefix:       visualPrefix(vid),
+		MaxSize:      app.cfg.Uploads.PhotoMaxBytes,
 	}
 }
 
-func handlePatchVisual(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(10 << 20)
+func (app *App) handlePatchVisual(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, app.cfg.Uploads.VisualFormMaxBytes)
+	err := r.ParseMultipartForm(app.cfg.Uploads.VisualFormMaxBytes)
 	if err != nil {
 		log.Printf("Error parsing form: %v", err)
 		http.Error(w, "Unable to parse form data", http.StatusBadRequest)
 		return
 	}
 
-	visualID, err := strconv.Atoi(r.FormValue("id"))
+	// /api/v1/visuals/{id} has the id in its path; the /visuals/ forms
+	// send it as a field.
+	visualID, err := strconv.Atoi(cmp.Or(r.PathValue("id"), r.FormValue("id")))
 	if err != nil {
 		http.Error(w, "Invalid visual ID", http.StatusBadRequest)
 		return
 	}
 
-	visual, err := getVisualByID(visualID)
+	visual, err := app.getVisualByID(visualID)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, sql.ErrNoRows) {
 			http.Error(w, "Visual not found", http.StatusNotFound)
 		} else {
 			http.Error(w, "Error fetching visual", http.StatusInternalServerError)
@@ -419,167 +522,187 @@ func handlePatchVisual(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before := *visual
 	visual.Title = r.FormValue("title")
 	visual.Description = r.FormValue("description")
 
-	visualDir := getVisualBaseDir(visual.ID)
-
-	var newPhotoFilenames []string
+	var newPhotos []Photo
+	var names []string
 	if files := r.MultipartForm.File["photos"]; len(files) > 0 {
-		config := getVisualUploadConfig(visualDir)
+		config := app.getVisualUploadConfig(visual.ID)
 		for _, fileHeader := range files {
-			filename, err := storeFile(fileHeader, config)
+			stored, err := app.storeFile(r.Context(), fileHeader, config)
 			if err != nil {
 				log.Printf("Error uploading file: %v", err)
+				app.deleteUploadedPhotos(r.Context(), visual.ID, newPhotos)
 				http.Error(w, "Error storing file", http.StatusInternalServerError)
 				return
 			}
-			newPhotoFilenames = append(newPhotoFilenames, filename)
+			newPhotos = append(newPhotos, newPhoto(stored))
+			names = append(names, fileHeader.Filename)
 		}
 	}
 
-	err = updateVisual(*visual)
+	duplicates, err := app.findDuplicates(visual.ID, newPhotos)
+	if err != nil {
+		log.Printf("Error looking for duplicate photos: %v", err)
+	}
+	if len(duplicates) > 0 && app.cfg.Duplicates.Action == "reject" {
+		app.deleteUploadedPhotos(r.Context(), visual.ID, newPhotos)
+		http.Error(w, duplicatesMessage(duplicates, names), http.StatusConflict)
+		return
+	}
+
+	err = app.updateVisual(*visual)
 	if err != nil {
 		log.Printf("Error updating visual: %v", err)
+		app.deleteUploadedPhotos(r.Context(), visual.ID, newPhotos)
 		http.Error(w, "Failed to update visual work", http.StatusInternalServerError)
 		return
 	}
 
-	if len(newPhotoFilenames) > 0 {
-		err = insertPhotos(visual.ID, newPhotoFilenames)
+	if len(newPhotos) > 0 {
+		err = app.insertPhotos(visual.ID, newPhotos)
 		if err != nil {
 			log.Printf("Error inserting new photos: %v", err)
+			app.deleteUploadedPhotos(r.Context(), visual.ID, newPhotos)
+			http.Error(w, "Failed to save photos", http.StatusInternalServerError)
+			return
 		}
+		visual.Photos = newPhotos
 	}
+	app.recordAuditEvent(r, "visual.update", "visual", visual.ID, before, visual)
 
-	http.Redirect(w, r, fmt.Sprintf("/visuals/%d", visual.ID), http.StatusSeeOther)
+	http.Redirect(w, r, visualURL(visual.ID, len(duplicates)), http.StatusSeeOther)
 }
 
-func handleDeleteVisual(w http.ResponseWriter, r *http.Request) {
-	visualID, err := strconv.Atoi(r.FormValue("id"))
+func (app *App) handleDeleteVisual(w http.ResponseWriter, r *http.Request) {
+	visualID, err := strconv.Atoi(cmp.Or(r.PathValue("id"), r.FormValue("id")))
 	if err != nil {
 		http.Error(w, "Invalid visual ID", http.StatusBadRequest)
 		return
 	}
 
-	visual, err := getVisuals(visualID)
-	if err != nil {
+	visual, err := app.getVisuals(visualID)
+	if err != nil || len(visual) == 0 {
 		http.Error(w, "Visual not found", http.StatusNotFound)
 		return
 	}
+	photos, _, err := app.getPhotosByVisualID(visualID, 0, -1)
+	if err != nil {
+		log.Printf("Error retrieving photos of visual %d: %v", visualID, err)
+	}
+	visual[0].Photos = photos
 
-	err = cleanupVisualFiles(visual[0])
+	err = app.cleanupVisualFiles(r.Context(), visual[0])
 	if err != nil {
 		http.Error(w, "Failed to delete visual work", http.StatusInternalServerError)
 		log.Printf("Error deleting visual: %v", err)
 		return
 	}
 
-	err = deleteVisual(visualID)
+	err = app.deleteVisual(visualID)
 	if err != nil {
 		http.Error(w, "Failed to delete visual work", http.StatusInternalServerError)
 		log.Printf("Error deleting visual: %v", err)
 		return
 	}
+	app.recordAuditEvent(r, "visual.delete", "visual", visualID, visual[0], nil)
 
 	http.Redirect(w, r, "/visuals", http.StatusSeeOther)
 }
 
-func listVisualsHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) listVisualsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		handleListVisuals(w, r)
+		app.handleListVisuals(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func handleListVisuals(w http.ResponseWriter, r *http.Request) {
-	visuals, err := getVisuals()
+func (app *App) handleListVisuals(w http.ResponseWriter, r *http.Request) {
+	visuals, err := app.getVisuals()
 	if err != nil {
 		http.Error(w, "Failed to retrieve visuals", http.StatusInternalServerError)
 		log.Printf("Error retrieving visuals: %v", err)
 		return
 	}
 
-	_, loggedIn := getLoginStatus(r)
-	err = TPL.ExecuteTemplate(w, "visuals.gohtml", listVisualData{Login: loggedIn, Visuals: visuals})
+	_, loggedIn := app.getLoginStatus(r)
+	err = app.tpl.ExecuteTemplate(w, "visuals.gohtml", listVisualData{Login: loggedIn, Visuals: visuals})
 	if err != nil {
 		http.Error(w, "Template error", http.StatusInternalServerError)
 	}
 }
 
-func createVisualHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) createVisualHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	handlePostVisualPhotos(w, r)
+	app.handlePostVisualPhotos(w, r)
 }
 
-func visualsApiHandler(w http.ResponseWriter, r *http.Request) {
-	trimmedPath := strings.TrimPrefix(r.URL.Path, "/api/v1/visuals/")
-	parts := strings.Split(trimmedPath, "/")
-
-	if len(parts) == 1 && parts[0] == "" {
-		if r.Method == http.MethodPost {
-			handlePostVisualPhotos(w, r)
-		} else {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
+// visualApiHandler serves /api/v1/visuals/{id}. GET lists the photos, as
+// /api/v1/visuals/{id}/photos does; PATCH and DELETE take the same forms as
+// /visuals/{id}.
+func (app *App) visualApiHandler(w http.ResponseWriter, r *http.Request) {
+	visualID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid visual ID in path", http.StatusBadRequest)
 		return
 	}
+	switch r.Method {
+	case http.MethodGet:
+		app.handleGetVisualPhotos(w, r, visualID)
+	case http.MethodPatch:
+		app.handlePatchVisual(w, r)
+	case http.MethodDelete:
+		app.handleDeleteVisual(w, r)
+	default:
+		http.Error(w, "Method not allowed on this resource", http.StatusMethodNotAllowed)
+	}
+}
 
-	visualID, err := strconv.Atoi(parts[0])
+// visualPhotosApiHandler serves /api/v1/visuals/{id}/photos.
+func (app *App) visualPhotosApiHandler(w http.ResponseWriter, r *http.Request) {
+	visualID, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
 		http.Error(w, "Invalid visual ID in path", http.StatusBadRequest)
 		return
 	}
-
-	if len(parts) == 1 {
-		switch r.Method {
-		case http.MethodGet:
-			handleGetVisualPhotos(w, r, visualID)
-		case http.MethodPatch:
-			handlePatchVisual(w, r)
-		case http.MethodDelete:
-			handleDeleteVisual(w, r)
-		default:
-			http.Error(w, "Method not allowed on this resource", http.StatusMethodNotAllowed)
-		}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed on photos collection", http.StatusMethodNotAllowed)
 		return
 	}
+	app.handleGetVisualPhotos(w, r, visualID)
+}
 
-	if len(parts) > 1 && parts[1] == "photos" {
-		if len(parts) == 2 { // /api/v1/visuals/{id}/photos
-			if r.Method == http.MethodGet {
-				handleGetVisualPhotos(w, r, visualID)
-			} else {
-				http.Error(w, "Method not allowed on photos collection", http.StatusMethodNotAllowed)
-			}
-		} else if len(parts) == 3 { // /api/v1/visuals/{id}/photos/{pid}
-			photoID, err := strconv.Atoi(parts[2])
-			if err != nil {
-				http.Error(w, "Invalid photo ID in path", http.StatusBadRequest)
-				return
-			}
-			if r.Method == http.MethodDelete {
-				handleDeleteVisualPhoto(w, r, visualID, photoID)
-			} else {
-				http.Error(w, "Method not allowed on photo resource", http.StatusMethodNotAllowed)
-			}
-		}
+// visualPhotoApiHandler serves /api/v1/visuals/{id}/photos/{photoID}.
+func (app *App) visualPhotoApiHandler(w http.ResponseWriter, r *http.Request) {
+	visualID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid visual ID in path", http.StatusBadRequest)
 		return
 	}
-
-	http.NotFound(w, r)
+	photoID, err := strconv.Atoi(r.PathValue("photoID"))
+	if err != nil {
+		http.Error(w, "Invalid photo ID in path", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed on photo resource", http.StatusMethodNotAllowed)
+		return
+	}
+	app.handleDeleteVisualPhoto(w, r, visualID, photoID)
 }
 
-func handleGetVisualPhotos(w http.ResponseWriter, r *http.Request, visualID int) {
+func (app *App) handleGetVisualPhotos(w http.ResponseWriter, r *http.Request, visualID int) {
 	page, perPage := getPaginationParams(r)
 	offset := (page - 1) * perPage
 
-	photos, totalCount, err := getPhotosByVisualID(visualID, offset, perPage)
+	photos, totalCount, err := app.getPhotosByVisualID(visualID, offset, perPage)
 	if err != nil {
 		log.Printf("Error retrieving photos: %v", err)
 		http.Error(w, "Failed to retrieve photos", http.StatusInternalServerError)
@@ -588,32 +711,27 @@ func handleGetVisualPhotos(w http.ResponseWriter, r *http.Request, visualID int)
 
 	photoResponses := make([]photoResponse, len(photos))
 	for i, p := range photos {
+		photoPath := path.Join(visualPrefix(visualID), p.Filename)
 		photoResponses[i] = photoResponse{
-			ID:         p.ID,
-			Filename:   p.Filename,
-			Thumbnails: generateThumbnailPaths(filepath.Join("visuals", strconv.Itoa(visualID), p.Filename)),
+			ID:          p.ID,
+			Filename:    p.Filename,
+			Status:      p.Status,
+			Thumbnails:  generateThumbnailPaths(photoPath),
+			Image:       app.responsiveImage(photoPath, p.Width, p.Height, photoSizes),
+			Metadata:    newPhotoMetadata(p),
+			Placeholder: p.Placeholder,
 		}
 	}
 
-	totalPages := 0
-	if totalCount > 0 {
-		totalPages = (totalCount + perPage - 1) / perPage
-	}
-	finalResponse := map[string]any{
-		"photos": photoResponses,
-		"pagination": map[string]any{
-			"total":        totalCount,
-			"per_page":     perPage,
-			"current_page": page,
-			"total_pages":  totalPages,
-		},
-	}
-
-	respondWithJSON(w, http.StatusOK, finalResponse)
+	respondWithJSON(w, http.StatusOK, photoListResponse{
+		Photos:     photoResponses,
+		Pagination: newPagination(totalCount, page, perPage),
+	})
 }
 
-func handlePostVisualPhotos(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(10 << 20) // 10 MB max
+func (app *App) handlePostVisualPhotos(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, app.cfg.Uploads.VisualFormMaxBytes)
+	err := r.ParseMultipartForm(app.cfg.Uploads.VisualFormMaxBytes)
 	if err != nil {
 		log.Printf("Error parsing form: %v", err)
 		http.Error(w, "Unable to parse form data", http.StatusBadRequest)
@@ -630,55 +748,63 @@ func handlePostVisualPhotos(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	vid, err := insertVisual(visual)
+	vid, err := app.insertVisual(visual)
 	if err != nil {
 		http.Error(w, "Failed to save visual", http.StatusInternalServerError)
 		log.Printf("Error inserting visual: %v", err)
 		return
 	}
 
-	visualDir := getVisualBaseDir(vid)
-	if err := os.MkdirAll(visualDir, 0755); err != nil {
-		log.Printf("Error creating visual directory: %v", err)
-		deleteVisual(vid) // Rollback visual creation
-		http.Error(w, "Failed to create storage", http.StatusInternalServerError)
-		return
-	}
-
-	var photoFilenames []string
+	var photos []Photo
+	var names []string
 	files := r.MultipartForm.File["photos"]
 
 	for _, fileHeader := range files {
-		config := getVisualUploadConfig(visualDir)
+		config := app.getVisualUploadConfig(vid)
 
-		filename, err := storeFile(fileHeader, config)
+		stored, err := app.storeFile(r.Context(), fileHeader, config)
 		if err != nil {
 			log.Printf("Error uploading file: %v", err)
-			os.RemoveAll(visualDir)
-			deleteVisual(vid)
+			app.cleanupVisualFiles(r.Context(), Visual{ID: vid})
+			app.deleteVisual(vid)
 			http.Error(w, "Error storing file", http.StatusInternalServerError)
 			return
 		}
-		photoFilenames = append(photoFilenames, filename)
+		photos = append(photos, newPhoto(stored))
+		names = append(names, fileHeader.Filename)
 	}
 
-	if len(photoFilenames) > 0 {
-		err = insertPhotos(vid, photoFilenames)
+	duplicates, err := app.findDuplicates(vid, photos)
+	if err != nil {
+		log.Printf("Error looking for duplicate photos: %v", err)
+	}
+	if len(duplicates) > 0 && app.cfg.Duplicates.Action == "reject" {
+		app.cleanupVisualFiles(r.Context(), Visual{ID: vid})
+		app.deleteVisual(vid)
+		http.Error(w, duplicatesMessage(duplicates, names), http.StatusConflict)
+		return
+	}
+
+	if len(photos) > 0 {
+		err = app.insertPhotos(vid, photos)
 		if err != nil {
-			os.RemoveAll(visualDir)
-			deleteVisual(vid)
+			app.cleanupVisualFiles(r.Context(), Visual{ID: vid})
+			app.deleteVisual(vid)
 			http.Error(w, "Failed to save photos", http.StatusInternalServerError)
 			log.Printf("Error inserting photos: %v", err)
 			return
 		}
 	}
+	visual.ID = vid
+	visual.Photos = photos
+	app.recordAuditEvent(r, "visual.create", "visual", vid, nil, visual)
 
-	http.Redirect(w, r, fmt.Sprintf("/visuals/%d", vid), http.StatusSeeOther)
+	http.Redirect(w, r, visualURL(vid, len(duplicates)), http.StatusSeeOther)
 }
-func handleDeleteVisualPhoto(w http.ResponseWriter, r *http.Request, visualID int, photoID int) {
-	photo, err := getPhotoByID(photoID)
+func (app *App) handleDeleteVisualPhoto(w http.ResponseWriter, r *http.Request, visualID int, photoID int) {
+	photo, err := app.getPhotoByID(photoID)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, sql.ErrNoRows) {
 			http.Error(w, "Photo not found", http.StatusNotFound)
 		} else {
 			http.Error(w, "Error fetching photo", http.StatusInternalServerError)
@@ -692,90 +818,611 @@ func handleDeleteVisualPhoto(w http.ResponseWriter, r *http.Request, visualID in
 		return
 	}
 
-	if err := deletePhoto(photoID); err != nil {
+	if err := app.deletePhoto(photoID); err != nil {
 		log.Printf("Error deleting photo record from DB for ID %d: %v", photoID, err)
 		http.Error(w, "Failed to delete photo from database", http.StatusInternalServerError)
 		return
 	}
 
-	visualDir := getVisualBaseDir(visualID)
-	photoPath := filepath.Join(visualDir, photo.Filename)
-
-	err = os.Remove(photoPath)
-	if err != nil && !os.IsNotExist(err) {
-		log.Printf("Warning: Failed to delete photo file at '%s': %v. The database record was deleted.", photoPath, err)
-	}
+	app.deleteImageFiles(r.Context(), path.Join(visualPrefix(visualID), photo.Filename))
 
+	app.recordAuditEvent(r, "photo.delete", "photo", photoID, photo, nil)
 	log.Printf("Successfully deleted photo with id '%d' from visual '%d'", photoID, visualID)
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func uploadFormHandler(w http.ResponseWriter, r *http.Request) {
-	_, loggedIn := getLoginStatus(r)
+// uploadPermissions maps each upload form onto the permission needed to
+// submit it.
+var uploadPermissions = map[string]string{
+	"cover":     "covers:replace",
+	"portfolio": "portfolios:replace",
+	"story":     "stories:create",
+	"visual":    "visuals:create",
+}
+
+func (app *App) uploadFormHandler(w http.ResponseWriter, r *http.Request) {
+	_, loggedIn := app.getLoginStatus(r)
 
 	uploadType := strings.TrimPrefix(r.URL.Path, "/upload/")
+	permission, ok := uploadPermissions[uploadType]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	permissions := app.currentPermissions(r)
+	if !permissions.Has(permission) {
+		http.Error(w, fmt.Sprintf("Forbidden: missing %s permission", permission), http.StatusForbidden)
+		return
+	}
+
 	data := struct {
 		Login                    bool
 		UploadType               string
 		IncludeCompressionScript bool
 		Title                    string
+		CSRFToken                string
+		Permissions              permissionSet
 	}{
 		Login:                    loggedIn,
 		UploadType:               uploadType,
 		IncludeCompressionScript: uploadType == "cover" || uploadType == "visual",
 		Title:                    "Upload " + cases.Title(language.English).String(uploadType),
+		CSRFToken:                app.csrfToken(r),
+		Permissions:              permissions,
 	}
 
-	err := TPL.ExecuteTemplate(w, "upload-page.gohtml", data)
+	err := app.tpl.ExecuteTemplate(w, "upload-page.gohtml", data)
 	if err != nil {
 		http.Error(w, "error templating page", http.StatusInternalServerError)
 	}
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	_, loggedIn := getLoginStatus(r)
-	err := TPL.ExecuteTemplate(w, "upload.gohtml", struct{ Login bool }{Login: loggedIn})
+func (app *App) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	_, loggedIn := app.getLoginStatus(r)
+	err := app.tpl.ExecuteTemplate(w, "upload.gohtml", struct {
+		Login       bool
+		CSRFToken   string
+		Permissions permissionSet
+	}{Login: loggedIn, CSRFToken: app.csrfToken(r), Permissions: app.currentPermissions(r)})
 	if err != nil {
 		http.Error(w, "error templating page", http.StatusInternalServerError)
 	}
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	_, loggedIn := getLoginStatus(r)
+func (app *App) loginHandler(w http.ResponseWriter, r *http.Request) {
+	_, loggedIn := app.getLoginStatus(r)
 	if loggedIn {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 	if r.Method == http.MethodPost {
 		email := r.FormValue("email")
-		err := addSession(w, email, []byte(r.FormValue("password")))
+		ip := clientIP(r)
+		attempt, ok := app.beginLoginAttempt(w, ip, email)
+		if !ok {
+			return
+		}
+
+		userId, err := app.login(email, []byte(r.FormValue("password")))
 		if err != nil {
+			log.Printf("Login failed: %v", err)
 			http.Error(w, "Login failed. Please try again.", http.StatusForbidden)
 			return
 		}
+
+		twoFactor, err := app.getTwoFactor(*userId)
+		if err != nil {
+			log.Printf("Error loading two-factor settings: %v", err)
+			http.Error(w, "Login failed. Please try again.", http.StatusInternalServerError)
+			return
+		}
+		if twoFactor.Enabled {
+			// The password was right, but the outcome is only recorded
+			// once the second factor has been checked.
+			if err := app.throttle.Forget(attempt); err != nil {
+				log.Printf("Error forgetting login attempt: %v", err)
+			}
+			challenge, err := app.createLoginChallenge(*userId, email, time.Now())
+			if err != nil {
+				log.Printf("Error creating login challenge: %v", err)
+				http.Error(w, "Login failed. Please try again.", http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, newLoginChallengeCookie(r, challenge))
+			http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+			return
+		}
+
+		if err := app.throttle.Succeed(attempt); err != nil {
+			log.Printf("Error recording login attempt: %v", err)
+		}
+		if err := app.addSession(w, r, *userId); err != nil {
+			http.Error(w, "Login failed. Please try again.", http.StatusInternalServerError)
+			return
+		}
 		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
 	}
-	err := TPL.ExecuteTemplate(w, "login.gohtml", nil)
+	err := app.tpl.ExecuteTemplate(w, "login.gohtml", nil)
 	if err != nil {
 		http.Error(w, "error templating page", http.StatusInternalServerError)
 	}
 }
 
-func styleSheetHandler(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "static/styles/style.css")
+// beginLoginAttempt records a login attempt as failed until told otherwise,
+// and returns its ID. It answers with 429 and reports false when the client
+// has to back off before trying again.
+func (app *App) beginLoginAttempt(w http.ResponseWriter, ip, email string) (int64, bool) {
+	attempt, wait, err := app.throttle.Begin(ip, email)
+	if err != nil {
+		log.Printf("Error checking login throttle: %v", err)
+		http.Error(w, "Login failed. Please try again.", http.StatusInternalServerError)
+		return 0, false
+	}
+	if wait > 0 {
+		log.Printf("Login throttled for ip %s (retry after %s)", ip, wait.Round(time.Second))
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		http.Error(w, "Too many login attempts. Please try again later.", http.StatusTooManyRequests)
+		return 0, false
+	}
+	return attempt, true
 }
 
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	_, loggedIn := getLoginStatus(r)
+func (app *App) loginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	challenge, err := app.getLoginChallenge(r, time.Now())
+	if err != nil {
+		if !errors.Is(err, errLoginChallengeNotFound) {
+			log.Printf("Error loading login challenge: %v", err)
+		}
+		http.SetCookie(w, clearLoginChallengeCookie(r))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		err := app.tpl.ExecuteTemplate(w, "login-2fa.gohtml", nil)
+		if err != nil {
+			http.Error(w, "error templating page", http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		app.handlePostLoginTwoFactor(w, r, challenge)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) handlePostLoginTwoFactor(w http.ResponseWriter, r *http.Request, challenge *loginChallenge) {
+	attempt, ok := app.beginLoginAttempt(w, clientIP(r), challenge.Email)
+	if !ok {
+		return
+	}
+	if err := app.recordLoginChallengeAttempt(challenge.ID); err != nil {
+		log.Printf("Error recording login challenge attempt: %v", err)
+		http.Error(w, "Login failed. Please try again.", http.StatusInternalServerError)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(challenge.UserID, r.FormValue("code"), time.Now())
+	if err != nil {
+		log.Printf("Error verifying second factor: %v", err)
+		http.Error(w, "Login failed. Please try again.", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		log.Printf("Second factor rejected for user %d", challenge.UserID)
+		http.Error(w, "Invalid code. Please try again.", http.StatusForbidden)
+		return
+	}
+	if err := app.throttle.Succeed(attempt); err != nil {
+		log.Printf("Error recording login attempt: %v", err)
+	}
+
+	if err := app.deleteLoginChallenge(challenge.ID); err != nil {
+		log.Printf("Error deleting login challenge: %v", err)
+	}
+	http.SetCookie(w, clearLoginChallengeCookie(r))
+	if err := app.addSession(w, r, challenge.UserID); err != nil {
+		http.Error(w, "Login failed. Please try again.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *App) accountTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		app.handleGetAccountTwoFactor(w, r)
+	case http.MethodPost:
+		app.handlePostAccountTwoFactor(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) handleGetAccountTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userId, _ := app.getLoginStatus(r)
+	app.renderAccountTwoFactor(w, r, *userId, nil, "")
+}
+
+// renderAccountTwoFactor shows either the enrolment QR code or the current
+// status. Newly generated recovery codes are only ever passed in right after
+// they were created, so they are displayed exactly once.
+func (app *App) renderAccountTwoFactor(w http.ResponseWriter, r *http.Request, userId int, recoveryCodes []string, errorMessage string) {
+	twoFactor, err := app.getTwoFactor(userId)
+	if err != nil {
+		log.Printf("Error loading two-factor settings: %v", err)
+		http.Error(w, "Failed to load two-factor settings", http.StatusInternalServerError)
+		return
+	}
+
+	data := twoFactorData{
+		Login:         true,
+		CSRFToken:     app.csrfToken(r),
+		Enabled:       twoFactor.Enabled,
+		RecoveryCodes: recoveryCodes,
+		Error:         errorMessage,
+	}
+
+	if twoFactor.Enabled {
+		data.RemainingRecoveryCodes, err = app.countUnusedRecoveryCodes(userId)
+		if err != nil {
+			log.Printf("Error counting recovery codes: %v", err)
+		}
+	} else {
+		if twoFactor.Secret == "" {
+			twoFactor.Secret, err = newTOTPSecret()
+			if err == nil {
+				err = app.setPendingTOTPSecret(userId, twoFactor.Secret)
+			}
+			if err != nil {
+				log.Printf("Error starting two-factor enrolment: %v", err)
+				http.Error(w, "Failed to start two-factor enrolment", http.StatusInternalServerError)
+				return
+			}
+		}
+		email, err := app.getUserEmail(userId)
+		if err != nil {
+			log.Printf("Error loading user: %v", err)
+			http.Error(w, "Failed to load account", http.StatusInternalServerError)
+			return
+		}
+		data.Secret = twoFactor.Secret
+		data.QRCode, err = totpQRCode(totpURI(twoFactor.Secret, email))
+		if err != nil {
+			log.Printf("Error drawing two-factor QR code: %v", err)
+			http.Error(w, "Failed to start two-factor enrolment", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if errorMessage != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	err = app.tpl.ExecuteTemplate(w, "account-2fa.gohtml", data)
+	if err != nil {
+		http.Error(w, "error templating page", http.StatusInternalServerError)
+	}
+}
+
+func (app *App) handlePostAccountTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userId, _ := app.getLoginStatus(r)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	twoFactor, err := app.getTwoFactor(*userId)
+	if err != nil {
+		log.Printf("Error loading two-factor settings: %v", err)
+		http.Error(w, "Failed to load two-factor settings", http.StatusInternalServerError)
+		return
+	}
+	code := r.FormValue("code")
+
+	switch action := r.FormValue("action"); action {
+	case "enable":
+		if twoFactor.Enabled {
+			http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+			return
+		}
+		step, ok := verifyTOTP(twoFactor.Secret, code, time.Now(), twoFactor.LastStep)
+		if !ok {
+			app.renderAccountTwoFactor(w, r, *userId, nil, "That code did not match. Check the time on your phone and try again.")
+			return
+		}
+		codes, err := app.enableTOTP(*userId, step)
+		if err != nil {
+			log.Printf("Error enabling two-factor authentication: %v", err)
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Two-factor authentication enabled for user %d", *userId)
+		app.recordAuditEvent(r, "2fa.enable", "user", *userId, map[string]bool{"enabled": false}, map[string]bool{"enabled": true})
+		app.renderAccountTwoFactor(w, r, *userId, codes, "")
+
+	case "disable", "regenerate":
+		if !twoFactor.Enabled {
+			http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+			return
+		}
+		ok, err := app.verifySecondFactor(*userId, code, time.Now())
+		if err != nil {
+			log.Printf("Error verifying second factor: %v", err)
+			http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			app.renderAccountTwoFactor(w, r, *userId, nil, "That code did not match.")
+			return
+		}
+		if action == "disable" {
+			if err := app.disableTOTP(*userId); err != nil {
+				log.Printf("Error disabling two-factor authentication: %v", err)
+				http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Two-factor authentication disabled for user %d", *userId)
+			app.recordAuditEvent(r, "2fa.disable", "user", *userId, map[string]bool{"enabled": true}, map[string]bool{"enabled": false})
+			http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+			return
+		}
+		codes, err := app.regenerateRecoveryCodes(*userId)
+		if err != nil {
+			log.Printf("Error regenerating recovery codes: %v", err)
+			http.Error(w, "Failed to regenerate recovery codes", http.StatusInternalServerError)
+			return
+		}
+		app.recordAuditEvent(r, "2fa.regenerate_recovery_codes", "user", *userId, nil, nil)
+		app.renderAccountTwoFactor(w, r, *userId, codes, "")
+
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+	}
+}
+
+func (app *App) accountTokensHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		app.renderAccountTokens(w, r, "", "")
+	case http.MethodPost:
+		app.handlePostAccountTokens(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// renderAccountTokens lists the caller's tokens. A freshly created token is
+// passed in once so it can be copied; it cannot be shown again afterwards.
+func (app *App) renderAccountTokens(w http.ResponseWriter, r *http.Request, newToken, errorMessage string) {
+	userId, _ := app.getLoginStatus(r)
+	tokens, err := app.listAPITokens(*userId)
+	if err != nil {
+		log.Printf("Error listing API tokens: %v", err)
+		http.Error(w, "Failed to load API tokens", http.StatusInternalServerError)
+		return
+	}
+
+	if errorMessage != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	err = app.tpl.ExecuteTemplate(w, "account-tokens.gohtml", tokensData{
+		Login:     true,
+		CSRFToken: app.csrfToken(r),
+		Tokens:    tokens,
+		Scopes:    apitoken.Scopes,
+		NewToken:  newToken,
+		Error:     errorMessage,
+	})
+	if err != nil {
+		http.Error(w, "error templating page", http.StatusInternalServerError)
+	}
+}
+
+func (app *App) handlePostAccountTokens(w http.ResponseWriter, r *http.Request) {
+	userId, _ := app.getLoginStatus(r)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "create":
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			app.renderAccountTokens(w, r, "", "Give the token a name so you can recognise it later.")
+			return
+		}
+		scopes, err := apitoken.ParseScopes(strings.Join(r.Form["scopes"], ","))
+		if err != nil {
+			app.renderAccountTokens(w, r, "", err.Error())
+			return
+		}
+		raw, tokenID, err := app.createAPIToken(*userId, name, scopes)
+		if err != nil {
+			log.Printf("Error creating API token: %v", err)
+			http.Error(w, "Failed to create API token", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("API token %q created for user %d", name, *userId)
+		app.recordAuditEvent(r, "token.create", "api_token", tokenID, nil, map[string]any{"name": name, "scopes": scopes})
+		app.renderAccountTokens(w, r, raw, "")
+
+	case "revoke":
+		tokenID, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid token ID", http.StatusBadRequest)
+			return
+		}
+		if err := app.revokeAPIToken(*userId, tokenID); err != nil {
+			if errors.Is(err, errAPITokenNotFound) {
+				http.Error(w, "Token not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error revoking API token: %v", err)
+			http.Error(w, "Failed to revoke API token", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("API token %d revoked by user %d", tokenID, *userId)
+		app.recordAuditEvent(r, "token.revoke", "api_token", tokenID, nil, nil)
+		http.Redirect(w, r, "/account/tokens", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+	}
+}
+
+// fsHandler serves uploads from storage under /fs/<key>. With fs_mode
+// "redirect" and a backend that has direct URLs, the browser is sent to a
+// presigned URL instead of the file passing through the app.
+func (app *App) fsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isSafeMethod(r.Method) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := storage.CleanKey(strings.TrimPrefix(r.URL.Path, "/fs/"))
+	if err != nil || isQuarantined(key) {
+		http.NotFound(w, r)
+		return
+	}
+	if isVisualOriginal(key) && app.cfg.Storage.ProtectOriginals {
+		if app.originalsHidden(r) {
+			http.Error(w, "Originals are not public", http.StatusForbidden)
+			return
+		}
+		// Keep shared caches from handing it to anyone else.
+		w.Header().Set("Cache-Control", "private")
+	}
+
+	if app.cfg.Storage.FSMode == "redirect" {
+		url, err := app.storage.URL(r.Context(), key, app.cfg.Storage.URLExpiry)
+		if err == nil {
+			http.Redirect(w, r, url, http.StatusFound)
+			return
+		}
+		if !errors.Is(err, storage.ErrNoURL) {
+			log.Printf("Failed to create URL for %s: %v", key, err)
+			http.Error(w, "Failed to fetch file", http.StatusInternalServerError)
+			return
+		}
+	}
+	app.serveFile(w, r, key)
+}
+
+// serveFile streams an object from storage, with range and conditional
+// request support.
+func (app *App) serveFile(w http.ResponseWriter, r *http.Request, key string) {
+	obj, info, err := app.storage.Get(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read %s from storage: %v", key, err)
+		http.Error(w, "Failed to fetch file", http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+	app.serveObject(w, r, key, obj, info, info.ContentType)
+}
+
+func (app *App) serveObject(w http.ResponseWriter, r *http.Request, key string, obj storage.Object, info storage.ObjectInfo, contentType string) {
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	http.ServeContent(w, r, path.Base(key), info.ModTime, obj)
+}
+
+func (app *App) styleSheetHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, filepath.Join(app.cfg.StaticDir, "styles", "style.css"))
+}
+
+// logoutHandler ends the session. It only takes a POST, so that logging
+// someone out needs the CSRF token.
+func (app *App) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, loggedIn := app.getLoginStatus(r)
 	if !loggedIn {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-	cookie := deleteSession(r)
+	cookie := app.deleteSession(r)
 	http.SetCookie(w, cookie)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+func (app *App) auditPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events, total, err := app.listAuditEvents(filter)
+	if err != nil {
+		log.Printf("Error retrieving audit events: %v", err)
+		http.Error(w, "Failed to retrieve audit log", http.StatusInternalServerError)
+		return
+	}
+
+	data := auditData{
+		Login:       true,
+		CSRFToken:   app.csrfToken(r),
+		Permissions: app.currentPermissions(r),
+		Events:      events,
+		Filter:      filter,
+		Since:       r.URL.Query().Get("since"),
+		Until:       r.URL.Query().Get("until"),
+		Total:       total,
+	}
+	if filter.Page > 1 {
+		data.PrevURL = pageURL(r, filter.Page-1)
+	}
+	if filter.Page*filter.PerPage < total {
+		data.NextURL = pageURL(r, filter.Page+1)
+	}
+	if err := app.tpl.ExecuteTemplate(w, "audit.gohtml", data); err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+	}
+}
+
+func (app *App) auditEventsApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events, total, err := app.listAuditEvents(filter)
+	if err != nil {
+		log.Printf("Error retrieving audit events: %v", err)
+		http.Error(w, "Failed to retrieve audit log", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, auditEventListResponse{
+		Events:     events,
+		Pagination: newPagination(total, filter.Page, filter.PerPage),
+	})
+}
+
+// pageURL returns the current URL with its page parameter replaced, so
+// pagination links keep the active filters.
+func pageURL(r *http.Request, page int) string {
+	q := r.URL.Query()
+	q.Set("page", strconv.Itoa(page))
+	return r.URL.Path + "?" + q.Encode()
+}
+
 func AddPrefixHandler(prefix string, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		r.URL.Path = prefix + r.URL.Path
@@ -783,10 +1430,15 @@ func AddPrefixHandler(prefix string, h http.Handler) http.Handler {
 	})
 }
 
-func requireAuthUnlessGet(next http.HandlerFunc) http.HandlerFunc {
+// requireSession only admits browser sessions. Account settings use it so a
+// leaked API token cannot be used to mint more tokens or switch off 2FA.
+func (app *App) requireSession(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		_, loggedIn := getLoginStatus(r)
-		if r.Method != http.MethodGet && !loggedIn {
+		if _, ok := bearerToken(r); ok {
+			http.Error(w, "Forbidden: API tokens cannot manage account settings", http.StatusForbidden)
+			return
+		}
+		if _, ok := app.getSession(r); !ok {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -794,9 +1446,9 @@ func requireAuthUnlessGet(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+func (app *App) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		_, loggedIn := getLoginStatus(r)
+		_, loggedIn := app.getLoginStatus(r)
 		if !loggedIn {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
@@ -821,19 +1473,19 @@ func methodOverride(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func thumbnailsHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) thumbnailsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		handleGetThumbnail(w, r)
+		app.handleGetThumbnail(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func handleGetThumbnail(w http.ResponseWriter, r *http.Request) {
+func (app *App) handleGetThumbnail(w http.ResponseWriter, r *http.Request) {
 	filePath := r.URL.Query().Get("path")
 
-	cleanedPath, err := validateAndCleanPath(filePath)
+	cleanedPath, err := app.validateAndCleanPath(r.Context(), filePath)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			http.Error(w, err.Error(), http.StatusNotFound)
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/storage"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/thumbnail"
+	"github.com/disintegration/imaging"
+)
+
+const (
+	imageSigningKeyName     = "image_signing_key"
+	imageCachePruneInterval = time.Hour
+)
+
+// imageFits are the ways /img/ can make an image fit the requested box:
+// "fit" scales it to fit inside, "fill" scales and crops it to cover it.
+var imageFits = []string{"fit", "fill"}
+
+// imageVariant is one resized version of an original, as named in an /img/
+// URL.
+type imageVariant struct {
+	Width, Height int
+	Fit           string
+	Key           string
+}
+
+func (v imageVariant) String() string {
+	return fmt.Sprintf("%dx%d/%s/%s", v.Width, v.Height, v.Fit, v.Key)
+}
+
+// imageURL returns the signed /img/ URL of the original stored under key,
+// resized to width by height. Either may be 0 to follow the aspect ratio.
+func (app *App) imageURL(key string, width, height int, fit string) string {
+	v := imageVariant{Width: width, Height: height, Fit: fit, Key: key}
+	return "/img/" + v.String() + "?sig=" + app.signImage(v)
+}
+
+func (app *App) signImage(v imageVariant) string {
+	mac := hmac.New(sha256.New, app.imageKey)
+	mac.Write([]byte(v.String()))
+	// 128 bits are plenty to make guessing hopeless and keep URLs short.
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// parseImageVariant parses the part of an /img/ URL after the prefix.
+func parseImageVariant(p string, maxDimension int) (imageVariant, error) {
+	box, rest, _ := strings.Cut(p, "/")
+	fit, key, _ := strings.Cut(rest, "/")
+	w, h, ok := strings.Cut(box, "x")
+	if !ok {
+		return imageVariant{}, fmt.Errorf("size %q is not WIDTHxHEIGHT", box)
+	}
+	width, err := strconv.Atoi(w)
+	if err != nil || width < 0 || width > maxDimension {
+		return imageVariant{}, fmt.Errorf("width must be between 0 and %d", maxDimension)
+	}
+	height, err := strconv.Atoi(h)
+	if err != nil || height < 0 || height > maxDimension {
+		return imageVariant{}, fmt.Errorf("height must be between 0 and %d", maxDimension)
+	}
+	switch {
+	case width == 0 && height == 0:
+		return imageVariant{}, errors.New("width and height cannot both be 0")
+	case fit == "fill" && (width == 0 || height == 0):
+		return imageVariant{}, errors.New("fill needs both a width and a height")
+	case fit != "fit" && fit != "fill":
+		return imageVariant{}, fmt.Errorf("fit %q is not one of %s", fit, strings.Join(imageFits, ", "))
+	}
+	key, err = storage.CleanKey(key)
+	if err != nil {
+		return imageVariant{}, err
+	}
+	return imageVariant{Width: width, Height: height, Fit: fit, Key: key}, nil
+}
+
+// imageHandler serves GET /img/{w}x{h}/{fit}/{key}?sig=..., resizing the
+// original on first request and serving the cached variant after that.
+// Variants are made as WebP or JPEG; AVIF takes too long to make while the
+// browser waits.
+func (app *App) imageHandler(w http.ResponseWriter, r *http.Request) {
+	if !isSafeMethod(r.Method) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	v, err := parseImageVariant(strings.TrimPrefix(r.URL.Path, "/img/"), app.cfg.Images.MaxDimension)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(app.signImage(v))) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	// Variants are made from the original, without watermarks.
+	if isVisualOriginal(v.Key) && app.originalsHidden(r) {
+		http.Error(w, "Originals are not public", http.StatusForbidden)
+		return
+	}
+
+	var formats []thumbnail.Format
+	for _, name := range []string{"webp", thumbnail.JPEG} {
+		f, _ := thumbnail.LookupFormat(name)
+		formats = append(formats, f)
+	}
+	format := acceptedThumbnailFormats(r.Header.Get("Accept"), formats)[0]
+
+	w.Header().Set("Vary", "Accept")
+	// Other requests may be waiting on this one's resize, so it must not be
+	// cut short if this client goes away.
+	ctx := context.WithoutCancel(r.Context())
+	file, err := app.images.Get(v, format, func() ([]byte, error) { return app.resizeImage(ctx, v, format) })
+	if errors.Is(err, storage.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to resize %s: %v", v, err)
+		http.Error(w, "Failed to resize image", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Failed to resize image", http.StatusInternalServerError)
+		return
+	}
+
+	// The URL names the variant exactly and originals are never replaced.
+	if isVisualOriginal(v.Key) && app.cfg.Storage.ProtectOriginals {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	w.Header().Set("Content-Type", format.ContentType)
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+func (app *App) resizeImage(ctx context.Context, v imageVariant, format thumbnail.Format) ([]byte, error) {
+	// A master is quicker to decode than the HEIC it was made from.
+	obj, _, err := app.storage.Get(ctx, thumbnail.MasterKey(v.Key))
+	if errors.Is(err, storage.ErrNotFound) {
+		obj, _, err = app.storage.Get(ctx, v.Key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	img, _, err := thumbnail.Decode(obj)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", v.Key, err)
+	}
+
+	// Never upscale: shrink the box until it fits in the original, keeping
+	// its aspect ratio for fill.
+	dx, dy := img.Bounds().Dx(), img.Bounds().Dy()
+	width, height := v.Width, v.Height
+	if v.Fit == "fill" {
+		scale := min(1, float64(dx)/float64(width), float64(dy)/float64(height))
+		img = imaging.Fill(img, max(1, int(float64(width)*scale)), max(1, int(float64(height)*scale)), imaging.Center, imaging.Lanczos)
+	} else {
+		if width == 0 {
+			width = dx
+		}
+		if height == 0 {
+			height = dy
+		}
+		img = imaging.Fit(img, width, height, imaging.Lanczos)
+	}
+
+	var buf bytes.Buffer
+	if err := format.Encode(&buf, img, app.cfg.Images.Quality); err != nil {
+		return nil, fmt.Errorf("encoding %s: %w", v, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ImageCache keeps resized images on local disk, under a directory named
+// after the original's key so they can be dropped with it.
+type ImageCache struct {
+	dir    string
+	maxAge time.Duration
+
+	// Concurrent requests for a variant that is not cached yet wait for the
+	// first one to make it instead of each resizing the original.
+	mu    sync.Mutex
+	calls map[string]*imageCacheCall
+}
+
+type imageCacheCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newImageCache(dir string, maxAge time.Duration) *ImageCache {
+	return &ImageCache{dir: dir, maxAge: maxAge, calls: map[string]*imageCacheCall{}}
+}
+
+func (c *ImageCache) path(v imageVariant, format thumbnail.Format) string {
+	name := fmt.Sprintf("%dx%d-%s%s", v.Width, v.Height, v.Fit, format.Ext)
+	return filepath.Join(c.dir, filepath.FromSlash(v.Key), name)
+}
+
+// Get opens the cached variant, calling create to make it if needed.
+func (c *ImageCache) Get(v imageVariant, format thumbnail.Format, create func() ([]byte, error)) (*os.File, error) {
+	p := c.path(v, format)
+	if f, err := os.Open(p); err == nil {
+		return f, nil
+	}
+
+	c.mu.Lock()
+	call, ok := c.calls[p]
+	if !ok {
+		call = &imageCacheCall{done: make(chan struct{})}
+		c.calls[p] = call
+	}
+	c.mu.Unlock()
+
+	if ok {
+		<-call.done
+	} else {
+		call.err = c.store(p, create)
+		c.mu.Lock()
+		delete(c.calls, p)
+		c.mu.Unlock()
+		close(call.done)
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	return os.Open(p)
+}
+
+func (c *ImageCache) store(p string, create func() ([]byte, error)) error {
+	data, err := create()
+	if err != nil {
+		return err
+	}
+	tmp, err := c.createTemp(filepath.Dir(p))
+	if err != nil {
+		return fmt.Errorf("ImageCache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("ImageCache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("ImageCache: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return fmt.Errorf("ImageCache: %w", err)
+	}
+	return nil
+}
+
+// createTemp creates a temporary file in dir, making dir first. Prune may
+// remove dir in between when it is empty, in which case it is made again.
+func (c *ImageCache) createTemp(dir string) (f *os.File, err error) {
+	for range 3 {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		f, err = os.CreateTemp(dir, ".tmp-*")
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	return f, err
+}
+
+// Purge removes the variants of every original under prefix, which may be a
+// single key.
+func (c *ImageCache) Purge(prefix string) error {
+	key, err := storage.CleanKey(prefix)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(c.dir, filepath.FromSlash(key))); err != nil {
+		return fmt.Errorf("ImageCache.Purge: %w", err)
+	}
+	return nil
+}
+
+// Prune removes variants made longer than maxAge ago; they are made again
+// when next asked for. Directories left empty, of originals that are gone
+// or no longer asked for, are removed too.
+func (c *ImageCache) Prune() (int64, error) {
+	cutoff := time.Now().Add(-c.maxAge)
+	var removed int64
+	var dirs []string
+	err := filepath.WalkDir(c.dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != c.dir {
+				dirs = append(dirs, p)
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(cutoff) {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("ImageCache.Prune: %w", err)
+	}
+	// Deepest first, so that a directory holding only empty ones goes too.
+	// Removing one that is not empty fails, and is meant to.
+	for _, dir := range slices.Backward(dirs) {
+		os.Remove(dir)
+	}
+	return removed, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/config"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/thumbnail"
+)
+
+func TestImageCachePrune(t *testing.T) {
+	dir := t.TempDir()
+	c := newImageCache(dir, time.Hour)
+	old := filepath.Join(dir, "visuals", "3", "a.jpg", "800x0-fit.webp")
+	fresh := filepath.Join(dir, "visuals", "4", "b.jpg", "800x0-fit.webp")
+	for _, p := range []string{old, fresh} {
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	long := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(old, long, long); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := c.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("Prune removed %d files, want 1", removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "visuals", "3")); !os.IsNotExist(err) {
+		t.Errorf("the emptied directories are still there: %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("the fresh variant is gone: %v", err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("the cache directory is gone: %v", err)
+	}
+}
+
+func TestResponsiveImageSrcset(t *testing.T) {
+	app := &App{cfg: config.Default(), imageKey: []byte("key")}
+
+	img := app.responsiveImage("visuals/3/a.jpg", 4000, 3000, photoSizes)
+	widths := srcsetWidths(img.Srcset)
+	want := []string{"150w", "212w", "300w", "424w", "600w", "805w", "1080w", "1610w", "2400w"}
+	if strings.Join(widths, " ") != strings.Join(want, " ") {
+		t.Errorf("srcset widths %v, want %v", widths, want)
+	}
+	if !strings.Contains(img.Srcset, "/img/2400x0/fit/visuals/3/a.jpg?sig=") {
+		t.Errorf("srcset %q has no /img/ variant at the maximum width", img.Srcset)
+	}
+	if img.Src != "/thumbnails/medium/visuals/3/a.jpg" {
+		t.Errorf("src %q, want the medium thumbnail", img.Src)
+	}
+
+	// Not wider than the original, which is not known yet here.
+	img = app.responsiveImage("visuals/3/a.jpg", 0, 0, photoSizes)
+	if got := srcsetWidths(img.Srcset); got[len(got)-1] != "1080w" {
+		t.Errorf("srcset widths %v, want them to stop at the large thumbnail", got)
+	}
+
+	app.cfg.Storage.ProtectOriginals = true
+	if img := app.responsiveImage("visuals/3/a.jpg", 4000, 3000, photoSizes); strings.Contains(img.Srcset, "/img/") {
+		t.Errorf("srcset %q resizes a protected original", img.Srcset)
+	}
+	if img := app.responsiveImage("covers/a.jpg", 4000, 3000, coverSizes); !strings.Contains(img.Srcset, "/img/") {
+		t.Errorf("srcset %q does not resize a cover", img.Srcset)
+	}
+
+	// Src follows the configured sizes: with medium cropped, the middle of
+	// the others is large.
+	app.cfg.Thumbnails[2].Crop = true
+	if img := app.responsiveImage("visuals/3/a.jpg", 4000, 3000, photoSizes); img.Src != "/thumbnails/large/visuals/3/a.jpg" {
+		t.Errorf("src %q, want the large thumbnail", img.Src)
+	}
+	app.cfg.Thumbnails[2].Crop = false
+
+	app.cfg.Storage.ProtectOriginals = false
+	app.cfg.Thumbnails[3].Watermark = &thumbnail.WatermarkConfig{Text: "©"}
+	if img := app.responsiveImage("covers/a.jpg", 4000, 3000, coverSizes); strings.Contains(img.Srcset, "/img/") {
+		t.Errorf("srcset %q has unwatermarked variants", img.Srcset)
+	}
+}
+
+func srcsetWidths(srcset string) []string {
+	var widths []string
+	for _, c := range strings.Split(srcset, ", ") {
+		_, w, _ := strings.Cut(c, " ")
+		widths = append(widths, w)
+	}
+	return widths
+}
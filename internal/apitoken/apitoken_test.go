@@ -0,0 +1,62 @@
+package apitoken
+
+import (
+	"bytes"
+	"encoding/base64"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	token, hash, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, Prefix) {
+		t.Errorf("token %q lacks the %q prefix", token, Prefix)
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, Prefix)); err != nil || len(b) != 32 {
+		t.Errorf("token %q does not carry 32 random bytes", token)
+	}
+	if !bytes.Equal(hash, Hash(token)) {
+		t.Error("New returned a hash that Hash does not reproduce")
+	}
+	other, otherHash, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == token || bytes.Equal(otherHash, hash) {
+		t.Error("New returned the same token twice")
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"", []string{}, false},
+		{"visuals:write", []string{"visuals:write"}, false},
+		{"visuals:write, audit:read", []string{"visuals:write", "audit:read"}, false},
+		{"stories:write stories:write", []string{"stories:write"}, false},
+		{"visuals:read", nil, true},
+		{"visuals:write,admin", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseScopes(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseScopes(%q) error = %v", tt.in, err)
+			continue
+		}
+		if !tt.wantErr && !slices.Equal(got, tt.want) {
+			t.Errorf("ParseScopes(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if !tt.wantErr {
+			if again, err := ParseScopes(FormatScopes(got)); err != nil || !slices.Equal(again, got) {
+				t.Errorf("FormatScopes(%q) does not parse back: %q, %v", got, again, err)
+			}
+		}
+	}
+}
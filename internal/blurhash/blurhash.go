@@ -0,0 +1,128 @@
+// Package blurhash encodes images as BlurHash strings: a few dozen
+// characters from which a blurred placeholder can be painted before the
+// image itself has loaded. See https://blurha.sh for the format and decoders.
+package blurhash
+
+import (
+	"errors"
+	"image"
+	"math"
+	"strings"
+)
+
+const characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Encode returns the BlurHash of img with xComponents by yComponents
+// components, each between 1 and 9. More components keep more detail and
+// make a longer hash. The work grows with the number of pixels, so img is
+// best shrunk to a few dozen pixels across first.
+func Encode(img image.Image, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", errors.New("blurhash: components must be between 1 and 9")
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return "", errors.New("blurhash: empty image")
+	}
+
+	// The pixels in linear RGB, read once.
+	pixels := make([][3]float64, 0, width*height)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			pixels = append(pixels, [3]float64{toLinear(r), toLinear(g), toLinear(b)})
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := range yComponents {
+		for i := range xComponents {
+			var f [3]float64
+			for y := range height {
+				cy := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := range width {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) * cy
+					p := pixels[y*width+x]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+			scale := 2.0
+			if i == 0 && j == 0 {
+				scale = 1
+			}
+			scale /= float64(width * height)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	encode83(&hash, (xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = max(actualMax, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+		}
+		quantisedMax := int(max(0, min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		encode83(&hash, quantisedMax, 1)
+	} else {
+		encode83(&hash, 0, 1)
+	}
+
+	encode83(&hash, toSRGB(dc[0])<<16+toSRGB(dc[1])<<8+toSRGB(dc[2]), 4)
+	for _, f := range ac {
+		quantise := func(v float64) int {
+			return int(max(0, min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		encode83(&hash, quantise(f[0])*19*19+quantise(f[1])*19+quantise(f[2]), 2)
+	}
+	return hash.String(), nil
+}
+
+// Components picks the number of components for an image of the given size:
+// n along its longer side and proportionally fewer, but at least 1, along
+// the other.
+func Components(width, height, n int) (x, y int) {
+	if width <= 0 || height <= 0 {
+		return n, n
+	}
+	if width >= height {
+		return n, max(1, min(n, int(math.Round(float64(n)*float64(height)/float64(width)))))
+	}
+	return max(1, min(n, int(math.Round(float64(n)*float64(width)/float64(height))))), n
+}
+
+func encode83(b *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := value / int(math.Pow(83, float64(length-i))) % 83
+		b.WriteByte(characters[digit])
+	}
+}
+
+// toLinear converts a 16-bit sRGB channel value to linear light, 0 to 1.
+func toLinear(v uint32) float64 {
+	c := float64(v) / 0xffff
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// toSRGB converts a linear value to an 8-bit sRGB channel value.
+func toSRGB(v float64) int {
+	v = max(0, min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
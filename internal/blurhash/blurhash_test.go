@@ -0,0 +1,93 @@
+package blurhash
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func gradient() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 24))
+	for y := range 24 {
+		for x := range 32 {
+			img.Set(x, y, color.NRGBA{uint8(x * 8), uint8(y * 10), uint8(255 - x*4 - y*3), 255})
+		}
+	}
+	return img
+}
+
+// split is red over blue, taller than wide.
+func split() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 20, 30))
+	draw.Draw(img, image.Rect(0, 0, 20, 15), image.NewUniform(color.NRGBA{200, 40, 40, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 15, 20, 30), image.NewUniform(color.NRGBA{30, 60, 180, 255}), image.Point{}, draw.Src)
+	return img
+}
+
+func solid(c color.Color) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+// The hashes are the ones the reference encoder gives for the same images.
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name string
+		img  image.Image
+		x, y int
+		want string
+	}{
+		{"gradient 4x3", gradient(), 4, 3, "LxH2812yw#XAmLWZjuf8gLfkfQfk"},
+		{"gradient 9x9", gradient(), 9, 9, "|xH2812yw#XAa~ogWrogWrmLWZjuf8fRf8fRf8fRgLfkfQfkfQfjfQfjfQn-WrjufRfRfRfRfRfRe?fRfQfQfQfQfQfQfQogWrjufRfRfRfQfRfQe?fRfQfQfQfQfQfQfQogWrjufRfRfRfQfRfQesfRfQfQfQfQfQfQfQ"},
+		{"gradient 1x1", gradient(), 1, 1, "00H281"},
+		{"split 3x4", split(), 3, 4, "T#G};OspfQ{]n~fQs9jsfQJ;a}fQ"},
+		{"black 4x3", solid(color.Black), 4, 3, "L00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{"white 1x1", solid(color.White), 1, 1, "00TSUA"},
+	}
+	for _, tt := range tests {
+		got, err := Encode(tt.img, tt.x, tt.y)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("%s: Encode = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		img  image.Image
+		x, y int
+	}{
+		{"no components", gradient(), 0, 3},
+		{"too many components", gradient(), 4, 10},
+		{"empty image", image.NewNRGBA(image.Rect(0, 0, 0, 5)), 4, 3},
+	}
+	for _, tt := range tests {
+		if _, err := Encode(tt.img, tt.x, tt.y); err == nil {
+			t.Errorf("%s: Encode succeeded", tt.name)
+		}
+	}
+}
+
+func TestComponents(t *testing.T) {
+	tests := []struct {
+		width, height, n int
+		x, y             int
+	}{
+		{400, 300, 4, 4, 3},
+		{300, 400, 4, 3, 4},
+		{500, 500, 4, 4, 4},
+		{4000, 100, 4, 4, 1},
+		{100, 4000, 9, 1, 9},
+		{0, 300, 4, 4, 4},
+	}
+	for _, tt := range tests {
+		if x, y := Components(tt.width, tt.height, tt.n); x != tt.x || y != tt.y {
+			t.Errorf("Components(%d, %d, %d) = %d, %d, want %d, %d", tt.width, tt.height, tt.n, x, y, tt.x, tt.y)
+		}
+	}
+}
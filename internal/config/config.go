@@ -0,0 +1,471 @@
+// Package config is the configuration of the web app, which the ops tools
+// read too, so that they see the same settings as the server does.
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/storage"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/thumbnail"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting the web app reads at startup. Values are
+// layered, each overriding the last: built-in defaults, the optional config
+// file (YAML or TOML, chosen by extension), PORTFOLIO_* environment variables
+// and finally command-line flags.
+type Config struct {
+	Port         int           `yaml:"port" toml:"port"`
+	DatabasePath string        `yaml:"database_path" toml:"database_path"`
+	ServeDir     string        `yaml:"serve_dir" toml:"serve_dir"`
+	StaticDir    string        `yaml:"static_dir" toml:"static_dir"`
+	ReadTimeout  time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests get to finish after
+	// SIGTERM or SIGINT before their connections are closed.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// ValidateAPI checks every /api/v1 request and response against the
+	// OpenAPI document and logs what does not match. It costs a copy of
+	// each body, so it is meant for development and staging.
+	ValidateAPI bool `yaml:"validate_api" toml:"validate_api"`
+	// ReapplyWatermarks queues the watermarked thumbnails of every photo to
+	// be made again on startup. It is a flag only.
+	ReapplyWatermarks bool `yaml:"-" toml:"-"`
+	// Fsck checks storage against the database, prints what it finds and
+	// exits instead of serving; FsckRepair also repairs it. Flags only.
+	Fsck       bool `yaml:"-" toml:"-"`
+	FsckRepair bool `yaml:"-" toml:"-"`
+
+	Storage    StorageConfig      `yaml:"storage" toml:"storage"`
+	Uploads    UploadConfig       `yaml:"uploads" toml:"uploads"`
+	Jobs       JobsConfig         `yaml:"jobs" toml:"jobs"`
+	Images     ImagesConfig       `yaml:"images" toml:"images"`
+	Duplicates DuplicatesConfig   `yaml:"duplicates" toml:"duplicates"`
+	Thumbnails []thumbnail.Config `yaml:"thumbnails" toml:"thumbnails"`
+}
+
+// StorageConfig selects where uploads are kept. The local backend stores
+// them under ServeDir.
+type StorageConfig struct {
+	Backend string   `yaml:"backend" toml:"backend"`
+	S3      S3Config `yaml:"s3" toml:"s3"`
+	// FSMode says how /fs/ serves files from a backend with direct URLs:
+	// "proxy" streams them through the app, "redirect" sends the browser to
+	// a presigned URL valid for URLExpiry.
+	FSMode    string        `yaml:"fs_mode" toml:"fs_mode"`
+	URLExpiry time.Duration `yaml:"url_expiry" toml:"url_expiry"`
+	// ProtectOriginals keeps the original files of visual photos from
+	// anyone not logged in; they only get the thumbnails.
+	ProtectOriginals bool `yaml:"protect_originals" toml:"protect_originals"`
+}
+
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint" toml:"endpoint"`
+	Bucket          string `yaml:"bucket" toml:"bucket"`
+	Region          string `yaml:"region" toml:"region"`
+	AccessKeyID     string `yaml:"access_key_id" toml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key" toml:"secret_access_key"`
+	Insecure        bool   `yaml:"insecure" toml:"insecure"`
+	Prefix          string `yaml:"prefix" toml:"prefix"`
+}
+
+// JobsConfig sizes the background job queue that generates thumbnails.
+type JobsConfig struct {
+	Workers     int `yaml:"workers" toml:"workers"`
+	MaxAttempts int `yaml:"max_attempts" toml:"max_attempts"`
+	// PollInterval is how often idle workers look for jobs that are due for
+	// a retry; new jobs wake them immediately.
+	PollInterval time.Duration `yaml:"poll_interval" toml:"poll_interval"`
+}
+
+// ImagesConfig controls the /img/ endpoint that resizes images on demand.
+type ImagesConfig struct {
+	// SigningKey signs /img/ URLs. Empty means a key generated on first
+	// start and kept in the database.
+	SigningKey string `yaml:"signing_key" toml:"signing_key"`
+	// CacheDir holds the resized variants, on local disk whatever the
+	// storage backend. Variants not made for CacheMaxAge are removed.
+	CacheDir    string        `yaml:"cache_dir" toml:"cache_dir"`
+	CacheMaxAge time.Duration `yaml:"cache_max_age" toml:"cache_max_age"`
+	// MaxDimension caps the width and height that can be asked for.
+	MaxDimension int `yaml:"max_dimension" toml:"max_dimension"`
+	Quality      int `yaml:"quality" toml:"quality"`
+}
+
+// DuplicatesConfig says what happens to an uploaded photo that looks like
+// one already on the site.
+type DuplicatesConfig struct {
+	// Action is "warn" to accept it and say so, "reject" to refuse the whole
+	// upload, or "off" not to look.
+	Action string `yaml:"action" toml:"action"`
+	// Scope is "visual" to compare with the photos of the same visual only,
+	// or "site" to compare with every photo.
+	Scope string `yaml:"scope" toml:"scope"`
+	// Threshold is how many of the 64 bits of their perceptual hashes two
+	// photos may differ in and still count as the same. Identical files
+	// always do.
+	Threshold int `yaml:"threshold" toml:"threshold"`
+}
+
+type UploadConfig struct {
+	// CoverMaxBytes caps the cover upload request.
+	CoverMaxBytes int64 `yaml:"cover_max_bytes" toml:"cover_max_bytes"`
+	// VisualFormMaxBytes caps a whole visual create or edit request, all
+	// photos included; PhotoMaxBytes applies to each photo in it.
+	VisualFormMaxBytes int64 `yaml:"visual_form_max_bytes" toml:"visual_form_max_bytes"`
+	PhotoMaxBytes      int64 `yaml:"photo_max_bytes" toml:"photo_max_bytes"`
+	PortfolioMaxBytes  int64 `yaml:"portfolio_max_bytes" toml:"portfolio_max_bytes"`
+
+	AllowedImageTypes []string `yaml:"allowed_image_types" toml:"allowed_image_types"`
+}
+
+// requiredThumbnails are the sizes the templates and the photo API link to.
+var requiredThumbnails = []string{"mini", "small", "medium", "large"}
+
+// DuplicateActions are the values of duplicates.action.
+var DuplicateActions = []string{"warn", "reject", "off"}
+
+// Default returns the built-in settings.
+func Default() *Config {
+	return &Config{
+		Port:         8080,
+		DatabasePath: "./data/sqlite.DB",
+		ServeDir:     "data/serve",
+		StaticDir:    "static",
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  2 * time.Minute,
+		// Below docker's default 10s stop grace period, so the drain finishes
+		// before the container is killed.
+		ShutdownTimeout: 8 * time.Second,
+		Storage: StorageConfig{
+			Backend:   "local",
+			FSMode:    "proxy",
+			URLExpiry: 15 * time.Minute,
+		},
+		Uploads: UploadConfig{
+			CoverMaxBytes:      2 << 20,
+			VisualFormMaxBytes: 10 << 20,
+			PhotoMaxBytes:      2_000_000,
+			PortfolioMaxBytes:  10_000_000,
+			AllowedImageTypes:  []string{"image/jpeg", "image/png", "image/heic", "image/heif", "image/webp"},
+		},
+		Jobs: JobsConfig{
+			Workers:      2,
+			MaxAttempts:  5,
+			PollInterval: 5 * time.Second,
+		},
+		Images: ImagesConfig{
+			CacheDir:     "data/cache/images",
+			CacheMaxAge:  30 * 24 * time.Hour,
+			MaxDimension: 2400,
+			Quality:      80,
+		},
+		Duplicates: DuplicatesConfig{
+			Action:    "warn",
+			Scope:     "visual",
+			Threshold: 6,
+		},
+		Thumbnails: thumbnail.Defaults(),
+	}
+}
+
+// Load returns the defaults overridden by the config file at path, if path
+// is not empty, and then by the PORTFOLIO_* environment variables. The
+// result is not validated yet, since flags may still override it.
+func Load(path string, getenv func(string) string) (*Config, error) {
+	c := Default()
+	if path != "" {
+		if err := c.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.ApplyEnv(getenv); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadFile reads a YAML or TOML file, chosen by extension, over c. Keys
+// that are not settings are an error.
+func (c *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(strings.NewReader(string(data)))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("config: %s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("config: %s: unknown key %q", path, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("config: %s: unsupported format %q, use .yaml, .yml or .toml", path, ext)
+	}
+	return nil
+}
+
+// ApplyEnv overrides c with the PORTFOLIO_* environment variables that are
+// set.
+func (c *Config) ApplyEnv(getenv func(string) string) error {
+	// SERVER_PORT predates the PORTFOLIO_ prefix and is still honoured.
+	for _, name := range []string{"SERVER_PORT", "PORTFOLIO_PORT"} {
+		if v := getenv(name); v != "" {
+			port, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("config: %s: %q is not a port number", name, v)
+			}
+			c.Port = port
+		}
+	}
+	if v := getenv("PORTFOLIO_DATABASE_PATH"); v != "" {
+		c.DatabasePath = v
+	}
+	if v := getenv("PORTFOLIO_SERVE_DIR"); v != "" {
+		c.ServeDir = v
+	}
+	if v := getenv("PORTFOLIO_STATIC_DIR"); v != "" {
+		c.StaticDir = v
+	}
+
+	values := []struct {
+		name string
+		dst  *string
+	}{
+		{"PORTFOLIO_STORAGE_BACKEND", &c.Storage.Backend},
+		{"PORTFOLIO_STORAGE_FS_MODE", &c.Storage.FSMode},
+		{"PORTFOLIO_S3_ENDPOINT", &c.Storage.S3.Endpoint},
+		{"PORTFOLIO_S3_BUCKET", &c.Storage.S3.Bucket},
+		{"PORTFOLIO_S3_REGION", &c.Storage.S3.Region},
+		{"PORTFOLIO_S3_ACCESS_KEY_ID", &c.Storage.S3.AccessKeyID},
+		{"PORTFOLIO_S3_SECRET_ACCESS_KEY", &c.Storage.S3.SecretAccessKey},
+		{"PORTFOLIO_S3_PREFIX", &c.Storage.S3.Prefix},
+		{"PORTFOLIO_IMAGE_SIGNING_KEY", &c.Images.SigningKey},
+		{"PORTFOLIO_IMAGE_CACHE_DIR", &c.Images.CacheDir},
+	}
+	for _, s := range values {
+		if v := getenv(s.name); v != "" {
+			*s.dst = v
+		}
+	}
+	if v := getenv("PORTFOLIO_JOB_WORKERS"); v != "" {
+		workers, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: PORTFOLIO_JOB_WORKERS: %q is not a number", v)
+		}
+		c.Jobs.Workers = workers
+	}
+	if v := getenv("PORTFOLIO_S3_INSECURE"); v != "" {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("config: PORTFOLIO_S3_INSECURE: %q is not a boolean", v)
+		}
+		c.Storage.S3.Insecure = insecure
+	}
+	if v := getenv("PORTFOLIO_PROTECT_ORIGINALS"); v != "" {
+		protect, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("config: PORTFOLIO_PROTECT_ORIGINALS: %q is not a boolean", v)
+		}
+		c.Storage.ProtectOriginals = protect
+	}
+	if v := getenv("PORTFOLIO_VALIDATE_API"); v != "" {
+		validate, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("config: PORTFOLIO_VALIDATE_API: %q is not a boolean", v)
+		}
+		c.ValidateAPI = validate
+	}
+
+	durations := []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"PORTFOLIO_READ_TIMEOUT", &c.ReadTimeout},
+		{"PORTFOLIO_WRITE_TIMEOUT", &c.WriteTimeout},
+		{"PORTFOLIO_IDLE_TIMEOUT", &c.IdleTimeout},
+		{"PORTFOLIO_SHUTDOWN_TIMEOUT", &c.ShutdownTimeout},
+		{"PORTFOLIO_STORAGE_URL_EXPIRY", &c.Storage.URLExpiry},
+	}
+	for _, d := range durations {
+		if v := getenv(d.name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("config: %s: %w", d.name, err)
+			}
+			*d.dst = parsed
+		}
+	}
+	return nil
+}
+
+// Validate reports every setting that is out of range or missing.
+func (c *Config) Validate() error {
+	var problems []string
+	if c.Port < 1 || c.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %d is out of range", c.Port))
+	}
+	if c.DatabasePath == "" {
+		problems = append(problems, "database_path is empty")
+	}
+	if c.ServeDir == "" {
+		problems = append(problems, "serve_dir is empty")
+	}
+	switch c.Storage.Backend {
+	case "local":
+	case "s3":
+		if c.Storage.S3.Endpoint == "" {
+			problems = append(problems, "storage.s3.endpoint is empty")
+		}
+		if c.Storage.S3.Bucket == "" {
+			problems = append(problems, "storage.s3.bucket is empty")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("storage.backend %q is not one of local, s3", c.Storage.Backend))
+	}
+	if c.Storage.FSMode != "proxy" && c.Storage.FSMode != "redirect" {
+		problems = append(problems, fmt.Sprintf("storage.fs_mode %q is not one of proxy, redirect", c.Storage.FSMode))
+	}
+	if c.Images.CacheDir == "" {
+		problems = append(problems, "images.cache_dir is empty")
+	}
+	if c.Images.Quality < 1 || c.Images.Quality > 100 {
+		problems = append(problems, "images.quality must be between 1 and 100")
+	}
+	if !slices.Contains(DuplicateActions, c.Duplicates.Action) {
+		problems = append(problems, fmt.Sprintf("duplicates.action %q is not one of %s", c.Duplicates.Action, strings.Join(DuplicateActions, ", ")))
+	}
+	if c.Duplicates.Scope != "visual" && c.Duplicates.Scope != "site" {
+		problems = append(problems, fmt.Sprintf("duplicates.scope %q is not one of visual, site", c.Duplicates.Scope))
+	}
+	if c.Duplicates.Threshold < 0 || c.Duplicates.Threshold > 64 {
+		problems = append(problems, "duplicates.threshold must be between 0 and 64")
+	}
+	u := c.Uploads
+	positive := []struct {
+		name  string
+		value int64
+	}{
+		{"read_timeout", int64(c.ReadTimeout)},
+		{"write_timeout", int64(c.WriteTimeout)},
+		{"idle_timeout", int64(c.IdleTimeout)},
+		{"shutdown_timeout", int64(c.ShutdownTimeout)},
+		{"storage.url_expiry", int64(c.Storage.URLExpiry)},
+		{"jobs.workers", int64(c.Jobs.Workers)},
+		{"jobs.max_attempts", int64(c.Jobs.MaxAttempts)},
+		{"jobs.poll_interval", int64(c.Jobs.PollInterval)},
+		{"images.cache_max_age", int64(c.Images.CacheMaxAge)},
+		{"images.max_dimension", int64(c.Images.MaxDimension)},
+		{"uploads.cover_max_bytes", u.CoverMaxBytes},
+		{"uploads.visual_form_max_bytes", u.VisualFormMaxBytes},
+		{"uploads.photo_max_bytes", u.PhotoMaxBytes},
+		{"uploads.portfolio_max_bytes", u.PortfolioMaxBytes},
+	}
+	for _, p := range positive {
+		if p.value <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be positive", p.name))
+		}
+	}
+	if len(u.AllowedImageTypes) == 0 {
+		problems = append(problems, "uploads.allowed_image_types is empty")
+	}
+	for _, t := range u.AllowedImageTypes {
+		if !strings.HasPrefix(t, "image/") {
+			problems = append(problems, fmt.Sprintf("uploads.allowed_image_types: %q is not an image type", t))
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, t := range c.Thumbnails {
+		if seen[t.Name] {
+			problems = append(problems, fmt.Sprintf("thumbnail %q is defined twice", t.Name))
+		}
+		seen[t.Name] = true
+		for _, p := range t.Validate() {
+			problems = append(problems, fmt.Sprintf("thumbnail %q: %s", t.Name, p))
+		}
+	}
+	for _, name := range requiredThumbnails {
+		if !seen[name] {
+			problems = append(problems, fmt.Sprintf("thumbnail %q is required", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Addr is the listen address for http.Server.
+func (c *Config) Addr() string {
+	return ":" + strconv.Itoa(c.Port)
+}
+
+// AllowedImageTypes returns uploads.allowed_image_types as a set.
+func (c *Config) AllowedImageTypes() map[string]bool {
+	types := make(map[string]bool, len(c.Uploads.AllowedImageTypes))
+	for _, t := range c.Uploads.AllowedImageTypes {
+		types[t] = true
+	}
+	return types
+}
+
+// Print writes the configuration as YAML, in the format LoadFile accepts.
+// Secrets are masked.
+func (c *Config) Print(w io.Writer) error {
+	masked := *c
+	if masked.Storage.S3.SecretAccessKey != "" {
+		masked.Storage.S3.SecretAccessKey = "<redacted>"
+	}
+	if masked.Images.SigningKey != "" {
+		masked.Images.SigningKey = "<redacted>"
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(masked); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	return enc.Close()
+}
+
+// NewStorage opens the storage backend c selects. The local backend keeps
+// files under serveDir, which is normally c.ServeDir.
+func (c StorageConfig) NewStorage(ctx context.Context, serveDir string) (storage.Storage, error) {
+	switch c.Backend {
+	case "s3":
+		return storage.NewS3(ctx, storage.S3Config{
+			Endpoint:        c.S3.Endpoint,
+			Bucket:          c.S3.Bucket,
+			Region:          c.S3.Region,
+			AccessKeyID:     c.S3.AccessKeyID,
+			SecretAccessKey: c.S3.SecretAccessKey,
+			Insecure:        c.S3.Insecure,
+			Prefix:          c.S3.Prefix,
+		})
+	case "local":
+		return storage.NewLocal(serveDir)
+	default:
+		return nil, fmt.Errorf("config: unknown storage backend %q", c.Backend)
+	}
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func env(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": "port: 9000\nread_timeout: 20s\nstorage:\n  s3:\n    bucket: from-file\njobs:\n  workers: 4\n",
+		"config.toml": "port = 9000\nread_timeout = \"20s\"\n[storage.s3]\nbucket = \"from-file\"\n[jobs]\nworkers = 4\n",
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := writeFile(t, name, content)
+			c, err := Load(path, env(map[string]string{
+				"PORTFOLIO_PORT":         "9100",
+				"PORTFOLIO_S3_BUCKET":    "from-env",
+				"PORTFOLIO_READ_TIMEOUT": "",
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Port != 9100 {
+				t.Errorf("port = %d, want the environment's 9100", c.Port)
+			}
+			if c.Storage.S3.Bucket != "from-env" {
+				t.Errorf("bucket = %q, want the environment's", c.Storage.S3.Bucket)
+			}
+			if c.ReadTimeout != 20*time.Second || c.Jobs.Workers != 4 {
+				t.Errorf("read_timeout %v, workers %d; want the file's 20s and 4", c.ReadTimeout, c.Jobs.Workers)
+			}
+			if c.WriteTimeout != Default().WriteTimeout || len(c.Thumbnails) != len(Default().Thumbnails) {
+				t.Error("settings the file does not mention lost their defaults")
+			}
+			if err := c.Validate(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestLoadFileRejectsUnknownKeys(t *testing.T) {
+	files := map[string]string{
+		"typo.yaml":   "prot: 9000\n",
+		"nested.yml":  "storage:\n  backned: s3\n",
+		"typo.toml":   "prot = 9000\n",
+		"nested.toml": "[storage]\nbackned = \"s3\"\n",
+		"config.json": "{}",
+	}
+	for name, content := range files {
+		if err := Default().LoadFile(writeFile(t, name, content)); err == nil {
+			t.Errorf("%s: LoadFile succeeded", name)
+		}
+	}
+	if err := Default().LoadFile(writeFile(t, "empty.yaml", "")); err != nil {
+		t.Errorf("empty file: %v", err)
+	}
+}
+
+func TestApplyEnvRejectsBadValues(t *testing.T) {
+	tests := map[string]string{
+		"SERVER_PORT":                 "eighty",
+		"PORTFOLIO_PORT":              "8080x",
+		"PORTFOLIO_JOB_WORKERS":       "many",
+		"PORTFOLIO_S3_INSECURE":       "sometimes",
+		"PORTFOLIO_PROTECT_ORIGINALS": "maybe",
+		"PORTFOLIO_VALIDATE_API":      "2",
+		"PORTFOLIO_WRITE_TIMEOUT":     "10",
+	}
+	for name, value := range tests {
+		err := Default().ApplyEnv(env(map[string]string{name: value}))
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s=%q: %v, want an error naming the variable", name, value, err)
+		}
+	}
+
+	// PORTFOLIO_PORT is newer and wins over SERVER_PORT.
+	c := Default()
+	if err := c.ApplyEnv(env(map[string]string{"SERVER_PORT": "8081", "PORTFOLIO_PORT": "8082"})); err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 8082 {
+		t.Errorf("port = %d, want 8082", c.Port)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+
+	c := Default()
+	c.Port = 0
+	c.Storage.Backend = "s3"
+	c.Duplicates.Action = "ignore"
+	c.Jobs.Workers = 0
+	c.Uploads.AllowedImageTypes = []string{"text/plain"}
+	c.Thumbnails = c.Thumbnails[1:]
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("Validate succeeded")
+	}
+	for _, want := range []string{
+		"port 0",
+		"storage.s3.endpoint",
+		"storage.s3.bucket",
+		`duplicates.action "ignore"`,
+		"jobs.workers",
+		`"text/plain"`,
+		"is required",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %s:\n%v", want, err)
+		}
+	}
+}
+
+func TestPrintMasksSecrets(t *testing.T) {
+	c := Default()
+	c.Storage.S3.SecretAccessKey = "s3cr3t"
+	c.Images.SigningKey = "k3y"
+	var b strings.Builder
+	if err := c.Print(&b); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), "s3cr3t") || strings.Contains(b.String(), "k3y") {
+		t.Errorf("secrets printed:\n%s", b.String())
+	}
+
+	// What it prints loads back.
+	path := writeFile(t, "printed.yaml", b.String())
+	if err := Default().LoadFile(path); err != nil {
+		t.Error(err)
+	}
+}
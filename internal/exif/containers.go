@@ -0,0 +1,511 @@
+package exif
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// found collects the metadata a container walk turns up: EXIF TIFF
+// structures and XMP packets, as slices of the file (or of a copy, for
+// metadata stored compressed or in pieces) to be read and scrubbed in place.
+type found struct {
+	tiffs [][]byte
+	xmps  [][]byte
+	// blanks are filled with spaces unread, like the parts of an extended
+	// XMP packet.
+	blanks [][]byte
+	// after write copies back into the file once scrubbed.
+	after []func()
+}
+
+func (f *found) addTIFF(b []byte) {
+	if len(b) >= 8 && isTIFFHeader(b[:4]) {
+		f.tiffs = append(f.tiffs, b)
+	}
+}
+
+// process reads m from what was found and scrubs it. EXIF comes first:
+// XMP only fills in what EXIF left out.
+func (f *found) process(m *Metadata) {
+	for _, b := range f.tiffs {
+		t := &tiff{data: b}
+		t.read(m)
+		t.scrub()
+	}
+	for _, b := range f.xmps {
+		processXMP(b, m)
+	}
+	for _, b := range f.blanks {
+		blank(b)
+	}
+	for _, fn := range f.after {
+		fn()
+	}
+}
+
+var (
+	jpegSOI = []byte{0xFF, 0xD8}
+	// The APP1 segments that hold EXIF, an XMP packet and a part of an
+	// extended XMP packet start with these.
+	jpegExif        = []byte("Exif\x00\x00")
+	jpegXMP         = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegExtendedXMP = []byte("http://ns.adobe.com/xmp/extension/\x00")
+)
+
+// walkJPEG finds the APP1 segments before the first scan. What follows
+// SOS is entropy-coded image data and is never looked at.
+func walkJPEG(data []byte, f *found) {
+	for pos := len(jpegSOI); pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return
+		}
+		marker := data[pos+1]
+		switch {
+		case marker == 0xFF: // fill byte
+			pos++
+			continue
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD7: // no length
+			pos += 2
+			continue
+		case marker == 0xD9 || marker == 0xDA: // EOI, SOS
+			return
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end < pos+4 || end > len(data) {
+			return
+		}
+		if marker == 0xE1 {
+			payload := data[pos+4 : end]
+			switch {
+			case bytes.HasPrefix(payload, jpegExif):
+				f.addTIFF(payload[len(jpegExif):])
+			case bytes.HasPrefix(payload, jpegXMP):
+				f.xmps = append(f.xmps, payload[len(jpegXMP):])
+			case bytes.HasPrefix(payload, jpegExtendedXMP):
+				// A 32-byte GUID, the full length and this part's offset
+				// precede the part itself.
+				if part := payload[len(jpegExtendedXMP):]; len(part) > 40 {
+					f.blanks = append(f.blanks, part[40:])
+				}
+			}
+		}
+		pos = end
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngXMPKeyword is the keyword of the iTXt chunk holding XMP.
+const pngXMPKeyword = "XML:com.adobe.xmp"
+
+// pngChunk is a chunk of a PNG file: its type and data, as slices of the
+// file.
+type pngChunk struct {
+	typ, data []byte
+	// start and end span the whole chunk, length to CRC.
+	start, end int
+}
+
+func pngChunks(data []byte) []pngChunk {
+	var chunks []pngChunk
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			break
+		}
+		chunks = append(chunks, pngChunk{typ: data[pos+4 : pos+8], data: data[pos+8 : end-4], start: pos, end: end})
+		pos = end
+	}
+	return chunks
+}
+
+// processPNG reads and scrubs the eXIf chunk and XMP iTXt chunks. The
+// checksums of the chunks it changes are recomputed; a compressed iTXt
+// chunk is compressed again, which changes its length, so the file is
+// returned rather than changed in place.
+func processPNG(data []byte, m *Metadata) []byte {
+	var f found
+	var touched []pngChunk
+	// replaced holds the new contents of compressed iTXt chunks, by start.
+	replaced := map[int]*[]byte{}
+	for _, c := range pngChunks(data) {
+		switch string(c.typ) {
+		case "eXIf":
+			f.addTIFF(c.data)
+			touched = append(touched, c)
+		case "iTXt":
+			text, compressed, ok := pngXMP(c.data)
+			if !ok {
+				continue
+			}
+			if !compressed {
+				f.xmps = append(f.xmps, text)
+				touched = append(touched, c)
+				continue
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(text))
+			if err != nil {
+				continue
+			}
+			packet, err := io.ReadAll(zr)
+			if err != nil {
+				continue
+			}
+			f.xmps = append(f.xmps, packet)
+			header := c.data[:len(c.data)-len(text)]
+			chunk := new([]byte)
+			replaced[c.start] = chunk
+			f.after = append(f.after, func() {
+				var body bytes.Buffer
+				body.Write(header)
+				zw := zlib.NewWriter(&body)
+				zw.Write(packet)
+				zw.Close()
+				*chunk = pngChunkBytes(c.typ, body.Bytes())
+			})
+		}
+	}
+	f.process(m)
+
+	for _, c := range touched {
+		binary.BigEndian.PutUint32(data[c.end-4:], crc32.ChecksumIEEE(data[c.start+4:c.end-4]))
+	}
+	if len(replaced) == 0 {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:len(pngSignature)]...)
+	last := len(pngSignature)
+	for _, c := range pngChunks(data) {
+		if chunk, ok := replaced[c.start]; ok {
+			out = append(out, *chunk...)
+		} else {
+			out = append(out, data[c.start:c.end]...)
+		}
+		last = c.end
+	}
+	return append(out, data[last:]...)
+}
+
+// pngXMP returns the text of an iTXt chunk holding XMP and whether it is
+// compressed.
+func pngXMP(chunk []byte) (text []byte, compressed, ok bool) {
+	keyword, rest, ok := bytes.Cut(chunk, []byte{0})
+	if !ok || string(keyword) != pngXMPKeyword || len(rest) < 2 {
+		return nil, false, false
+	}
+	compressed = rest[0] == 1
+	// The language tag and translated keyword follow the compression
+	// flag and method.
+	rest = rest[2:]
+	for range 2 {
+		if _, rest, ok = bytes.Cut(rest, []byte{0}); !ok {
+			return nil, false, false
+		}
+	}
+	return rest, compressed, true
+}
+
+func pngChunkBytes(typ, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	b = append(b, typ...)
+	b = append(b, data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// walkWebP finds the EXIF and XMP chunks of an extended WebP file.
+func walkWebP(data []byte, f *found) {
+	size := int(binary.LittleEndian.Uint32(data[4:]))
+	end := min(8+size, len(data))
+	for pos := 12; pos+8 <= end; {
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		next := pos + 8 + length + length%2
+		if length < 0 || pos+8+length > end {
+			return
+		}
+		payload := data[pos+8 : pos+8+length]
+		switch string(data[pos : pos+4]) {
+		case "EXIF":
+			// Some writers keep the JPEG APP1 prefix.
+			f.addTIFF(bytes.TrimPrefix(payload, jpegExif))
+		case "XMP ":
+			f.xmps = append(f.xmps, payload)
+		}
+		pos = next
+	}
+}
+
+// box is an ISO base media file format box: its type and contents.
+type box struct {
+	typ  string
+	data []byte
+}
+
+// boxes splits data into boxes.
+func boxes(data []byte) []box {
+	var bs []box
+	for pos := 0; pos+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		header := 8
+		switch size {
+		case 0:
+			size = len(data) - pos
+		case 1:
+			if pos+16 > len(data) {
+				return bs
+			}
+			large := binary.BigEndian.Uint64(data[pos+8:])
+			if large > uint64(len(data)-pos) {
+				return bs
+			}
+			size, header = int(large), 16
+		}
+		if size < header || pos+size > len(data) {
+			return bs
+		}
+		bs = append(bs, box{typ: string(data[pos+4 : pos+8]), data: data[pos+header : pos+size]})
+		pos += size
+	}
+	return bs
+}
+
+func isHEIF(data []byte) bool {
+	return len(data) >= 12 && string(data[4:8]) == "ftyp"
+}
+
+// heifItem is an item of a HEIF file's meta box.
+type heifItem struct {
+	typ, contentType string
+	// construction is 0 for data in the file, 1 for data in the idat box.
+	construction int
+	extents      [][2]int
+}
+
+// walkHEIF finds the Exif item and XMP items (mime items of type
+// application/rdf+xml) of a HEIF file, such as HEIC or AVIF.
+func walkHEIF(data []byte, f *found) {
+	var meta *box
+	for _, b := range boxes(data) {
+		if b.typ == "meta" && len(b.data) >= 4 {
+			meta = &b
+			break
+		}
+	}
+	if meta == nil {
+		return
+	}
+	items := map[uint32]*heifItem{}
+	var idat *box
+	children := boxes(meta.data[4:])
+	for _, b := range children {
+		switch b.typ {
+		case "iinf":
+			readIINF(b.data, items)
+		case "idat":
+			idat = &b
+		}
+	}
+	for _, b := range children {
+		if b.typ == "iloc" {
+			readILOC(b.data, items)
+		}
+	}
+
+	for _, item := range items {
+		var base []byte
+		switch item.construction {
+		case 0:
+			base = data
+		case 1:
+			if idat == nil {
+				continue
+			}
+			base = idat.data
+		default:
+			continue
+		}
+		b, ok := itemData(base, item.extents, f)
+		if !ok {
+			continue
+		}
+		switch {
+		case item.typ == "Exif":
+			// The item starts with the offset of the TIFF header from
+			// the end of the offset itself.
+			if len(b) < 4 {
+				continue
+			}
+			skip := int(binary.BigEndian.Uint32(b))
+			if skip < 0 || 4+skip > len(b) {
+				continue
+			}
+			f.addTIFF(b[4+skip:])
+		case item.typ == "mime" && item.contentType == "application/rdf+xml":
+			f.xmps = append(f.xmps, b)
+		}
+	}
+}
+
+// itemData returns an item's data. An item in several extents is copied
+// together, and copied back once scrubbed.
+func itemData(base []byte, extents [][2]int, f *found) ([]byte, bool) {
+	for _, e := range extents {
+		if e[0] < 0 || e[1] <= 0 || e[0]+e[1] > len(base) {
+			return nil, false
+		}
+	}
+	switch len(extents) {
+	case 0:
+		return nil, false
+	case 1:
+		e := extents[0]
+		return base[e[0] : e[0]+e[1]], true
+	}
+	var joined []byte
+	for _, e := range extents {
+		joined = append(joined, base[e[0]:e[0]+e[1]]...)
+	}
+	f.after = append(f.after, func() {
+		rest := joined
+		for _, e := range extents {
+			rest = rest[copy(base[e[0]:e[0]+e[1]], rest):]
+		}
+	})
+	return joined, true
+}
+
+// readIINF reads the item types from an item info box.
+func readIINF(data []byte, items map[uint32]*heifItem) {
+	if len(data) < 6 {
+		return
+	}
+	skip := 6
+	if data[0] != 0 {
+		skip = 8
+	}
+	if skip > len(data) {
+		return
+	}
+	for _, b := range boxes(data[skip:]) {
+		// Versions 0 and 1 of infe predate item types.
+		if b.typ != "infe" || len(b.data) < 4 || b.data[0] < 2 {
+			continue
+		}
+		r := reader{data: b.data[4:]}
+		var id uint32
+		if b.data[0] == 2 {
+			id = uint32(r.uint(2))
+		} else {
+			id = uint32(r.uint(4))
+		}
+		r.uint(2) // protection index
+		item := &heifItem{typ: string(r.bytes(4))}
+		r.cstring() // name
+		if item.typ == "mime" {
+			item.contentType = r.cstring()
+		}
+		if r.err {
+			continue
+		}
+		items[id] = item
+	}
+}
+
+// readILOC reads where the items of items are from an item location box.
+func readILOC(data []byte, items map[uint32]*heifItem) {
+	if len(data) < 4 {
+		return
+	}
+	version := data[0]
+	r := reader{data: data[4:]}
+	sizes := r.uint(1)
+	offsetSize, lengthSize := sizes>>4, sizes&0xF
+	sizes = r.uint(1)
+	baseOffsetSize, indexSize := sizes>>4, 0
+	if version == 1 || version == 2 {
+		indexSize = sizes & 0xF
+	}
+	var count int
+	if version < 2 {
+		count = r.uint(2)
+	} else {
+		count = r.uint(4)
+	}
+	for range count {
+		var id uint32
+		if version < 2 {
+			id = uint32(r.uint(2))
+		} else {
+			id = uint32(r.uint(4))
+		}
+		construction := 0
+		if version == 1 || version == 2 {
+			construction = r.uint(2) & 0xF
+		}
+		r.uint(2) // data reference index
+		base := r.uint(baseOffsetSize)
+		var extents [][2]int
+		for range r.uint(2) {
+			r.uint(indexSize)
+			offset := r.uint(offsetSize)
+			length := r.uint(lengthSize)
+			extents = append(extents, [2]int{base + offset, length})
+		}
+		if r.err {
+			return
+		}
+		if item := items[id]; item != nil {
+			item.construction = construction
+			item.extents = extents
+		}
+	}
+}
+
+// reader reads big-endian fields, remembering if it ran out of data.
+type reader struct {
+	data []byte
+	err  bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if n > len(r.data) {
+		r.err = true
+		r.data = nil
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// uint reads an n-byte unsigned integer; n is 0, 1, 2, 4 or 8.
+func (r *reader) uint(n int) int {
+	var v uint64
+	for _, c := range r.bytes(n) {
+		v = v<<8 | uint64(c)
+	}
+	if v > 1<<48 {
+		r.err = true
+		return 0
+	}
+	return int(v)
+}
+
+func (r *reader) cstring() string {
+	s, rest, ok := bytes.Cut(r.data, []byte{0})
+	if !ok {
+		r.err = true
+		r.data = nil
+		return ""
+	}
+	r.data = rest
+	return string(s)
+}
@@ -0,0 +1,251 @@
+// Package exif reads the few EXIF and XMP fields the site shows about a
+// photo and scrubs the ones that give away more than the photo itself: where
+// it was taken and the serial numbers of the camera and lens.
+//
+// The metadata is found by walking the file's container, the segments of a
+// JPEG, the chunks of a PNG or WebP, the items of a HEIC, and never by
+// searching the image data, where any byte sequence can turn up. Scrubbing
+// overwrites values in place rather than rewriting the file, so every offset
+// in it stays valid and the image is untouched. The one exception is XMP in a
+// compressed PNG chunk, which has to be compressed again.
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// Metadata is what is kept of a photo's EXIF and XMP. Zero values mean the
+// file did not say.
+type Metadata struct {
+	// TakenAt is when the shutter fired, by the camera's clock. It is in
+	// UTC when the file records no time zone.
+	TakenAt     time.Time
+	CameraMake  string
+	CameraModel string
+	Lens        string
+	// Width and Height are the pixel dimensions as recorded, before
+	// Orientation is applied.
+	Width, Height int
+	// Orientation is the EXIF orientation, 1 to 8; 1 is upright.
+	Orientation int
+}
+
+// UprightSize returns Width and Height after applying Orientation.
+func (m Metadata) UprightSize() (width, height int) {
+	if m.Orientation >= 5 && m.Orientation <= 8 {
+		return m.Height, m.Width
+	}
+	return m.Width, m.Height
+}
+
+// TIFF tags used here.
+const (
+	tagMake               = 0x010F
+	tagModel              = 0x0110
+	tagOrientation        = 0x0112
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagMakerNote          = 0x927C
+	tagPixelXDimension    = 0xA002
+	tagPixelYDimension    = 0xA003
+	tagCameraOwnerName    = 0xA430
+	tagBodySerialNumber   = 0xA431
+	tagLensModel          = 0xA434
+	tagLensSerialNumber   = 0xA435
+)
+
+// scrubbedTags are blanked wherever they appear. Maker notes are opaque and
+// commonly hold serial numbers, and sometimes a location, so they go too.
+var scrubbedTags = map[uint16]bool{
+	tagCameraOwnerName:  true,
+	tagBodySerialNumber: true,
+	tagLensSerialNumber: true,
+	tagMakerNote:        true,
+}
+
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// Process returns the metadata of the image file in data and the file with
+// it scrubbed. That is data itself, scrubbed in place, except for a PNG whose
+// XMP is compressed. Files without EXIF or XMP are left as they are.
+func Process(data []byte) ([]byte, Metadata) {
+	var m Metadata
+	var f found
+	switch {
+	case bytes.HasPrefix(data, jpegSOI):
+		walkJPEG(data, &f)
+	case bytes.HasPrefix(data, pngSignature):
+		return processPNG(data, &m), m
+	case isWebP(data):
+		walkWebP(data, &f)
+	case isHEIF(data):
+		walkHEIF(data, &f)
+	}
+	f.process(&m)
+	return data, m
+}
+
+func isTIFFHeader(b []byte) bool {
+	return bytes.Equal(b, []byte("MM\x00*")) || bytes.Equal(b, []byte("II*\x00"))
+}
+
+// tiff is an EXIF TIFF structure. All offsets in it are relative to its
+// start; anything pointing outside data is ignored.
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	tag, typ uint16
+	count    uint32
+	// pos is where the entry is, value where its value is.
+	pos, value int
+	size       int
+}
+
+var typeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+func (t *tiff) byteOrder() binary.ByteOrder {
+	if t.order == nil {
+		if t.data[0] == 'M' {
+			t.order = binary.BigEndian
+		} else {
+			t.order = binary.LittleEndian
+		}
+	}
+	return t.order
+}
+
+// ifd returns the entries of the IFD at off.
+func (t *tiff) ifd(off int) []ifdEntry {
+	order := t.byteOrder()
+	if off < 8 || off+2 > len(t.data) {
+		return nil
+	}
+	n := int(order.Uint16(t.data[off:]))
+	var entries []ifdEntry
+	for i := 0; i < n; i++ {
+		pos := off + 2 + 12*i
+		if pos+12 > len(t.data) {
+			break
+		}
+		e := ifdEntry{
+			tag:   order.Uint16(t.data[pos:]),
+			typ:   order.Uint16(t.data[pos+2:]),
+			count: order.Uint32(t.data[pos+4:]),
+			pos:   pos,
+			value: pos + 8,
+		}
+		size, ok := typeSizes[e.typ]
+		if !ok || e.count > uint32(len(t.data)) {
+			continue
+		}
+		e.size = size * int(e.count)
+		if e.size > 4 {
+			e.value = int(order.Uint32(t.data[pos+8:]))
+		}
+		if e.value < 0 || e.value+e.size > len(t.data) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (t *tiff) ifd0() int {
+	return int(t.byteOrder().Uint32(t.data[4:]))
+}
+
+func (t *tiff) subIFD(entries []ifdEntry, tag uint16) int {
+	for _, e := range entries {
+		if e.tag == tag && e.size == 4 {
+			return int(t.byteOrder().Uint32(t.data[e.value:]))
+		}
+	}
+	return 0
+}
+
+func (t *tiff) string(e ifdEntry) string {
+	return strings.TrimSpace(strings.TrimRight(string(t.data[e.value:e.value+e.size]), "\x00"))
+}
+
+func (t *tiff) uint(e ifdEntry) int {
+	switch {
+	case e.typ == 3 && e.count >= 1:
+		return int(t.byteOrder().Uint16(t.data[e.value:]))
+	case e.typ == 4 && e.count >= 1:
+		return int(t.byteOrder().Uint32(t.data[e.value:]))
+	}
+	return 0
+}
+
+func (t *tiff) read(m *Metadata) {
+	ifd0 := t.ifd(t.ifd0())
+	for _, e := range ifd0 {
+		switch e.tag {
+		case tagMake:
+			m.CameraMake = t.string(e)
+		case tagModel:
+			m.CameraModel = t.string(e)
+		case tagOrientation:
+			m.Orientation = t.uint(e)
+		}
+	}
+
+	var taken, offset string
+	for _, e := range t.ifd(t.subIFD(ifd0, tagExifIFD)) {
+		switch e.tag {
+		case tagDateTimeOriginal:
+			taken = t.string(e)
+		case tagOffsetTimeOriginal:
+			offset = t.string(e)
+		case tagLensModel:
+			m.Lens = t.string(e)
+		case tagPixelXDimension:
+			m.Width = t.uint(e)
+		case tagPixelYDimension:
+			m.Height = t.uint(e)
+		}
+	}
+	if taken != "" {
+		if offset != "" {
+			if at, err := time.Parse(exifDateLayout+"-07:00", taken+offset); err == nil {
+				m.TakenAt = at
+				return
+			}
+		}
+		if at, err := time.Parse(exifDateLayout, taken); err == nil {
+			m.TakenAt = at
+		}
+	}
+}
+
+// scrub empties the GPS IFD and blanks scrubbedTags.
+func (t *tiff) scrub() {
+	ifd0 := t.ifd(t.ifd0())
+	exifIFD := t.ifd(t.subIFD(ifd0, tagExifIFD))
+	for _, e := range append(ifd0, exifIFD...) {
+		if scrubbedTags[e.tag] {
+			clear(t.data[e.value : e.value+e.size])
+		}
+	}
+
+	gpsOffset := t.subIFD(ifd0, tagGPSIFD)
+	gps := t.ifd(gpsOffset)
+	if gps == nil {
+		return
+	}
+	for _, e := range gps {
+		clear(t.data[e.value : e.value+e.size])
+	}
+	// Leave an IFD with no entries, and no next IFD either: the zeroed entry
+	// table now reads as a next-IFD offset of 0.
+	n := int(t.byteOrder().Uint16(t.data[gpsOffset:]))
+	clear(t.data[gpsOffset:min(gpsOffset+2+12*n+4, len(t.data))])
+}
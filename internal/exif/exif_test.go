@@ -0,0 +1,250 @@
+package exif
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/gen2brain/webp"
+)
+
+//go:generate go run gen_testdata.go
+
+// private is what the fixtures say about where they were taken and which
+// camera took them, in EXIF and XMP.
+var private = []string{
+	"BODY-SN-0042",
+	"LENS-SN-0042",
+	"Jane Fixture",
+	"WGS-84-FIXTURE",
+	"GPSLatitude",
+	"GPSLongitude",
+	"LocationShown",
+	"Amsterdam",
+	"Prinsengracht",
+}
+
+// latitude is the GPSLatitude of the fixtures: 52/1, 22/1, 1234/100.
+var latitude = []uint32{52, 1, 22, 1, 1234, 100}
+
+var fixtureMetadata = Metadata{
+	TakenAt:     time.Date(2024, 5, 17, 14, 3, 21, 0, time.FixedZone("", 2*60*60)),
+	CameraMake:  "FixtureCam",
+	CameraModel: "FC-1",
+	Lens:        "FC 35mm F2",
+	Width:       48,
+	Height:      32,
+	Orientation: 6,
+}
+
+func TestProcess(t *testing.T) {
+	tests := []struct {
+		file string
+		want Metadata
+	}{
+		// Big-endian EXIF and XMP in APP1 segments.
+		{"gps.jpg", fixtureMetadata},
+		// Little-endian EXIF in eXIf, XMP in a compressed iTXt chunk.
+		{"gps.png", fixtureMetadata},
+		// EXIF without the lens, which comes from XMP that has no
+		// x:xmpmeta wrapper.
+		{"gps.webp", fixtureMetadata},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			original := readFixture(t, tt.file)
+			assertPrivate(t, original, true)
+
+			scrubbed, got := Process(bytes.Clone(original))
+			assertMetadata(t, got, tt.want)
+			assertPrivate(t, scrubbed, false)
+			assertSamePixels(t, original, scrubbed)
+
+			// What is kept is still there to be read.
+			if _, again := Process(bytes.Clone(scrubbed)); again.CameraMake != tt.want.CameraMake || again.TakenAt.IsZero() {
+				t.Errorf("scrubbed file lost its make or date: %+v", again)
+			}
+		})
+	}
+}
+
+func TestProcessLeavesImageDataAlone(t *testing.T) {
+	// The pixels of this uncompressed PNG spell out an XMP packet and EXIF
+	// headers.
+	original := readFixture(t, "pixels-like-metadata.png")
+	if !bytes.Contains(original, []byte("<x:xmpmeta")) || !bytes.Contains(original, []byte("Exif\x00\x00MM")) {
+		t.Fatal("fixture pixels do not look like metadata")
+	}
+	scrubbed, got := Process(bytes.Clone(original))
+	if got != (Metadata{}) {
+		t.Errorf("Process read %+v from pixels", got)
+	}
+	if !bytes.Equal(scrubbed, original) {
+		t.Error("Process changed the image data")
+	}
+}
+
+func TestProcessHEIF(t *testing.T) {
+	// HEIF has no encoder in the standard library, so this is a HEIF
+	// container around the JPEG fixture's EXIF and XMP, with no image in
+	// it. The Exif item is in two extents, as some writers split it.
+	jpg := readFixture(t, "gps.jpg")
+	exifEnd := 4 + int(binary.BigEndian.Uint16(jpg[4:]))
+	tiffData := jpg[4+2+len(jpegExif) : exifEnd]
+	xmpEnd := exifEnd + 2 + int(binary.BigEndian.Uint16(jpg[exifEnd+2:]))
+	xmp := jpg[exifEnd+4+len(jpegXMP) : xmpEnd]
+
+	exifItem := append([]byte{0, 0, 0, 6}, "Exif\x00\x00"...)
+	exifItem = append(exifItem, tiffData...)
+	half := len(exifItem) / 2
+	// mdat holds the first half of the Exif item, the XMP item, then the
+	// second half.
+	mdat := append(append(bytes.Clone(exifItem[:half]), xmp...), exifItem[half:]...)
+
+	ftyp := bmffBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	iinf := bmffBox("iinf", concat([]byte{0, 0, 0, 0, 0, 2},
+		infe(1, "Exif", ""),
+		infe(2, "mime", "application/rdf+xml")))
+	meta := func(mdatStart int) []byte {
+		exifA := [2]int{mdatStart, half}
+		xmpExtent := [2]int{mdatStart + half, len(xmp)}
+		exifB := [2]int{mdatStart + half + len(xmp), len(exifItem) - half}
+		iloc := concat([]byte{0, 0, 0, 0, 0x44, 0x00, 0, 2},
+			ilocItem(1, exifA, exifB),
+			ilocItem(2, xmpExtent))
+		return bmffBox("meta", concat([]byte{0, 0, 0, 0}, iinf, bmffBox("iloc", iloc)))
+	}
+	start := len(ftyp) + len(meta(0)) + 8
+	original := concat(ftyp, meta(start), bmffBox("mdat", mdat))
+	assertPrivate(t, original, true)
+
+	scrubbed, got := Process(bytes.Clone(original))
+	assertMetadata(t, got, fixtureMetadata)
+	assertPrivate(t, scrubbed, false)
+	if len(scrubbed) != len(original) || !bytes.Equal(scrubbed[:start], original[:start]) {
+		t.Error("Process changed the file outside its items")
+	}
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// text returns data with the text of its compressed PNG chunks added, so
+// that it can be searched.
+func text(data []byte) []byte {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return data
+	}
+	all := bytes.Clone(data)
+	for _, c := range pngChunks(data) {
+		if t, compressed, ok := pngXMP(c.data); ok && compressed {
+			if zr, err := zlib.NewReader(bytes.NewReader(t)); err == nil {
+				b, _ := io.ReadAll(zr)
+				all = append(all, b...)
+			}
+		}
+	}
+	return all
+}
+
+// assertPrivate checks that the private values are all in data, or that
+// none of them are.
+func assertPrivate(t *testing.T, data []byte, want bool) {
+	t.Helper()
+	searchable := text(data)
+	for _, s := range private {
+		if bytes.Contains(searchable, []byte(s)) != want {
+			t.Errorf("contains %q: %v, want %v", s, !want, want)
+		}
+	}
+	for _, order := range []binary.AppendByteOrder{binary.BigEndian, binary.LittleEndian} {
+		var lat []byte
+		for _, v := range latitude {
+			lat = order.AppendUint32(lat, v)
+		}
+		if bytes.Contains(data, lat) && !want {
+			t.Errorf("GPS latitude is still there (%v)", order)
+		}
+	}
+}
+
+func assertMetadata(t *testing.T, got, want Metadata) {
+	t.Helper()
+	if !got.TakenAt.Equal(want.TakenAt) || got.TakenAt.Format(time.RFC3339) != want.TakenAt.Format(time.RFC3339) {
+		t.Errorf("TakenAt = %v, want %v", got.TakenAt, want.TakenAt)
+	}
+	got.TakenAt, want.TakenAt = time.Time{}, time.Time{}
+	if got != want {
+		t.Errorf("Metadata = %+v, want %+v", got, want)
+	}
+}
+
+func assertSamePixels(t *testing.T, original, scrubbed []byte) {
+	t.Helper()
+	before, _, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("decoding original: %v", err)
+	}
+	after, _, err := image.Decode(bytes.NewReader(scrubbed))
+	if err != nil {
+		t.Fatalf("decoding scrubbed: %v", err)
+	}
+	if before.Bounds() != after.Bounds() {
+		t.Fatalf("bounds %v, want %v", after.Bounds(), before.Bounds())
+	}
+	b := before.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if before.At(x, y) != after.At(x, y) {
+				t.Fatalf("pixel %d,%d is %v, was %v", x, y, after.At(x, y), before.At(x, y))
+			}
+		}
+	}
+}
+
+func bmffBox(typ string, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+	return append(append(b, typ...), data...)
+}
+
+func infe(id uint16, typ, contentType string) []byte {
+	b := binary.BigEndian.AppendUint16([]byte{2, 0, 0, 0}, id)
+	b = append(b, 0, 0)
+	b = append(b, typ...)
+	b = append(b, 0) // no name
+	if contentType != "" {
+		b = append(append(b, contentType...), 0)
+	}
+	return bmffBox("infe", b)
+}
+
+// ilocItem is an item of a version 0 iloc box with 4-byte offsets and
+// lengths and no base offset.
+func ilocItem(id uint16, extents ...[2]int) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = append(b, 0, 0) // data reference index
+	b = binary.BigEndian.AppendUint16(b, uint16(len(extents)))
+	for _, e := range extents {
+		b = binary.BigEndian.AppendUint32(b, uint32(e[0]))
+		b = binary.BigEndian.AppendUint32(b, uint32(e[1]))
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
@@ -0,0 +1,334 @@
+//go:build ignore
+
+// gen_testdata writes the fixtures in testdata: small images from the
+// standard encoders with EXIF and XMP added the way cameras and editors lay
+// them out, including a GPS IFD, serial numbers and an XMP location.
+//
+//	go generate ./internal/exif
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gen2brain/webp"
+)
+
+const width, height = 48, 32
+
+func main() {
+	img := gradient()
+	write("gps.jpg", jpegFixture(img))
+	write("gps.png", pngFixture(img))
+	write("gps.webp", webpFixture(img))
+	write("pixels-like-metadata.png", pixelsLikeMetadata())
+}
+
+func write(name string, data []byte) {
+	if err := os.WriteFile(filepath.Join("testdata", name), data, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func gradient() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.NRGBA{uint8(x * 5), uint8(y * 7), uint8((x + y) * 3), 255})
+		}
+	}
+	return img
+}
+
+// jpegFixture puts a big-endian EXIF APP1 segment and an XMP APP1 segment
+// right after SOI, as cameras do.
+func jpegFixture(img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		log.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	out := append([]byte{}, encoded[:2]...)
+	out = append(out, app1(append([]byte("Exif\x00\x00"), exifTIFF(binary.BigEndian, true)...))...)
+	out = append(out, app1(append([]byte("http://ns.adobe.com/xap/1.0/\x00"), xmpPacket(true)...))...)
+	return append(out, encoded[2:]...)
+}
+
+func app1(payload []byte) []byte {
+	b := []byte{0xFF, 0xE1}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)+2))
+	return append(b, payload...)
+}
+
+// pngFixture adds a little-endian eXIf chunk and a compressed XMP iTXt
+// chunk before the image data.
+func pngFixture(img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		log.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	idat := bytes.Index(encoded, []byte("IDAT")) - 4
+
+	var text bytes.Buffer
+	text.WriteString("XML:com.adobe.xmp\x00\x01\x00\x00\x00")
+	zw := zlib.NewWriter(&text)
+	zw.Write(xmpPacket(true))
+	zw.Close()
+
+	out := append([]byte{}, encoded[:idat]...)
+	out = append(out, pngChunk("eXIf", exifTIFF(binary.LittleEndian, true))...)
+	out = append(out, pngChunk("iTXt", text.Bytes())...)
+	return append(out, encoded[idat:]...)
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	b = append(b, typ...)
+	b = append(b, data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+}
+
+// webpFixture makes an extended WebP file: VP8X, the image, then EXIF
+// without a lens model and XMP without an x:xmpmeta wrapper, which supplies
+// the lens instead.
+func webpFixture(img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, img, webp.Options{Quality: 90}); err != nil {
+		log.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	var imageChunk []byte
+	for pos := 12; pos+8 <= len(encoded); {
+		length := int(binary.LittleEndian.Uint32(encoded[pos+4:]))
+		next := pos + 8 + length + length%2
+		if typ := string(encoded[pos : pos+4]); typ == "VP8 " || typ == "VP8L" {
+			imageChunk = encoded[pos:next]
+		}
+		pos = next
+	}
+	if imageChunk == nil {
+		log.Fatal("webp: no image chunk")
+	}
+
+	vp8x := []byte{0x08 | 0x04, 0, 0, 0} // EXIF and XMP
+	vp8x = append(vp8x, uint24(width-1)...)
+	vp8x = append(vp8x, uint24(height-1)...)
+
+	body := []byte("WEBP")
+	body = append(body, riffChunk("VP8X", vp8x)...)
+	body = append(body, imageChunk...)
+	body = append(body, riffChunk("EXIF", exifTIFF(binary.LittleEndian, false))...)
+	body = append(body, riffChunk("XMP ", xmpPacket(false))...)
+	out := []byte("RIFF")
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(body)))
+	return append(out, body...)
+}
+
+func uint24(v int) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+}
+
+func riffChunk(typ string, data []byte) []byte {
+	b := []byte(typ)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// pixelsLikeMetadata is a PNG stored without compression whose pixels
+// spell out an XMP packet and an EXIF header, which only a search of the
+// raw bytes would mistake for metadata.
+func pixelsLikeMetadata() []byte {
+	rows := []string{
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/">pixels</x:xmpmeta>`,
+		"Exif\x00\x00MM\x00*\x00\x00\x00\x08\x00\x01\x88\x25\x00\x04\x00\x00\x00\x01\x00\x00\x00\x1a",
+		"eXIfII*\x00\x08\x00\x00\x00",
+	}
+	img := image.NewGray(image.Rect(0, 0, 64, len(rows)))
+	for y, row := range rows {
+		copy(img.Pix[y*img.Stride:], row)
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := enc.Encode(&buf, img); err != nil {
+		log.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Values the fixtures carry. The tests look for the private ones to make
+// sure they are gone.
+const (
+	cameraMake  = "FixtureCam"
+	model       = "FC-1"
+	lens        = "FC 35mm F2"
+	taken       = "2024:05:17 14:03:21"
+	offset      = "+02:00"
+	bodySerial  = "BODY-SN-0042"
+	lensSerial  = "LENS-SN-0042"
+	owner       = "Jane Fixture"
+	mapDatum    = "WGS-84-FIXTURE"
+	orientation = 6
+)
+
+// appendOrder is a byte order that can append.
+type appendOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+type entry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+func ascii(tag uint16, s string) entry {
+	return entry{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+// exifTIFF builds a TIFF structure with IFD0, an EXIF IFD and a GPS IFD.
+func exifTIFF(order appendOrder, withLens bool) []byte {
+	short := func(tag uint16, v uint16) entry {
+		return entry{tag, 3, 1, order.AppendUint16(nil, v)}
+	}
+	long := func(tag uint16, v uint32) entry {
+		return entry{tag, 4, 1, order.AppendUint32(nil, v)}
+	}
+	rationals := func(tag uint16, vs ...uint32) entry {
+		var b []byte
+		for i := 0; i < len(vs); i += 2 {
+			b = order.AppendUint32(b, vs[i])
+			b = order.AppendUint32(b, vs[i+1])
+		}
+		return entry{tag, 5, uint32(len(vs) / 2), b}
+	}
+
+	exifIFD := []entry{
+		ascii(0x9003, taken),
+		ascii(0x9011, offset),
+		long(0xA002, width),
+		long(0xA003, height),
+		ascii(0xA430, owner),
+		ascii(0xA431, bodySerial),
+		ascii(0xA435, lensSerial),
+	}
+	if withLens {
+		exifIFD = append(exifIFD, ascii(0xA434, lens))
+	}
+	gpsIFD := []entry{
+		{0x0000, 1, 4, []byte{2, 3, 0, 0}},
+		ascii(0x0001, "N"),
+		rationals(0x0002, 52, 1, 22, 1, 1234, 100),
+		ascii(0x0003, "E"),
+		rationals(0x0004, 4, 1, 53, 1, 5678, 100),
+		ascii(0x0012, mapDatum),
+	}
+
+	// Lay out IFD0, then the EXIF IFD, then the GPS IFD, each followed by
+	// the values too long to fit in their entries.
+	ifd0Size := ifdSize(5, []entry{ascii(0x010F, cameraMake), ascii(0x0110, model)})
+	exifOffset := 8 + ifd0Size
+	gpsOffset := exifOffset + ifdSize(len(exifIFD), exifIFD)
+	ifd0 := []entry{
+		ascii(0x010F, cameraMake),
+		ascii(0x0110, model),
+		short(0x0112, orientation),
+		long(0x8769, uint32(exifOffset)),
+		long(0x8825, uint32(gpsOffset)),
+	}
+
+	var b []byte
+	if order == binary.BigEndian {
+		b = []byte("MM\x00*")
+	} else {
+		b = []byte("II*\x00")
+	}
+	b = order.AppendUint32(b, 8)
+	b = appendIFD(b, order, ifd0)
+	b = appendIFD(b, order, exifIFD)
+	return appendIFD(b, order, gpsIFD)
+}
+
+func ifdSize(n int, entries []entry) int {
+	size := 2 + 12*n + 4
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			size += len(e.value) + len(e.value)%2
+		}
+	}
+	return size
+}
+
+func appendIFD(b []byte, order appendOrder, entries []entry) []byte {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+	start := len(b)
+	data := start + 2 + 12*len(entries) + 4
+	var values []byte
+	b = order.AppendUint16(b, uint16(len(entries)))
+	for _, e := range entries {
+		b = order.AppendUint16(b, e.tag)
+		b = order.AppendUint16(b, e.typ)
+		b = order.AppendUint32(b, e.count)
+		if len(e.value) <= 4 {
+			v := make([]byte, 4)
+			copy(v, e.value)
+			b = append(b, v...)
+			continue
+		}
+		b = order.AppendUint32(b, uint32(data+len(values)))
+		values = append(values, e.value...)
+		if len(e.value)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	b = order.AppendUint32(b, 0) // no next IFD
+	return append(b, values...)
+}
+
+// xmpPacket is an XMP packet with a location, both as GPS coordinates and
+// as IPTC's LocationShown, and a serial number. Without the wrapper it is
+// the bare rdf:RDF some writers store.
+func xmpPacket(wrapped bool) []byte {
+	rdf := `<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmlns:aux="http://ns.adobe.com/exif/1.0/aux/"
+    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:Iptc4xmpExt="http://iptc.org/std/Iptc4xmpExt/2008-02-29/"
+    exif:GPSLatitude="52,22.2057N"
+    exif:GPSLongitude="4,53.9463E"
+    aux:SerialNumber="` + bodySerial + `"
+    aux:Lens="` + lens + `"
+    xmp:CreateDate="2024-05-17T14:03:21+02:00"
+    photoshop:City="Amsterdam">
+   <Iptc4xmpExt:LocationShown>
+    <rdf:Bag>
+     <rdf:li rdf:parseType="Resource">
+      <Iptc4xmpExt:City>Amsterdam</Iptc4xmpExt:City>
+      <Iptc4xmpExt:Sublocation>Prinsengracht 263</Iptc4xmpExt:Sublocation>
+     </rdf:li>
+    </rdf:Bag>
+   </Iptc4xmpExt:LocationShown>
+  </rdf:Description>
+ </rdf:RDF>`
+	if wrapped {
+		rdf = "<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n " + rdf + "\n</x:xmpmeta>"
+	}
+	return []byte("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" + rdf + "\n<?xpacket end=\"w\"?>")
+}
@@ -0,0 +1,104 @@
+package exif
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	xmpStart = []byte("<x:xmpmeta")
+	xmpEnd   = []byte("</x:xmpmeta>")
+)
+
+// xmpDateLayouts are the date forms XMP allows, most precise first.
+var xmpDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// processXMP fills in what EXIF left out of m from the XMP in data, the
+// payload of a segment, chunk or item meant for XMP, then blanks it. XMP can
+// carry a location under many names, from exif:GPSLatitude to
+// Iptc4xmpExt:LocationShown, so none of it is kept. XML allows whitespace
+// where the x:xmpmeta element was, so the packet wrapper around it stays; a
+// payload without one is blanked whole.
+func processXMP(data []byte, m *Metadata) {
+	if m.TakenAt.IsZero() {
+		for _, name := range []string{"exif:DateTimeOriginal", "photoshop:DateCreated", "xmp:CreateDate"} {
+			if at, ok := parseXMPDate(xmpValue(data, name)); ok {
+				m.TakenAt = at
+				break
+			}
+		}
+	}
+	fill := []struct {
+		dst   *string
+		names []string
+	}{
+		{&m.CameraMake, []string{"tiff:Make"}},
+		{&m.CameraModel, []string{"tiff:Model"}},
+		{&m.Lens, []string{"exifEX:LensModel", "aux:Lens"}},
+	}
+	for _, f := range fill {
+		for _, name := range f.names {
+			if *f.dst == "" {
+				*f.dst = xmpValue(data, name)
+			}
+		}
+	}
+	if m.Orientation == 0 {
+		m.Orientation, _ = strconv.Atoi(xmpValue(data, "tiff:Orientation"))
+	}
+
+	blanked := false
+	for i := 0; ; {
+		start := bytes.Index(data[i:], xmpStart)
+		if start < 0 {
+			break
+		}
+		start += i
+		end := bytes.Index(data[start:], xmpEnd)
+		if end < 0 {
+			break
+		}
+		end += start + len(xmpEnd)
+		blank(data[start:end])
+		blanked = true
+		i = end
+	}
+	if !blanked {
+		blank(data)
+	}
+}
+
+func blank(b []byte) {
+	for i := range b {
+		b[i] = ' '
+	}
+}
+
+// xmpValue returns a simple property, written either as an attribute,
+// name="value", or as an element, <name>value</name>.
+func xmpValue(packet []byte, name string) string {
+	q := regexp.QuoteMeta(name)
+	re := regexp.MustCompile(q + `\s*=\s*"([^"]*)"|<` + q + `>([^<]*)</` + q + `>`)
+	match := re.FindSubmatch(packet)
+	if match == nil {
+		return ""
+	}
+	return string(bytes.TrimSpace(append(match[1], match[2]...)))
+}
+
+func parseXMPDate(s string) (time.Time, bool) {
+	for _, layout := range xmpDateLayouts {
+		if at, err := time.Parse(layout, s); err == nil {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
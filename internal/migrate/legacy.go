@@ -0,0 +1,45 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// afterUp holds Go steps that run after a migration's SQL, in the same
+// transaction, for changes SQLite cannot express idempotently.
+var afterUp = map[int]func(tx *sql.Tx) error{
+	1: addLegacyColumns,
+}
+
+// legacyColumns were added to existing tables on startup before migrations
+// existed. A database created by such a release already has the tables, so
+// the CREATE TABLE IF NOT EXISTS in 0001 skips them and any of these columns
+// it is still missing has to be added by hand.
+var legacyColumns = []struct {
+	table, column, definition string
+}{
+	{"users", "disabled", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"users", "totp_secret", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "totp_enabled", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+	// Accounts that predate roles belong to the owner.
+	{"users", "role", "TEXT NOT NULL DEFAULT 'owner'"},
+	{"sessions", "csrf_token", "TEXT NOT NULL DEFAULT ''"},
+}
+
+func addLegacyColumns(tx *sql.Tx) error {
+	for _, c := range legacyColumns {
+		var count int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("inspecting %s: %w", c.table, err)
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, c.table, c.column, c.definition)); err != nil {
+			return fmt.Errorf("adding %s.%s: %w", c.table, c.column, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+// Package migrate applies the numbered schema migrations embedded from
+// migrations/ to the SQLite database. The web app migrates to the latest
+// version on startup; the admin CLI uses it to inspect and roll back.
+//
+// Migrations are pairs of files named NNNN_description.up.sql and
+// NNNN_description.down.sql. Each runs in its own transaction together with
+// the bookkeeping row in schema_migrations, so a failed migration leaves the
+// database at the previous version.
+package migrate
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var files embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+	Down    func(tx *sql.Tx) error
+}
+
+// Status describes one migration and whether it has been applied.
+type Status struct {
+	Version   int
+	Name      string
+	AppliedAt sql.NullTime
+	// Unknown is set for versions recorded in the database that this build
+	// has no migration for, i.e. the database was migrated by a newer build.
+	Unknown bool
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+	now        func() time.Time
+}
+
+// New returns a Migrator for the migrations built into the binary.
+func New(db *sql.DB) (*Migrator, error) {
+	migrations, err := load(files)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations, now: time.Now}, nil
+}
+
+var filenamePattern = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+func load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := filenamePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migrate: unexpected file %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		body, err := fs.ReadFile(fsys, path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("migrate: %w", err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migrate: version %d is used by both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = execSQL(string(body))
+		} else {
+			m.Down = execSQL(string(body))
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == nil || m.Down == nil {
+			return nil, fmt.Errorf("migrate: %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		if step, ok := afterUp[m.Version]; ok {
+			m.Up = chain(m.Up, step)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func execSQL(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+func chain(steps ...func(tx *sql.Tx) error) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, step := range steps {
+			if err := step(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (m *Migrator) ensureTable() error {
+	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("migrate: creating schema_migrations: %w", err)
+	}
+	return nil
+}
+
+func (m *Migrator) applied() (map[int]Status, error) {
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+	rows, err := m.db.Query(`SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: reading schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := map[int]Status{}
+	for rows.Next() {
+		var s Status
+		if err := rows.Scan(&s.Version, &s.Name, &s.AppliedAt); err != nil {
+			return nil, fmt.Errorf("migrate: reading schema_migrations: %w", err)
+		}
+		applied[s.Version] = s
+	}
+	return applied, rows.Err()
+}
+
+// Status lists every known migration in order, followed by any applied
+// versions this build does not know about.
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []Status
+	for _, migration := range m.migrations {
+		s := Status{Version: migration.Version, Name: migration.Name}
+		if a, ok := applied[migration.Version]; ok {
+			s.AppliedAt = a.AppliedAt
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, s)
+	}
+	var unknown []Status
+	for _, a := range applied {
+		a.Unknown = true
+		unknown = append(unknown, a)
+	}
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i].Version < unknown[j].Version })
+	return append(statuses, unknown...), nil
+}
+
+// Latest returns the highest version built into the binary.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies pending migrations up to and including target, or all of them
+// when target is 0, and returns the ones it applied.
+func (m *Migrator) Up(target int) ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkNotNewer(applied); err != nil {
+		return nil, err
+	}
+	if target == 0 {
+		target = m.Latest()
+	}
+
+	var done []Migration
+	for _, migration := range m.migrations {
+		if migration.Version > target {
+			break
+		}
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err := m.inTx(func(tx *sql.Tx) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+				migration.Version, migration.Name, m.now().UTC())
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migrate: applying %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Down rolls back the most recently applied migrations, newest first, and
+// returns the ones it reverted.
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	if steps < 1 {
+		return nil, errors.New("migrate: steps must be at least 1")
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkNotNewer(applied); err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		err := m.inTx(func(tx *sql.Tx) error {
+			if err := migration.Down(tx); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, migration.Version)
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migrate: reverting %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// checkNotNewer refuses to touch a database that a newer build has migrated
+// past what this one knows about.
+func (m *Migrator) checkNotNewer(applied map[int]Status) error {
+	for version := range applied {
+		if version > m.Latest() {
+			return fmt.Errorf("migrate: database is at version %d, newer than this build (%d)", version, m.Latest())
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
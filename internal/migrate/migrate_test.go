@@ -0,0 +1,290 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// schema describes every table and index apart from the bookkeeping, by
+// column rather than by CREATE statement, which ALTER TABLE rewrites.
+func schema(t *testing.T, db *sql.DB) map[string]string {
+	t.Helper()
+	rows, err := db.Query(`SELECT type, name, tbl_name FROM sqlite_master
+		WHERE name NOT LIKE 'sqlite_%' AND name != 'schema_migrations'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type object struct{ typ, name, table string }
+	var objects []object
+	for rows.Next() {
+		var o object
+		if err := rows.Scan(&o.typ, &o.name, &o.table); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, o)
+	}
+	rows.Close()
+
+	s := map[string]string{}
+	for _, o := range objects {
+		query := `SELECT name, type, "notnull", COALESCE(dflt_value, ''), pk FROM pragma_table_info(?)`
+		if o.typ == "index" {
+			query = `SELECT name, '', 0, '', seqno FROM pragma_index_info(?)`
+		}
+		cols, err := db.Query(query, o.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var desc []string
+		for cols.Next() {
+			var name, typ, dflt string
+			var notNull, pk int
+			if err := cols.Scan(&name, &typ, &notNull, &dflt, &pk); err != nil {
+				t.Fatal(err)
+			}
+			desc = append(desc, fmt.Sprintf("%s %s %d %s %d", name, typ, notNull, dflt, pk))
+		}
+		cols.Close()
+		s[o.typ+" "+o.name+" on "+o.table] = strings.Join(desc, ", ")
+	}
+	return s
+}
+
+func TestUpDownRoundTrip(t *testing.T) {
+	db := openDB(t)
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := schema(t, db)
+
+	// Each migration's down undoes its up exactly.
+	for _, migration := range m.migrations {
+		before := schema(t, db)
+		if _, err := m.Up(migration.Version); err != nil {
+			t.Fatal(err)
+		}
+		after := schema(t, db)
+		if _, err := m.Down(1); err != nil {
+			t.Fatal(err)
+		}
+		if got := schema(t, db); !reflect.DeepEqual(got, before) {
+			t.Errorf("%04d_%s: down left\n%v\nwant\n%v", migration.Version, migration.Name, got, before)
+		}
+		if _, err := m.Up(migration.Version); err != nil {
+			t.Fatal(err)
+		}
+		if got := schema(t, db); !reflect.DeepEqual(got, after) {
+			t.Errorf("%04d_%s: up after down gave\n%v\nwant\n%v", migration.Version, migration.Name, got, after)
+		}
+	}
+
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if !s.AppliedAt.Valid || s.Unknown {
+			t.Errorf("after Up: %+v", s)
+		}
+	}
+	if done, err := m.Up(0); err != nil || len(done) != 0 {
+		t.Errorf("second Up applied %d migrations, %v", len(done), err)
+	}
+
+	done, err := m.Down(len(m.migrations) + 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(m.migrations) || done[0].Version != m.Latest() {
+		t.Errorf("Down reverted %d migrations starting at %d", len(done), done[0].Version)
+	}
+	if got := schema(t, db); !reflect.DeepEqual(got, empty) {
+		t.Errorf("everything down left %v", got)
+	}
+}
+
+func TestUpToTarget(t *testing.T) {
+	db := openDB(t)
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := m.Up(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 3 || done[2].Version != 3 {
+		t.Fatalf("Up(3) applied %v", done)
+	}
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if s.AppliedAt.Valid != (s.Version <= 3) {
+			t.Errorf("after Up(3): %+v", s)
+		}
+	}
+	if _, err := m.Down(0); err == nil {
+		t.Error("Down(0) succeeded")
+	}
+}
+
+func TestRefusesNewerDatabase(t *testing.T) {
+	db := openDB(t)
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'from_the_future', ?)`, m.Latest()+1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(0); err == nil {
+		t.Error("Up on a newer database succeeded")
+	}
+	if _, err := m.Down(1); err == nil {
+		t.Error("Down on a newer database succeeded")
+	}
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := statuses[len(statuses)-1]; !last.Unknown || last.Version != m.Latest()+1 {
+		t.Errorf("Status ends with %+v, want the unknown version", last)
+	}
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+	// Numbered past the versions with Go steps attached in afterUp.
+	migrations, err := load(fstest.MapFS{
+		"migrations/0101_a.up.sql":   {Data: []byte("CREATE TABLE a (x INTEGER);")},
+		"migrations/0101_a.down.sql": {Data: []byte("DROP TABLE a;")},
+		"migrations/0102_b.up.sql":   {Data: []byte("CREATE TABLE b (x INTEGER); INSERT INTO nowhere VALUES (1);")},
+		"migrations/0102_b.down.sql": {Data: []byte("DROP TABLE b;")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openDB(t)
+	m := &Migrator{db: db, migrations: migrations, now: time.Now}
+	done, err := m.Up(0)
+	if err == nil {
+		t.Fatal("Up succeeded")
+	}
+	if len(done) != 1 || done[0].Version != 101 {
+		t.Errorf("Up applied %v before failing", done)
+	}
+	got := schema(t, db)
+	if _, ok := got["table b on b"]; ok {
+		t.Error("the failed migration's table is there")
+	}
+	if _, ok := got["table a on a"]; !ok {
+		t.Error("the migration before the failed one was rolled back too")
+	}
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[1].AppliedAt.Valid {
+		t.Error("the failed migration is recorded as applied")
+	}
+}
+
+func TestLoadRejectsBadFiles(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"unexpected name": {
+			"migrations/0001_a.up.sql":   {},
+			"migrations/0001_a.down.sql": {},
+			"migrations/notes.txt":       {},
+		},
+		"missing down": {
+			"migrations/0001_a.up.sql": {},
+		},
+		"version used twice": {
+			"migrations/0001_a.up.sql":   {},
+			"migrations/0001_a.down.sql": {},
+			"migrations/0001_b.up.sql":   {},
+			"migrations/0001_b.down.sql": {},
+		},
+	}
+	for name, fsys := range tests {
+		if _, err := load(fsys); err == nil {
+			t.Errorf("%s: load succeeded", name)
+		}
+	}
+}
+
+func TestUpgradesPreMigrationDatabase(t *testing.T) {
+	db := openDB(t)
+	// The schema the app created on startup before it had migrations.
+	_, err := db.Exec(`
+		CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, email TEXT NOT NULL UNIQUE, password_digest BLOB NOT NULL);
+		CREATE TABLE stories (id INTEGER PRIMARY KEY AUTOINCREMENT, title TEXT NOT NULL, content TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, UNIQUE(title));
+		CREATE TABLE visuals (id INTEGER PRIMARY KEY AUTOINCREMENT, title TEXT NOT NULL, description TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+		CREATE TABLE visual_photos (id INTEGER PRIMARY KEY AUTOINCREMENT, visual_id INTEGER NOT NULL, file_path TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+		CREATE TABLE info (singleton INTEGER PRIMARY KEY CHECK (singleton = 1), content TEXT NOT NULL, last_updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+		CREATE TABLE covers (id INTEGER PRIMARY KEY AUTOINCREMENT, file_path TEXT NOT NULL UNIQUE, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+		CREATE TABLE portfolios (id INTEGER PRIMARY KEY AUTOINCREMENT, file_path TEXT NOT NULL UNIQUE, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+		INSERT INTO users (email, password_digest) VALUES ('artist@example.com', x'00');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(0); err != nil {
+		t.Fatal(err)
+	}
+
+	var role string
+	var disabled bool
+	if err := db.QueryRow(`SELECT role, disabled FROM users WHERE email = 'artist@example.com'`).Scan(&role, &disabled); err != nil {
+		t.Fatal(err)
+	}
+	if role != "owner" || disabled {
+		t.Errorf("existing user is %s, disabled %v; want an enabled owner", role, disabled)
+	}
+
+	// It ends up with the same tables as a new database, if not always in
+	// the same column order.
+	fresh := openDB(t)
+	freshMigrator, err := New(fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := freshMigrator.Up(0); err != nil {
+		t.Fatal(err)
+	}
+	got, want := schema(t, db), schema(t, fresh)
+	for name := range want {
+		if _, ok := got[name]; !ok {
+			t.Errorf("upgraded database lacks %s", name)
+		}
+	}
+}
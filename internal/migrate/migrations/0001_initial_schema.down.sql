@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS audit_events;
+DROP TABLE IF EXISTS login_challenges;
+DROP TABLE IF EXISTS api_tokens;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS login_attempts;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS portfolios;
+DROP TABLE IF EXISTS covers;
+DROP TABLE IF EXISTS info;
+DROP TABLE IF EXISTS visual_photos;
+DROP TABLE IF EXISTS visuals;
+DROP TABLE IF EXISTS stories;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,132 @@
+-- The schema as it stood when migrations were introduced. Every statement is
+-- idempotent so databases created by earlier releases, which ran these as
+-- CREATE TABLE IF NOT EXISTS on every start, can adopt it as their baseline.
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL UNIQUE,
+	password_digest BLOB NOT NULL,
+	disabled BOOLEAN NOT NULL DEFAULT 0,
+	totp_secret TEXT NOT NULL DEFAULT '',
+	totp_enabled BOOLEAN NOT NULL DEFAULT 0,
+	totp_last_step INTEGER NOT NULL DEFAULT 0,
+	role TEXT NOT NULL DEFAULT 'owner'
+);
+
+CREATE TABLE IF NOT EXISTS stories (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	title TEXT NOT NULL,
+	content TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(title)
+);
+CREATE INDEX IF NOT EXISTS idx_stories_created_at ON stories(created_at);
+
+CREATE TABLE IF NOT EXISTS visuals (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	title TEXT NOT NULL,
+	description TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_visuals_created_at ON visuals(created_at);
+
+CREATE TABLE IF NOT EXISTS visual_photos (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	visual_id INTEGER NOT NULL,
+	file_path TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (visual_id) REFERENCES visuals(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_visual_photos_visual_id ON visual_photos(visual_id);
+
+CREATE TABLE IF NOT EXISTS info (
+	singleton INTEGER PRIMARY KEY CHECK (singleton = 1),
+	content TEXT NOT NULL,
+	last_updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+INSERT OR IGNORE INTO info (singleton, content) VALUES (1, 'Welcome to my Website');
+
+CREATE TABLE IF NOT EXISTS covers (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	file_path TEXT NOT NULL UNIQUE,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO covers (file_path) SELECT 'cover.png' WHERE NOT EXISTS (SELECT 1 FROM covers);
+
+CREATE TABLE IF NOT EXISTS portfolios (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	file_path TEXT NOT NULL UNIQUE,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO portfolios (file_path) SELECT 'portfolios/portfolio.pdf' WHERE NOT EXISTS (SELECT 1 FROM portfolios);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	last_seen_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	csrf_token TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	ip TEXT NOT NULL,
+	email TEXT NOT NULL,
+	succeeded BOOLEAN NOT NULL,
+	attempted_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_ip ON login_attempts(ip, attempted_at);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_email ON login_attempts(email, attempted_at);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	code_hash BLOB NOT NULL,
+	used_at TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes(user_id);
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	token_hash BLOB NOT NULL UNIQUE,
+	scopes TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL,
+	last_used_at TIMESTAMP,
+	revoked_at TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+
+CREATE TABLE IF NOT EXISTS login_challenges (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	email TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- No foreign key on actor_id: the trail has to outlive deleted accounts,
+-- which is also why the email is copied in.
+CREATE TABLE IF NOT EXISTS audit_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	actor_id INTEGER,
+	actor_email TEXT NOT NULL DEFAULT '',
+	action TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL DEFAULT '',
+	before_json TEXT,
+	after_json TEXT,
+	ip TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_entity ON audit_events(entity_type, entity_id);
@@ -0,0 +1 @@
+-- The directory prefixes were redundant and are not restored.
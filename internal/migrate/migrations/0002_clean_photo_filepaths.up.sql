@@ -0,0 +1,5 @@
+-- Older uploads stored visual_photos.file_path with its directory prefix.
+-- Only the base name is kept now (formerly ops/cleanup-filepaths).
+UPDATE visual_photos
+SET file_path = replace(file_path, rtrim(file_path, replace(file_path, '/', '')), '')
+WHERE file_path LIKE '%/%';
@@ -0,0 +1,2 @@
+ALTER TABLE visual_photos DROP COLUMN status;
+DROP TABLE jobs;
@@ -0,0 +1,19 @@
+-- Background jobs, such as generating thumbnails for an upload. Workers claim
+-- queued jobs whose run_after has passed; failures are retried with backoff
+-- until max_attempts, then left as 'failed' with the last error.
+CREATE TABLE jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'done', 'failed')),
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL,
+	run_after TIMESTAMP NOT NULL,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+CREATE INDEX idx_jobs_status_run_after ON jobs(status, run_after);
+
+-- Photos uploaded before the queue existed already have their thumbnails.
+ALTER TABLE visual_photos ADD COLUMN status TEXT NOT NULL DEFAULT 'ready';
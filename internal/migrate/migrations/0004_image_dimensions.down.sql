@@ -0,0 +1,4 @@
+ALTER TABLE covers DROP COLUMN height;
+ALTER TABLE covers DROP COLUMN width;
+ALTER TABLE visual_photos DROP COLUMN height;
+ALTER TABLE visual_photos DROP COLUMN width;
@@ -0,0 +1,6 @@
+-- Intrinsic size of an upload after EXIF rotation, recorded by its thumbnail
+-- job so pages can reserve space for it. 0 until then.
+ALTER TABLE visual_photos ADD COLUMN width INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE visual_photos ADD COLUMN height INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE covers ADD COLUMN width INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE covers ADD COLUMN height INTEGER NOT NULL DEFAULT 0;
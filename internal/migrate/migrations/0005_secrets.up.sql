@@ -0,0 +1,7 @@
+-- Keys the app generates for itself on first start, such as the one that
+-- signs /img/ URLs, so they stay the same across restarts.
+CREATE TABLE secrets (
+	name TEXT PRIMARY KEY,
+	value BLOB NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
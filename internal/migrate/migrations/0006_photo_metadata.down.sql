@@ -0,0 +1,6 @@
+DELETE FROM jobs WHERE kind = 'metadata';
+ALTER TABLE visual_photos DROP COLUMN orientation;
+ALTER TABLE visual_photos DROP COLUMN lens;
+ALTER TABLE visual_photos DROP COLUMN camera_model;
+ALTER TABLE visual_photos DROP COLUMN camera_make;
+ALTER TABLE visual_photos DROP COLUMN taken_at;
@@ -0,0 +1,17 @@
+-- What is kept of each photo's EXIF/XMP. Uploads are scrubbed of GPS and
+-- serial numbers before they are stored; the queued jobs do the same for
+-- the originals stored before, and fill these columns in for them.
+ALTER TABLE visual_photos ADD COLUMN taken_at TIMESTAMP;
+ALTER TABLE visual_photos ADD COLUMN camera_make TEXT NOT NULL DEFAULT '';
+ALTER TABLE visual_photos ADD COLUMN camera_model TEXT NOT NULL DEFAULT '';
+ALTER TABLE visual_photos ADD COLUMN lens TEXT NOT NULL DEFAULT '';
+ALTER TABLE visual_photos ADD COLUMN orientation INTEGER NOT NULL DEFAULT 0;
+
+INSERT INTO jobs (kind, payload, max_attempts, run_after, created_at, updated_at)
+SELECT 'metadata', json_object('key', 'visuals/' || visual_id || '/' || file_path, 'photo_id', id),
+	5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+FROM visual_photos;
+
+INSERT INTO jobs (kind, payload, max_attempts, run_after, created_at, updated_at)
+SELECT 'metadata', json_object('key', 'covers/' || file_path), 5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+FROM covers;
@@ -0,0 +1,3 @@
+ALTER TABLE visual_photos DROP COLUMN lqip;
+ALTER TABLE visual_photos DROP COLUMN blurhash;
+ALTER TABLE visual_photos DROP COLUMN color;
@@ -0,0 +1,6 @@
+-- Placeholders painted while a photo loads, computed by its thumbnail job.
+-- Empty until then; photos processed before this keep showing none until
+-- their thumbnails are made again.
+ALTER TABLE visual_photos ADD COLUMN color TEXT NOT NULL DEFAULT '';
+ALTER TABLE visual_photos ADD COLUMN blurhash TEXT NOT NULL DEFAULT '';
+ALTER TABLE visual_photos ADD COLUMN lqip TEXT NOT NULL DEFAULT '';
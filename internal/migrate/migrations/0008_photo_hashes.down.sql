@@ -0,0 +1,3 @@
+DELETE FROM jobs WHERE kind = 'photo_hashes';
+ALTER TABLE visual_photos DROP COLUMN phash;
+ALTER TABLE visual_photos DROP COLUMN sha256;
@@ -0,0 +1,10 @@
+-- Content hashes to recognise duplicate uploads by: the hex SHA-256 of the
+-- stored file and a 64-bit perceptual hash as 16 hex digits. Empty until
+-- computed; the queued jobs compute them for the photos already stored.
+ALTER TABLE visual_photos ADD COLUMN sha256 TEXT NOT NULL DEFAULT '';
+ALTER TABLE visual_photos ADD COLUMN phash TEXT NOT NULL DEFAULT '';
+
+INSERT INTO jobs (kind, payload, max_attempts, run_after, created_at, updated_at)
+SELECT 'photo_hashes', json_object('key', 'visuals/' || visual_id || '/' || file_path, 'photo_id', id),
+	5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+FROM visual_photos;
@@ -0,0 +1,2 @@
+-- Nothing to undo: the queued jobs are the same as an upload's and may
+-- already have run. Any still queued are harmless to leave.
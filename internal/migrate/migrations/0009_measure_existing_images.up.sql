@@ -0,0 +1,15 @@
+-- Only the thumbnail job records an image's size (0004) and a photo's
+-- placeholders (0007), so photos and covers stored before those lack them.
+-- Queue one for each of them; it also makes any thumbnail sizes or formats
+-- added since they were uploaded.
+INSERT INTO jobs (kind, payload, max_attempts, run_after, created_at, updated_at)
+SELECT 'thumbnails', json_object('key', 'visuals/' || visual_id || '/' || file_path, 'photo_id', id),
+	5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+FROM visual_photos
+WHERE width = 0 OR color = '';
+
+INSERT INTO jobs (kind, payload, max_attempts, run_after, created_at, updated_at)
+SELECT 'thumbnails', json_object('key', 'covers/' || file_path, 'cover_id', id),
+	5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+FROM covers
+WHERE width = 0;
@@ -0,0 +1,334 @@
+// Package openapi holds the OpenAPI 3.1 description of the JSON API, kept
+// by hand in openapi.json, and checks requests and responses against it.
+//
+// The checks understand the parts of OpenAPI and JSON Schema the document
+// uses, and no more. Load refuses a schema with a keyword it does not know,
+// so the document cannot start promising something that goes unchecked.
+package openapi
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+//go:embed openapi.json
+var document []byte
+
+// Document returns the embedded document, as served to clients.
+func Document() []byte {
+	return document
+}
+
+// Spec is a parsed document.
+type Spec struct {
+	OpenAPI    string              `json:"openapi"`
+	Servers    []Server            `json:"servers"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+
+	// basePath is the path of the first server, which every path in Paths
+	// is relative to.
+	basePath string
+	routes   []route
+}
+
+type Server struct {
+	URL string `json:"url"`
+}
+
+type Components struct {
+	Schemas    map[string]*Schema    `json:"schemas"`
+	Parameters map[string]*Parameter `json:"parameters"`
+	Responses  map[string]*Response  `json:"responses"`
+}
+
+// PathItem holds the operations on one path. Parameters shared by all of
+// them are listed on each operation instead.
+type PathItem struct {
+	Get    *Operation `json:"get"`
+	Put    *Operation `json:"put"`
+	Post   *Operation `json:"post"`
+	Patch  *Operation `json:"patch"`
+	Delete *Operation `json:"delete"`
+}
+
+// Operation returns the operation for an HTTP method, if documented. HEAD
+// is answered like GET.
+func (p PathItem) Operation(method string) *Operation {
+	switch method {
+	case "GET", "HEAD":
+		return p.Get
+	case "PUT":
+		return p.Put
+	case "POST":
+		return p.Post
+	case "PATCH":
+		return p.Patch
+	case "DELETE":
+		return p.Delete
+	}
+	return nil
+}
+
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary"`
+	Parameters  []*Parameter         `json:"parameters"`
+	RequestBody *RequestBody         `json:"requestBody"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+// Parameter is a path, query or header parameter, or a $ref to one under
+// components.
+type Parameter struct {
+	Ref      string  `json:"$ref"`
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response is one documented response, or a $ref to one under components.
+// No content means no body.
+type Response struct {
+	Ref     string               `json:"$ref"`
+	Headers map[string]Header    `json:"headers"`
+	Content map[string]MediaType `json:"content"`
+}
+
+type Header struct {
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema is the subset of JSON Schema the document is written in.
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 Types              `json:"type"`
+	Format               string             `json:"format"`
+	Description          string             `json:"description"`
+	Examples             []any              `json:"examples"`
+	Enum                 []any              `json:"enum"`
+	MinLength            *int               `json:"minLength"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	ContentMediaType     string             `json:"contentMediaType"`
+}
+
+// UnmarshalJSON refuses keywords Schema does not model.
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	type schema Schema
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*schema)(s))
+}
+
+// Types is a schema's "type": one name, or a list of them.
+type Types []string
+
+func (t *Types) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = Types{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+	*t = many
+	return nil
+}
+
+// route is a path of the document, split into segments; "{name}" segments
+// match any one segment.
+type route struct {
+	path     string
+	segments []string
+	item     PathItem
+}
+
+// Load parses the embedded document.
+func Load() (*Spec, error) {
+	return Parse(document)
+}
+
+// Parse parses a document and checks that every $ref in it resolves.
+func Parse(data []byte) (*Spec, error) {
+	var s Spec
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("openapi: %w", err)
+	}
+	if !strings.HasPrefix(s.OpenAPI, "3.1.") {
+		return nil, fmt.Errorf("openapi: version %q is not 3.1", s.OpenAPI)
+	}
+	if len(s.Servers) > 0 {
+		u, err := url.Parse(s.Servers[0].URL)
+		if err != nil {
+			return nil, fmt.Errorf("openapi: server url: %w", err)
+		}
+		s.basePath = strings.TrimSuffix(u.Path, "/")
+	}
+
+	for path, item := range s.Paths {
+		s.routes = append(s.routes, route{path: path, segments: strings.Split(path, "/"), item: item})
+		for _, op := range []*Operation{item.Get, item.Put, item.Post, item.Patch, item.Delete} {
+			if op == nil {
+				continue
+			}
+			if err := s.checkOperation(op); err != nil {
+				return nil, fmt.Errorf("openapi: %s %s: %w", path, op.OperationID, err)
+			}
+		}
+	}
+	return &s, nil
+}
+
+func (s *Spec) checkOperation(op *Operation) error {
+	var errs []error
+	for _, p := range op.Parameters {
+		param, err := s.parameter(p)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, s.checkRefs(param.Schema))
+	}
+	if op.RequestBody != nil {
+		for _, mt := range op.RequestBody.Content {
+			errs = append(errs, s.checkRefs(mt.Schema))
+		}
+	}
+	if len(op.Responses) == 0 {
+		errs = append(errs, errors.New("no responses"))
+	}
+	for _, r := range op.Responses {
+		resp, err := s.response(r)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, mt := range resp.Content {
+			errs = append(errs, s.checkRefs(mt.Schema))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkRefs walks a schema and reports the first $ref that does not
+// resolve.
+func (s *Spec) checkRefs(schema *Schema) error {
+	if schema == nil {
+		return nil
+	}
+	if schema.Ref != "" {
+		_, err := s.schema(schema)
+		return err
+	}
+	for _, p := range schema.Properties {
+		if err := s.checkRefs(p); err != nil {
+			return err
+		}
+	}
+	return s.checkRefs(schema.Items)
+}
+
+// schema follows $refs to components/schemas.
+func (s *Spec) schema(schema *Schema) (*Schema, error) {
+	for schema != nil && schema.Ref != "" {
+		name, ok := strings.CutPrefix(schema.Ref, "#/components/schemas/")
+		if !ok || s.Components.Schemas[name] == nil {
+			return nil, fmt.Errorf("unresolved $ref %q", schema.Ref)
+		}
+		schema = s.Components.Schemas[name]
+	}
+	return schema, nil
+}
+
+func (s *Spec) parameter(p *Parameter) (*Parameter, error) {
+	if p.Ref == "" {
+		return p, nil
+	}
+	name, ok := strings.CutPrefix(p.Ref, "#/components/parameters/")
+	if !ok || s.Components.Parameters[name] == nil {
+		return nil, fmt.Errorf("unresolved $ref %q", p.Ref)
+	}
+	return s.Components.Parameters[name], nil
+}
+
+func (s *Spec) response(r *Response) (*Response, error) {
+	if r.Ref == "" {
+		return r, nil
+	}
+	name, ok := strings.CutPrefix(r.Ref, "#/components/responses/")
+	if !ok || s.Components.Responses[name] == nil {
+		return nil, fmt.Errorf("unresolved $ref %q", r.Ref)
+	}
+	return s.Components.Responses[name], nil
+}
+
+// Covers reports whether a request path falls under the document's server
+// path, and so should be documented.
+func (s *Spec) Covers(path string) bool {
+	return path == s.basePath || strings.HasPrefix(path, s.basePath+"/")
+}
+
+// find returns the path item a request path matches, and the values of its
+// path parameters. Where several match, the one with the most literal
+// segments wins, as in http.ServeMux.
+func (s *Spec) find(path string) (*route, map[string]string) {
+	if !s.Covers(path) {
+		return nil, nil
+	}
+	segments := strings.Split(strings.TrimPrefix(path, s.basePath), "/")
+
+	var best *route
+	var bestParams map[string]string
+	bestLiterals := -1
+	for i := range s.routes {
+		rt := &s.routes[i]
+		if len(rt.segments) != len(segments) {
+			continue
+		}
+		params := map[string]string{}
+		literals := 0
+		matched := true
+		for j, seg := range rt.segments {
+			if name, ok := strings.CutPrefix(seg, "{"); ok && strings.HasSuffix(name, "}") {
+				if segments[j] == "" {
+					matched = false
+					break
+				}
+				params[strings.TrimSuffix(name, "}")] = segments[j]
+				continue
+			}
+			if seg != segments[j] {
+				matched = false
+				break
+			}
+			literals++
+		}
+		if matched && literals > bestLiterals {
+			best, bestParams, bestLiterals = rt, params, literals
+		}
+	}
+	return best, bestParams
+}
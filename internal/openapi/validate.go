@@ -0,0 +1,361 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ValidationError lists everything about one request or response that does
+// not match the document.
+type ValidationError struct {
+	// What was checked, e.g. "GET /api/v1/stories" or "response 200 to
+	// GET /api/v1/stories".
+	Subject  string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s does not match the OpenAPI document: %s", e.Subject, strings.Join(e.Problems, "; "))
+}
+
+func (e *ValidationError) add(format string, args ...any) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+func (e *ValidationError) err() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// ValidateRequest checks a request against the operation documented for
+// its method and path: the path and query parameters, the content type of
+// the body and, for JSON, the body itself. The body is read and put back.
+// Multipart bodies are only checked for their content type.
+func (s *Spec) ValidateRequest(r *http.Request) error {
+	verr := &ValidationError{Subject: r.Method + " " + r.URL.Path}
+	rt, pathParams := s.find(r.URL.Path)
+	if rt == nil {
+		verr.add("path is not documented")
+		return verr
+	}
+	op := rt.item.Operation(r.Method)
+	if op == nil {
+		verr.add("method is not documented for %s", rt.path)
+		return verr
+	}
+
+	query := r.URL.Query()
+	for _, p := range op.Parameters {
+		param, err := s.parameter(p)
+		if err != nil {
+			verr.add("%v", err)
+			continue
+		}
+		var values []string
+		switch param.In {
+		case "path":
+			values = []string{pathParams[param.Name]}
+		case "query":
+			values = query[param.Name]
+		case "header":
+			values = r.Header.Values(param.Name)
+		}
+		if len(values) == 0 {
+			if param.Required {
+				verr.add("%s parameter %q is required", param.In, param.Name)
+			}
+			continue
+		}
+		for _, v := range values {
+			for _, problem := range s.validateParameter(param.Schema, v) {
+				verr.add("%s parameter %q: %s", param.In, param.Name, problem)
+			}
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		verr.add("reading body: %v", err)
+		return verr
+	}
+	switch {
+	case op.RequestBody == nil:
+		if len(body) > 0 {
+			verr.add("the operation takes no body")
+		}
+	case len(body) == 0:
+		if op.RequestBody.Required {
+			verr.add("a body is required")
+		}
+	default:
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		mt, ok := op.RequestBody.Content[mediaType]
+		if !ok {
+			verr.add("content type %q is not one of %s", mediaType, mediaTypes(op.RequestBody.Content))
+			break
+		}
+		if isJSON(mediaType) {
+			s.validateBody(verr, mt.Schema, body)
+		}
+	}
+	return verr.err()
+}
+
+// ValidateResponse checks a response to r against the document: that the
+// status is documented, that the headers it requires are there, and that
+// the body has a documented content type and, for JSON, matches its schema.
+// Responses to requests outside the document are not checked.
+func (s *Spec) ValidateResponse(r *http.Request, status int, header http.Header, body []byte) error {
+	rt, _ := s.find(r.URL.Path)
+	if rt == nil || rt.item.Operation(r.Method) == nil {
+		return nil
+	}
+	op := rt.item.Operation(r.Method)
+
+	verr := &ValidationError{Subject: fmt.Sprintf("response %d to %s %s", status, r.Method, r.URL.Path)}
+	documented := op.Responses[strconv.Itoa(status)]
+	if documented == nil {
+		documented = op.Responses[fmt.Sprintf("%dXX", status/100)]
+	}
+	if documented == nil {
+		documented = op.Responses["default"]
+	}
+	if documented == nil {
+		verr.add("status is not documented")
+		return verr
+	}
+	resp, err := s.response(documented)
+	if err != nil {
+		verr.add("%v", err)
+		return verr
+	}
+
+	for name, h := range resp.Headers {
+		if h.Required && header.Get(name) == "" {
+			verr.add("header %s is required", name)
+		}
+	}
+	if len(resp.Content) == 0 {
+		if len(body) > 0 && r.Method != http.MethodHead {
+			verr.add("the response has no documented body")
+		}
+		return verr.err()
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	mt, ok := resp.Content[mediaType]
+	if !ok {
+		verr.add("content type %q is not one of %s", mediaType, mediaTypes(resp.Content))
+		return verr
+	}
+	if isJSON(mediaType) && r.Method != http.MethodHead {
+		s.validateBody(verr, mt.Schema, body)
+	}
+	return verr.err()
+}
+
+func (s *Spec) validateBody(verr *ValidationError, schema *Schema, body []byte) {
+	if schema == nil {
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		verr.add("body is not JSON: %v", err)
+		return
+	}
+	for _, problem := range s.validate(schema, v, "") {
+		verr.add("%s", problem)
+	}
+}
+
+// validateParameter checks a parameter, which arrives as text, against a
+// schema of a single type.
+func (s *Spec) validateParameter(schema *Schema, raw string) []string {
+	schema, err := s.schema(schema)
+	if err != nil || schema == nil {
+		return nil
+	}
+	var v any = raw
+	switch {
+	case slices.Contains(schema.Type, "integer"), slices.Contains(schema.Type, "number"):
+		if _, err := strconv.ParseFloat(raw, 64); err != nil {
+			return []string{fmt.Sprintf("%q is not a number", raw)}
+		}
+		v = json.Number(raw)
+	case slices.Contains(schema.Type, "boolean"):
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return []string{fmt.Sprintf("%q is not a boolean", raw)}
+		}
+		v = b
+	}
+	return s.validate(schema, v, "")
+}
+
+// validate checks a decoded JSON value against a schema. Problems are
+// located by JSON pointer.
+func (s *Spec) validate(schema *Schema, v any, pointer string) []string {
+	schema, err := s.schema(schema)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	at := pointer
+	if at == "" {
+		at = "/"
+	}
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	kind := jsonType(v)
+	if len(schema.Type) > 0 && !slices.Contains(schema.Type, kind) &&
+		!(kind == "integer" && slices.Contains(schema.Type, "number")) {
+		fail("is %s, want %s", kind, strings.Join(schema.Type, " or "))
+		return problems
+	}
+	if len(schema.Enum) > 0 && !slices.ContainsFunc(schema.Enum, func(e any) bool { return fmt.Sprint(e) == fmt.Sprint(v) }) {
+		fail("%v is not one of %v", v, schema.Enum)
+	}
+
+	switch v := v.(type) {
+	case string:
+		if schema.MinLength != nil && utf8.RuneCountInString(v) < *schema.MinLength {
+			fail("is shorter than %d characters", *schema.MinLength)
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				fail("%q is not a date-time", v)
+			}
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if schema.Minimum != nil && n < *schema.Minimum {
+			fail("%v is less than %v", v, *schema.Minimum)
+		}
+		if schema.Maximum != nil && n > *schema.Maximum {
+			fail("%v is more than %v", v, *schema.Maximum)
+		}
+	case []any:
+		if schema.Items != nil {
+			for i, item := range v {
+				problems = append(problems, s.validate(schema.Items, item, fmt.Sprintf("%s/%d", pointer, i))...)
+			}
+		}
+	case map[string]any:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				fail("property %q is required", name)
+			}
+		}
+		for name, value := range v {
+			child := pointer + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+			if prop, ok := schema.Properties[name]; ok {
+				problems = append(problems, s.validate(prop, value, child)...)
+			} else if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				fail("property %q is not documented", name)
+			}
+		}
+	}
+	return problems
+}
+
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func mediaTypes(content map[string]MediaType) string {
+	var types []string
+	for t := range content {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+	return strings.Join(types, ", ")
+}
+
+// Middleware checks every request under the document's server path, and
+// the response to it, and hands what does not match to report. It does not
+// change either, so it can sit in front of the running app to log drift as
+// well as in tests:
+//
+//	handler := spec.Middleware(app.routes(), func(r *http.Request, err error) {
+//		t.Error(err)
+//	})
+func (s *Spec) Middleware(next http.Handler, report func(*http.Request, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.Covers(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := s.ValidateRequest(r); err != nil {
+			report(r, err)
+		}
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if err := s.ValidateResponse(r, rec.status, w.Header(), rec.body.Bytes()); err != nil {
+			report(r, err)
+		}
+	})
+}
+
+// recorder passes a response through while keeping its status and a copy
+// of its body.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tempPrefix marks files Put is still writing; List skips them.
+const tempPrefix = ".tmp-"
+
+// Local stores objects as files under a root directory.
+type Local struct {
+	root string
+}
+
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+	return &Local{root: root}, nil
+}
+
+func (l *Local) path(key string) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file next to the destination and renames it
+// into place, so an upload cut off halfway never leaves a truncated file.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	dstPath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dstPath), tempPrefix+filepath.Base(dstPath)+"-*")
+	if err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("storage: writing %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("storage: writing %s: %w", key, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), dstPath); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+	return nil
+}
+
+func (l *Local) Get(ctx context.Context, key string) (Object, ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, ObjectInfo{}, localError(key, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, localError(key, err)
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	return f, localInfo(key, info), nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("storage: %w", err)
+	}
+	l.removeEmptyParents(filepath.Dir(p))
+	return nil
+}
+
+// removeEmptyParents tidies up directories left empty by Delete, so deleting
+// every object under a prefix leaves no trace, as it would in a bucket.
+func (l *Local) removeEmptyParents(dir string) {
+	root := filepath.Clean(l.root)
+	for dir != root && strings.HasPrefix(dir, root) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// List only walks the directory prefix is in: for "visuals/3/" that is the
+// one visual's, not the whole store.
+func (l *Local) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	start := l.root
+	if dir := prefix[:strings.LastIndex(prefix, "/")+1]; dir != "" {
+		p, err := l.path(dir)
+		if err != nil {
+			return nil, err
+		}
+		start = p
+	}
+	var objects []ObjectInfo
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Nothing was ever stored under prefix.
+			if p == start && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, localInfo(key, info))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storage: listing %q: %w", prefix, err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, localError(key, err)
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return localInfo(key, info), nil
+}
+
+func (l *Local) URL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return "", ErrNoURL
+}
+
+func localInfo(key string, info fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:         key,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+	}
+}
+
+func localError(key string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return fmt.Errorf("storage: %s: %w", key, err)
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type S3Config struct {
+	// Endpoint is the host[:port] of the service, e.g. "s3.eu-west-1.amazonaws.com"
+	// or "localhost:9000" for a local MinIO.
+	Endpoint        string
+	Bucket          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Insecure talks plain HTTP, for a MinIO on localhost.
+	Insecure bool
+	// Prefix is prepended to every key, so several sites can share a bucket.
+	Prefix string
+}
+
+// S3 stores objects in a bucket of an S3-compatible service.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3(ctx context.Context, cfg S3Config) (*S3, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
+		Secure: !cfg.Insecure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("storage: checking bucket %s: %w", cfg.Bucket, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("storage: bucket %s does not exist", cfg.Bucket)
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3{client: client, bucket: cfg.Bucket, prefix: prefix}, nil
+}
+
+func (s *S3) objectName(key string) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return s.prefix + key, nil
+}
+
+// Put uploads r in one request when size is known, or in multipart chunks
+// otherwise. S3 only makes an object visible once the upload completes.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	name, err := s.objectName(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, s.bucket, name, r, size, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return fmt.Errorf("storage: uploading %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (Object, ObjectInfo, error) {
+	name, err := s.objectName(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, s3Error(key, err)
+	}
+	// GetObject is lazy; Stat makes the request and surfaces a missing key.
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, ObjectInfo{}, s3Error(key, err)
+	}
+	return obj, s.info(info), nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	name, err := s.objectName(key)
+	if err != nil {
+		return err
+	}
+	if err := s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("storage: deleting %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for info := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix + prefix, Recursive: true}) {
+		if info.Err != nil {
+			return nil, fmt.Errorf("storage: listing %q: %w", prefix, info.Err)
+		}
+		objects = append(objects, s.info(info))
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	name, err := s.objectName(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, s3Error(key, err)
+	}
+	return s.info(info), nil
+}
+
+// URL returns a presigned GET link.
+func (s *S3) URL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	name, err := s.objectName(key)
+	if err != nil {
+		return "", err
+	}
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, name, expiry, nil)
+	if err != nil {
+		return "", fmt.Errorf("storage: presigning %s: %w", key, err)
+	}
+	return u.String(), nil
+}
+
+func (s *S3) info(info minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:         strings.TrimPrefix(info.Key, s.prefix),
+		Size:        info.Size,
+		ModTime:     info.LastModified,
+		ContentType: info.ContentType,
+	}
+}
+
+func s3Error(key string, err error) error {
+	if resp := minio.ToErrorResponse(err); resp.StatusCode == http.StatusNotFound || resp.Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return fmt.Errorf("storage: %s: %w", key, err)
+}
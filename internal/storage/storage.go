@@ -0,0 +1,90 @@
+// Package storage abstracts where uploaded files live. Files are addressed by
+// slash-separated keys relative to the storage root, such as
+// "visuals/3/5f0c....jpg"; the same key is what appears after /fs/ in URLs.
+//
+// Local keeps files in a directory on disk, S3 in a bucket of any
+// S3-compatible service (AWS, MinIO, Cloudflare R2, ...).
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Get and Stat for keys that do not exist.
+var ErrNotFound = errors.New("storage: object not found")
+
+// ErrNoURL is returned by URL when the backend cannot hand out direct links
+// and files have to be served through the app.
+var ErrNoURL = errors.New("storage: backend has no direct URLs")
+
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+// Object is an open file. It can seek, so it can be passed straight to
+// http.ServeContent.
+type Object interface {
+	io.ReadSeekCloser
+}
+
+type Storage interface {
+	// Put stores r under key, replacing any existing object. Readers never
+	// see a partially written object.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (Object, ObjectInfo, error)
+	// Delete removes key. Deleting a key that does not exist is not an error.
+	Delete(ctx context.Context, key string) error
+	// List returns every object whose key starts with prefix, at any depth,
+	// ordered by key.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// URL returns a link the browser can fetch the object from directly,
+	// valid for at least expiry, or ErrNoURL.
+	URL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// DeletePrefix removes every object under prefix, the equivalent of
+// os.RemoveAll on a directory.
+func DeletePrefix(ctx context.Context, s Storage, prefix string) error {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	objects, err := s.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if err := s.Delete(ctx, o.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanKey validates a key taken from a URL or the database and returns it
+// in canonical form. Keys must be relative and may not climb out of the root.
+func CleanKey(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("storage: empty key")
+	}
+	if strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("storage: invalid key %q (contains '..')", key)
+		}
+	}
+	cleaned := path.Clean(key)
+	if cleaned == "." {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	s, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+}
+
+// TestS3 runs against the bucket in PORTFOLIO_TEST_S3_BUCKET at
+// PORTFOLIO_TEST_S3_ENDPOINT, for instance a local MinIO:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	mc alias set local http://localhost:9000 minioadmin minioadmin && mc mb local/test
+//	PORTFOLIO_TEST_S3_ENDPOINT=localhost:9000 PORTFOLIO_TEST_S3_BUCKET=test \
+//	PORTFOLIO_TEST_S3_ACCESS_KEY_ID=minioadmin PORTFOLIO_TEST_S3_SECRET_ACCESS_KEY=minioadmin \
+//	PORTFOLIO_TEST_S3_INSECURE=1 go test ./internal/storage
+//
+// Each run works under a prefix of its own and removes it afterwards.
+func TestS3(t *testing.T) {
+	endpoint := os.Getenv("PORTFOLIO_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("PORTFOLIO_TEST_S3_ENDPOINT is not set")
+	}
+	ctx := context.Background()
+	s, err := NewS3(ctx, S3Config{
+		Endpoint:        endpoint,
+		Bucket:          os.Getenv("PORTFOLIO_TEST_S3_BUCKET"),
+		Region:          os.Getenv("PORTFOLIO_TEST_S3_REGION"),
+		AccessKeyID:     os.Getenv("PORTFOLIO_TEST_S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("PORTFOLIO_TEST_S3_SECRET_ACCESS_KEY"),
+		Insecure:        os.Getenv("PORTFOLIO_TEST_S3_INSECURE") != "",
+		Prefix:          "storage-test-" + rand.Text(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		objects, _ := s.List(ctx, "")
+		for _, o := range objects {
+			s.Delete(ctx, o.Key)
+		}
+	})
+	testStorage(t, s)
+}
+
+// testStorage checks the behaviour every backend must have.
+func testStorage(t *testing.T, s Storage) {
+	ctx := context.Background()
+	put := func(key, data string) {
+		t.Helper()
+		if err := s.Put(ctx, key, strings.NewReader(data), int64(len(data)), "image/jpeg"); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+	get := func(key string) string {
+		t.Helper()
+		obj, info, err := s.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", key, err)
+		}
+		defer obj.Close()
+		data, err := io.ReadAll(obj)
+		if err != nil {
+			t.Fatalf("reading %q: %v", key, err)
+		}
+		if info.Key != key || info.Size != int64(len(data)) {
+			t.Errorf("Get(%q) info = %+v for %d bytes", key, info, len(data))
+		}
+		return string(data)
+	}
+	list := func(prefix string) []string {
+		t.Helper()
+		objects, err := s.List(ctx, prefix)
+		if err != nil {
+			t.Fatalf("List(%q): %v", prefix, err)
+		}
+		var keys []string
+		for _, o := range objects {
+			keys = append(keys, o.Key)
+		}
+		return keys
+	}
+
+	t.Run("PutGetStat", func(t *testing.T) {
+		put("visuals/1/a.jpg", "first")
+		put("visuals/1/a.jpg", "second")
+		if got := get("visuals/1/a.jpg"); got != "second" {
+			t.Errorf("Get after replacing = %q, want %q", got, "second")
+		}
+		info, err := s.Stat(ctx, "visuals/1/a.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Key != "visuals/1/a.jpg" || info.Size != 6 || info.ContentType != "image/jpeg" || info.ModTime.IsZero() {
+			t.Errorf("Stat = %+v", info)
+		}
+		// Get hands out a seekable object, for http.ServeContent.
+		obj, _, err := s.Get(ctx, "visuals/1/a.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer obj.Close()
+		if _, err := obj.Seek(3, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if rest, _ := io.ReadAll(obj); string(rest) != "ond" {
+			t.Errorf("read after Seek(3) = %q, want %q", rest, "ond")
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		if _, _, err := s.Get(ctx, "visuals/1/missing.jpg"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get of a missing key: %v, want ErrNotFound", err)
+		}
+		if _, err := s.Stat(ctx, "visuals/1/missing.jpg"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat of a missing key: %v, want ErrNotFound", err)
+		}
+		if err := s.Delete(ctx, "visuals/1/missing.jpg"); err != nil {
+			t.Errorf("Delete of a missing key: %v", err)
+		}
+		if keys := list("nothing/here/"); len(keys) != 0 {
+			t.Errorf("List of a missing prefix = %q", keys)
+		}
+	})
+
+	t.Run("KeyEscaping", func(t *testing.T) {
+		for _, key := range []string{
+			"covers/with space.png",
+			"covers/plus+percent%20.png",
+			"covers/ünïcødé.png",
+			"covers/question?hash#.png",
+		} {
+			put(key, key)
+			if got := get(key); got != key {
+				t.Errorf("Get(%q) = %q", key, got)
+			}
+			if keys := list(key); !slices.Equal(keys, []string{key}) {
+				t.Errorf("List(%q) = %q", key, keys)
+			}
+		}
+		for _, key := range []string{"", "/etc/passwd", "../outside", "visuals/../../outside", `visuals\1\a.jpg`} {
+			if err := s.Put(ctx, key, strings.NewReader("x"), 1, ""); err == nil {
+				t.Errorf("Put(%q) succeeded", key)
+			}
+			if _, _, err := s.Get(ctx, key); err == nil || errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(%q): %v, want an invalid key error", key, err)
+			}
+		}
+		// Non-canonical keys name the same object as their clean form.
+		put("covers/./dot//slashes.png", "clean")
+		if got := get("covers/dot/slashes.png"); got != "clean" {
+			t.Errorf("Get of the cleaned key = %q", got)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		for _, key := range []string{"visuals/3/b.jpg", "visuals/3/a.jpg", "visuals/3/thumbnails/small/a.webp", "visuals/30/c.jpg", "visuals/4/d.jpg"} {
+			put(key, "x")
+		}
+		want := []string{"visuals/3/a.jpg", "visuals/3/b.jpg", "visuals/3/thumbnails/small/a.webp"}
+		if got := list("visuals/3/"); !slices.Equal(got, want) {
+			t.Errorf("List(visuals/3/) = %q, want %q", got, want)
+		}
+		// A prefix is a prefix of the key, not a directory.
+		want = append(want, "visuals/30/c.jpg")
+		if got := list("visuals/3"); !slices.Equal(got, want) {
+			t.Errorf("List(visuals/3) = %q, want %q", got, want)
+		}
+		if got := list("visuals/3/thumb"); !slices.Equal(got, []string{"visuals/3/thumbnails/small/a.webp"}) {
+			t.Errorf("List(visuals/3/thumb) = %q", got)
+		}
+	})
+
+	t.Run("DeletePrefix", func(t *testing.T) {
+		for i := range 3 {
+			put(fmt.Sprintf("visuals/7/%d.jpg", i), "x")
+		}
+		put("visuals/70/keep.jpg", "x")
+		if err := DeletePrefix(ctx, s, "visuals/7"); err != nil {
+			t.Fatal(err)
+		}
+		if keys := list("visuals/7/"); len(keys) != 0 {
+			t.Errorf("left after DeletePrefix: %q", keys)
+		}
+		if keys := list("visuals/70/"); !slices.Equal(keys, []string{"visuals/70/keep.jpg"}) {
+			t.Errorf("DeletePrefix(visuals/7) took visuals/70 with it: %q", keys)
+		}
+		if err := s.Delete(ctx, "visuals/70/keep.jpg"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Stat(ctx, "visuals/70/keep.jpg"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat after Delete: %v", err)
+		}
+	})
+}
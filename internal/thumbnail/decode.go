@@ -0,0 +1,91 @@
+package thumbnail
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/gen2brain/heic"
+)
+
+// ISO-BMFF brands, as listed in the ftyp box at the start of a file. iPhones
+// write HEVC-coded HEIF, which goes by HEIC.
+var (
+	heicBrands = []string{"heic", "heix", "hevc", "hevx", "heim", "heis"}
+	avifBrands = []string{"avif", "avis"}
+	heifBrands = []string{"mif1", "msf1"}
+)
+
+// DetectContentType is http.DetectContentType, which does not know HEIF,
+// plus sniffing for the HEIF family.
+func DetectContentType(data []byte) string {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return http.DetectContentType(data)
+	}
+	// The box holds the major brand, a minor version and then the
+	// compatible brands, to its end.
+	end := min(int(binary.BigEndian.Uint32(data)), len(data))
+	brands := []string{string(data[8:12])}
+	for i := 16; i+4 <= end; i += 4 {
+		brands = append(brands, string(data[i:i+4]))
+	}
+	hasBrand := func(want []string) bool {
+		return slices.ContainsFunc(brands, func(b string) bool { return slices.Contains(want, b) })
+	}
+	switch {
+	case hasBrand(heicBrands):
+		return "image/heic"
+	case hasBrand(avifBrands):
+		return "image/avif"
+	case hasBrand(heifBrands):
+		return "image/heif"
+	}
+	return http.DetectContentType(data)
+}
+
+func IsHEIF(contentType string) bool {
+	return contentType == "image/heic" || contentType == "image/heif"
+}
+
+// Decode decodes an upload the right way up, HEIC included. It also returns
+// the sniffed content type.
+func Decode(r io.Reader) (image.Image, string, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(512)
+	contentType := DetectContentType(head)
+	if IsHEIF(contentType) {
+		// libheif applies the rotation stored in the file itself.
+		img, err := heic.Decode(br)
+		if err != nil {
+			return nil, contentType, fmt.Errorf("decoding HEIC: %w", err)
+		}
+		return img, contentType, nil
+	}
+	img, err := imaging.Decode(br, imaging.AutoOrientation(true))
+	return img, contentType, err
+}
+
+// MasterQuality is the JPEG quality masters are stored at.
+const MasterQuality = 90
+
+// MasterKey is where a JPEG copy of an original browsers cannot show, such
+// as HEIC, is kept, for thumbnails and resizing to be made from.
+func MasterKey(photoPath string) string {
+	name := path.Base(photoPath)
+	name = strings.TrimSuffix(name, path.Ext(name)) + ".jpg"
+	return path.Join(path.Dir(photoPath), "masters", name)
+}
+
+// NeedsMaster guesses from its name whether the original at photoPath is
+// one browsers cannot show, and so has a master.
+func NeedsMaster(photoPath string) bool {
+	ext := strings.ToLower(path.Ext(photoPath))
+	return ext == ".heic" || ext == ".heif"
+}
@@ -0,0 +1,66 @@
+package thumbnail
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// ftyp is the start of an ISO-BMFF file: its ftyp box followed by what
+// comes after.
+func ftyp(major string, compatible []string, after string) []byte {
+	box := make([]byte, 16, 16+4*len(compatible))
+	binary.BigEndian.PutUint32(box, uint32(16+4*len(compatible)))
+	copy(box[4:], "ftyp")
+	copy(box[8:], major)
+	for _, b := range compatible {
+		box = append(box, b...)
+	}
+	return append(box, after...)
+}
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"iPhone photo", ftyp("heic", []string{"mif1", "heic"}, ""), "image/heic"},
+		{"heix", ftyp("heix", []string{"mif1", "heix"}, ""), "image/heic"},
+		{"HEVC as a compatible brand", ftyp("mif1", []string{"mif1", "heic"}, ""), "image/heic"},
+		{"plain HEIF", ftyp("mif1", []string{"mif1", "miaf"}, ""), "image/heif"},
+		{"avif", ftyp("avif", []string{"avif", "mif1", "miaf"}, ""), "image/avif"},
+		{"avif over mif1", ftyp("mif1", []string{"avif"}, ""), "image/avif"},
+		{"brand after the box", ftyp("isom", []string{"mp41"}, "heic"), "video/mp4"},
+		{"mp4", ftyp("isom", []string{"isom", "iso2", "mp41"}, ""), "video/mp4"},
+		{"jpeg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), "image/jpeg"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "image/png"},
+		{"webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), "image/webp"},
+		{"too short", []byte("\x00\x00\x00\x0cftyp"), "application/octet-stream"},
+		{"empty", nil, "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		if got := DetectContentType(tt.data); got != tt.want {
+			t.Errorf("%s: DetectContentType = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// A box that claims more than was read is cut short, not overrun.
+	truncated := ftyp("mif1", []string{"mif1", "heic"}, "")
+	binary.BigEndian.PutUint32(truncated, 4096)
+	if got := DetectContentType(truncated); got != "image/heic" {
+		t.Errorf("truncated box: DetectContentType = %q, want image/heic", got)
+	}
+}
+
+func TestIsHEIF(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"image/heic": true,
+		"image/heif": true,
+		"image/avif": false,
+		"image/jpeg": false,
+	} {
+		if got := IsHEIF(contentType); got != want {
+			t.Errorf("IsHEIF(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Package thumbnail makes the thumbnails of uploaded images: which sizes and
+// formats there are, where each is stored, and how an original is decoded,
+// resized, watermarked and encoded into them. The web app's background jobs
+// and the make-thumbnails tool both go through it, so they agree on all of
+// that.
+package thumbnail
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/webp"
+)
+
+// Config is one thumbnail size.
+type Config struct {
+	Name    string `yaml:"name" toml:"name"`
+	Width   int    `yaml:"width" toml:"width"`
+	Quality int    `yaml:"quality" toml:"quality"`
+	Crop    bool   `yaml:"crop" toml:"crop"`
+	// Formats are the encodings stored, out of avif, webp and jpeg. Browsers
+	// get the best one they accept; jpeg is the fallback for the rest and
+	// must be included. Empty means jpeg only.
+	Formats []string `yaml:"formats" toml:"formats"`
+	// Watermark, if set, is drawn on every thumbnail of this size.
+	Watermark *WatermarkConfig `yaml:"watermark,omitempty" toml:"watermark,omitempty"`
+}
+
+// Defaults are the sizes made when none are configured.
+func Defaults() []Config {
+	return []Config{
+		{Name: "mini", Width: 40, Quality: 80, Crop: true, Formats: []string{"webp", "jpeg"}},
+		{Name: "small", Width: 150, Quality: 80, Formats: []string{"avif", "webp", "jpeg"}},
+		{Name: "medium", Width: 600, Quality: 80, Formats: []string{"avif", "webp", "jpeg"}},
+		{Name: "large", Width: 1080, Quality: 80, Formats: []string{"avif", "webp", "jpeg"}},
+	}
+}
+
+// Validate returns what is wrong with c, if anything.
+func (c Config) Validate() []string {
+	var problems []string
+	if c.Width <= 0 {
+		problems = append(problems, "width must be positive")
+	}
+	if c.Quality < 1 || c.Quality > 100 {
+		problems = append(problems, "quality must be between 1 and 100")
+	}
+	for _, f := range c.Formats {
+		if _, ok := LookupFormat(f); !ok {
+			problems = append(problems, fmt.Sprintf("unknown format %q (want avif, webp or jpeg)", f))
+		}
+	}
+	if len(c.Formats) > 0 && !slices.Contains(c.Formats, JPEG) {
+		problems = append(problems, "formats must include jpeg")
+	}
+	if c.Watermark != nil {
+		for _, p := range c.Watermark.validate() {
+			problems = append(problems, "watermark: "+p)
+		}
+	}
+	return problems
+}
+
+// Format is an encoding thumbnails can be stored in.
+type Format struct {
+	Name        string
+	Ext         string
+	ContentType string
+	encode      func(w io.Writer, img image.Image, quality int) error
+}
+
+// Encode writes img to w in f.
+func (f Format) Encode(w io.Writer, img image.Image, quality int) error {
+	return f.encode(w, img, quality)
+}
+
+// Formats lists the supported formats, smallest files first. That is also
+// the order they are preferred in when a browser accepts several equally.
+var Formats = []Format{
+	{Name: "avif", Ext: ".avif", ContentType: "image/avif", encode: func(w io.Writer, img image.Image, quality int) error {
+		// Speed 8 keeps a large thumbnail at a few seconds of CPU.
+		return avif.Encode(w, img, avif.Options{Quality: quality, QualityAlpha: quality, Speed: 8})
+	}},
+	{Name: "webp", Ext: ".webp", ContentType: "image/webp", encode: func(w io.Writer, img image.Image, quality int) error {
+		return webp.Encode(w, img, webp.Options{Quality: quality, Method: 4})
+	}},
+	{Name: "jpeg", Ext: ".jpg", ContentType: "image/jpeg", encode: func(w io.Writer, img image.Image, quality int) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}},
+}
+
+// JPEG is the name of the fallback format every browser can show.
+const JPEG = "jpeg"
+
+func LookupFormat(name string) (Format, bool) {
+	for _, f := range Formats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// StoredFormats returns the formats c is stored in, in order of preference.
+func (c Config) StoredFormats() []Format {
+	var formats []Format
+	for _, f := range Formats {
+		if slices.Contains(c.Formats, f.Name) {
+			formats = append(formats, f)
+		}
+	}
+	if len(formats) == 0 {
+		f, _ := LookupFormat(JPEG)
+		formats = append(formats, f)
+	}
+	return formats
+}
+
+// Key is where the thumbnail of photoPath of the given size is stored in
+// format f: the original's name with the extension of f, so a PNG original
+// gets thumbnails/<size>/<name>.jpg, .webp and .avif.
+func Key(photoPath, size string, f Format) string {
+	name := path.Base(photoPath)
+	name = strings.TrimSuffix(name, path.Ext(name)) + f.Ext
+	return path.Join(path.Dir(photoPath), "thumbnails", size, name)
+}
+
+// LegacyKey is where thumbnails were stored before they had formats: always
+// JPEG, under the original's name.
+func LegacyKey(photoPath, size string) string {
+	return path.Join(path.Dir(photoPath), "thumbnails", size, path.Base(photoPath))
+}
+
+// Keys lists every key the thumbnails of photoPath may be stored under,
+// including the ones written before thumbnails had formats.
+func Keys(photoPath string, configs []Config) []string {
+	var keys []string
+	for _, c := range configs {
+		keys = append(keys, LegacyKey(photoPath, c.Name))
+		for _, f := range Formats {
+			if key := Key(photoPath, c.Name, f); !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// Renderer turns decoded originals into thumbnails, watermarks included.
+type Renderer struct {
+	watermarks map[string]*watermark
+}
+
+// NewRenderer prepares the watermarks of configs.
+func NewRenderer(configs []Config) (*Renderer, error) {
+	watermarks, err := loadWatermarks(configs)
+	if err != nil {
+		return nil, err
+	}
+	return &Renderer{watermarks: watermarks}, nil
+}
+
+// Render returns the thumbnail of img for c. It is never wider than img.
+func (r *Renderer) Render(img image.Image, c Config) image.Image {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	var thumb image.Image
+	if c.Crop {
+		side := min(c.Width, width, height)
+		thumb = imaging.Fill(img, side, side, imaging.Center, imaging.Lanczos)
+	} else {
+		thumb = imaging.Resize(img, min(c.Width, width), 0, imaging.Lanczos)
+	}
+	if w := r.watermarks[c.Name]; w != nil {
+		thumb = w.apply(thumb)
+	}
+	return thumb
+}
@@ -0,0 +1,239 @@
+package thumbnail
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// WatermarkConfig overlays a mark on every thumbnail of a size: Text drawn
+// in white with a dark outline, or the PNG at Image, transparency kept.
+// Exactly one of the two is set.
+type WatermarkConfig struct {
+	Text  string `yaml:"text,omitempty" toml:"text,omitempty"`
+	Image string `yaml:"image,omitempty" toml:"image,omitempty"`
+	// Position is where the mark goes: one of WatermarkPositions, default
+	// bottom-right.
+	Position string `yaml:"position,omitempty" toml:"position,omitempty"`
+	// Opacity is from 0 (invisible) to 1; 0 means the default, 0.5.
+	Opacity float64 `yaml:"opacity,omitempty" toml:"opacity,omitempty"`
+	// Scale is the width of the mark as a fraction of the thumbnail's; 0
+	// means the default, 0.25.
+	Scale float64 `yaml:"scale,omitempty" toml:"scale,omitempty"`
+}
+
+// WatermarkPositions are the values of WatermarkConfig.Position.
+var WatermarkPositions = []string{
+	"top-left", "top", "top-right",
+	"left", "center", "right",
+	"bottom-left", "bottom", "bottom-right",
+}
+
+const (
+	defaultWatermarkPosition = "bottom-right"
+	defaultWatermarkOpacity  = 0.5
+	defaultWatermarkScale    = 0.25
+	// watermarkTextSize is the pixel size text marks are rendered at, large
+	// enough that they are only ever scaled down.
+	watermarkTextSize = 160
+	// watermarkMargin is the gap between a mark and the edges, as a
+	// fraction of the thumbnail's shorter side.
+	watermarkMargin = 0.03
+)
+
+func (w WatermarkConfig) validate() []string {
+	var problems []string
+	if (w.Text == "") == (w.Image == "") {
+		problems = append(problems, "exactly one of text and image must be set")
+	}
+	if w.Position != "" && !slices.Contains(WatermarkPositions, w.Position) {
+		problems = append(problems, fmt.Sprintf("position %q is not one of %s", w.Position, strings.Join(WatermarkPositions, ", ")))
+	}
+	if w.Opacity < 0 || w.Opacity > 1 {
+		problems = append(problems, "opacity must be between 0 and 1")
+	}
+	if w.Scale < 0 || w.Scale > 1 {
+		problems = append(problems, "scale must be between 0 and 1")
+	}
+	return problems
+}
+
+// watermark is a mark ready to be applied.
+type watermark struct {
+	mark     image.Image
+	position string
+	opacity  float64
+	scale    float64
+}
+
+// loadWatermarks prepares the marks of the thumbnail sizes that have one,
+// keyed by size name.
+func loadWatermarks(configs []Config) (map[string]*watermark, error) {
+	watermarks := map[string]*watermark{}
+	for _, t := range configs {
+		if t.Watermark == nil {
+			continue
+		}
+		w := watermark{
+			position: cmp.Or(t.Watermark.Position, defaultWatermarkPosition),
+			opacity:  cmp.Or(t.Watermark.Opacity, defaultWatermarkOpacity),
+			scale:    cmp.Or(t.Watermark.Scale, defaultWatermarkScale),
+		}
+		var err error
+		if t.Watermark.Image != "" {
+			w.mark, err = loadWatermarkImage(t.Watermark.Image)
+		} else {
+			w.mark, err = renderWatermarkText(t.Watermark.Text)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("thumbnail %q watermark: %w", t.Name, err)
+		}
+		watermarks[t.Name] = &w
+	}
+	return watermarks, nil
+}
+
+func loadWatermarkImage(name string) (image.Image, error) {
+	if !strings.EqualFold(path.Ext(name), ".png") {
+		return nil, errors.New("image must be a PNG")
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return imaging.Decode(f)
+}
+
+// renderWatermarkText draws text in Go Regular, white, with a dark outline
+// so that it shows on light and dark photos alike.
+func renderWatermarkText(text string) (image.Image, error) {
+	mask, err := rasterizeText(text)
+	if err != nil {
+		return nil, err
+	}
+	outline := watermarkTextSize / 24
+	b := mask.Bounds()
+	img := image.NewNRGBA(image.Rect(0, 0, b.Dx()+2*outline, b.Dy()+2*outline))
+	shadow := image.NewUniform(color.NRGBA{A: 160})
+	for dx := 0; dx <= 2*outline; dx += outline {
+		for dy := 0; dy <= 2*outline; dy += outline {
+			draw.DrawMask(img, b.Add(image.Pt(dx, dy)), shadow, image.Point{}, mask, image.Point{}, draw.Over)
+		}
+	}
+	draw.DrawMask(img, b.Add(image.Pt(outline, outline)), image.White, image.Point{}, mask, image.Point{}, draw.Over)
+	return img, nil
+}
+
+// rasterizeText returns the coverage of text set in Go Regular at
+// watermarkTextSize, one line, cropped to the font's ascent and descent.
+func rasterizeText(text string) (*image.Alpha, error) {
+	f, err := sfnt.Parse(goregular.TTF)
+	if err != nil {
+		return nil, err
+	}
+	var buf sfnt.Buffer
+	ppem := fixed.I(watermarkTextSize)
+	metrics, err := f.Metrics(&buf, ppem, font.HintingNone)
+	if err != nil {
+		return nil, err
+	}
+
+	type glyph struct {
+		segments []sfnt.Segment
+		x        fixed.Int26_6
+	}
+	var glyphs []glyph
+	var x fixed.Int26_6
+	prev := sfnt.GlyphIndex(0)
+	for _, r := range text {
+		idx, err := f.GlyphIndex(&buf, r)
+		if err != nil {
+			return nil, err
+		}
+		if prev != 0 {
+			if kern, err := f.Kern(&buf, prev, idx, ppem, font.HintingNone); err == nil {
+				x += kern
+			}
+		}
+		segments, err := f.LoadGlyph(&buf, idx, ppem, nil)
+		if err != nil {
+			return nil, err
+		}
+		// LoadGlyph reuses buf for the segments.
+		glyphs = append(glyphs, glyph{slices.Clone(segments), x})
+		advance, err := f.GlyphAdvance(&buf, idx, ppem, font.HintingNone)
+		if err != nil {
+			return nil, err
+		}
+		x += advance
+		prev = idx
+	}
+
+	width, height := max(1, x.Ceil()), max(1, (metrics.Ascent+metrics.Descent).Ceil())
+	z := vector.NewRasterizer(width, height)
+	pt := func(p fixed.Point26_6, dx fixed.Int26_6) (float32, float32) {
+		return float32(p.X+dx) / 64, float32(p.Y+metrics.Ascent) / 64
+	}
+	for _, g := range glyphs {
+		for _, s := range g.segments {
+			ax, ay := pt(s.Args[0], g.x)
+			bx, by := pt(s.Args[1], g.x)
+			cx, cy := pt(s.Args[2], g.x)
+			switch s.Op {
+			case sfnt.SegmentOpMoveTo:
+				z.ClosePath()
+				z.MoveTo(ax, ay)
+			case sfnt.SegmentOpLineTo:
+				z.LineTo(ax, ay)
+			case sfnt.SegmentOpQuadTo:
+				z.QuadTo(ax, ay, bx, by)
+			case sfnt.SegmentOpCubeTo:
+				z.CubeTo(ax, ay, bx, by, cx, cy)
+			}
+		}
+		z.ClosePath()
+	}
+	mask := image.NewAlpha(z.Bounds())
+	z.Draw(mask, mask.Bounds(), image.Opaque, image.Point{})
+	return mask, nil
+}
+
+// apply returns img with the mark on it, scaled to img's width.
+func (w *watermark) apply(img image.Image) image.Image {
+	b := img.Bounds()
+	mark := imaging.Resize(w.mark, max(1, int(float64(b.Dx())*w.scale)), 0, imaging.Lanczos)
+	mb := mark.Bounds()
+	margin := int(float64(min(b.Dx(), b.Dy())) * watermarkMargin)
+
+	x, y := (b.Dx()-mb.Dx())/2, (b.Dy()-mb.Dy())/2
+	if strings.HasSuffix(w.position, "left") {
+		x = margin
+	} else if strings.HasSuffix(w.position, "right") {
+		x = b.Dx() - mb.Dx() - margin
+	}
+	if strings.HasPrefix(w.position, "top") {
+		y = margin
+	} else if strings.HasPrefix(w.position, "bottom") {
+		y = b.Dy() - mb.Dy() - margin
+	}
+
+	dst := imaging.Clone(img)
+	opacity := &image.Uniform{color.Alpha{A: uint8(w.opacity * 255)}}
+	draw.DrawMask(dst, mb.Add(image.Pt(x, y)), mark, image.Point{}, opacity, image.Point{}, draw.Over)
+	return dst
+}
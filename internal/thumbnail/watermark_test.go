@@ -0,0 +1,119 @@
+package thumbnail
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func filled(w, h int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+// markBounds is the rectangle of img brighter than mid-grey.
+func markBounds(img image.Image) image.Rectangle {
+	var r image.Rectangle
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if red, _, _, _ := img.At(x, y).RGBA(); red > 0x8000 {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
+
+func TestWatermarkPlacement(t *testing.T) {
+	// On a 400x200 photo a 0.25 mark is 100 wide and keeps the 2:1 of
+	// the source, 6 pixels (3% of the shorter side) from the edges.
+	photo := filled(400, 200, color.Black)
+	tests := map[string]image.Point{
+		"top-left":     {6, 6},
+		"top":          {150, 6},
+		"top-right":    {294, 6},
+		"left":         {6, 75},
+		"center":       {150, 75},
+		"right":        {294, 75},
+		"bottom-left":  {6, 144},
+		"bottom":       {150, 144},
+		"bottom-right": {294, 144},
+	}
+	for position, at := range tests {
+		w := &watermark{mark: filled(200, 100, color.White), position: position, opacity: 1, scale: 0.25}
+		got := markBounds(w.apply(photo))
+		if want := image.Rect(0, 0, 100, 50).Add(at); got != want {
+			t.Errorf("%s: mark at %v, want %v", position, got, want)
+		}
+	}
+	if markBounds(photo) != (image.Rectangle{}) {
+		t.Error("apply drew on the original")
+	}
+}
+
+func TestWatermarkScaleAndOpacity(t *testing.T) {
+	photo := filled(400, 300, color.Black)
+	for _, scale := range []float64{0.1, 0.5, 1} {
+		w := &watermark{mark: filled(100, 100, color.White), position: "center", opacity: 1, scale: scale}
+		if got, want := markBounds(w.apply(photo)).Dx(), int(400*scale); got != want {
+			t.Errorf("scale %v: mark is %d wide, want %d", scale, got, want)
+		}
+	}
+
+	w := &watermark{mark: filled(100, 100, color.White), position: "center", opacity: 0.5, scale: 0.5}
+	r, _, _, _ := w.apply(photo).At(200, 150).RGBA()
+	if r>>8 < 120 || r>>8 > 135 {
+		t.Errorf("half opaque white on black is %d, want about 127", r>>8)
+	}
+}
+
+func TestLoadWatermarks(t *testing.T) {
+	watermarks, err := loadWatermarks([]Config{
+		{Name: "small"},
+		{Name: "large", Watermark: &WatermarkConfig{Text: "© Yuanyuan Zhou"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := watermarks["small"]; ok || len(watermarks) != 1 {
+		t.Fatalf("watermarks for %v, want only large", watermarks)
+	}
+	w := watermarks["large"]
+	if w.position != defaultWatermarkPosition || w.opacity != defaultWatermarkOpacity || w.scale != defaultWatermarkScale {
+		t.Errorf("defaults not applied: %+v", w)
+	}
+	b := w.mark.Bounds()
+	if b.Dx() <= b.Dy() || b.Dy() < watermarkTextSize {
+		t.Errorf("text mark is %v, want one line at least %d high", b, watermarkTextSize)
+	}
+	if markBounds(w.mark).Empty() {
+		t.Error("text mark has no white in it")
+	}
+
+	if _, err := loadWatermarks([]Config{{Name: "large", Watermark: &WatermarkConfig{Image: "mark.jpg"}}}); err == nil {
+		t.Error("a JPEG mark was accepted")
+	}
+}
+
+func TestWatermarkValidate(t *testing.T) {
+	tests := []struct {
+		config WatermarkConfig
+		ok     bool
+	}{
+		{WatermarkConfig{Text: "x"}, true},
+		{WatermarkConfig{Image: "mark.png", Position: "top", Opacity: 1, Scale: 1}, true},
+		{WatermarkConfig{}, false},
+		{WatermarkConfig{Text: "x", Image: "mark.png"}, false},
+		{WatermarkConfig{Text: "x", Position: "middle"}, false},
+		{WatermarkConfig{Text: "x", Opacity: 1.5}, false},
+		{WatermarkConfig{Text: "x", Scale: -0.1}, false},
+	}
+	for _, tt := range tests {
+		if problems := tt.config.validate(); (len(problems) == 0) != tt.ok {
+			t.Errorf("%+v: %v", tt.config, problems)
+		}
+	}
+}
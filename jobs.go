@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/config"
+)
+
+const (
+	jobBaseBackoff = 10 * time.Second
+	jobMaxBackoff  = 10 * time.Minute
+	// Finished jobs are kept this long for inspection, then pruned.
+	jobRetention     = 7 * 24 * time.Hour
+	jobPruneInterval = time.Hour
+)
+
+// JobHandler performs one job. A returned error makes the job be retried
+// later, unless it wraps errJobPermanent.
+type JobHandler func(ctx context.Context, payload json.RawMessage) error
+
+// JobFailedHandler is called once a job has given up for good.
+type JobFailedHandler func(payload json.RawMessage, err error)
+
+type jobKind struct {
+	run    JobHandler
+	failed JobFailedHandler
+}
+
+// errJobPermanent marks failures that retrying cannot fix.
+var errJobPermanent = errors.New("permanent failure")
+
+type Job struct {
+	ID          int64
+	Kind        string
+	Payload     json.RawMessage
+	Attempts    int
+	MaxAttempts int
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so jobs can be enqueued
+// in the same transaction as the rows they belong to.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// JobQueue runs background work stored in the jobs table with a fixed pool
+// of workers. Jobs survive restarts: one interrupted mid-run is picked up
+// again on the next start.
+type JobQueue struct {
+	db           *sql.DB
+	workers      int
+	maxAttempts  int
+	pollInterval time.Duration
+	kinds        map[string]jobKind
+	now          func() time.Time
+
+	// Claiming is a read-modify-write; serialise it like the other SQLite
+	// writers so two workers never take the same job.
+	mu       sync.Mutex
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	running  sync.WaitGroup
+
+	// ctx is what handlers run with. Stop cancels it when its deadline
+	// passes with jobs still running.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newJobQueue(db *sql.DB, cfg config.JobsConfig) *JobQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &JobQueue{
+		db:           db,
+		workers:      cfg.Workers,
+		maxAttempts:  cfg.MaxAttempts,
+		pollInterval: cfg.PollInterval,
+		kinds:        map[string]jobKind{},
+		now:          func() time.Time { return time.Now().UTC() },
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+// Register sets the handlers for a kind of job; failed may be nil. It must
+// be called before Start.
+func (q *JobQueue) Register(kind string, run JobHandler, failed JobFailedHandler) {
+	q.kinds[kind] = jobKind{run: run, failed: failed}
+}
+
+// Enqueue adds a job through db, which may be a transaction. Call Notify
+// once it is committed to have a worker pick it up straight away.
+func (q *JobQueue) Enqueue(db execer, kind string, payload any) error {
+	if _, ok := q.kinds[kind]; !ok {
+		return fmt.Errorf("Enqueue: no handler for job kind %q", kind)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("Enqueue: %w", err)
+	}
+	now := q.now()
+	_, err = db.Exec(`
+		INSERT INTO jobs (kind, payload, max_attempts, run_after, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		kind, string(body), q.maxAttempts, now, now, now)
+	if err != nil {
+		return fmt.Errorf("Enqueue: %w", err)
+	}
+	return nil
+}
+
+// Notify wakes an idle worker.
+func (q *JobQueue) Notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start requeues jobs left running by a previous process and starts the
+// workers.
+func (q *JobQueue) Start() error {
+	result, err := q.db.Exec(`UPDATE jobs SET status = 'queued', updated_at = ? WHERE status = 'running'`, q.now())
+	if err != nil {
+		return fmt.Errorf("JobQueue.Start: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Requeued %d interrupted jobs", n)
+	}
+	for range q.workers {
+		q.running.Add(1)
+		go q.work()
+	}
+	return nil
+}
+
+// Stop stops the workers from claiming new jobs and waits for the ones in
+// progress to finish, or for ctx to expire. When it does, the context the
+// jobs run with is cancelled; jobs cut off that way are queued again
+// without counting the attempt, or picked up by Start if the process is
+// gone before that. Calling it again just waits again.
+func (q *JobQueue) Stop(ctx context.Context) error {
+	q.stopOnce.Do(func() { close(q.stop) })
+	done := make(chan struct{})
+	go func() {
+		q.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		return ctx.Err()
+	}
+}
+
+func (q *JobQueue) work() {
+	defer q.running.Done()
+	ticker := time.NewTicker(q.pollInterval)
+	defer ticker.Stop()
+	for {
+		// Drain the queue before going back to sleep.
+		for {
+			select {
+			case <-q.stop:
+				return
+			default:
+			}
+			job, err := q.claim()
+			if err != nil {
+				log.Printf("Job worker: %v", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			q.run(job)
+		}
+
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *JobQueue) claim() (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	var job Job
+	var payload string
+	err := q.db.QueryRow(`
+		UPDATE jobs SET status = 'running', attempts = attempts + 1, updated_at = ?
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE status = 'queued' AND run_after <= ?
+			ORDER BY run_after, id
+			LIMIT 1
+		)
+		RETURNING id, kind, payload, attempts, max_attempts`, now, now).
+		Scan(&job.ID, &job.Kind, &payload, &job.Attempts, &job.MaxAttempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claim: %w", err)
+	}
+	job.Payload = json.RawMessage(payload)
+	return &job, nil
+}
+
+func (q *JobQueue) run(job *Job) {
+	kind, ok := q.kinds[job.Kind]
+	var err error
+	if !ok {
+		err = fmt.Errorf("%w: no handler for job kind %q", errJobPermanent, job.Kind)
+	} else {
+		err = runJobHandler(q.ctx, kind.run, job.Payload)
+	}
+	interrupted := err != nil && q.ctx.Err() != nil
+	final := err != nil && !interrupted && (errors.Is(err, errJobPermanent) || job.Attempts >= job.MaxAttempts)
+	if final && kind.failed != nil {
+		kind.failed(job.Payload, err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	switch {
+	case interrupted:
+		log.Printf("Job %d (%s) interrupted by shutdown, queued again: %v", job.ID, job.Kind, err)
+		_, err = q.db.Exec(`UPDATE jobs SET status = 'queued', attempts = attempts - 1, updated_at = ? WHERE id = ?`, now, job.ID)
+	case err == nil:
+		_, err = q.db.Exec(`UPDATE jobs SET status = 'done', last_error = '', updated_at = ? WHERE id = ?`, now, job.ID)
+	case final:
+		log.Printf("Job %d (%s) failed after %d attempts: %v", job.ID, job.Kind, job.Attempts, err)
+		_, err = q.db.Exec(`UPDATE jobs SET status = 'failed', last_error = ?, updated_at = ? WHERE id = ?`, err.Error(), now, job.ID)
+	default:
+		retryIn := jobBackoff(job.Attempts)
+		log.Printf("Job %d (%s) attempt %d failed, retrying in %s: %v", job.ID, job.Kind, job.Attempts, retryIn, err)
+		_, err = q.db.Exec(`UPDATE jobs SET status = 'queued', last_error = ?, run_after = ?, updated_at = ? WHERE id = ?`,
+			err.Error(), now.Add(retryIn), now, job.ID)
+	}
+	if err != nil {
+		log.Printf("Failed to record outcome of job %d: %v", job.ID, err)
+	}
+}
+
+// runJobHandler turns a panicking handler into a failed attempt instead of
+// taking the whole server down.
+func runJobHandler(ctx context.Context, run JobHandler, payload json.RawMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return run(ctx, payload)
+}
+
+// jobBackoff doubles the wait after every failed attempt, up to a cap.
+func jobBackoff(attempts int) time.Duration {
+	backoff := jobBaseBackoff
+	for i := 1; i < attempts && backoff < jobMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, jobMaxBackoff)
+}
+
+// Prune removes finished jobs past the retention period.
+func (q *JobQueue) Prune() (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	result, err := q.db.Exec(`DELETE FROM jobs WHERE status IN ('done', 'failed') AND updated_at < ?`, q.now().Add(-jobRetention))
+	if err != nil {
+		return 0, fmt.Errorf("JobQueue.Prune: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJobQueueStopCancelsRunningJobs(t *testing.T) {
+	app := newTestApp(t)
+	q := newJobQueue(app.db, app.cfg.Jobs)
+	started := make(chan struct{})
+	q.Register("wait", func(ctx context.Context, payload json.RawMessage) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}, func(payload json.RawMessage, err error) {
+		t.Errorf("job given up on: %v", err)
+	})
+	if err := q.Enqueue(app.db, "wait", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	q.Notify()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not start")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := q.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Stop = %v, want the deadline to pass", err)
+	}
+	// The handler returns once its context is cancelled, so this returns.
+	if err := q.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var status string
+	var attempts int
+	if err := app.db.QueryRow(`SELECT status, attempts FROM jobs WHERE kind = 'wait'`).Scan(&status, &attempts); err != nil {
+		t.Fatal(err)
+	}
+	if status != "queued" || attempts != 0 {
+		t.Errorf("job is %s after %d attempts, want queued after 0", status, attempts)
+	}
+}
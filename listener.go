@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by the socket
+// activation protocol; 0, 1 and 2 are the standard streams.
+const listenFDsStart = 3
+
+// listen returns the socket to serve on. When started through systemd socket
+// activation (LISTEN_FDS and LISTEN_PID set for this process) the inherited
+// socket is used, so restarts never refuse a connection: the kernel queues
+// them until the new process accepts. Otherwise it listens on addr.
+func listen(addr string) (net.Listener, error) {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return net.Listen("tcp", addr)
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("listen: LISTEN_FDS=%q, expected at least one socket", os.Getenv("LISTEN_FDS"))
+	}
+	// Do not pass the sockets on to anything this process starts.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(listenFDsStart, "listener")
+	defer file.Close()
+	l, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("listen: inherited socket: %w", err)
+	}
+	return l, nil
+}
@@ -1,70 +1,127 @@
 package main
 
 import (
-	"database/sql"
-	"html/template"
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/config"
 )
 
-var TPL = template.Must(template.ParseGlob("static/html/*.gohtml"))
-var err error
-var sessionStore = make(map[string]int)
-var allowedImageMIMETypes = map[string]bool{
-	"image/jpeg": true,
-	"image/png":  true,
-	"image/heic": true,
-	"image/webp": true,
-}
-
-const localFSDir = "data/serve"
-
 func main() {
-	port := determinePort()
-
-	DB, err = sql.Open("sqlite3", "./data/sqlite.DB")
+	cfg, printOnly, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer DB.Close()
+	if printOnly {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cfg.Fsck || cfg.FsckRepair {
+		ok, err := runFsck(cfg, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := run(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	err = configDatabase()
+// run serves until SIGINT or SIGTERM, then stops accepting connections and
+// gives in-flight requests and running jobs up to cfg.ShutdownTimeout to
+// finish before the background sweepers are stopped and the database is
+// closed.
+func run(cfg *config.Config) error {
+	ctx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+
+	app, err := newApp(cfg)
 	if err != nil {
-		log.Fatalf("Failed to start database: %v", err)
+		return err
 	}
+	defer func() {
+		if err := app.Close(); err != nil {
+			log.Printf("Failed to close database: %v", err)
+		}
+	}()
 
-	fileHandler := http.StripPrefix("/fs/", http.FileServer(http.Dir("data/serve")))
+	stopSessionSweeper := startSweeper("Session", "sessions", sessionSweepInterval, app.sessions.DeleteExpired)
+	defer stopSessionSweeper()
+	stopLoginAttemptSweeper := startSweeper("Login attempt", "attempts", loginAttemptPruneInterval, app.throttle.Prune)
+	defer stopLoginAttemptSweeper()
+	stopLoginChallengeSweeper := startSweeper("Login challenge", "challenges", sessionSweepInterval, app.deleteExpiredLoginChallenges)
+	defer stopLoginChallengeSweeper()
+	stopJobSweeper := startSweeper("Job", "jobs", jobPruneInterval, app.jobs.Prune)
+	defer stopJobSweeper()
+	stopImageCacheSweeper := startSweeper("Image cache", "files", imageCachePruneInterval, app.images.Prune)
+	defer stopImageCacheSweeper()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", requireAuthUnlessGet(indexHandler))
-	mux.HandleFunc("/stories/", methodOverride(requireAuthUnlessGet(storiesHandler)))
-	mux.HandleFunc("/stories", requireAuthUnlessGet(listStoriesHandler))
-	mux.HandleFunc("/api/v1/thumbnails/", requireAuthUnlessGet(thumbnailsHandler))
-	mux.HandleFunc("/api/v1/visuals", requireAuth(createVisualHandler))
-	mux.HandleFunc("/api/v1/visuals/", methodOverride(requireAuthUnlessGet(visualsApiHandler)))
-	mux.HandleFunc("/visuals/", methodOverride(requireAuthUnlessGet(visualsHandler)))
-	mux.HandleFunc("/visuals", requireAuthUnlessGet(listVisualsHandler))
-	mux.HandleFunc("/info", methodOverride(requireAuthUnlessGet(infoHandler)))
-	mux.HandleFunc("/upload/", requireAuth(uploadFormHandler))
-	mux.HandleFunc("/upload", requireAuth(uploadHandler))
-	mux.HandleFunc("/login", loginHandler)
-	mux.HandleFunc("/logout", requireAuthUnlessGet(logoutHandler))
-	mux.HandleFunc("/portfolio", requireAuthUnlessGet(portfolioHandler))
-	mux.HandleFunc("/api/v1/portfolios", requireAuth(portfolioUploadHandler))
-	mux.Handle("/fs/", fileHandler)
-	mux.Handle("/favicon.ico", http.NotFoundHandler())
-	mux.Handle("/robots.txt", AddPrefixHandler("/fs", fileHandler))
-	mux.HandleFunc("/style.css", styleSheetHandler)
+	if cfg.ReapplyWatermarks {
+		n, err := app.reapplyWatermarks()
+		if err != nil {
+			return err
+		}
+		log.Printf("Queued %d thumbnail jobs to reapply watermarks", n)
+	}
+	if err := app.jobs.Start(); err != nil {
+		return err
+	}
+	// Normally already stopped below, with a deadline; this covers the
+	// early returns.
+	defer app.jobs.Stop(context.Background())
 
+	listener, err := listen(cfg.Addr())
+	if err != nil {
+		return err
+	}
 	srv := &http.Server{
-		Addr:         port,
-		Handler:      mux,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Addr:         cfg.Addr(),
+		Handler:      app.routes(),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("Server starting on %s...", listener.Addr())
+		serveErr <- srv.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	stopSignals()
+
+	log.Printf("Shutting down, waiting up to %s for in-flight requests...", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Graceful shutdown incomplete, closing remaining connections: %v", err)
+		srv.Close()
+	}
+	if err := app.jobs.Stop(shutdownCtx); err != nil {
+		log.Printf("Background jobs still running, they will resume on next start: %v", err)
 	}
-	log.Printf("Server starting on %s...", port)
-	log.Fatal(srv.ListenAndServe())
+	log.Printf("Server stopped")
+	return nil
 }
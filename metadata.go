@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/exif"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/storage"
+)
+
+// photoMetadata is the part of a photo's EXIF/XMP the API exposes. Location
+// and serial numbers are never kept, let alone shown.
+type photoMetadata struct {
+	TakenAt     *time.Time `json:"taken_at,omitempty"`
+	CameraMake  string     `json:"camera_make,omitempty"`
+	CameraModel string     `json:"camera_model,omitempty"`
+	Lens        string     `json:"lens,omitempty"`
+	Orientation int        `json:"orientation,omitempty"`
+}
+
+func newPhotoMetadata(p Photo) photoMetadata {
+	return photoMetadata{
+		TakenAt:     p.TakenAt,
+		CameraMake:  p.CameraMake,
+		CameraModel: p.CameraModel,
+		Lens:        p.Lens,
+		Orientation: p.Orientation,
+	}
+}
+
+// newPhoto describes a stored upload, ready for insertPhotos. Its size is
+// what the metadata says until the thumbnail job measures it.
+func newPhoto(stored storedFile) Photo {
+	p := Photo{Filename: stored.Filename, SHA256: stored.SHA256, PHash: stored.PHash}
+	setPhotoMetadata(&p, stored.Metadata)
+	p.Width, p.Height = stored.Metadata.UprightSize()
+	return p
+}
+
+func setPhotoMetadata(p *Photo, m exif.Metadata) {
+	if !m.TakenAt.IsZero() {
+		p.TakenAt = &m.TakenAt
+	}
+	p.CameraMake = m.CameraMake
+	p.CameraModel = m.CameraModel
+	p.Lens = m.Lens
+	p.Orientation = m.Orientation
+}
+
+const jobMetadata = "metadata"
+
+// metadataJob scrubs an original stored before uploads were scrubbed, and
+// records its metadata if it is a visual photo. Migration 0006 queues one
+// for every photo and cover.
+type metadataJob struct {
+	Key     string `json:"key"`
+	PhotoID int    `json:"photo_id,omitempty"`
+}
+
+func (app *App) runMetadataJob(ctx context.Context, payload json.RawMessage) error {
+	var job metadataJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return fmt.Errorf("%w: %v", errJobPermanent, err)
+	}
+
+	obj, info, err := app.storage.Get(ctx, job.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil // Deleted since, or never uploaded, like the default cover.
+	}
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", job.Key, err)
+	}
+
+	original := bytes.Clone(data)
+	scrubbed, m := exif.Process(data)
+	if !bytes.Equal(scrubbed, original) {
+		if err := app.storage.Put(ctx, job.Key, bytes.NewReader(scrubbed), int64(len(scrubbed)), info.ContentType); err != nil {
+			return err
+		}
+	}
+
+	if job.PhotoID == 0 {
+		return nil
+	}
+	var p Photo
+	setPhotoMetadata(&p, m)
+	return app.setPhotoMetadata(job.PhotoID, p)
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/apitoken"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/migrate"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+const minPasswordLength = 8
+
+// roles mirrors the roles the web app knows about (roles.go).
+var roles = []string{"owner", "editor", "viewer"}
+
+const usage = `Usage: admin [-db path] <command> <subcommand> [args]
+
+Commands:
+  user add [-cost n] [-role r] <email>
+                                  Create an account, prompting for its password
+  user list                       List all accounts
+  user role <email> <role>        Change an account's role: owner, editor or viewer
+  user passwd [-cost n] <email>   Reset an account's password
+  user disable <email>            Block an account from logging in
+  user enable <email>             Re-enable a disabled account
+  user delete [-yes] <email>      Permanently remove an account
+  user reset-2fa <email>          Turn off two-factor authentication for an account
+
+  token create [-scopes s] <email> <name>
+                                  Create an API token; scopes are comma separated
+  token list [email]              List API tokens, optionally for one account
+  token revoke <id>               Revoke an API token
+
+  migrate status                  Show which schema migrations have been applied
+  migrate up [version]            Apply pending migrations, up to version if given
+  migrate down [-yes] [steps]     Revert the last applied migrations (default 1)
+`
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	dbPath := flag.String("db", "./data/sqlite.DB", "Path to the SQLite database.")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := sql.Open("sqlite3", *dbPath)
+	if err != nil {
+		log.Fatalf("FATAL: Could not open database: %v", err)
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "user":
+		err = runUser(db, args[1], args[2:])
+	case "token":
+		err = runToken(db, args[1], args[2:])
+	case "migrate":
+		err = runMigrate(db, args[1], args[2:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+}
+
+func runUser(db *sql.DB, subcommand string, args []string) error {
+	if err := checkUsersTable(db); err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("user "+subcommand, flag.ExitOnError)
+	cost := fs.Int("cost", bcrypt.DefaultCost, "bcrypt cost factor.")
+	yes := fs.Bool("yes", false, "Skip the confirmation prompt.")
+	role := fs.String("role", "owner", "Role for the new account: "+strings.Join(roles, ", ")+".")
+
+	switch subcommand {
+	case "list":
+		fs.Parse(args)
+		return listUsers(db)
+	case "role":
+		fs.Parse(args)
+		if fs.NArg() != 2 {
+			return errors.New("user role expects an email address and a role")
+		}
+		return setRole(db, strings.ToLower(strings.TrimSpace(fs.Arg(0))), fs.Arg(1))
+	case "add", "passwd", "disable", "enable", "delete", "reset-2fa":
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			return fmt.Errorf("user %s expects exactly one email address", subcommand)
+		}
+		email := strings.ToLower(strings.TrimSpace(fs.Arg(0)))
+		switch subcommand {
+		case "add":
+			return addUser(db, email, *role, *cost)
+		case "passwd":
+			return resetPassword(db, email, *cost)
+		case "disable":
+			return setDisabled(db, email, true)
+		case "enable":
+			return setDisabled(db, email, false)
+		case "delete":
+			return deleteUser(db, email, *yes)
+		case "reset-2fa":
+			return resetTwoFactor(db, email)
+		}
+	}
+	return fmt.Errorf("unknown user subcommand %q", subcommand)
+}
+
+func runToken(db *sql.DB, subcommand string, args []string) error {
+	if err := checkUsersTable(db); err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("token "+subcommand, flag.ExitOnError)
+	scopesFlag := fs.String("scopes", "", "Comma separated scopes: "+strings.Join(apitoken.Scopes, ", ")+". Empty means full access.")
+	fs.Parse(args)
+
+	switch subcommand {
+	case "create":
+		if fs.NArg() != 2 {
+			return errors.New("token create expects an email address and a token name")
+		}
+		scopes, err := apitoken.ParseScopes(*scopesFlag)
+		if err != nil {
+			return err
+		}
+		return createToken(db, strings.ToLower(strings.TrimSpace(fs.Arg(0))), fs.Arg(1), scopes)
+	case "list":
+		if fs.NArg() > 1 {
+			return errors.New("token list accepts at most one email address")
+		}
+		return listTokens(db, strings.ToLower(strings.TrimSpace(fs.Arg(0))))
+	case "revoke":
+		if fs.NArg() != 1 {
+			return errors.New("token revoke expects a token ID")
+		}
+		id, err := strconv.Atoi(fs.Arg(0))
+		if err != nil {
+			return fmt.Errorf("invalid token ID %q", fs.Arg(0))
+		}
+		return revokeToken(db, id)
+	}
+	return fmt.Errorf("unknown token subcommand %q", subcommand)
+}
+
+func runMigrate(db *sql.DB, subcommand string, args []string) error {
+	migrator, err := migrate.New(db)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("migrate "+subcommand, flag.ExitOnError)
+	yes := fs.Bool("yes", false, "Skip the confirmation prompt.")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return fmt.Errorf("migrate %s accepts at most one argument", subcommand)
+	}
+	number := 0
+	if fs.NArg() == 1 {
+		if number, err = strconv.Atoi(fs.Arg(0)); err != nil || number < 1 {
+			return fmt.Errorf("invalid number %q", fs.Arg(0))
+		}
+	}
+
+	switch subcommand {
+	case "status":
+		return migrationStatus(migrator)
+	case "up":
+		applied, err := migrator.Up(number)
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("Nothing to apply.")
+		}
+		return err
+	case "down":
+		if number == 0 {
+			number = 1
+		}
+		if !*yes {
+			answer, err := prompt(fmt.Sprintf("Revert the last %d migration(s)? This can drop tables and data. [y/N] ", number))
+			if err != nil {
+				return err
+			}
+			if a := strings.ToLower(answer); a != "y" && a != "yes" {
+				fmt.Println("Aborted.")
+				return nil
+			}
+		}
+		reverted, err := migrator.Down(number)
+		for _, m := range reverted {
+			fmt.Printf("Reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(reverted) == 0 {
+			fmt.Println("Nothing to revert.")
+		}
+		return err
+	}
+	return fmt.Errorf("unknown migrate subcommand %q", subcommand)
+}
+
+func migrationStatus(migrator *migrate.Migrator) error {
+	statuses, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+	for _, s := range statuses {
+		applied := "pending"
+		if s.AppliedAt.Valid {
+			applied = s.AppliedAt.Time.Local().Format(time.DateTime)
+		}
+		if s.Unknown {
+			applied += " (unknown to this build)"
+		}
+		fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+	return tw.Flush()
+}
+
+func createToken(db *sql.DB, email, name string, scopes []string) error {
+	id, err := lookupUser(db, email)
+	if err != nil {
+		return err
+	}
+	token, hash, err := apitoken.New()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		id, name, hash, apitoken.FormatScopes(scopes), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("could not create token: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Created token %q for %s. Store it now; it cannot be shown again.\n", name, email)
+	fmt.Println(token)
+	return nil
+}
+
+func listTokens(db *sql.DB, email string) error {
+	query := `
+		SELECT t.id, u.email, t.name, t.scopes, t.created_at, t.last_used_at, t.revoked_at
+		FROM api_tokens t
+		JOIN users u ON u.id = t.user_id`
+	var queryArgs []any
+	if email != "" {
+		query += " WHERE u.email = ? COLLATE NOCASE"
+		queryArgs = append(queryArgs, email)
+	}
+	query += " ORDER BY t.id"
+
+	rows, err := db.Query(query, queryArgs...)
+	if err != nil {
+		return fmt.Errorf("could not query tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tEMAIL\tNAME\tSCOPES\tCREATED\tLAST USED\tSTATUS")
+	for rows.Next() {
+		var (
+			id                  int
+			owner, name, scopes string
+			createdAt           time.Time
+			lastUsed, revoked   sql.NullTime
+		)
+		if err := rows.Scan(&id, &owner, &name, &scopes, &createdAt, &lastUsed, &revoked); err != nil {
+			return fmt.Errorf("could not scan token: %w", err)
+		}
+		if scopes == "" {
+			scopes = "all"
+		}
+		lastUsedText := "never"
+		if lastUsed.Valid {
+			lastUsedText = lastUsed.Time.Format(time.DateTime)
+		}
+		status := "active"
+		if revoked.Valid {
+			status = "revoked"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", id, owner, name, scopes, createdAt.Format(time.DateTime), lastUsedText, status)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not read tokens: %w", err)
+	}
+	return tw.Flush()
+}
+
+func revokeToken(db *sql.DB, id int) error {
+	result, err := db.Exec("UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("could not revoke token %d: %w", id, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not revoke token %d: %w", id, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("no active token with ID %d", id)
+	}
+	fmt.Printf("Revoked token %d\n", id)
+	return nil
+}
+
+// checkUsersTable makes sure the schema migrations have been applied, so this
+// tool never works against a half-initialised database.
+func checkUsersTable(db *sql.DB) error {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('users') WHERE name = 'role'`).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("could not inspect users table: %w", err)
+	}
+	if count == 0 {
+		return errors.New("users table is missing or outdated; run `admin migrate up` or start the web app once")
+	}
+	return nil
+}
+
+func listUsers(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, email, role, disabled FROM users ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("could not query users: %w", err)
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tEMAIL\tROLE\tSTATUS")
+	for rows.Next() {
+		var id int
+		var email, role string
+		var disabled bool
+		if err := rows.Scan(&id, &email, &role, &disabled); err != nil {
+			return fmt.Errorf("could not scan user: %w", err)
+		}
+		status := "active"
+		if disabled {
+			status = "disabled"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", id, email, role, status)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not read users: %w", err)
+	}
+	return tw.Flush()
+}
+
+func addUser(db *sql.DB, email, role string, cost int) error {
+	if !strings.Contains(email, "@") {
+		return fmt.Errorf("%q is not an email address", email)
+	}
+	if !slices.Contains(roles, role) {
+		return fmt.Errorf("unknown role %q; choose one of %s", role, strings.Join(roles, ", "))
+	}
+	digest, err := promptPasswordDigest(cost)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO users (email, password_digest, role) VALUES (?, ?, ?)", email, digest, role)
+	if err != nil {
+		return fmt.Errorf("could not create user %s: %w", email, err)
+	}
+	fmt.Printf("Created %s %s\n", role, email)
+	return nil
+}
+
+func setRole(db *sql.DB, email, role string) error {
+	if !slices.Contains(roles, role) {
+		return fmt.Errorf("unknown role %q; choose one of %s", role, strings.Join(roles, ", "))
+	}
+	id, err := lookupUser(db, email)
+	if err != nil {
+		return err
+	}
+	if role != "owner" {
+		if err := checkNotLastOwner(db, id); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec("UPDATE users SET role = ? WHERE id = ?", role, id); err != nil {
+		return fmt.Errorf("could not update role for %s: %w", email, err)
+	}
+	fmt.Printf("%s is now %s\n", email, role)
+	return nil
+}
+
+// checkNotLastOwner refuses to leave the site without anyone who can
+// delete work or replace the cover. Disabled owners cannot log in, so they
+// do not count.
+func checkNotLastOwner(db *sql.DB, userID int) error {
+	var role string
+	var disabled bool
+	if err := db.QueryRow("SELECT role, disabled FROM users WHERE id = ?", userID).Scan(&role, &disabled); err != nil {
+		return fmt.Errorf("could not look up role: %w", err)
+	}
+	if role != "owner" || disabled {
+		return nil
+	}
+	var owners int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE role = 'owner' AND NOT disabled").Scan(&owners); err != nil {
+		return fmt.Errorf("could not count owners: %w", err)
+	}
+	if owners <= 1 {
+		return errors.New("this is the only active owner; make someone else owner first")
+	}
+	return nil
+}
+
+func resetPassword(db *sql.DB, email string, cost int) error {
+	id, err := lookupUser(db, email)
+	if err != nil {
+		return err
+	}
+	digest, err := promptPasswordDigest(cost)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET password_digest = ? WHERE id = ?", digest, id); err != nil {
+		return fmt.Errorf("could not update password for %s: %w", email, err)
+	}
+	if err := revokeSessions(db, id); err != nil {
+		return err
+	}
+	fmt.Printf("Password updated for %s; existing sessions were logged out\n", email)
+	return nil
+}
+
+func setDisabled(db *sql.DB, email string, disabled bool) error {
+	id, err := lookupUser(db, email)
+	if err != nil {
+		return err
+	}
+	if disabled {
+		if err := checkNotLastOwner(db, id); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec("UPDATE users SET disabled = ? WHERE id = ?", disabled, id); err != nil {
+		return fmt.Errorf("could not update %s: %w", email, err)
+	}
+	if !disabled {
+		fmt.Printf("Enabled user %s\n", email)
+		return nil
+	}
+	if err := revokeSessions(db, id); err != nil {
+		return err
+	}
+	fmt.Printf("Disabled user %s; existing sessions were logged out\n", email)
+	return nil
+}
+
+func deleteUser(db *sql.DB, email string, yes bool) error {
+	id, err := lookupUser(db, email)
+	if err != nil {
+		return err
+	}
+	if err := checkNotLastOwner(db, id); err != nil {
+		return err
+	}
+	if !yes {
+		answer, err := prompt(fmt.Sprintf("Permanently delete %s? [y/N] ", email))
+		if err != nil {
+			return err
+		}
+		if a := strings.ToLower(answer); a != "y" && a != "yes" {
+			fmt.Println("Aborted.")
+			return nil
+		}
+	}
+	// All or nothing, so a failure cannot leave live sessions or tokens
+	// behind for a user who is half gone.
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not delete %s: %w", email, err)
+	}
+	defer tx.Rollback()
+	owned := []struct{ table, what string }{
+		{"sessions", "sessions"},
+		{"login_challenges", "login challenges"},
+		{"recovery_codes", "recovery codes"},
+		{"api_tokens", "API tokens"},
+	}
+	for _, o := range owned {
+		if _, err := tx.Exec("DELETE FROM "+o.table+" WHERE user_id = ?", id); err != nil {
+			return fmt.Errorf("could not delete %s for %s: %w", o.what, email, err)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", id); err != nil {
+		return fmt.Errorf("could not delete %s: %w", email, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not delete %s: %w", email, err)
+	}
+	fmt.Printf("Deleted user %s\n", email)
+	return nil
+}
+
+// resetTwoFactor is the way back in for someone who lost both their phone
+// and their recovery codes.
+func resetTwoFactor(db *sql.DB, email string) error {
+	id, err := lookupUser(db, email)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET totp_secret = '', totp_enabled = 0, totp_last_step = 0 WHERE id = ?", id); err != nil {
+		return fmt.Errorf("could not reset two-factor authentication for %s: %w", email, err)
+	}
+	if _, err := db.Exec("DELETE FROM recovery_codes WHERE user_id = ?", id); err != nil {
+		return fmt.Errorf("could not delete recovery codes for %s: %w", email, err)
+	}
+	fmt.Printf("Two-factor authentication turned off for %s\n", email)
+	return nil
+}
+
+func lookupUser(db *sql.DB, email string) (int, error) {
+	var id int
+	err := db.QueryRow("SELECT id FROM users WHERE email = ? COLLATE NOCASE", email).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("no user with email %s", email)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not look up %s: %w", email, err)
+	}
+	return id, nil
+}
+
+// revokeSessions logs the user out everywhere. Foreign keys are not enforced
+// on this connection, so the ON DELETE CASCADE cannot be relied on.
+func revokeSessions(db *sql.DB, userID int) error {
+	if _, err := db.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("could not revoke sessions: %w", err)
+	}
+	return nil
+}
+
+func promptPasswordDigest(cost int) ([]byte, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	password, err := promptPassword("Password: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(password) < minPasswordLength {
+		return nil, fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		confirm, err := promptPassword("Repeat password: ")
+		if err != nil {
+			return nil, err
+		}
+		if string(confirm) != string(password) {
+			return nil, errors.New("passwords do not match")
+		}
+	}
+	digest, err := bcrypt.GenerateFromPassword(password, cost)
+	if err != nil {
+		return nil, fmt.Errorf("could not hash password: %w", err)
+	}
+	return digest, nil
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// promptPassword reads a password without echoing it. When stdin is not a
+// terminal (e.g. piped from a secret store) a single line is read instead.
+func promptPassword(label string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("could not read password: %w", err)
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+	fmt.Fprint(os.Stderr, label)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("could not read password: %w", err)
+	}
+	return password, nil
+}
+
+func prompt(label string) (string, error) {
+	fmt.Fprint(os.Stderr, label)
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("could not read answer: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
@@ -1,128 +1,398 @@
+// Command make-thumbnails brings the thumbnails of every visual photo and
+// cover in storage up to date, the way the web app's thumbnail jobs make
+// them: after thumbnail sizes or formats are added, or when files were
+// copied in by hand. It only touches files, never the database. It uses
+// the storage backend of the web app's config, local or S3.
+//
+// Thumbnails newer than their original are left alone, so an interrupted
+// run picks up where it stopped when started again. That also means a
+// change to the watermark or quality of existing sizes is not picked up:
+// run with --force, and --sizes to limit it to the sizes that changed.
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
-	"image/jpeg"
-	"io/fs"
+	"io"
+	"log"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"path"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/disintegration/imaging"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/config"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/storage"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/thumbnail"
 )
 
-type ThumbnailConfig struct {
-	Name    string
-	Width   int
-	Quality int
-	Crop    bool
-}
+const usage = `Usage: make-thumbnails [flags]
 
-var thumbnailConfigs = []ThumbnailConfig{
-	{Name: "mini", Width: 40, Quality: 80, Crop: true},
-	{Name: "small", Width: 150, Quality: 80},
-	{Name: "medium", Width: 600, Quality: 80},
-	{Name: "large", Width: 1080, Quality: 80},
-}
+Makes the missing and outdated thumbnails of the originals under visuals/
+and covers/ in storage. Sizes, formats and the storage backend are read from
+the web app's config file and PORTFOLIO_* environment variables, the
+built-in sizes and the local serve directory if there are none. Thumbnails
+are not made again when only their watermark or quality changed; use
+--force for that.
+
+Flags:
+`
 
 func main() {
-	visualsDirPtr := flag.String("dir", "data/serve/visuals", "The root directory of the visuals to process.")
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	configPath := flag.String("config", os.Getenv("PORTFOLIO_CONFIG"), "The web app's YAML or TOML config file (env PORTFOLIO_CONFIG).")
+	dir := flag.String("dir", "", "Directory uploads are stored in with the local backend (default serve_dir from the config, env PORTFOLIO_SERVE_DIR, or data/serve).")
+	workers := flag.Int("workers", runtime.NumCPU(), "Number of images to process at once.")
+	sizes := flag.String("sizes", "", "Comma separated thumbnail sizes to make (default all).")
+	onlyMissing := flag.Bool("only-missing", false, "Only make thumbnails that do not exist, however old the ones that do.")
+	force := flag.Bool("force", false, "Make every thumbnail again, up to date or not.")
+	dryRun := flag.Bool("dry-run", false, "List the thumbnails that would be made without making them.")
 	flag.Parse()
-	visualsDir := *visualsDirPtr
+	if flag.NArg() > 0 || *workers < 1 || (*onlyMissing && *force) {
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	fmt.Printf("Processing visuals in: %s\n", visualsDir)
+	// The web app's own loader, so that a config file the server refuses
+	// is refused here too.
+	cfg, err := config.Load(*configPath, os.Getenv)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	serveDir := cmp.Or(*dir, cfg.ServeDir)
+	configs, err := selectSizes(cfg.Thumbnails, *sizes)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	renderer, err := thumbnail.NewRenderer(configs)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+
+	// On Ctrl-C, finish the images being processed and stop.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	store, err := cfg.Storage.NewStorage(ctx, serveDir)
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+	where := serveDir
+	if s3 := cfg.Storage.S3; cfg.Storage.Backend == "s3" {
+		where = "s3://" + path.Join(s3.Bucket, s3.Prefix)
+	}
 
-	entries, err := os.ReadDir(visualsDir)
+	m := &maker{
+		store:       store,
+		renderer:    renderer,
+		configs:     configs,
+		onlyMissing: *onlyMissing,
+		force:       *force,
+		dryRun:      *dryRun,
+	}
+	fmt.Printf("Checking thumbnails in %s\n", where)
+	sources, err := m.plan(ctx)
 	if err != nil {
-		fmt.Printf("Error reading visuals directory: %v\n", err)
+		log.Fatalf("FATAL: %v", err)
+	}
+	s := m.run(ctx, sources, *workers)
+	s.print(os.Stdout, m.dryRun)
+	if s.failed > 0 || s.interrupted {
 		os.Exit(1)
 	}
+}
 
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
+// selectSizes returns the configs named in the comma separated list, or all
+// of them if it is empty.
+func selectSizes(configs []thumbnail.Config, list string) ([]thumbnail.Config, error) {
+	if list == "" {
+		return configs, nil
+	}
+	var selected []thumbnail.Config
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		i := slices.IndexFunc(configs, func(c thumbnail.Config) bool { return c.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown thumbnail size %q", name)
 		}
+		selected = append(selected, configs[i])
+	}
+	return selected, nil
+}
 
-		// Check if the directory name is a number (visual ID)
-		if _, err := strconv.Atoi(entry.Name()); err != nil {
-			continue
-		}
+type maker struct {
+	store       storage.Storage
+	renderer    *thumbnail.Renderer
+	configs     []thumbnail.Config
+	onlyMissing bool
+	force       bool
+	dryRun      bool
+}
 
-		visualPath := filepath.Join(visualsDir, entry.Name())
-		fmt.Printf("\nProcessing visual directory: %s\n", visualPath)
+// source is an original with thumbnails to make.
+type source struct {
+	key string
+	// master is set when its JPEG master is to be made too; decodeKey is
+	// what to decode, the master if there is a current one.
+	master    bool
+	decodeKey string
+	sizes     []size
+}
 
-		// Clean up existing thumbnails before generating new ones
-		thumbnailsPath := filepath.Join(visualPath, "thumbnails")
-		if _, err := os.Stat(thumbnailsPath); err == nil {
-			fmt.Printf("  - Removing existing thumbnails directory: %s\n", thumbnailsPath)
-			if err := os.RemoveAll(thumbnailsPath); err != nil {
-				fmt.Printf("    - Error removing thumbnails: %v\n", err)
-				continue
-			}
-		}
+// size is the formats to make of one thumbnail size.
+type size struct {
+	config  thumbnail.Config
+	formats []thumbnail.Format
+}
 
-		err = filepath.Walk(visualPath, func(path string, info fs.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
+func (s source) count() int {
+	n := 0
+	if s.master {
+		n++
+	}
+	for _, sz := range s.sizes {
+		n += len(sz.formats)
+	}
+	return n
+}
 
-			if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
-				return nil
-			}
+// isOriginal reports whether key is an uploaded original rather than a
+// thumbnail or master: visuals/<id>/<file> or covers/<file>.
+func isOriginal(key string) bool {
+	parts := strings.Split(key, "/")
+	if strings.HasPrefix(parts[len(parts)-1], ".") {
+		return false
+	}
+	switch {
+	case len(parts) == 3 && parts[0] == "visuals":
+		_, err := strconv.Atoi(parts[1])
+		return err == nil
+	case len(parts) == 2 && parts[0] == "covers":
+		return true
+	}
+	return false
+}
 
-			fmt.Printf("  - Processing file: %s\n", info.Name())
-			img, err := imaging.Open(path, imaging.AutoOrientation(true))
-			if err != nil {
-				fmt.Printf("    - Skipping, not a valid image: %s\n", info.Name())
-				return nil // Continue with the next file
-			}
+// plan lists the originals that have thumbnails to make, and which.
+func (m *maker) plan(ctx context.Context) ([]source, error) {
+	var objects []storage.ObjectInfo
+	for _, prefix := range []string{"visuals/", "covers/"} {
+		list, err := m.store.List(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", prefix, err)
+		}
+		objects = append(objects, list...)
+	}
+	modTimes := map[string]time.Time{}
+	for _, o := range objects {
+		modTimes[o.Key] = o.ModTime
+	}
+	// outdated reports whether the file at key is to be made from an
+	// original last modified at modTime.
+	outdated := func(key string, modTime time.Time) bool {
+		t, ok := modTimes[key]
+		switch {
+		case !ok:
+			return true
+		case m.onlyMissing:
+			return false
+		case m.force:
+			return true
+		}
+		return t.Before(modTime)
+	}
 
-			for _, config := range thumbnailConfigs {
-				var thumbErr error
-				if config.Crop {
-					thumbErr = saveCroppedThumbnail(img, config.Width, config.Name, path, config.Quality)
-				} else {
-					thumbErr = saveResizedImage(img, config.Width, config.Name, path, config.Quality)
-				}
-				if thumbErr != nil {
-					fmt.Printf("    - Error generating %s thumbnail: %v\n", config.Name, thumbErr)
+	var sources []source
+	for _, o := range objects {
+		if !isOriginal(o.Key) {
+			continue
+		}
+		src := source{key: o.Key, decodeKey: o.Key}
+		if thumbnail.NeedsMaster(o.Key) {
+			master := thumbnail.MasterKey(o.Key)
+			src.master = outdated(master, o.ModTime)
+			if !src.master {
+				// A master is quicker to decode than the HEIC it was made
+				// from.
+				src.decodeKey = master
+			}
+		}
+		for _, c := range m.configs {
+			sz := size{config: c}
+			for _, f := range c.StoredFormats() {
+				if outdated(thumbnail.Key(o.Key, c.Name, f), o.ModTime) {
+					sz.formats = append(sz.formats, f)
 				}
 			}
-			return nil
-		})
-
-		if err != nil {
-			fmt.Printf("Error walking the path %s: %v\n", visualPath, err)
+			if len(sz.formats) > 0 {
+				src.sizes = append(src.sizes, sz)
+			}
 		}
+		sources = append(sources, src)
 	}
+	return sources, nil
+}
 
-	fmt.Println("\nThumbnail generation completed!")
+type summary struct {
+	originals   int
+	upToDate    int
+	made        int
+	failed      int
+	interrupted bool
+	elapsed     time.Duration
+}
+
+func (s summary) print(w io.Writer, dryRun bool) {
+	verb := "made"
+	if dryRun {
+		verb = "to make"
+	}
+	fmt.Fprintf(w, "\n%d originals: %d up to date, %d thumbnails %s, %d failed, in %s\n",
+		s.originals, s.upToDate, s.made, verb, s.failed, s.elapsed.Round(time.Millisecond))
+	if s.interrupted {
+		fmt.Fprintln(w, "Interrupted; run again to make the rest.")
+	}
 }
 
-func saveResizedImage(img image.Image, width int, sizeName, originalImagePath string, quality int) error {
-	resizedImg := imaging.Resize(img, width, 0, imaging.Lanczos)
-	return saveImage(resizedImg, sizeName, originalImagePath, quality)
+// run makes the thumbnails of sources with the given number of workers,
+// reporting on each original as it is done.
+func (m *maker) run(ctx context.Context, sources []source, workers int) summary {
+	start := time.Now()
+	s := summary{originals: len(sources)}
+	var todo []source
+	for _, src := range sources {
+		if src.count() == 0 {
+			s.upToDate++
+		} else {
+			todo = append(todo, src)
+		}
+	}
+
+	type result struct {
+		src  source
+		made int
+		err  error
+	}
+	queue := make(chan source)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for src := range queue {
+				made, err := m.make(src)
+				results <- result{src, made, err}
+			}
+		}()
+	}
+	go func() {
+		defer close(queue)
+		for _, src := range todo {
+			select {
+			case queue <- src:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	done := 0
+	for r := range results {
+		done++
+		s.made += r.made
+		status := fmt.Sprintf("%d thumbnails", r.made)
+		if m.dryRun {
+			status = "would make " + describe(r.src)
+		}
+		if r.err != nil {
+			s.failed++
+			status = "FAILED: " + r.err.Error()
+		}
+		fmt.Printf("[%*d/%d] %s: %s\n", len(strconv.Itoa(len(todo))), done, len(todo), r.src.key, status)
+	}
+	s.interrupted = done < len(todo)
+	s.elapsed = time.Since(start)
+	return s
 }
 
-func saveCroppedThumbnail(img image.Image, size int, sizeName, originalImagePath string, quality int) error {
-	thumb := imaging.Fill(img, size, size, imaging.Center, imaging.Lanczos)
-	return saveImage(thumb, sizeName, originalImagePath, quality)
+// describe lists what is to be made for src, e.g. "master, small (avif, webp)".
+func describe(src source) string {
+	var parts []string
+	if src.master {
+		parts = append(parts, "master")
+	}
+	for _, sz := range src.sizes {
+		var names []string
+		for _, f := range sz.formats {
+			names = append(names, f.Name)
+		}
+		parts = append(parts, fmt.Sprintf("%s (%s)", sz.config.Name, strings.Join(names, ", ")))
+	}
+	return strings.Join(parts, ", ")
 }
 
-func saveImage(img image.Image, sizeName, originalImagePath string, quality int) error {
-	thumbDir := filepath.Join(filepath.Dir(originalImagePath), "thumbnails", sizeName)
-	if err := os.MkdirAll(thumbDir, 0755); err != nil {
-		return fmt.Errorf("error creating %s thumbnail directory: %v", sizeName, err)
+// make makes what src needs and returns how many files it stored. Files
+// are made even once the run is interrupted, so none is left half done.
+func (m *maker) make(src source) (int, error) {
+	if m.dryRun {
+		return src.count(), nil
 	}
-	thumbPath := filepath.Join(thumbDir, filepath.Base(originalImagePath))
-	outFile, err := os.Create(thumbPath)
+	ctx := context.Background()
+	obj, _, err := m.store.Get(ctx, src.decodeKey)
 	if err != nil {
-		return fmt.Errorf("error creating output file for %s thumbnail: %v", sizeName, err)
+		return 0, err
+	}
+	img, contentType, err := thumbnail.Decode(obj)
+	obj.Close()
+	if err != nil {
+		return 0, fmt.Errorf("decoding %s: %w", src.decodeKey, err)
 	}
-	defer outFile.Close()
 
-	return jpeg.Encode(outFile, img, &jpeg.Options{Quality: quality})
-}
\ No newline at end of file
+	made := 0
+	var errs []error
+	put := func(key string, img image.Image, f thumbnail.Format, quality int) {
+		var buf bytes.Buffer
+		err := f.Encode(&buf, img, quality)
+		if err == nil {
+			err = m.store.Put(ctx, key, &buf, int64(buf.Len()), f.ContentType)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			return
+		}
+		made++
+	}
+	if src.master && thumbnail.IsHEIF(contentType) {
+		jpeg, _ := thumbnail.LookupFormat(thumbnail.JPEG)
+		put(thumbnail.MasterKey(src.key), img, jpeg, thumbnail.MasterQuality)
+	}
+	for _, sz := range src.sizes {
+		thumb := m.renderer.Render(img, sz.config)
+		for _, f := range sz.formats {
+			put(thumbnail.Key(src.key, sz.config.Name, f), thumb, f, sz.config.Quality)
+		}
+	}
+	return made, errors.Join(errs...)
+}
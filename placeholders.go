@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/blurhash"
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// Blurhash components along a photo's longer side; 4 is what blurha.sh
+	// suggests and makes hashes of about 30 characters.
+	blurhashComponents = 4
+	// blurhashSampleSize is the width the photo is shrunk to first: the
+	// hash cannot hold more detail than that anyway.
+	blurhashSampleSize = 32
+	// The LQIP is a tiny JPEG meant to be stretched and blurred by the
+	// browser, a few hundred bytes inline.
+	lqipWidth   = 16
+	lqipQuality = 40
+)
+
+// placeholder is what a page can paint where a photo goes while it loads,
+// from cheapest to most faithful: a colour, a blurhash for pages with a
+// decoder, and an inline LQIP (low-quality image placeholder).
+type placeholder struct {
+	Color    string `json:"color,omitempty"`
+	Blurhash string `json:"blurhash,omitempty"`
+	LQIP     string `json:"lqip,omitempty"`
+}
+
+// makePlaceholder computes the placeholder of img, which must be upright.
+func makePlaceholder(img image.Image) (placeholder, error) {
+	sample := imaging.Resize(img, blurhashSampleSize, 0, imaging.Box)
+	bounds := sample.Bounds()
+	x, y := blurhash.Components(bounds.Dx(), bounds.Dy(), blurhashComponents)
+	hash, err := blurhash.Encode(sample, x, y)
+	if err != nil {
+		return placeholder{}, err
+	}
+
+	// The average of every pixel, which is what shrinking to one pixel with
+	// a box filter gives.
+	avg := imaging.Resize(sample, 1, 1, imaging.Box).NRGBAAt(0, 0)
+
+	var lqip bytes.Buffer
+	if err := jpeg.Encode(&lqip, imaging.Resize(img, lqipWidth, 0, imaging.Lanczos), &jpeg.Options{Quality: lqipQuality}); err != nil {
+		return placeholder{}, fmt.Errorf("encoding LQIP: %w", err)
+	}
+
+	return placeholder{
+		Color:    fmt.Sprintf("#%02x%02x%02x", avg.R, avg.G, avg.B),
+		Blurhash: hash,
+		LQIP:     "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(lqip.Bytes()),
+	}, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type Role string
+
+const (
+	// RoleOwner is the artist: full control over the site.
+	RoleOwner Role = "owner"
+	// RoleEditor can add work and fix text, but cannot delete anything or
+	// replace the cover and portfolio.
+	RoleEditor Role = "editor"
+	// RoleViewer can log in and look around the admin pages, nothing more.
+	RoleViewer Role = "viewer"
+)
+
+// allPermissions is every action that can be granted. Permissions are named
+// "<resource>:<action>"; the resource part doubles as the API token scope
+// that has to cover it ("<resource>:read" for viewing, "<resource>:write"
+// for everything else).
+var allPermissions = []string{
+	"visuals:create",
+	"visuals:edit",
+	// Deleting a visual or any of its photos.
+	"visuals:delete",
+	"stories:create",
+	"stories:edit",
+	"stories:delete",
+	"info:edit",
+	"covers:replace",
+	"portfolios:replace",
+	"audit:view",
+	// Checking storage against the database and repairing what it finds.
+	"storage:check",
+}
+
+var rolePermissions = map[Role][]string{
+	RoleOwner: allPermissions,
+	RoleEditor: {
+		"visuals:create",
+		"visuals:edit",
+		"stories:create",
+		"stories:edit",
+		"info:edit",
+	},
+	RoleViewer: {},
+}
+
+func validRole(role Role) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// permissionSet is handed to templates so they can hide controls the user
+// cannot use: {{ if .Permissions.Has "visuals:delete" }}.
+type permissionSet map[string]bool
+
+func (p permissionSet) Has(permission string) bool {
+	return p[permission]
+}
+
+func permissionsForRole(role Role) permissionSet {
+	set := permissionSet{}
+	for _, p := range rolePermissions[role] {
+		set[p] = true
+	}
+	return set
+}
+
+// scopeForPermission maps a permission onto the API token scope that must
+// be present for a token to exercise it.
+func scopeForPermission(permission string) string {
+	resource, action, _ := strings.Cut(permission, ":")
+	if action == "view" {
+		return resource + ":read"
+	}
+	return resource + ":write"
+}
+
+type currentUser struct {
+	ID          int
+	Role        Role
+	Permissions permissionSet
+	// Token is set when the request was authenticated by API token rather
+	// than by browser session.
+	Token *APIToken
+}
+
+// Can reports whether the user holds a permission, taking the scopes of an
+// API token into account.
+func (u *currentUser) Can(permission string) bool {
+	if !u.Permissions.Has(permission) {
+		return false
+	}
+	if u.Token != nil && !u.Token.HasScope(scopeForPermission(permission)) {
+		return false
+	}
+	return true
+}
+
+// getCurrentUser resolves the caller the same way getLoginStatus does, and
+// loads their role.
+func (app *App) getCurrentUser(r *http.Request) (*currentUser, bool) {
+	user := &currentUser{}
+	if _, ok := bearerToken(r); ok {
+		token, ok := app.getAPIToken(r)
+		if !ok {
+			return nil, false
+		}
+		user.ID = token.UserID
+		user.Token = token
+	} else {
+		session, ok := app.getSession(r)
+		if !ok {
+			return nil, false
+		}
+		user.ID = session.UserID
+	}
+
+	role, err := app.getUserRole(user.ID)
+	if err != nil {
+		log.Printf("Failed to look up role for user %d: %v", user.ID, err)
+		return nil, false
+	}
+	if !validRole(role) {
+		log.Printf("User %d has unknown role %q; granting no permissions", user.ID, role)
+	}
+	user.Role = role
+	user.Permissions = permissionsForRole(role)
+	return user, true
+}
+
+// currentPermissions returns what the visitor may do, for use in templates.
+// Anonymous visitors get an empty set.
+func (app *App) currentPermissions(r *http.Request) permissionSet {
+	user, ok := app.getCurrentUser(r)
+	if !ok {
+		return permissionSet{}
+	}
+	return user.Permissions
+}
+
+func mustBeKnownPermission(permission string) {
+	if !slices.Contains(allPermissions, permission) {
+		panic(fmt.Sprintf("unknown permission %q", permission))
+	}
+}
+
+// methodPermissions says which permission each HTTP method on a route needs.
+type methodPermissions map[string]string
+
+// requirePermission only lets the request through when the caller holds
+// the permission, whatever the method.
+func (app *App) requirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	mustBeKnownPermission(permission)
+	return func(w http.ResponseWriter, r *http.Request) {
+		app.authorize(w, r, permission, next)
+	}
+}
+
+// requirePermissions guards a route whose methods need different
+// permissions. Safe methods that are not listed stay public, which is how
+// every page of the portfolio is read; any other unlisted method is refused.
+func (app *App) requirePermissions(byMethod methodPermissions, next http.HandlerFunc) http.HandlerFunc {
+	for _, permission := range byMethod {
+		mustBeKnownPermission(permission)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		permission, ok := byMethod[r.Method]
+		if !ok {
+			if isSafeMethod(r.Method) {
+				next(w, r)
+			} else {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		app.authorize(w, r, permission, next)
+	}
+}
+
+func (app *App) authorize(w http.ResponseWriter, r *http.Request, permission string, next http.HandlerFunc) {
+	user, ok := app.getCurrentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !user.Can(permission) {
+		log.Printf("User %d (%s) denied %s on %s %s", user.ID, user.Role, permission, r.Method, r.URL.Path)
+		if user.Token != nil && user.Permissions.Has(permission) {
+			http.Error(w, fmt.Sprintf("Forbidden: token lacks the %s scope", scopeForPermission(permission)), http.StatusForbidden)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Forbidden: missing %s permission", permission), http.StatusForbidden)
+		return
+	}
+	next(w, r)
+}
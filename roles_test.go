@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestRolePermissions(t *testing.T) {
+	editor := []string{"visuals:create", "visuals:edit", "stories:create", "stories:edit", "info:edit"}
+	for _, permission := range allPermissions {
+		tests := []struct {
+			role Role
+			want bool
+		}{
+			{RoleOwner, true},
+			{RoleEditor, slices.Contains(editor, permission)},
+			{RoleViewer, false},
+			{Role("admin"), false},
+		}
+		for _, tt := range tests {
+			if got := permissionsForRole(tt.role).Has(permission); got != tt.want {
+				t.Errorf("%s has %s: %v, want %v", tt.role, permission, got, tt.want)
+			}
+		}
+	}
+	for role, permissions := range rolePermissions {
+		for _, p := range permissions {
+			if !slices.Contains(allPermissions, p) {
+				t.Errorf("%s is granted unknown permission %q", role, p)
+			}
+		}
+	}
+	if validRole("admin") || !validRole(RoleViewer) {
+		t.Error("validRole does not match rolePermissions")
+	}
+}
+
+func TestScopeForPermission(t *testing.T) {
+	tests := map[string]string{
+		"visuals:create": "visuals:write",
+		"visuals:delete": "visuals:write",
+		"covers:replace": "covers:write",
+		"audit:view":     "audit:read",
+	}
+	for permission, want := range tests {
+		if got := scopeForPermission(permission); got != want {
+			t.Errorf("scopeForPermission(%q) = %q, want %q", permission, got, want)
+		}
+	}
+}
+
+func TestRequirePermissions(t *testing.T) {
+	app := newTestApp(t)
+	session := func(role Role) *http.Cookie {
+		userID := createTestUser(t, app, string(role)+"@example.com", "password1", role)
+		s, err := app.sessions.Create(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: sessionCookieName, Value: s.ID}
+	}
+	owner, editor, viewer := session(RoleOwner), session(RoleEditor), session(RoleViewer)
+	handler := app.requirePermissions(methodPermissions{
+		http.MethodPatch:  "stories:edit",
+		http.MethodDelete: "stories:delete",
+	}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		cookie *http.Cookie
+		want   int
+	}{
+		{"public read", http.MethodGet, nil, http.StatusNoContent},
+		{"unlisted method", http.MethodPost, owner, http.StatusMethodNotAllowed},
+		{"anonymous", http.MethodPatch, nil, http.StatusUnauthorized},
+		{"viewer", http.MethodPatch, viewer, http.StatusForbidden},
+		{"editor edits", http.MethodPatch, editor, http.StatusNoContent},
+		{"editor deletes", http.MethodDelete, editor, http.StatusForbidden},
+		{"owner deletes", http.MethodDelete, owner, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/stories/1", nil)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("an unknown permission did not panic")
+		}
+	}()
+	app.requirePermission("stories:publish", nil)
+}
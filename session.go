@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	sessionCookieName      = "session"
+	sessionIdleTimeout     = 24 * time.Hour
+	sessionAbsoluteTimeout = 30 * 24 * time.Hour
+	sessionSweepInterval   = 15 * time.Minute
+	// Sliding renewal only writes last_seen_at when it is older than this,
+	// so a page full of thumbnail requests does not turn into a write storm.
+	sessionTouchInterval = time.Minute
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+type Session struct {
+	ID         string
+	UserID     int
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	CSRFToken  string
+}
+
+// SessionStore keeps track of logged-in users. Implementations must be safe
+// for concurrent use by multiple handlers.
+type SessionStore interface {
+	// Create starts a new session for the given user.
+	Create(userID int) (*Session, error)
+	// Get returns a live session and renews its idle deadline. Expired or
+	// unknown sessions yield errSessionNotFound.
+	Get(id string) (*Session, error)
+	Delete(id string) error
+	// DeleteExpired removes every expired session and reports how many
+	// were removed.
+	DeleteExpired() (int64, error)
+}
+
+type sqliteSessionStore struct {
+	db              *sql.DB
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+	now             func() time.Time
+
+	// SQLite allows a single writer; serialising writes here avoids
+	// "database is locked" errors when many requests renew at once.
+	mu sync.Mutex
+}
+
+func newSQLiteSessionStore(db *sql.DB, idleTimeout, absoluteTimeout time.Duration) *sqliteSessionStore {
+	return &sqliteSessionStore{
+		db:              db,
+		idleTimeout:     idleTimeout,
+		absoluteTimeout: absoluteTimeout,
+		now:             func() time.Time { return time.Now().UTC() },
+	}
+}
+
+// expiry returns the moment a session becomes invalid: whichever comes first
+// of the idle deadline and the absolute lifetime.
+func (s *sqliteSessionStore) expiry(createdAt, lastSeenAt time.Time) time.Time {
+	idle := lastSeenAt.Add(s.idleTimeout)
+	absolute := createdAt.Add(s.absoluteTimeout)
+	if idle.Before(absolute) {
+		return idle
+	}
+	return absolute
+}
+
+func (s *sqliteSessionStore) Create(userID int) (*Session, error) {
+	token, err := newCSRFToken()
+	if err != nil {
+		return nil, fmt.Errorf("createSession: %w", err)
+	}
+	now := s.now()
+	session := &Session{
+		ID:         uuid.NewV4().String(),
+		UserID:     userID,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		CSRFToken:  token,
+	}
+	session.ExpiresAt = s.expiry(session.CreatedAt, session.LastSeenAt)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.db.Exec(`
+		INSERT INTO sessions (id, user_id, created_at, last_seen_at, expires_at, csrf_token)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		session.ID, session.UserID, session.CreatedAt, session.LastSeenAt, session.ExpiresAt, session.CSRFToken)
+	if err != nil {
+		return nil, fmt.Errorf("createSession: %w", err)
+	}
+	return session, nil
+}
+
+func (s *sqliteSessionStore) Get(id string) (*Session, error) {
+	var session Session
+	err := s.db.QueryRow(`
+		SELECT id, user_id, created_at, last_seen_at, expires_at, csrf_token
+		FROM sessions
+		WHERE id = ?`, id).Scan(&session.ID, &session.UserID, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.CSRFToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getSession: %w", err)
+	}
+
+	now := s.now()
+	if !now.Before(session.ExpiresAt) {
+		if err := s.Delete(id); err != nil {
+			log.Printf("getSession: failed to remove expired session: %v", err)
+		}
+		return nil, errSessionNotFound
+	}
+
+	if now.Sub(session.LastSeenAt) < sessionTouchInterval {
+		return &session, nil
+	}
+
+	session.LastSeenAt = now
+	session.ExpiresAt = s.expiry(session.CreatedAt, session.LastSeenAt)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.db.Exec(`
+		UPDATE sessions
+		SET last_seen_at = ?, expires_at = ?
+		WHERE id = ?`,
+		session.LastSeenAt, session.ExpiresAt, session.ID)
+	if err != nil {
+		return nil, fmt.Errorf("getSession (renew): %w", err)
+	}
+	return &session, nil
+}
+
+func (s *sqliteSessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("deleteSession: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteSessionStore) DeleteExpired() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, s.now())
+	if err != nil {
+		return 0, fmt.Errorf("deleteExpiredSessions: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// isSecureRequest reports whether the client reached us over HTTPS, either
+// directly or through the nginx proxy that terminates TLS in production.
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func newSessionCookie(r *http.Request, session *Session) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.CreatedAt.Add(sessionAbsoluteTimeout),
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
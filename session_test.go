@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionExpiry(t *testing.T) {
+	app := newTestApp(t)
+	userID := createTestUser(t, app, "a@example.com", "password1", RoleOwner)
+	store := newSQLiteSessionStore(app.db, time.Hour, 3*time.Hour)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	idle, err := store.Create(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !idle.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("new session expires at %v, want after the idle timeout", idle.ExpiresAt)
+	}
+	active, err := store.Create(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active.ID == idle.ID || active.CSRFToken == idle.CSRFToken {
+		t.Error("two sessions share an id or CSRF token")
+	}
+
+	// Requests in quick succession do not move the deadline.
+	now = now.Add(30 * time.Second)
+	s, err := store.Get(active.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.ExpiresAt.Equal(active.ExpiresAt) {
+		t.Errorf("Get within the touch interval renewed the session to %v", s.ExpiresAt)
+	}
+
+	// Using a session keeps it alive past the idle timeout, up to the
+	// absolute one; an unused one lapses.
+	for range 3 {
+		now = now.Add(50 * time.Minute)
+		if _, err := store.Get(active.ID); err != nil {
+			t.Fatalf("active session at %v: %v", now, err)
+		}
+	}
+	if _, err := store.Get(idle.ID); !errors.Is(err, errSessionNotFound) {
+		t.Errorf("idle session: %v, want errSessionNotFound", err)
+	}
+	s, err = store.Get(active.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := active.CreatedAt.Add(3 * time.Hour); !s.ExpiresAt.Equal(want) {
+		t.Errorf("renewed session expires at %v, want the absolute deadline %v", s.ExpiresAt, want)
+	}
+	now = now.Add(30 * time.Minute)
+	if _, err := store.Get(active.ID); !errors.Is(err, errSessionNotFound) {
+		t.Errorf("session past its absolute lifetime: %v, want errSessionNotFound", err)
+	}
+}
+
+func TestSessionDeleteExpired(t *testing.T) {
+	app := newTestApp(t)
+	userID := createTestUser(t, app, "a@example.com", "password1", RoleOwner)
+	store := newSQLiteSessionStore(app.db, time.Hour, 3*time.Hour)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	for range 2 {
+		if _, err := store.Create(userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(30 * time.Minute)
+	live, err := store.Create(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(45 * time.Minute)
+
+	n, err := store.DeleteExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("DeleteExpired removed %d sessions, want 2", n)
+	}
+	if _, err := store.Get(live.ID); err != nil {
+		t.Errorf("live session: %v", err)
+	}
+}
+
+func TestLoginStartsNewSession(t *testing.T) {
+	app := newTestApp(t)
+	createTestUser(t, app, "a@example.com", "password1", RoleOwner)
+	handler := app.routes()
+
+	// A session id planted before login is not taken over.
+	planted := "00000000-0000-0000-0000-000000000000"
+	form := url.Values{"email": {"a@example.com"}, "password": {"password1"}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: planted})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("login: %d %s", rec.Code, rec.Body)
+	}
+	cookie := sessionCookie(rec.Result())
+	if cookie == nil || cookie.Value == planted {
+		t.Fatalf("login set session cookie %+v, want a new one", cookie)
+	}
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("session cookie is not HttpOnly and SameSite=Lax: %+v", cookie)
+	}
+	if _, err := app.sessions.Get(planted); !errors.Is(err, errSessionNotFound) {
+		t.Errorf("planted session: %v, want errSessionNotFound", err)
+	}
+	session, err := app.sessions.Get(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Logging out ends the session on the server, not just in the browser.
+	form = url.Values{csrfFormField: {session.CSRFToken}}
+	req = httptest.NewRequest(http.MethodPost, "/logout", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("logout: %d %s", rec.Code, rec.Body)
+	}
+	if c := sessionCookie(rec.Result()); c == nil || c.MaxAge >= 0 {
+		t.Errorf("logout did not clear the cookie: %+v", c)
+	}
+	if _, err := app.sessions.Get(cookie.Value); !errors.Is(err, errSessionNotFound) {
+		t.Errorf("session after logout: %v, want errSessionNotFound", err)
+	}
+}
+
+func sessionCookie(resp *http.Response) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookieName {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Failed attempts older than this are forgotten.
+	loginAttemptWindow = 24 * time.Hour
+	// Failures allowed before backoff kicks in. An IP gets more slack than an
+	// account because several people can share one address.
+	loginFreeAttemptsPerIP    = 10
+	loginFreeAttemptsPerEmail = 5
+	loginBaseBackoff          = time.Second
+	// Once the backoff reaches this cap the key is effectively locked out
+	// until the cap has elapsed since its last failure.
+	loginMaxBackoff           = 15 * time.Minute
+	loginAttemptPruneInterval = time.Hour
+)
+
+// LoginThrottle slows down password guessing by tracking failed logins per
+// client IP and per account in SQLite, so a restart does not reset the
+// counters.
+type LoginThrottle struct {
+	db  *sql.DB
+	now func() time.Time
+	mu  sync.Mutex
+}
+
+func newLoginThrottle(db *sql.DB) *LoginThrottle {
+	return &LoginThrottle{
+		db:  db,
+		now: func() time.Time { return time.Now().UTC() },
+	}
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Begin starts a login attempt from this IP for this email. If either has
+// to back off first, it reports how long and records nothing. Otherwise it
+// records the attempt as failed, in the same transaction as the check, and
+// returns its ID for Succeed or Forget. Recording before the password is
+// checked means concurrent attempts each see the ones before them.
+func (t *LoginThrottle) Begin(ip, email string) (attempt int64, wait time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tx, err := t.db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("beginLoginAttempt: %w", err)
+	}
+	defer tx.Rollback()
+
+	email = normalizeEmail(email)
+	ipWait, err := t.wait(tx, "ip", ip, loginFreeAttemptsPerIP)
+	if err != nil {
+		return 0, 0, err
+	}
+	emailWait, err := t.wait(tx, "email", email, loginFreeAttemptsPerEmail)
+	if err != nil {
+		return 0, 0, err
+	}
+	if wait := max(ipWait, emailWait); wait > 0 {
+		return 0, wait, nil
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO login_attempts (ip, email, succeeded, attempted_at)
+		VALUES (?, ?, 0, ?)`,
+		ip, email, t.now())
+	if err != nil {
+		return 0, 0, fmt.Errorf("beginLoginAttempt: %w", err)
+	}
+	attempt, err = result.LastInsertId()
+	if err != nil {
+		return 0, 0, fmt.Errorf("beginLoginAttempt: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("beginLoginAttempt: %w", err)
+	}
+	return attempt, 0, nil
+}
+
+// Succeed marks an attempt as successful, which clears the failure streak
+// for both the IP and the account.
+func (t *LoginThrottle) Succeed(attempt int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.db.Exec(`UPDATE login_attempts SET succeeded = 1 WHERE id = ?`, attempt); err != nil {
+		return fmt.Errorf("succeedLoginAttempt: %w", err)
+	}
+	return nil
+}
+
+// Forget drops an attempt that neither failed nor succeeded yet: the
+// password was right, and the outcome is up to the second factor.
+func (t *LoginThrottle) Forget(attempt int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.db.Exec(`DELETE FROM login_attempts WHERE id = ?`, attempt); err != nil {
+		return fmt.Errorf("forgetLoginAttempt: %w", err)
+	}
+	return nil
+}
+
+// Prune deletes attempts that no longer count towards any backoff.
+func (t *LoginThrottle) Prune() (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result, err := t.db.Exec(`DELETE FROM login_attempts WHERE attempted_at < ?`, t.now().Add(-loginAttemptWindow))
+	if err != nil {
+		return 0, fmt.Errorf("pruneLoginAttempts: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// wait counts the consecutive failures for one key since its last success
+// and turns them into a remaining backoff.
+func (t *LoginThrottle) wait(tx *sql.Tx, column, value string, freeAttempts int) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	now := t.now()
+	rows, err := tx.Query(fmt.Sprintf(`
+		SELECT succeeded, attempted_at
+		FROM login_attempts
+		WHERE %s = ? AND attempted_at >= ?
+		ORDER BY attempted_at DESC`, column),
+		value, now.Add(-loginAttemptWindow))
+	if err != nil {
+		return 0, fmt.Errorf("loginThrottle (%s): %w", column, err)
+	}
+	defer rows.Close()
+
+	var failures int
+	var lastFailure time.Time
+	for rows.Next() {
+		var succeeded bool
+		var attemptedAt time.Time
+		if err := rows.Scan(&succeeded, &attemptedAt); err != nil {
+			return 0, fmt.Errorf("loginThrottle (%s): %w", column, err)
+		}
+		if succeeded {
+			break
+		}
+		if failures == 0 {
+			lastFailure = attemptedAt
+		}
+		failures++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("loginThrottle (%s): %w", column, err)
+	}
+
+	if failures < freeAttempts {
+		return 0, nil
+	}
+	remaining := lastFailure.Add(loginBackoff(failures - freeAttempts)).Sub(now)
+	if remaining < 0 {
+		return 0, nil
+	}
+	return remaining, nil
+}
+
+// loginBackoff doubles the delay for every failure past the free allowance,
+// capped at loginMaxBackoff.
+func loginBackoff(excess int) time.Duration {
+	if excess >= 32 {
+		return loginMaxBackoff
+	}
+	backoff := loginBaseBackoff * time.Duration(1<<excess)
+	if backoff <= 0 || backoff > loginMaxBackoff {
+		return loginMaxBackoff
+	}
+	return backoff
+}
+
+// retryAfterSeconds renders a wait as the whole number of seconds expected
+// by the Retry-After header.
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// clientIP returns the address of the visitor. Behind the nginx proxy every
+// request comes from a private address, so in that case the last hop added
+// to X-Forwarded-For is used instead; entries before it are client-supplied
+// and cannot be trusted.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	if remote == nil || !(remote.IsLoopback() || remote.IsPrivate()) {
+		return host
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		return host
+	}
+	hops := strings.Split(forwarded[len(forwarded)-1], ",")
+	last := strings.TrimSpace(hops[len(hops)-1])
+	if ip := net.ParseIP(last); ip != nil {
+		return ip.String()
+	}
+	return host
+}
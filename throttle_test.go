@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		excess int
+		want   time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{5, 32 * time.Second},
+		{9, 512 * time.Second},
+		{10, loginMaxBackoff},
+		{63, loginMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := loginBackoff(tt.excess); got != tt.want {
+			t.Errorf("loginBackoff(%d) = %v, want %v", tt.excess, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{loginMaxBackoff, "900"},
+	}
+	for _, tt := range tests {
+		if got := retryAfterSeconds(tt.wait); got != tt.want {
+			t.Errorf("retryAfterSeconds(%v) = %q, want %q", tt.wait, got, tt.want)
+		}
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	app := newTestApp(t)
+	throttle := newLoginThrottle(app.db)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	throttle.now = func() time.Time { return now }
+	fail := func(ip, email string) {
+		t.Helper()
+		if _, wait, err := throttle.Begin(ip, email); err != nil || wait > 0 {
+			t.Fatalf("Begin(%s, %s) = wait %v, %v", ip, email, wait, err)
+		}
+	}
+
+	// An account gets loginFreeAttemptsPerEmail tries, from any address,
+	// before it has to wait; the address is counted separately.
+	for i := range loginFreeAttemptsPerEmail {
+		fail(fmt.Sprintf("192.0.2.%d", i+1), "A@example.com ")
+	}
+	_, wait, err := throttle.Begin("192.0.2.100", "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait != loginBaseBackoff {
+		t.Errorf("wait after %d failures = %v, want %v", loginFreeAttemptsPerEmail, wait, loginBaseBackoff)
+	}
+	fail("192.0.2.100", "b@example.com")
+
+	// A throttled attempt is not recorded, so waiting it out is enough.
+	now = now.Add(loginBaseBackoff)
+	fail("192.0.2.100", "a@example.com")
+	_, wait, _ = throttle.Begin("192.0.2.100", "a@example.com")
+	if wait != 2*loginBaseBackoff {
+		t.Errorf("wait after one more failure = %v, want %v", wait, 2*loginBaseBackoff)
+	}
+
+	// A success ends the streak.
+	now = now.Add(2 * loginBaseBackoff)
+	attempt, wait, err := throttle.Begin("192.0.2.100", "a@example.com")
+	if err != nil || wait > 0 {
+		t.Fatalf("Begin = wait %v, %v", wait, err)
+	}
+	if err := throttle.Succeed(attempt); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Second)
+	fail("192.0.2.100", "a@example.com")
+
+	// It does so for the address too, which then has as many free attempts
+	// as before, whichever accounts they are for.
+	for i := range loginFreeAttemptsPerIP - 1 {
+		fail("192.0.2.100", fmt.Sprintf("c%d@example.com", i))
+	}
+	if _, wait, _ := throttle.Begin("192.0.2.100", "d@example.com"); wait == 0 {
+		t.Error("an address past its free attempts was not throttled")
+	}
+
+	// Failures outside the window are forgotten, and pruned.
+	now = now.Add(loginAttemptWindow + time.Minute)
+	fail("192.0.2.100", "a@example.com")
+	n, err := throttle.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Error("Prune removed nothing")
+	}
+}
+
+func TestLoginThrottledResponse(t *testing.T) {
+	app := newTestApp(t)
+	createTestUser(t, app, "a@example.com", "password1", RoleOwner)
+	handler := app.routes()
+	login := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"email": {"a@example.com"}, "password": {password}}
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for range loginFreeAttemptsPerEmail {
+		if rec := login("wrong"); rec.Code != http.StatusForbidden {
+			t.Fatalf("wrong password: %d, want 403", rec.Code)
+		}
+	}
+	// Even the right password has to wait.
+	rec := login("password1")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("login after %d failures: %d, want 429", loginFreeAttemptsPerEmail, rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want %q", got, "1")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"203.0.113.7:1234", nil, "203.0.113.7"},
+		// A public client cannot choose its address by sending the header.
+		{"203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		// Behind the proxy, the hop it added, not what the client sent.
+		{"172.18.0.2:1234", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"127.0.0.1:1234", []string{"198.51.100.1", "203.0.113.7"}, "203.0.113.7"},
+		{"172.18.0.2:1234", nil, "172.18.0.2"},
+		{"172.18.0.2:1234", []string{"garbage"}, "172.18.0.2"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remote
+		for _, f := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%s, %q) = %s, want %s", tt.remote, tt.forwarded, got, tt.want)
+		}
+	}
+}
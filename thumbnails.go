@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/storage"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/thumbnail"
+)
+
+// thumbnailURL is where the thumbnail of the given size of the original
+// stored under key is served.
+func thumbnailURL(size, key string) string {
+	return "/thumbnails/" + size + "/" + key
+}
+
+// Suggested sizes attributes, matching the layout in style.css: the cover is
+// at most 600px wide and shares the row with the visuals on wide screens,
+// photos are shown at up to the large thumbnail's width.
+const (
+	coverSizes = "(min-width: 768px) min(600px, 38.2vw), min(600px, 100vw)"
+	photoSizes = "(min-width: 1080px) 1080px, 100vw"
+)
+
+// srcsetStep is how much wider one srcset candidate may be than the one
+// before it. Wider gaps between the thumbnails, and the room between the
+// largest one and the original, are filled with /img/ variants.
+const srcsetStep = 1.5
+
+// responsiveImage has what an <img> needs to let the browser pick the
+// thumbnail to download and reserve space before it arrives.
+type responsiveImage struct {
+	Src    string `json:"src"`
+	Srcset string `json:"srcset"`
+	Sizes  string `json:"sizes"`
+	// Width, Height and AspectRatio are left out until the thumbnail job
+	// has measured the original.
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	AspectRatio float64 `json:"aspect_ratio,omitempty"`
+}
+
+// srcsetCandidate is one URL of a srcset and the width of the image there.
+type srcsetCandidate struct {
+	URL   string
+	Width int
+}
+
+// responsiveImage describes the original stored under key, width by height
+// pixels (0 if not known yet). The uncropped thumbnails make up the srcset,
+// annotated with their actual width: no wider than the original. Where
+// /img/ may resize the original, its variants fill the gaps. Src, for
+// browsers that ignore srcset, is the middle one of the thumbnails.
+func (app *App) responsiveImage(key string, width, height int, sizes string) responsiveImage {
+	img := responsiveImage{
+		Sizes:  sizes,
+		Width:  width,
+		Height: height,
+	}
+	if width > 0 && height > 0 {
+		img.AspectRatio = math.Round(float64(width)/float64(height)*1e4) / 1e4
+	}
+
+	thumbnails := slices.Clone(app.cfg.Thumbnails)
+	slices.SortFunc(thumbnails, func(a, b thumbnail.Config) int { return a.Width - b.Width })
+	var candidates []srcsetCandidate
+	widest := 0
+	for _, t := range thumbnails {
+		w := t.Width
+		if width > 0 {
+			w = min(w, width)
+		}
+		if t.Crop || w <= widest {
+			continue
+		}
+		widest = w
+		candidates = append(candidates, srcsetCandidate{thumbnailURL(t.Name, key), w})
+	}
+	if len(candidates) > 0 {
+		img.Src = candidates[len(candidates)/2].URL
+	} else if len(thumbnails) > 0 {
+		img.Src = thumbnailURL(thumbnails[len(thumbnails)-1].Name, key)
+	}
+	if app.resizable(key) {
+		candidates = app.fillSrcset(key, candidates, width)
+	}
+
+	srcset := make([]string, len(candidates))
+	for i, c := range candidates {
+		srcset[i] = fmt.Sprintf("%s %dw", c.URL, c.Width)
+	}
+	img.Srcset = strings.Join(srcset, ", ")
+	return img
+}
+
+// resizable reports whether /img/ variants of key may be handed to anyone.
+// They are made from the original, so not when that is kept from the
+// public, nor when thumbnails are watermarked: the variants would not be.
+func (app *App) resizable(key string) bool {
+	if isVisualOriginal(key) && app.cfg.Storage.ProtectOriginals {
+		return false
+	}
+	return !slices.ContainsFunc(app.cfg.Thumbnails, func(t thumbnail.Config) bool { return t.Watermark != nil })
+}
+
+// fillSrcset adds /img/ variants of the original stored under key between
+// the thumbnails, so that no candidate is more than srcsetStep times wider
+// than the one before, and above them up to the original's width, capped
+// at images.max_dimension.
+func (app *App) fillSrcset(key string, thumbnails []srcsetCandidate, width int) []srcsetCandidate {
+	if len(thumbnails) == 0 {
+		return thumbnails
+	}
+	var filled []srcsetCandidate
+	between := func(from, to int) {
+		ratio := float64(to) / float64(from)
+		n := int(math.Ceil(math.Log(ratio) / math.Log(srcsetStep)))
+		for i := 1; i < n; i++ {
+			w := int(math.Round(float64(from) * math.Pow(ratio, float64(i)/float64(n))))
+			filled = append(filled, srcsetCandidate{app.imageURL(key, w, 0, "fit"), w})
+		}
+	}
+	for i, c := range thumbnails {
+		if i > 0 {
+			between(thumbnails[i-1].Width, c.Width)
+		}
+		filled = append(filled, c)
+	}
+	largest := thumbnails[len(thumbnails)-1].Width
+	if top := min(width, app.cfg.Images.MaxDimension); top > largest {
+		between(largest, top)
+		filled = append(filled, srcsetCandidate{app.imageURL(key, top, 0, "fit"), top})
+	}
+	return filled
+}
+
+// acceptedThumbnailFormats orders formats by what the Accept header asks
+// for. AVIF and WebP are only offered to browsers that name them: older
+// ones send image/* without being able to decode either. JPEG always comes
+// last as the fallback.
+func acceptedThumbnailFormats(accept string, formats []thumbnail.Format) []thumbnail.Format {
+	quality := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if name == "q" {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		quality[strings.ToLower(strings.TrimSpace(mediaType))] = q
+	}
+
+	var accepted []thumbnail.Format
+	for _, f := range formats {
+		if f.Name != thumbnail.JPEG && quality[f.ContentType] > 0 {
+			accepted = append(accepted, f)
+		}
+	}
+	slices.SortStableFunc(accepted, func(a, b thumbnail.Format) int {
+		switch qa, qb := quality[a.ContentType], quality[b.ContentType]; {
+		case qa > qb:
+			return -1
+		case qa < qb:
+			return 1
+		}
+		return 0
+	})
+	f, _ := thumbnail.LookupFormat(thumbnail.JPEG)
+	return append(accepted, f)
+}
+
+// thumbnailHandler serves GET /thumbnails/<size>/<key> in the best format
+// the browser accepts. Until the thumbnails of an upload have been generated
+// it serves the original instead.
+func (app *App) thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	if !isSafeMethod(r.Method) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	size, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/thumbnails/"), "/")
+	i := slices.IndexFunc(app.cfg.Thumbnails, func(t thumbnail.Config) bool { return t.Name == size })
+	key, err := storage.CleanKey(key)
+	if i < 0 || err != nil || isQuarantined(key) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Caches must keep a copy per format.
+	w.Header().Set("Vary", "Accept")
+
+	type candidate struct {
+		key         string
+		contentType string
+	}
+	var candidates []candidate
+	for _, f := range acceptedThumbnailFormats(r.Header.Get("Accept"), app.cfg.Thumbnails[i].StoredFormats()) {
+		candidates = append(candidates, candidate{thumbnail.Key(key, size, f), f.ContentType})
+	}
+	// Thumbnails from before formats were configurable are JPEG under the
+	// original's name, whatever its extension.
+	if legacy := thumbnail.LegacyKey(key, size); legacy != candidates[len(candidates)-1].key {
+		candidates = append(candidates, candidate{legacy, "image/jpeg"})
+	}
+	// Then the original, via its master if browsers cannot show it, unless
+	// it is kept from this visitor.
+	if !isVisualOriginal(key) || !app.originalsHidden(r) {
+		candidates = append(candidates, candidate{thumbnail.MasterKey(key), "image/jpeg"}, candidate{key, ""})
+	}
+
+	for _, c := range candidates {
+		obj, info, err := app.storage.Get(r.Context(), c.key)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to read %s from storage: %v", c.key, err)
+			http.Error(w, "Failed to fetch file", http.StatusInternalServerError)
+			return
+		}
+		defer obj.Close()
+		if c.contentType == "" {
+			c.contentType = info.ContentType
+		}
+		app.serveObject(w, r, c.key, obj, info, c.contentType)
+		return
+	}
+	http.NotFound(w, r)
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"rsc.io/qr"
+)
+
+// RFC 6238 parameters. These are the defaults every authenticator app
+// understands, so they are not configurable.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// Codes from one step either side of the current one are accepted to
+	// allow for clock drift on the phone.
+	totpSkew   = 1
+	totpIssuer = "Yuanyuan Zhou"
+
+	recoveryCodeCount = 10
+
+	loginChallengeCookieName  = "login_challenge"
+	loginChallengeTTL         = 5 * time.Minute
+	loginChallengeMaxAttempts = 5
+)
+
+var (
+	errLoginChallengeNotFound = errors.New("login challenge not found")
+	totpEncoding              = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// TwoFactor is a user's TOTP enrolment. A non-empty Secret with Enabled
+// false means enrolment was started but never confirmed.
+type TwoFactor struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("newTOTPSecret: %w", err)
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode computes the HOTP value (RFC 4226) for a time step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("totpCode: invalid secret: %w", err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for range totpDigits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// verifyTOTP checks a code against the steps around now and returns the
+// matching step. Steps at or before lastStep are refused so a code can only
+// be used once.
+func verifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI builds the otpauth:// URI that authenticator apps scan.
+func totpURI(secret, account string) string {
+	label := url.PathEscape(totpIssuer + ":" + account)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	// Some authenticator apps show a literal "+" for spaces in the issuer.
+	return "otpauth://totp/" + label + "?" + strings.ReplaceAll(params.Encode(), "+", "%20")
+}
+
+// totpQRCode renders uri as an SVG QR code. It is drawn here rather than in
+// the browser so that no third-party script ever sees the secret.
+func totpQRCode(uri string) (template.HTML, error) {
+	code, err := qr.Encode(uri, qr.M)
+	if err != nil {
+		return "", fmt.Errorf("totpQRCode: %w", err)
+	}
+	const quiet = 4 // modules of white border scanners need
+	size := code.Size + 2*quiet
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" shape-rendering="crispEdges" role="img" aria-label="QR code">`, size, size, 4*size, 4*size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y := range code.Size {
+		for x := range code.Size {
+			if code.Black(x, y) {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+quiet, y+quiet)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return template.HTML(b.String()), nil
+}
+
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("newRecoveryCodes: %w", err)
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode normalises what the user typed before hashing. Recovery
+// codes carry 50 random bits, so a fast hash is enough.
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+	sum := sha256.Sum256([]byte(normalized))
+	return sum[:]
+}
+
+func (app *App) getTwoFactor(userID int) (TwoFactor, error) {
+	var tf TwoFactor
+	err := app.db.QueryRow("SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = ?", userID).
+		Scan(&tf.Secret, &tf.Enabled, &tf.LastStep)
+	if err != nil {
+		return TwoFactor{}, fmt.Errorf("getTwoFactor: %w", err)
+	}
+	return tf, nil
+}
+
+// setPendingTOTPSecret starts enrolment. It refuses to overwrite a secret
+// that is already enabled.
+func (app *App) setPendingTOTPSecret(userID int, secret string) error {
+	_, err := app.db.Exec(`
+		UPDATE users
+		SET totp_secret = ?, totp_last_step = 0
+		WHERE id = ? AND totp_enabled = 0`, secret, userID)
+	if err != nil {
+		return fmt.Errorf("setPendingTOTPSecret: %w", err)
+	}
+	return nil
+}
+
+// enableTOTP confirms enrolment and returns a fresh set of recovery codes.
+func (app *App) enableTOTP(userID int, step int64) ([]string, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("enableTOTP (begin tx): %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?`, step, userID); err != nil {
+		return nil, fmt.Errorf("enableTOTP: %w", err)
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("enableTOTP (commit tx): %w", err)
+	}
+	return codes, nil
+}
+
+func (app *App) disableTOTP(userID int) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return fmt.Errorf("disableTOTP (begin tx): %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET totp_secret = '', totp_enabled = 0, totp_last_step = 0 WHERE id = ?`, userID); err != nil {
+		return fmt.Errorf("disableTOTP: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("disableTOTP (recovery codes): %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("disableTOTP (commit tx): %w", err)
+	}
+	return nil
+}
+
+func (app *App) regenerateRecoveryCodes(userID int) ([]string, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("regenerateRecoveryCodes (begin tx): %w", err)
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("regenerateRecoveryCodes (commit tx): %w", err)
+	}
+	return codes, nil
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return nil, fmt.Errorf("replaceRecoveryCodes (delete): %w", err)
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`, userID, hashRecoveryCode(code)); err != nil {
+			return nil, fmt.Errorf("replaceRecoveryCodes (insert): %w", err)
+		}
+	}
+	return codes, nil
+}
+
+func (app *App) countUnusedRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := app.db.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL`, userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("countUnusedRecoveryCodes: %w", err)
+	}
+	return count, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused
+// recovery code, and burns whichever one matched.
+func (app *App) verifySecondFactor(userID int, code string, now time.Time) (bool, error) {
+	tf, err := app.getTwoFactor(userID)
+	if err != nil {
+		return false, err
+	}
+	if !tf.Enabled {
+		return false, nil
+	}
+
+	if step, ok := verifyTOTP(tf.Secret, code, now, tf.LastStep); ok {
+		// The conditional update makes concurrent replays of the same code
+		// fail: only one of them can move last_step forward.
+		result, err := app.db.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`, step, userID, step)
+		if err != nil {
+			return false, fmt.Errorf("verifySecondFactor (totp): %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return false, fmt.Errorf("verifySecondFactor (totp): %w", err)
+		}
+		return n == 1, nil
+	}
+
+	result, err := app.db.Exec(`
+		UPDATE recovery_codes
+		SET used_at = ?
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`,
+		now.UTC(), userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, fmt.Errorf("verifySecondFactor (recovery code): %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("verifySecondFactor (recovery code): %w", err)
+	}
+	return n == 1, nil
+}
+
+// loginChallenge remembers that a user got their password right and still
+// owes us a second factor. It is deliberately not a session: nothing behind
+// requireAuth accepts it.
+type loginChallenge struct {
+	ID        string
+	UserID    int
+	Email     string
+	ExpiresAt time.Time
+	Attempts  int
+}
+
+func (app *App) createLoginChallenge(userID int, email string, now time.Time) (*loginChallenge, error) {
+	challenge := &loginChallenge{
+		ID:        uuid.NewV4().String(),
+		UserID:    userID,
+		Email:     email,
+		ExpiresAt: now.UTC().Add(loginChallengeTTL),
+	}
+	_, err := app.db.Exec(`
+		INSERT INTO login_challenges (id, user_id, email, expires_at)
+		VALUES (?, ?, ?, ?)`,
+		challenge.ID, challenge.UserID, challenge.Email, challenge.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("createLoginChallenge: %w", err)
+	}
+	return challenge, nil
+}
+
+func (app *App) getLoginChallenge(r *http.Request, now time.Time) (*loginChallenge, error) {
+	cookie, err := r.Cookie(loginChallengeCookieName)
+	if err != nil {
+		return nil, errLoginChallengeNotFound
+	}
+	var challenge loginChallenge
+	err = app.db.QueryRow(`
+		SELECT id, user_id, email, expires_at, attempts
+		FROM login_challenges
+		WHERE id = ?`, cookie.Value).
+		Scan(&challenge.ID, &challenge.UserID, &challenge.Email, &challenge.ExpiresAt, &challenge.Attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errLoginChallengeNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getLoginChallenge: %w", err)
+	}
+	if !now.Before(challenge.ExpiresAt) || challenge.Attempts >= loginChallengeMaxAttempts {
+		app.deleteLoginChallenge(challenge.ID)
+		return nil, errLoginChallengeNotFound
+	}
+	return &challenge, nil
+}
+
+func (app *App) recordLoginChallengeAttempt(id string) error {
+	if _, err := app.db.Exec(`UPDATE login_challenges SET attempts = attempts + 1 WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("recordLoginChallengeAttempt: %w", err)
+	}
+	return nil
+}
+
+func (app *App) deleteLoginChallenge(id string) error {
+	if _, err := app.db.Exec(`DELETE FROM login_challenges WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("deleteLoginChallenge: %w", err)
+	}
+	return nil
+}
+
+func (app *App) deleteExpiredLoginChallenges() (int64, error) {
+	result, err := app.db.Exec(`DELETE FROM login_challenges WHERE expires_at <= ?`, time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("deleteExpiredLoginChallenges: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func newLoginChallengeCookie(r *http.Request, challenge *loginChallenge) *http.Cookie {
+	return &http.Cookie{
+		Name:     loginChallengeCookieName,
+		Value:    challenge.ID,
+		Path:     "/login",
+		Expires:  challenge.ExpiresAt,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func clearLoginChallengeCookie(r *http.Request) *http.Cookie {
+	return &http.Cookie{
+		Name:     loginChallengeCookieName,
+		Value:    "",
+		Path:     "/login",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed of RFC 6238 Appendix B,
+// "12345678901234567890", in base32.
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+// The SHA-1 test vectors of RFC 6238 Appendix B. The RFC gives eight
+// digits; these are the last six, which is what a six-digit code is.
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		got, err := totpCode(rfc6238Secret, totpStep(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != v.code {
+			t.Errorf("at %d: totpCode = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		now := time.Unix(v.unix, 0)
+		want := totpStep(now)
+
+		step, ok := verifyTOTP(rfc6238Secret, v.code, now, 0)
+		if !ok || step != want {
+			t.Errorf("at %d: verifyTOTP = %d, %v, want %d, true", v.unix, step, ok, want)
+		}
+		// Clock drift of one step either way is allowed, two is not.
+		if _, ok := verifyTOTP(rfc6238Secret, v.code, now.Add(totpPeriod*time.Second), 0); !ok {
+			t.Errorf("at %d: code refused one step later", v.unix)
+		}
+		if _, ok := verifyTOTP(rfc6238Secret, v.code, now.Add(2*totpPeriod*time.Second), 0); ok {
+			t.Errorf("at %d: code accepted two steps later", v.unix)
+		}
+		// A step that was already used cannot be used again.
+		if _, ok := verifyTOTP(rfc6238Secret, v.code, now, want); ok {
+			t.Errorf("at %d: code accepted for a used step", v.unix)
+		}
+		if _, ok := verifyTOTP(rfc6238Secret, v.code, now, want-1); !ok {
+			t.Errorf("at %d: code refused after an earlier step was used", v.unix)
+		}
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, "28708", time.Unix(59, 0), 0); ok {
+		t.Error("five-digit code accepted")
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, "287 082", time.Unix(59, 0), 0); !ok {
+		t.Error("code with a space refused")
+	}
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	app := newTestApp(t)
+	userID := createTestUser(t, app, "owner@example.com", "password1", RoleOwner)
+	if err := app.setPendingTOTPSecret(userID, rfc6238Secret); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1111111109, 0)
+	codes, err := app.enableTOTP(userID, totpStep(now)-2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	verify := func(code string) bool {
+		t.Helper()
+		ok, err := app.verifySecondFactor(userID, code, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	t.Run("totp replay", func(t *testing.T) {
+		if !verify("081804") {
+			t.Fatal("current code refused")
+		}
+		if verify("081804") {
+			t.Error("the same code was accepted twice")
+		}
+		// The step before was never used, but it is behind the one that was.
+		previous, err := totpCode(rfc6238Secret, totpStep(now)-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verify(previous) {
+			t.Error("a code older than the last used one was accepted")
+		}
+	})
+
+	t.Run("recovery codes", func(t *testing.T) {
+		if !verify(codes[0]) {
+			t.Fatal("recovery code refused")
+		}
+		if verify(codes[0]) {
+			t.Error("a recovery code was accepted twice")
+		}
+		remaining, err := app.countUnusedRecoveryCodes(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remaining != recoveryCodeCount-1 {
+			t.Errorf("%d recovery codes left, want %d", remaining, recoveryCodeCount-1)
+		}
+
+		// Regenerating throws away the old codes, used or not.
+		fresh, err := app.regenerateRecoveryCodes(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verify(codes[1]) {
+			t.Error("a replaced recovery code was accepted")
+		}
+		if !verify(fresh[0]) {
+			t.Error("a new recovery code was refused")
+		}
+	})
+}
+
+func TestTOTPQRCode(t *testing.T) {
+	svg, err := totpQRCode(totpURI(rfc6238Secret, "owner@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(svg), "<svg ") || !strings.Contains(string(svg), "h1v1h-1z") {
+		t.Errorf("totpQRCode = %.80s…, want an SVG with modules", svg)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"html/template"
 	"time"
 )
 
@@ -10,11 +11,18 @@ type User struct {
 }
 
 type Cover struct {
+	ID       int `json:"-"`
 	FilePath string
+	// Width and Height are 0 until the cover's thumbnails are made.
+	Width     int       `json:",omitempty"`
+	Height    int       `json:",omitempty"`
+	CreatedAt time.Time `json:",omitzero"`
 }
 
 type Portfolio struct {
-	FilePath string
+	ID        int `json:"-"`
+	FilePath  string
+	CreatedAt time.Time `json:",omitzero"`
 }
 
 type Story struct {
@@ -41,13 +49,28 @@ type Photo struct {
 	ID        int       `json:"id"`
 	VisualID  int       `json:"visual_id"`
 	Filename  string    `json:"file_path"`
+	Status    string    `json:"status"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
 	CreatedAt time.Time `json:"created_at"`
-}
-
-type PhotoResponse struct {
-	Photos     []Photo                `json:"photos"`
-	Pagination map[string]interface{} `json:"pagination"`
-}
+	// What the upload's EXIF/XMP said; see photoMetadata.
+	TakenAt     *time.Time  `json:"taken_at,omitempty"`
+	CameraMake  string      `json:"camera_make,omitempty"`
+	CameraModel string      `json:"camera_model,omitempty"`
+	Lens        string      `json:"lens,omitempty"`
+	Orientation int         `json:"orientation,omitempty"`
+	Placeholder placeholder `json:"placeholder,omitzero"`
+	// SHA256 and PHash identify the photo's content; see duplicates.go.
+	SHA256 string `json:"sha256,omitempty"`
+	PHash  string `json:"phash,omitempty"`
+}
+
+// Photo statuses. A photo is processing until its thumbnail job has run.
+const (
+	photoProcessing = "processing"
+	photoReady      = "ready"
+	photoFailed     = "failed"
+)
 
 type loginData struct {
 	Login bool
@@ -56,25 +79,30 @@ type loginData struct {
 type coverData struct {
 	Login             bool
 	OriginalCoverPath string
-	LargeCoverPath    string
-	MediumCoverPath   string
+	Cover             responsiveImage
 	Visuals           []Visual
 	Stories           []Story
 }
 
 type infoData struct {
-	Login bool
-	Info  Info
+	Login       bool
+	Info        Info
+	CSRFToken   string
+	Permissions permissionSet
 }
 
 type portfolioData struct {
-	Login     bool
-	Portfolio Portfolio
+	Login       bool
+	Portfolio   Portfolio
+	CSRFToken   string
+	Permissions permissionSet
 }
 
 type listStoryData struct {
-	Login   bool
-	Stories []Story
+	Login       bool
+	Stories     []Story
+	CSRFToken   string
+	Permissions permissionSet
 }
 
 type listVisualData struct {
@@ -83,28 +111,66 @@ type listVisualData struct {
 }
 
 type storyData struct {
-	Login bool
-	Story Story
+	Login       bool
+	Story       Story
+	CSRFToken   string
+	Permissions permissionSet
 }
 
 type visualData struct {
-	Login  bool
-	Visual Visual
+	Login       bool
+	Visual      Visual
+	CSRFToken   string
+	Permissions permissionSet
+	// Duplicates is how many photos of the upload that led here look like
+	// ones already on the site.
+	Duplicates int
+}
+
+type twoFactorData struct {
+	Login                  bool
+	CSRFToken              string
+	Enabled                bool
+	Secret                 string
+	QRCode                 template.HTML
+	RecoveryCodes          []string
+	RemainingRecoveryCodes int
+	Error                  string
+}
+
+type apiExplorerData struct {
+	Login     bool
+	CSRFToken string
 }
 
-type ThumbnailConfig struct {
-	Name    string
-	Width   int
-	Quality int
-	Crop    bool
+type tokensData struct {
+	Login     bool
+	CSRFToken string
+	Tokens    []APIToken
+	Scopes    []string
+	NewToken  string
+	Error     string
+}
+
+type auditData struct {
+	Login       bool
+	CSRFToken   string
+	Permissions permissionSet
+	Events      []AuditEvent
+	Filter      auditFilter
+	Since       string
+	Until       string
+	Total       int
+	PrevURL     string
+	NextURL     string
 }
 
 type FileUploadConfig struct {
-	AllowedTypes   map[string]bool
-	DestinationDir string
-	MaxSize        int64
-	Filename       string
-	Thumbnails     []ThumbnailConfig
+	AllowedTypes map[string]bool
+	// Prefix is the storage key the file is stored under, e.g. "covers".
+	Prefix   string
+	MaxSize  int64
+	Filename string
 }
 
 type thumbnailPaths struct {
@@ -115,7 +181,43 @@ type thumbnailPaths struct {
 }
 
 type photoResponse struct {
-	ID         int            `json:"id"`
-	Filename   string         `json:"filename"`
-	Thumbnails thumbnailPaths `json:"thumbnails"`
+	ID         int             `json:"id"`
+	Filename   string          `json:"filename"`
+	Status     string          `json:"status"`
+	Thumbnails thumbnailPaths  `json:"thumbnails"`
+	Image      responsiveImage `json:"image"`
+	Metadata   photoMetadata   `json:"metadata"`
+	// Placeholder is empty until the photo's thumbnail job has run.
+	Placeholder placeholder `json:"placeholder"`
+}
+
+type photoListResponse struct {
+	Photos     []photoResponse `json:"photos"`
+	Pagination pagination      `json:"pagination"`
+}
+
+type auditEventListResponse struct {
+	Events     []AuditEvent `json:"events"`
+	Pagination pagination   `json:"pagination"`
+}
+
+// pagination says where a page of a list is. PerPage is -1 when the whole
+// list was asked for, which is then a single page.
+type pagination struct {
+	Total       int `json:"total"`
+	PerPage     int `json:"per_page"`
+	CurrentPage int `json:"current_page"`
+	TotalPages  int `json:"total_pages"`
+}
+
+func newPagination(total, page, perPage int) pagination {
+	p := pagination{Total: total, PerPage: perPage, CurrentPage: page}
+	switch {
+	case total == 0:
+	case perPage <= 0:
+		p.TotalPages = 1
+	default:
+		p.TotalPages = (total + perPage - 1) / perPage
+	}
+	return p
 }
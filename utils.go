@@ -1,17 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
-	"image/jpeg"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
-	"os"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"unicode"
 
@@ -19,21 +27,47 @@ import (
 
 	"path/filepath"
 
-	"github.com/disintegration/imaging"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/exif"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/storage"
+	"github.com/caspereijkens/portfolio-yuanyuanzhou/internal/thumbnail"
 	_ "github.com/mattn/go-sqlite3"
 	uuid "github.com/satori/go.uuid"
 )
 
-func determinePort() string {
-	port, ok := os.LookupEnv("SERVER_PORT")
-	if !ok {
-		port = "8080"
+// startSweeper runs a cleanup function every interval until the returned
+// stop function is called. sweep returns how many of unit it removed. stop
+// waits for a sweep that is already running, so the database can be closed
+// right after.
+func startSweeper(name, unit string, interval time.Duration, sweep func() (int64, error)) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case <-ticker.C:
+				n, err := sweep()
+				if err != nil {
+					log.Printf("%s sweeper: %v", name, err)
+				} else if n > 0 {
+					log.Printf("%s sweeper: removed %d %s", name, n, unit)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-exited
 	}
-	return ":" + port
 }
 
-func login(email string, password []byte) (*int, error) {
-	userId, registeredHashedPassword, err := getCredentials(email)
+func (app *App) login(email string, password []byte) (*int, error) {
+	userId, registeredHashedPassword, err := app.getCredentials(email)
 	if err != nil {
 		return nil, err
 	}
@@ -44,33 +78,13 @@ func login(email string, password []byte) (*int, error) {
 	return userId, nil
 }
 
-func addSession(w http.ResponseWriter, email string, password []byte) error {
-	userId, err := login(email, password)
+func (app *App) addSession(w http.ResponseWriter, r *http.Request, userId int) error {
+	session, err := app.sessions.Create(userId)
 	if err != nil {
-		log.Printf("Login failed: %v", err)
+		log.Printf("Failed to create session: %v", err)
 		return err
 	}
-	sessionID := uuid.NewV4().String()
-	sessionStore[sessionID] = *userId
-	cookie := &http.Cookie{
-		Name:  "session",
-		Value: sessionID,
-	}
-	http.SetCookie(w, cookie)
-	return nil
-}
-
-func saveFile(src multipart.File, dstPath string) error {
-	dst, err := os.Create(dstPath)
-	if err != nil {
-		return fmt.Errorf("error creating destination file: %v", err)
-	}
-	defer dst.Close()
-
-	if _, err := io.Copy(dst, src); err != nil {
-		return fmt.Errorf("error copying file contents: %v", err)
-	}
-
+	http.SetCookie(w, newSessionCookie(r, session))
 	return nil
 }
 
@@ -86,110 +100,161 @@ func sanitizeFilename(input string) string {
 	return output
 }
 
-func storeFile(fileHeader *multipart.FileHeader, config FileUploadConfig) (string, error) {
+// storedFile is what storeFile learns about an upload while storing it.
+type storedFile struct {
+	// Filename is what the database records.
+	Filename string
+	// SHA256 is the hex digest of the file as stored.
+	SHA256 string
+	// For images, the EXIF/XMP metadata, which is scrubbed from the stored
+	// file, and the perceptual hash ("" if the image cannot be decoded).
+	Metadata exif.Metadata
+	PHash    string
+}
+
+// errUploadRejected is wrapped by the errors storeFile returns when the
+// upload itself is at fault, as opposed to the storage.
+var errUploadRejected = errors.New("upload rejected")
+
+// storeFile checks an upload against config and puts it into storage under
+// config.Prefix. Thumbnails are left to a background job.
+func (app *App) storeFile(ctx context.Context, fileHeader *multipart.FileHeader, config FileUploadConfig) (storedFile, error) {
+	if config.MaxSize > 0 && fileHeader.Size > config.MaxSize {
+		log.Printf("uploaded file %s is %d bytes, over the %d byte limit", fileHeader.Filename, fileHeader.Size, config.MaxSize)
+		return storedFile{}, fmt.Errorf("%w: file is larger than %d bytes", errUploadRejected, config.MaxSize)
+	}
+
 	file, err := fileHeader.Open()
 	if err != nil {
 		log.Printf("Error opening uploaded file: %v", err)
-		return "", err
+		return storedFile{}, err
 	}
 	defer file.Close()
 
 	buffer := make([]byte, 512)
 	if _, err = file.Read(buffer); err != nil {
 		log.Printf("error reading file for MIME type check: %v", err)
-		return "", fmt.Errorf("error reading file for MIME type check: %v", err)
+		return storedFile{}, fmt.Errorf("error reading file for MIME type check: %v", err)
 	}
-	mimeType := http.DetectContentType(buffer)
+	mimeType := thumbnail.DetectContentType(buffer)
 	if !config.AllowedTypes[mimeType] {
 		log.Printf("uploaded file type %s is not supported", mimeType)
-		return "", fmt.Errorf("uploaded file type %s is not supported", mimeType)
+		return storedFile{}, fmt.Errorf("%w: file type %s is not supported", errUploadRejected, mimeType)
 	}
 	if _, err = file.Seek(0, 0); err != nil {
 		log.Printf("error resetting file pointer: %v", err)
-		return "", fmt.Errorf("error resetting file pointer: %v", err)
+		return storedFile{}, fmt.Errorf("error resetting file pointer: %v", err)
 	}
 
-	filename := config.Filename
-	if filename == "" {
-		ext := filepath.Ext(fileHeader.Filename)
-		filename = fmt.Sprintf("%s%s", uuid.NewV4().String(), ext)
+	// Scrubbing and hashing happen in memory; the size limit above keeps
+	// that bounded.
+	data, err := io.ReadAll(file)
+	if err != nil {
+		log.Printf("error reading uploaded file: %v", err)
+		return storedFile{}, fmt.Errorf("error reading uploaded file: %v", err)
 	}
-
-	if config.DestinationDir != "" {
-		if err := os.MkdirAll(config.DestinationDir, 0755); err != nil {
-			log.Printf("error creating destination directory: %v", err)
-			return "", fmt.Errorf("error creating destination directory: %v", err)
-		}
+	var stored storedFile
+	if strings.HasPrefix(mimeType, "image/") {
+		data, stored.Metadata = exif.Process(data)
+		stored.PHash = imageHash(bytes.NewReader(data))
 	}
+	sum := sha256.Sum256(data)
+	stored.SHA256 = hex.EncodeToString(sum[:])
 
-	filePath := filepath.Join(config.DestinationDir, filename)
-	if err := saveFile(file, filePath); err != nil {
-		log.Printf("error saving file: %v", err)
-		return "", fmt.Errorf("error saving file: %v", err)
+	stored.Filename = config.Filename
+	if stored.Filename == "" {
+		ext := filepath.Ext(fileHeader.Filename)
+		stored.Filename = fmt.Sprintf("%s%s", uuid.NewV4().String(), ext)
 	}
 
-	if strings.HasPrefix(mimeType, "image/") {
-		if err := generateAndSaveThumbnail(filePath, config); err != nil {
-			log.Printf("Warning: thumbnail generation failed: %v", err)
-		}
+	key := path.Join(config.Prefix, stored.Filename)
+	if err := app.storage.Put(ctx, key, bytes.NewReader(data), int64(len(data)), mimeType); err != nil {
+		log.Printf("error saving file: %v", err)
+		return storedFile{}, fmt.Errorf("error saving file: %v", err)
 	}
 
-	return filename, nil
+	return stored, nil
 }
 
-func getVisualBaseDir(vid int) string {
-	return filepath.Join(localFSDir, "visuals", strconv.Itoa(vid))
+// visualPrefix is the storage prefix a visual's photos are kept under.
+func visualPrefix(vid int) string {
+	return path.Join("visuals", strconv.Itoa(vid))
 }
 
-func cleanupVisualFiles(visual Visual) error {
-	visualDir := getVisualBaseDir(visual.ID)
-	err := os.RemoveAll(visualDir)
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove visual directory %s: %w", visualDir, err)
+// deleteImageFiles removes the image stored under key along with its master,
+// thumbnails and resized copies. Failures are logged: by the time files are
+// deleted, the row pointing at them is already gone.
+func (app *App) deleteImageFiles(ctx context.Context, key string) {
+	keys := append([]string{key, thumbnail.MasterKey(key)}, thumbnail.Keys(key, app.cfg.Thumbnails)...)
+	if err := app.images.Purge(key); err != nil {
+		log.Printf("Warning: Failed to purge resized copies of '%s': %v", key, err)
+	}
+	for _, k := range keys {
+		if err := app.storage.Delete(ctx, k); err != nil {
+			log.Printf("Warning: Failed to delete file at '%s': %v", k, err)
+		}
 	}
-	return nil
 }
 
-func isDirEmpty(dir string) (bool, error) {
-	f, err := os.Open(dir)
-	if err != nil {
-		return false, err
-	}
-	defer f.Close()
-
-	_, err = f.Readdirnames(1) // Try to read at least one entry
-	if err == io.EOF {
-		return true, nil
+func (app *App) cleanupVisualFiles(ctx context.Context, visual Visual) error {
+	prefix := visualPrefix(visual.ID)
+	if err := storage.DeletePrefix(ctx, app.storage, prefix); err != nil {
+		return fmt.Errorf("failed to remove visual files under %s: %w", prefix, err)
 	}
-	return false, err // Either not empty or error
+	return app.images.Purge(prefix)
 }
 
-func deleteSession(req *http.Request) *http.Cookie {
-	cookie, err := req.Cookie("session")
+func (app *App) deleteSession(req *http.Request) *http.Cookie {
+	cookie, err := req.Cookie(sessionCookieName)
 	if err != nil {
 		return nil
 	}
-	sessionId := cookie.Value
-	delete(sessionStore, sessionId)
+	if err := app.sessions.Delete(cookie.Value); err != nil {
+		log.Printf("Failed to delete session: %v", err)
+	}
 	cookie = &http.Cookie{
-		Name:   "session",
-		Value:  "",
-		MaxAge: -1,
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecureRequest(req),
+		SameSite: http.SameSiteLaxMode,
 	}
 	return cookie
 }
 
-func getLoginStatus(req *http.Request) (*int, bool) {
-	cookie, err := req.Cookie("session")
+func (app *App) getSession(req *http.Request) (*Session, bool) {
+	cookie, err := req.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, false
+	}
+	session, err := app.sessions.Get(cookie.Value)
 	if err != nil {
+		if !errors.Is(err, errSessionNotFound) {
+			log.Printf("Failed to look up session: %v", err)
+		}
 		return nil, false
 	}
-	sessionId := cookie.Value
-	userId, ok := sessionStore[sessionId]
+	return session, true
+}
+
+// getLoginStatus identifies the caller either by API token or by session
+// cookie. When an Authorization header is present the cookie is ignored, so
+// a bad token never falls back to a browser session.
+func (app *App) getLoginStatus(req *http.Request) (*int, bool) {
+	if _, ok := bearerToken(req); ok {
+		token, ok := app.getAPIToken(req)
+		if !ok {
+			return nil, false
+		}
+		return &token.UserID, true
+	}
+	session, ok := app.getSession(req)
 	if !ok {
 		return nil, false
 	}
-	return &userId, true
+	return &session.UserID, true
 }
 
 func getPaginationParams(r *http.Request) (int, int) {
@@ -217,92 +282,122 @@ func getPaginationParams(r *http.Request) (int, int) {
 	return page, perPage
 }
 
-var thumbnailConfigs = []ThumbnailConfig{
-	{Name: "mini", Width: 40, Quality: 80, Crop: true},
-	{Name: "small", Width: 150, Quality: 80},
-	{Name: "medium", Width: 600, Quality: 80},
-	{Name: "large", Width: 1080, Quality: 80},
+const jobThumbnails = "thumbnails"
+
+// thumbnailJob asks for the thumbnails of the image stored under Key. For
+// visual photos PhotoID is set, and the photo's status follows the job; for
+// covers CoverID is. Either gets the image's size once it is decoded. Sizes
+// limits the job to the named thumbnail sizes; empty means all of them.
+type thumbnailJob struct {
+	Key     string   `json:"key"`
+	PhotoID int      `json:"photo_id,omitempty"`
+	CoverID int      `json:"cover_id,omitempty"`
+	Sizes   []string `json:"sizes,omitempty"`
 }
 
-func generateAndSaveThumbnail(imagePath string, config FileUploadConfig) error {
-	img, err := imaging.Open(imagePath, imaging.AutoOrientation(true))
-	if err != nil {
-		return fmt.Errorf("error opening image for thumbnail: %v", err)
+func (app *App) runThumbnailJob(ctx context.Context, payload json.RawMessage) error {
+	var job thumbnailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return fmt.Errorf("%w: %v", errJobPermanent, err)
 	}
-
-	for _, thumbConfig := range config.Thumbnails {
-		if thumbConfig.Crop {
-			err = saveCroppedThumbnail(img, thumbConfig.Width, thumbConfig.Name, imagePath, thumbConfig.Quality)
-		} else {
-			err = saveResizedImage(img, thumbConfig.Width, thumbConfig.Name, imagePath, thumbConfig.Quality)
-		}
-		if err != nil {
-			log.Printf("Warning: failed to generate %s thumbnail for %s: %v", thumbConfig.Name, imagePath, err)
+	if job.PhotoID != 0 {
+		if _, err := app.getPhotoByID(job.PhotoID); errors.Is(err, sql.ErrNoRows) {
+			return nil // Deleted while the job was queued.
 		}
 	}
 
-	return nil // Return nil as long as the original file was saved.
-}
-
-func saveCroppedThumbnail(img image.Image, size int, sizeName string, originalImagePath string, quality int) error {
-	thumb := imaging.Fill(img, size, size, imaging.Center, imaging.Lanczos)
-	thumbDir := filepath.Join(filepath.Dir(originalImagePath), "thumbnails", sizeName)
-	if err := os.MkdirAll(thumbDir, 0755); err != nil {
-		return fmt.Errorf("error creating %s thumbnail directory: %v", sizeName, err)
+	obj, _, err := app.storage.Get(ctx, job.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("%w: %s is gone", errJobPermanent, job.Key)
 	}
-	thumbPath := filepath.Join(thumbDir, filepath.Base(originalImagePath))
-
-	// Save as JPEG with a quality setting
-	outFile, err := os.Create(thumbPath)
 	if err != nil {
-		return fmt.Errorf("error creating output file for %s thumbnail: %v", sizeName, err)
+		return err
 	}
-	defer outFile.Close()
+	defer obj.Close()
 
-	// Adjust quality as needed (0-100, higher is better quality but larger size)
-	err = jpeg.Encode(outFile, thumb, &jpeg.Options{Quality: quality})
+	thumbnails := app.cfg.Thumbnails
+	if len(job.Sizes) > 0 {
+		thumbnails = slices.DeleteFunc(slices.Clone(thumbnails), func(t thumbnail.Config) bool {
+			return !slices.Contains(job.Sizes, t.Name)
+		})
+	}
+	result, err := app.generateAndSaveThumbnail(ctx, obj, job.Key, thumbnails)
 	if err != nil {
-		return fmt.Errorf("error saving %s thumbnail as JPEG: %v", sizeName, err)
+		return err
+	}
+	switch {
+	case job.PhotoID != 0:
+		return app.markPhotoReady(job.PhotoID, result)
+	case job.CoverID != 0:
+		return app.setCoverDimensions(job.CoverID, result.Width, result.Height)
 	}
-
 	return nil
 }
 
-func saveResizedImage(img image.Image, width int, sizeName, originalImagePath string, quality int) error {
-	resizedImg := imaging.Resize(img, width, 0, imaging.Lanczos)
-
-	thumbDir := filepath.Join(filepath.Dir(originalImagePath), "thumbnails", sizeName)
-	if err := os.MkdirAll(thumbDir, 0755); err != nil {
-		return fmt.Errorf("error creating %s thumbnail directory: %v", sizeName, err)
+func (app *App) thumbnailJobFailed(payload json.RawMessage, err error) {
+	var job thumbnailJob
+	if json.Unmarshal(payload, &job) != nil || job.PhotoID == 0 {
+		return
+	}
+	if err := app.setPhotoStatus(job.PhotoID, photoFailed); err != nil {
+		log.Printf("Failed to mark photo %d as failed: %v", job.PhotoID, err)
 	}
+}
+
+// thumbnailResult is what making the thumbnails of an image learns about it.
+type thumbnailResult struct {
+	// Width and Height are the size of the image, upright.
+	Width, Height int
+	Placeholder   placeholder
+}
 
-	thumbPath := filepath.Join(thumbDir, filepath.Base(originalImagePath))
-	outFile, err := os.Create(thumbPath)
+// generateAndSaveThumbnail stores the thumbnails of the image in src and
+// returns its size and placeholder. Thumbnails are never wider than the
+// original. HEIC originals also get a JPEG master.
+func (app *App) generateAndSaveThumbnail(ctx context.Context, src io.Reader, key string, thumbnails []thumbnail.Config) (thumbnailResult, error) {
+	img, contentType, err := thumbnail.Decode(src)
 	if err != nil {
-		return fmt.Errorf("error creating output file for %s thumbnail: %v", sizeName, err)
+		// Retrying will not make a corrupt or unsupported image decodable.
+		return thumbnailResult{}, fmt.Errorf("%w: error opening image for thumbnail: %v", errJobPermanent, err)
 	}
-	defer outFile.Close()
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	result := thumbnailResult{Width: width, Height: height}
 
-	// Save as JPEG with a quality setting
-	err = jpeg.Encode(outFile, resizedImg, &jpeg.Options{Quality: quality})
-	if err != nil {
-		return fmt.Errorf("error saving %s thumbnail as JPEG: %v", sizeName, err)
+	var errs []error
+	if result.Placeholder, err = makePlaceholder(img); err != nil {
+		errs = append(errs, fmt.Errorf("placeholder: %w", err))
 	}
-	return nil
+	if thumbnail.IsHEIF(contentType) {
+		jpegMaster, _ := thumbnail.LookupFormat(thumbnail.JPEG)
+		if err := app.putThumbnail(ctx, thumbnail.MasterKey(key), img, jpegMaster, thumbnail.MasterQuality); err != nil {
+			errs = append(errs, fmt.Errorf("master: %w", err))
+		}
+	}
+	for _, thumbConfig := range thumbnails {
+		thumb := app.thumbnails.Render(img, thumbConfig)
+		for _, format := range thumbConfig.StoredFormats() {
+			if err := app.putThumbnail(ctx, thumbnail.Key(key, thumbConfig.Name, format), thumb, format, thumbConfig.Quality); err != nil {
+				errs = append(errs, fmt.Errorf("%s %s thumbnail: %w", thumbConfig.Name, format.Name, err))
+			}
+		}
+	}
+	return result, errors.Join(errs...)
 }
 
-func thumbnailPath(photoPath, size string) string {
-	dir := filepath.Dir(photoPath)
-	filename := filepath.Base(photoPath)
-	return filepath.Join(dir, "thumbnails", size, filename)
+func (app *App) putThumbnail(ctx context.Context, key string, img image.Image, format thumbnail.Format, quality int) error {
+	var buf bytes.Buffer
+	if err := format.Encode(&buf, img, quality); err != nil {
+		return fmt.Errorf("error encoding %s as %s: %v", key, format.Name, err)
+	}
+	return app.storage.Put(ctx, key, &buf, int64(buf.Len()), format.ContentType)
 }
 
 func generateThumbnailPaths(originalRelativePath string) thumbnailPaths {
 	return thumbnailPaths{
-		Mini:   "/fs/" + thumbnailPath(originalRelativePath, "mini"),
-		Small:  "/fs/" + thumbnailPath(originalRelativePath, "small"),
-		Medium: "/fs/" + thumbnailPath(originalRelativePath, "medium"),
-		Large:  "/fs/" + thumbnailPath(originalRelativePath, "large"),
+		Mini:   thumbnailURL("mini", originalRelativePath),
+		Small:  thumbnailURL("small", originalRelativePath),
+		Medium: thumbnailURL("medium", originalRelativePath),
+		Large:  thumbnailURL("large", originalRelativePath),
 	}
 }
 
@@ -314,23 +409,20 @@ func respondWithJSON(w http.ResponseWriter, statusCode int, payload interface{})
 	}
 }
 
-func validateAndCleanPath(userPath string) (string, error) {
+func (app *App) validateAndCleanPath(ctx context.Context, userPath string) (string, error) {
 	if userPath == "" {
 		return "", fmt.Errorf("missing 'path' query parameter")
 	}
 
-	cleanedPath := filepath.Clean(userPath)
-	if strings.Contains(cleanedPath, "..") {
-		return "", fmt.Errorf("invalid file path (contains '..')")
-	}
-
-	fullPath := filepath.Join(localFSDir, cleanedPath)
-	if !strings.HasPrefix(fullPath, localFSDir) {
-		return "", fmt.Errorf("invalid file path (outside of base directory)")
+	cleanedPath, err := storage.CleanKey(userPath)
+	if err != nil {
+		return "", fmt.Errorf("invalid file path")
 	}
 
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+	if _, err := app.storage.Stat(ctx, cleanedPath); errors.Is(err, storage.ErrNotFound) {
 		return "", fmt.Errorf("source file not found")
+	} else if err != nil {
+		return "", err
 	}
 
 	return cleanedPath, nil
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// isVisualOriginal reports whether key is the original of a visual photo,
+// or the JPEG master made from one, as opposed to a thumbnail.
+func isVisualOriginal(key string) bool {
+	parts := strings.Split(key, "/")
+	if parts[0] != "visuals" {
+		return false
+	}
+	return len(parts) == 3 || (len(parts) == 4 && parts[2] == "masters")
+}
+
+// originalsHidden reports whether r may not see visual originals.
+func (app *App) originalsHidden(r *http.Request) bool {
+	if !app.cfg.Storage.ProtectOriginals {
+		return false
+	}
+	_, loggedIn := app.getLoginStatus(r)
+	return !loggedIn
+}
+
+// reapplyWatermarks queues thumbnail jobs for the watermarked sizes of
+// every photo and cover, for when the watermarks have changed. It returns
+// the number of jobs queued.
+func (app *App) reapplyWatermarks() (int, error) {
+	var sizes []string
+	for _, t := range app.cfg.Thumbnails {
+		if t.Watermark != nil {
+			sizes = append(sizes, t.Name)
+		}
+	}
+	if len(sizes) == 0 {
+		return 0, nil
+	}
+
+	var jobs []thumbnailJob
+	rows, err := app.db.Query("SELECT id, visual_id, file_path FROM visual_photos")
+	if err != nil {
+		return 0, fmt.Errorf("reapplyWatermarks: %w", err)
+	}
+	for rows.Next() {
+		var p Photo
+		if err := rows.Scan(&p.ID, &p.VisualID, &p.Filename); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("reapplyWatermarks: %w", err)
+		}
+		jobs = append(jobs, thumbnailJob{Key: path.Join(visualPrefix(p.VisualID), p.Filename), PhotoID: p.ID, Sizes: sizes})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("reapplyWatermarks: %w", err)
+	}
+	cover, err := app.getLatestCover()
+	if err == nil {
+		jobs = append(jobs, thumbnailJob{Key: path.Join("covers", cover.FilePath), CoverID: cover.ID, Sizes: sizes})
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("reapplyWatermarks: %w", err)
+	}
+	for _, job := range jobs {
+		if err := app.jobs.Enqueue(tx, jobThumbnails, job); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("reapplyWatermarks: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("reapplyWatermarks: %w", err)
+	}
+	return len(jobs), nil
+}